@@ -0,0 +1,99 @@
+package gosed
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"regexp"
+)
+
+// InLines restricts the mapping to the lines from through to, counting from 1 and both included, like the sed address
+// "from,to". A to of 0 or less stands for the last line, like "from,$".
+func InLines(from, to int) MappingOption {
+	return func(o *mappingOptions) {
+		o.FromLine, o.ToLine = from, to
+	}
+}
+
+// Between restricts the mapping to the ranges of lines that start with a line matching the regular expression start
+// and end with the next line matching end, both included, like the sed address "/start/,/end/". A range that is
+// never closed runs to the end of the file, and another range may start after one has ended.
+// Between panics if start or end do not compile, like regexp.MustCompile.
+func Between(start, end string) MappingOption {
+	startRe, endRe := regexp.MustCompile(start), regexp.MustCompile(end)
+	return func(o *mappingOptions) {
+		o.Start, o.End = startRe, endRe
+	}
+}
+
+// addressed reports whether the options restrict the mapping to some lines
+func (o *mappingOptions) addressed() bool {
+	return o.FromLine > 0 || o.ToLine > 0 || o.Start != nil
+}
+
+// addressReader applies a mapping to the lines its addresses select, one line at a time, so its matches never span
+// two lines. The replacer is reset for every line but keeps its state, so occurrences are counted across lines.
+type addressReader struct {
+	rr          *recordReader
+	opts        *mappingOptions
+	replacer    BytesReplacer
+	brr         BytesReplacingReader
+	inRange     bool
+	occurrences int
+	out         []byte
+	err         error
+}
+
+func newAddressReader(r io.Reader, rc *replacerConfig, opts *mappingOptions, replacer BytesReplacer) *addressReader {
+	return &addressReader{rr: newRecordReader(r, rc.RecordSeparator, rc.MaxRecordLength), opts: opts, replacer: replacer}
+}
+
+// Read implements the `io.Reader` interface.
+func (ar *addressReader) Read(p []byte) (int, error) {
+	for len(ar.out) == 0 {
+		if ar.err != nil {
+			return 0, ar.err
+		}
+		var record []byte
+		record, ar.err = ar.rr.ReadRecord()
+		if len(record) == 0 {
+			continue
+		}
+		if !ar.selects(record) {
+			ar.out = record
+			continue
+		}
+		replaced, err := ioutil.ReadAll(ar.brr.ResetEx(bytes.NewReader(record), ar.replacer))
+		if err != nil {
+			ar.err = err
+			return 0, err
+		}
+		ar.occurrences += ar.brr.GetOccurrences()
+		ar.out = replaced
+	}
+	n := copy(p, ar.out)
+	ar.out = ar.out[n:]
+	return n, nil
+}
+
+// selects reports whether the addresses select the line just read
+func (ar *addressReader) selects(record []byte) bool {
+	line := ar.rr.record
+	selected := line >= ar.opts.FromLine && (ar.opts.ToLine <= 0 || line <= ar.opts.ToLine)
+	if ar.opts.Start == nil {
+		return selected
+	}
+	content := bytes.TrimSuffix(record, []byte{ar.rr.sep})
+	if !ar.inRange {
+		ar.inRange = ar.opts.Start.Match(content)
+		return selected && ar.inRange
+	}
+	// the line ending the range is still part of it
+	ar.inRange = !ar.opts.End.Match(content)
+	return selected
+}
+
+// GetOccurrences returns the number of matches replaced
+func (ar *addressReader) GetOccurrences() int {
+	return ar.occurrences
+}
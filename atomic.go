@@ -0,0 +1,95 @@
+package gosed
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// WithPreserveMetadata gives the replaced file the owner, group, mode (setuid, setgid and sticky bits included) and
+// modification time of the original, so that tools relying on them do not take the replace for another change.
+// Changing the owner usually takes privileges; if it fails, the replace fails and the file is left as it was.
+func WithPreserveMetadata() Option {
+	return func(c *replacerConfig) {
+		c.PreserveMetadata = true
+	}
+}
+
+// WithFileLock holds an exclusive advisory lock (flock) on the file from the check for concurrent writes until the
+// replaced copy has been renamed over it, so that writers taking the same lock are kept out of the swap. The lock
+// belongs to the original file: a writer waiting for it writes to the original once it is released, which the
+// replace then has already renamed away. Locks are only taken on Unix systems; elsewhere the option does nothing.
+func WithFileLock() Option {
+	return func(c *replacerConfig) {
+		c.Lock = true
+	}
+}
+
+// lock takes the lock of WithFileLock if set, and returns the function releasing it
+func (rc *replacerConfig) lock() (func(), error) {
+	if !rc.Lock {
+		return func() {}, nil
+	}
+	return lockFile(rc.FilePath)
+}
+
+// rename atomically replaces the file with tmpFile: the content of tmpFile is synced before the rename, and the
+// directory after it, so that a crash leaves either the original or the replaced file, never an empty one.
+func (rc *replacerConfig) rename(tmpFile string) error {
+	if err := rc.prepareTemp(tmpFile); err != nil {
+		_ = os.Remove(tmpFile)
+		return err
+	}
+	reopen := rc.release()
+	err := replaceFile(tmpFile, rc.FilePath)
+	reopen()
+	if err != nil {
+		_ = os.Remove(tmpFile)
+		return &ErrRenameFailed{Tmp: tmpFile, Dst: rc.FilePath, Err: err}
+	}
+	return syncDir(filepath.Dir(rc.FilePath))
+}
+
+// release closes the handle on the file for the time it is renamed over, which Windows refuses while it is open, and
+// returns the function opening it again, then on the replaced file
+func (rc *replacerConfig) release() func() {
+	if rc.File == nil {
+		return func() {}
+	}
+	_ = rc.File.Close()
+	return func() {
+		if f, err := os.OpenFile(rc.FilePath, os.O_RDWR, 0); err == nil {
+			rc.File = f
+		}
+	}
+}
+
+// prepareTemp syncs tmpFile and gives it the metadata of the file if it is preserved
+func (rc *replacerConfig) prepareTemp(tmpFile string) error {
+	tmp, err := os.OpenFile(tmpFile, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer func(tmp *os.File) {
+		_ = tmp.Close()
+	}(tmp)
+	if rc.PreserveMetadata {
+		info, err := os.Stat(rc.FilePath)
+		if err != nil {
+			return err
+		}
+		if err := chown(tmp, info); err != nil {
+			return err
+		}
+		// chown clears the setuid and setgid bits, so the mode comes after it
+		if err := tmp.Chmod(info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)); err != nil {
+			return err
+		}
+		if err := tmp.Sync(); err != nil {
+			return err
+		}
+		// the times come last, as nothing may write to the file after them
+		return os.Chtimes(tmpFile, time.Now(), info.ModTime())
+	}
+	return tmp.Sync()
+}
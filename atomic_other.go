@@ -0,0 +1,17 @@
+//go:build windows || plan9
+
+package gosed
+
+import (
+	"os"
+)
+
+// chown does nothing, as files have no owner and group ids here
+func chown(f *os.File, info os.FileInfo) error {
+	return nil
+}
+
+// syncDir does nothing, as directories cannot be synced here
+func syncDir(dir string) error {
+	return nil
+}
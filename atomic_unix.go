@@ -0,0 +1,29 @@
+//go:build !windows && !plan9
+
+package gosed
+
+import (
+	"os"
+	"syscall"
+)
+
+// chown gives f the owner and group of info
+func chown(f *os.File, info os.FileInfo) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return f.Chown(int(st.Uid), int(st.Gid))
+}
+
+// syncDir syncs the directory dir, so that a rename within it survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func(d *os.File) {
+		_ = d.Close()
+	}(d)
+	return d.Sync()
+}
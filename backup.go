@@ -0,0 +1,83 @@
+package gosed
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WithBackup keeps the original file as a backup when it is replaced, like sed -i.bak. The backup is named after the
+// file followed by suffix, unless suffix contains "*", which then stands for the name of the file: "bak/*.orig" backs
+// up config.yml as bak/config.yml.orig, relative to the directory of the file unless absolute. The directory must
+// exist. An existing backup is overwritten. The original is hard linked as the backup where it is renamed over,
+// and copied where it is rewritten in place.
+func WithBackup(suffix string) Option {
+	return func(c *replacerConfig) {
+		c.BackupSuffix = suffix
+	}
+}
+
+// backupPath returns the name of the backup of the file
+func (rc *replacerConfig) backupPath() string {
+	if !strings.Contains(rc.BackupSuffix, "*") {
+		return rc.FilePath + rc.BackupSuffix
+	}
+	name := strings.ReplaceAll(rc.BackupSuffix, "*", filepath.Base(rc.FilePath))
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(filepath.Dir(rc.FilePath), name)
+}
+
+// backup backs up the file, if backups are enabled, right before it is replaced
+func (rc *replacerConfig) backup() error {
+	if rc.BackupSuffix == "" {
+		return nil
+	}
+	name := rc.backupPath()
+	if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	// the rename leaves the original inode alone, so it can simply get a second name
+	if !rc.inPlace() && !rc.PatchInPlace {
+		if err := os.Link(rc.FilePath, name); err == nil {
+			return nil
+		}
+	}
+	return rc.copyBackup(name)
+}
+
+// copyBackup copies the file to name
+func (rc *replacerConfig) copyBackup(name string) error {
+	src, err := os.Open(rc.FilePath)
+	if err != nil {
+		return err
+	}
+	defer func(src *os.File) {
+		_ = src.Close()
+	}(src)
+	dst, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, rc.FilePerm)
+	if err != nil {
+		return err
+	}
+	if isSparse(src) {
+		sw := &sparseWriter{f: dst, sparse: true}
+		if _, err = io.CopyBuffer(sw, rc.count(src), make([]byte, 8192)); err == nil {
+			err = sw.finish()
+		}
+	} else {
+		_, err = io.CopyBuffer(dst, rc.count(src), make([]byte, 8192))
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(name)
+	}
+	return err
+}
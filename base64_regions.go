@@ -0,0 +1,207 @@
+package gosed
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+// Base64Region describes base64-encoded blobs embedded in a file, such as data URIs or PEM blocks.
+// With WithBase64Regions, every region is decoded, the mappings are applied to the decoded content,
+// and the result is re-encoded in place, keeping the original line wrapping.
+type Base64Region struct {
+	// Start is the marker the encoded data follows
+	Start []byte
+	// End is the marker that terminates the encoded data.
+	// If empty, the region ends at the first byte outside the base64 alphabet.
+	End []byte
+	// Encoding is the base64 variant of the region, base64.StdEncoding if nil
+	Encoding *base64.Encoding
+}
+
+// DataURIRegion matches the payload of base64 `data:` URIs
+var DataURIRegion = Base64Region{Start: []byte(";base64,")}
+
+// PEMRegion matches the body of PEM blocks with the given label, e.g. "CERTIFICATE" or "PRIVATE KEY"
+func PEMRegion(label string) Base64Region {
+	return Base64Region{
+		Start: []byte("-----BEGIN " + label + "-----"),
+		End:   []byte("-----END " + label + "-----"),
+	}
+}
+
+// WithBase64Regions applies the mappings inside the decoded content of the given base64 regions as well.
+// Regions are buffered whole, so they are bounded by the max record length.
+func WithBase64Regions(regions ...Base64Region) Option {
+	return func(c *replacerConfig) {
+		c.Base64Regions = append(c.Base64Regions, regions...)
+	}
+}
+
+func (br Base64Region) encoding() *base64.Encoding {
+	if br.Encoding == nil {
+		return base64.StdEncoding
+	}
+	return br.Encoding
+}
+
+// find returns the length of the encoded data at the start of buf.
+// decided is false while more data is needed to tell where the region ends.
+func (br Base64Region) find(buf []byte, eof bool) (length int, found, decided bool) {
+	if len(br.End) > 0 {
+		if i := bytes.Index(buf, br.End); i >= 0 {
+			return i, true, true
+		}
+		return 0, false, eof
+	}
+	for i, c := range buf {
+		if !isBase64Byte(c) {
+			return i, true, true
+		}
+	}
+	return len(buf), true, eof
+}
+
+func isBase64Byte(c byte) bool {
+	return (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+		c == '+' || c == '/' || c == '-' || c == '_' || c == '='
+}
+
+// base64RegionReader passes data through unchanged, except for the base64 regions, which are rewritten with the mappings applied.
+type base64RegionReader struct {
+	r        io.Reader
+	rc       *replacerConfig
+	chunk    []byte
+	pending  []byte
+	out      []byte
+	maxStart int
+	// offset is the stream offset of pending[0]
+	offset int64
+	err    error
+}
+
+func newBase64RegionReader(r io.Reader, rc *replacerConfig) *base64RegionReader {
+	br := &base64RegionReader{r: r, rc: rc, chunk: make([]byte, 32*1024)}
+	for _, region := range rc.Base64Regions {
+		br.maxStart = max(br.maxStart, len(region.Start))
+	}
+	return br
+}
+
+// Read implements the `io.Reader` interface.
+func (br *base64RegionReader) Read(p []byte) (int, error) {
+	for len(br.out) == 0 {
+		if br.err != nil && len(br.pending) == 0 {
+			return 0, br.err
+		}
+		if err := br.process(); err != nil {
+			br.pending, br.err = nil, err
+			return 0, err
+		}
+	}
+	n := copy(p, br.out)
+	br.out = br.out[n:]
+	return n, nil
+}
+
+func (br *base64RegionReader) process() error {
+	if br.err == nil {
+		n, err := br.r.Read(br.chunk)
+		br.pending = append(br.pending, br.chunk[:n]...)
+		br.err = err
+	}
+	eof := br.err != nil
+	for {
+		index, region := br.nextRegion()
+		if index < 0 {
+			keep := 0
+			if !eof {
+				keep = min(len(br.pending), br.maxStart-1)
+			}
+			br.emit(len(br.pending) - keep)
+			return nil
+		}
+		start := index + len(region.Start)
+		length, found, decided := region.find(br.pending[start:], eof)
+		if !decided {
+			if limit := br.rc.MaxRecordLength; limit > 0 && len(br.pending)-start > limit {
+				return fmt.Errorf("%w: base64 region at offset %d is longer than %d bytes", ErrRecordTooLong, br.offset+int64(start), limit)
+			}
+			// keep the start marker pending, so the region is recognised again once more data has arrived
+			br.emit(index)
+			return nil
+		}
+		br.emit(start)
+		if !found {
+			continue
+		}
+		rewritten, err := br.rewrite(region, br.pending[:length])
+		if err != nil {
+			return err
+		}
+		br.out = append(br.out, rewritten...)
+		br.drop(length)
+	}
+}
+
+// nextRegion returns the index of the first region start marker in pending.
+func (br *base64RegionReader) nextRegion() (int, Base64Region) {
+	index, region := -1, Base64Region{}
+	for _, r := range br.rc.Base64Regions {
+		if i := bytes.Index(br.pending, r.Start); i >= 0 && (index < 0 || i < index) {
+			index, region = i, r
+		}
+	}
+	return index, region
+}
+
+// emit moves the first n pending bytes to the output unchanged.
+func (br *base64RegionReader) emit(n int) {
+	br.out = append(br.out, br.pending[:n]...)
+	br.drop(n)
+}
+
+func (br *base64RegionReader) drop(n int) {
+	br.pending = br.pending[:copy(br.pending, br.pending[n:])]
+	br.offset += int64(n)
+}
+
+// rewrite applies the mappings to the decoded content of data and re-encodes it with the same surrounding whitespace and line width.
+// Data that does not decode is returned unchanged.
+func (br *base64RegionReader) rewrite(region Base64Region, data []byte) ([]byte, error) {
+	body := bytes.TrimLeft(data, " \t\r\n")
+	lead := data[:len(data)-len(body)]
+	encoded := bytes.TrimRight(body, " \t\r\n")
+	trail := body[len(encoded):]
+	sep, width := []byte("\n"), 0
+	if i := bytes.IndexByte(encoded, '\n'); i >= 0 {
+		if i > 0 && encoded[i-1] == '\r' {
+			sep, i = []byte("\r\n"), i-1
+		}
+		width = i
+	}
+	compact := bytes.Join(bytes.Fields(encoded), nil)
+	enc := region.encoding()
+	decoded := make([]byte, enc.DecodedLen(len(compact)))
+	n, err := enc.Decode(decoded, compact)
+	if err != nil {
+		return data, nil
+	}
+	replaced, err := br.rc.apply(decoded[:n])
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(replaced, decoded[:n]) {
+		return data, nil
+	}
+	reencoded := make([]byte, enc.EncodedLen(len(replaced)))
+	enc.Encode(reencoded, replaced)
+	out := append([]byte{}, lead...)
+	for width > 0 && len(reencoded) > width {
+		out = append(append(out, reencoded[:width]...), sep...)
+		reencoded = reencoded[width:]
+	}
+	out = append(out, reencoded...)
+	return append(out, trail...), nil
+}
@@ -0,0 +1,318 @@
+package gosed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Batch applies the same mappings to many files, each with its own temporary file and commit.
+// A failure on one file is recorded in the report and the batch carries on with the next.
+type Batch struct {
+	Files   []string
+	Options []Option
+	// Snapshotter, if set, is called once before any file is touched
+	Snapshotter Snapshotter
+	// StallTimeout, if positive, gives up on a file that makes no I/O progress for that long, typically one on a dead
+	// network mount, and moves on to the next. A stalled file is reported as FileStalled; it is never committed, and its
+	// temporary file is removed as soon as the blocked I/O returns, which may be never. A file whose commit has
+	// already begun is waited for instead, and reported as it turns out.
+	StallTimeout time.Duration
+	MappingSet
+
+	mu       sync.Mutex
+	stopping bool
+	// running is closed when the current Replace returns, cancel cancels the file in flight
+	running chan struct{}
+	cancel  context.CancelFunc
+	report  *BatchReport
+}
+
+// Snapshotter creates a filesystem snapshot (ZFS, Btrfs, LVM...) that the files of a batch can be rolled back to
+type Snapshotter interface {
+	// Snapshot snapshots the filesystems holding files and returns a reference to the snapshot, such as its name
+	Snapshot(files []string) (string, error)
+}
+
+// SnapshotFunc adapts a function to the Snapshotter interface
+type SnapshotFunc func(files []string) (string, error)
+
+// Snapshot calls f(files)
+func (f SnapshotFunc) Snapshot(files []string) (string, error) {
+	return f(files)
+}
+
+// FileStatus is the outcome of a batch for a single file
+type FileStatus int
+
+const (
+	// FileReplaced means the file was rewritten with the mappings applied
+	FileReplaced FileStatus = iota
+	// FileFailed means the file could not be processed and was left as it was, see FileResult.Err
+	FileFailed
+	// FileStalled means the file made no progress within the stall timeout and was abandoned
+	FileStalled
+	// FileCancelled means the batch was shut down while the file was being replaced, and it was left as it was
+	FileCancelled
+	// FileSkipped means the batch was shut down before the file was started
+	FileSkipped
+	// FileBinary means the file was left as it was because it looks binary, see DirReplacer.SkipBinary
+	FileBinary
+)
+
+func (fs FileStatus) String() string {
+	switch fs {
+	case FileReplaced:
+		return "replaced"
+	case FileFailed:
+		return "failed"
+	case FileStalled:
+		return "stalled"
+	case FileCancelled:
+		return "cancelled"
+	case FileSkipped:
+		return "skipped"
+	case FileBinary:
+		return "binary"
+	}
+	return fmt.Sprintf("FileStatus(%d)", int(fs))
+}
+
+// FileResult is the outcome of a batch for a single file
+type FileResult struct {
+	Path   string
+	Status FileStatus
+	Wrote  int
+	Err    error
+}
+
+// BatchReport describes what a batch did
+type BatchReport struct {
+	// Snapshot is the reference returned by the Snapshotter, empty if there is none
+	Snapshot string
+	Files    []FileResult
+}
+
+// Failed returns the results of the files that were not replaced
+func (br *BatchReport) Failed() []FileResult {
+	return br.filter(func(status FileStatus) bool {
+		return status != FileReplaced
+	})
+}
+
+// Completed returns the results of the files that were replaced
+func (br *BatchReport) Completed() []FileResult {
+	return br.filter(func(status FileStatus) bool {
+		return status == FileReplaced
+	})
+}
+
+// RolledBack returns the results of the files that were started but not committed, and so were left as they were
+func (br *BatchReport) RolledBack() []FileResult {
+	return br.filter(func(status FileStatus) bool {
+		return status == FileFailed || status == FileStalled || status == FileCancelled
+	})
+}
+
+// Untouched returns the results of the files that were never started
+func (br *BatchReport) Untouched() []FileResult {
+	return br.filter(func(status FileStatus) bool {
+		return status == FileSkipped
+	})
+}
+
+// Err returns a *MultiError listing the files that were replaced and those that failed, or nil if none failed
+func (br *BatchReport) Err() error {
+	return newMultiError(br.Files)
+}
+
+func (br *BatchReport) filter(keep func(FileStatus) bool) []FileResult {
+	var results []FileResult
+	for _, result := range br.Files {
+		if keep(result.Status) {
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// BatchCancelledError is returned by Batch.ReplaceContext when its context is done before every file was replaced.
+// Report tells which files were completed, rolled back and left untouched.
+type BatchCancelledError struct {
+	Report *BatchReport
+	Err    error
+}
+
+func (e *BatchCancelledError) Error() string {
+	return fmt.Sprintf("batch cancelled with %d files completed, %d rolled back and %d untouched: %v",
+		len(e.Report.Completed()), len(e.Report.RolledBack()), len(e.Report.Untouched()), e.Err)
+}
+
+// Unwrap returns the error of the context
+func (e *BatchCancelledError) Unwrap() error {
+	return e.Err
+}
+
+// NewBatch returns a new *Batch over files, whose replacers are configured with opts
+func NewBatch(files []string, opts ...Option) *Batch {
+	return &Batch{
+		Files:      files,
+		Options:    opts,
+		MappingSet: newMappingSet(),
+	}
+}
+
+// Replace takes the snapshot, if any, and replaces every file in turn.
+// It only returns an error if the snapshot fails, in which case no file is touched, or if the batch is already running;
+// per-file errors are in the report.
+func (b *Batch) Replace() (*BatchReport, error) {
+	return b.ReplaceContext(context.Background())
+}
+
+// ReplaceContext is Replace, cancelled when parent is done: the file in flight is rolled back, unless its commit has
+// already begun, and the remaining files are left untouched. The partial report then comes with a *BatchCancelledError.
+func (b *Batch) ReplaceContext(parent context.Context) (*BatchReport, error) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	b.mu.Lock()
+	if b.running != nil {
+		b.mu.Unlock()
+		return nil, errors.New("batch is already running")
+	}
+	running := make(chan struct{})
+	report := &BatchReport{}
+	b.running, b.cancel, b.report = running, cancel, report
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.running, b.cancel = nil, nil
+		b.mu.Unlock()
+		close(running)
+	}()
+	if err := parent.Err(); err != nil {
+		for _, file := range b.Files {
+			report.Files = append(report.Files, FileResult{Path: file, Status: FileSkipped})
+		}
+		return report, &BatchCancelledError{Report: report, Err: err}
+	}
+	if b.Snapshotter != nil {
+		ref, err := b.Snapshotter.Snapshot(b.Files)
+		if err != nil {
+			return report, fmt.Errorf("snapshot: %w", err)
+		}
+		report.Snapshot = ref
+	}
+	for _, file := range b.Files {
+		if b.stopped(ctx) {
+			report.Files = append(report.Files, FileResult{Path: file, Status: FileSkipped})
+			continue
+		}
+		report.Files = append(report.Files, b.replaceFile(ctx, file))
+	}
+	if err := parent.Err(); err != nil && len(report.Completed()) < len(report.Files) {
+		return report, &BatchCancelledError{Report: report, Err: err}
+	}
+	return report, nil
+}
+
+// Shutdown stops a running batch: no further file is started, and the file in flight may finish until ctx is done,
+// at which point it is cancelled. Shutdown waits for Replace to return and returns its partial report, with ctx.Err()
+// if the file in flight had to be cancelled. A cancelled file is never committed, and its temporary file is removed
+// as soon as its pending I/O returns. A batch that has been shut down does not start any file again.
+func (b *Batch) Shutdown(ctx context.Context) (*BatchReport, error) {
+	b.mu.Lock()
+	b.stopping = true
+	running := b.running
+	b.mu.Unlock()
+	if running == nil {
+		return b.report, nil
+	}
+	select {
+	case <-running:
+		return b.report, nil
+	case <-ctx.Done():
+	}
+	b.mu.Lock()
+	if b.cancel != nil {
+		b.cancel()
+	}
+	b.mu.Unlock()
+	<-running
+	return b.report, ctx.Err()
+}
+
+// stopped reports whether the batch must not start any more files
+func (b *Batch) stopped(ctx context.Context) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stopping || ctx.Err() != nil
+}
+
+// replaceFile replaces a single file, abandoning it if it stalls or the batch is cancelled
+func (b *Batch) replaceFile(parent context.Context, file string) FileResult {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	var progress int64
+	gate := &commitGate{}
+	done := make(chan FileResult, 1)
+	go func() {
+		wrote, err := b.replaceWith(ctx, &progress, gate, file)
+		result := FileResult{Path: file, Status: FileReplaced, Wrote: wrote, Err: err}
+		switch {
+		case err != nil && ctx.Err() != nil:
+			result.Status = FileCancelled
+		case err != nil:
+			result.Status = FileFailed
+		}
+		done <- result
+	}()
+	var tick <-chan time.Time
+	if b.StallTimeout > 0 {
+		interval := b.StallTimeout / 4
+		if interval < time.Millisecond {
+			interval = time.Millisecond
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	seen, since := int64(-1), time.Now()
+	cancelled := ctx.Done()
+	for {
+		select {
+		case result := <-done:
+			return result
+		case <-cancelled:
+			if gate.abandon() {
+				return FileResult{Path: file, Status: FileCancelled, Err: ctx.Err()}
+			}
+			// the commit has begun, so wait for it to finish
+			cancelled, tick = nil, nil
+		case now := <-tick:
+			if current := atomic.LoadInt64(&progress); current != seen {
+				seen, since = current, now
+			} else if now.Sub(since) >= b.StallTimeout {
+				if gate.abandon() {
+					return FileResult{Path: file, Status: FileStalled, Err: fmt.Errorf("%w for %s", ErrStalled, b.StallTimeout)}
+				}
+				cancelled, tick = nil, nil
+			}
+		}
+	}
+}
+
+func (b *Batch) replaceWith(ctx context.Context, progress *int64, gate *commitGate, file string) (int, error) {
+	rp, err := NewReplacer(file, b.Options...)
+	if err != nil {
+		return 0, err
+	}
+	defer func(rp *Replacer) {
+		_ = rp.Config.File.Close()
+	}(rp)
+	rp.Config.Mappings = b.mappings.clone()
+	rp.Config.ctx, rp.Config.progress, rp.Config.gate = ctx, progress, gate
+	return rp.ReplaceChained()
+}
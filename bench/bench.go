@@ -0,0 +1,86 @@
+// Package bench holds reproducible benchmarks of the gosed replace engine, to compare Replace with ReplaceChained on
+// files of the size and mappings of a workload, and to catch regressions of the matching engine.
+//
+// The benchmarks replace generated files of every size given with -bench.sizes (1MB and 16MB by default, up to 10GB
+// or more for a full run), with 1, 10 and 100 mappings matching none, 1% or 10% of the words of the file:
+//
+//	go test ./bench -run '^$' -bench . -benchtime 5x -bench.sizes 1MB,100MB,1GB,10GB
+//
+// Besides the throughput, every benchmark reports the time spent reading, matching, writing and renaming per replace,
+// as timed by gosed.WithTracer. The files are generated from -bench.seed, so runs with the same flags replace the same
+// bytes.
+package bench
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+)
+
+// lineLength is about how long the lines of a corpus are
+const lineLength = 80
+
+// Corpus describes a generated file of words, some of which are the keys of its mappings
+type Corpus struct {
+	// Size is the size of the file in bytes
+	Size int64
+	// Mappings is the number of mappings, and Density the share of the words of the file matching one of them
+	Mappings int
+	Density  float64
+	// Seed seeds the generator of the words
+	Seed int64
+}
+
+// Name names the corpus after its parameters, for sub-benchmarks
+func (c Corpus) Name() string {
+	return fmt.Sprintf("size=%d/mappings=%d/density=%g", c.Size, c.Mappings, c.Density)
+}
+
+// Key returns the key of mapping i, and Value the value it is replaced with. Keys and values have the same length
+// and are made of characters the other words lack, so that replacing the values with the keys restores the file.
+func (c Corpus) Key(i int) string {
+	return fmt.Sprintf("KEY%05d", i)
+}
+
+// Value returns the value of mapping i, see Key
+func (c Corpus) Value(i int) string {
+	return fmt.Sprintf("VAL%05d", i)
+}
+
+// WriteTo writes the file of the corpus to w
+func (c Corpus) WriteTo(w io.Writer) (int64, error) {
+	rng := rand.New(rand.NewSource(c.Seed))
+	bw := bufio.NewWriter(w)
+	var written int64
+	line := 0
+	word := make([]byte, 0, 16)
+	for written < c.Size {
+		word = word[:0]
+		if c.Mappings > 0 && rng.Float64() < c.Density {
+			word = append(word, c.Key(rng.Intn(c.Mappings))...)
+		} else {
+			for n := 2 + rng.Intn(9); n > 0; n-- {
+				word = append(word, byte('a'+rng.Intn(26)))
+			}
+		}
+		switch {
+		case line+len(word) >= lineLength:
+			word = append(word, '\n')
+			line = 0
+		default:
+			word = append(word, ' ')
+			line += len(word)
+		}
+		// the last word is cut to the size of the corpus
+		if rest := c.Size - written; int64(len(word)) > rest {
+			word = word[:rest]
+		}
+		n, err := bw.Write(word)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, bw.Flush()
+}
@@ -0,0 +1,146 @@
+package bench
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/mohamed-essam/gosed"
+)
+
+var (
+	sizes = flag.String("bench.sizes", "1MB,16MB", "comma-separated sizes of the files replaced, such as 1MB,1GB,10GB")
+	seed  = flag.Int64("bench.seed", 1, "seed of the generated files")
+)
+
+// corpusDir holds the files generated for the benchmarks, shared by those of the same corpus
+var corpusDir string
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	dir, err := os.MkdirTemp("", "gosed-bench-*")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	corpusDir = dir
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// corpora returns the corpora of every size, mapping count and density benchmarked
+func corpora(b *testing.B) []Corpus {
+	var cs []Corpus
+	for _, s := range strings.Split(*sizes, ",") {
+		size, err := units.FromHumanSize(strings.TrimSpace(s))
+		if err != nil {
+			b.Fatal(err.Error())
+		}
+		for _, mappings := range []int{1, 10, 100} {
+			for _, density := range []float64{0, 0.01, 0.1} {
+				cs = append(cs, Corpus{Size: size, Mappings: mappings, Density: density, Seed: *seed})
+			}
+		}
+	}
+	return cs
+}
+
+// corpusFile returns the path of the file of c, generating it the first time
+func corpusFile(b *testing.B, c Corpus) string {
+	path := filepath.Join(corpusDir, strings.NewReplacer("/", "_", "=", "-").Replace(c.Name())+".txt")
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	if _, err := c.WriteTo(f); err != nil {
+		_ = f.Close()
+		b.Fatal(err.Error())
+	}
+	if err := f.Close(); err != nil {
+		b.Fatal(err.Error())
+	}
+	return path
+}
+
+// benchmark replaces the file of every corpus with replace. Every other iteration maps the values back to the keys,
+// so that the file is restored without copying it.
+func benchmark(b *testing.B, replace func(rp *gosed.Replacer) (int, error)) {
+	for _, c := range corpora(b) {
+		c := c
+		b.Run(c.Name(), func(b *testing.B) {
+			path := corpusFile(b, c)
+			var stages [4]time.Duration
+			tracer := gosed.WithTracer(func(_ string, stage gosed.TraceStage, elapsed time.Duration) {
+				stages[stage] += elapsed
+			})
+			b.SetBytes(c.Size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rp, err := gosed.NewReplacer(path, tracer)
+				if err != nil {
+					b.Fatal(err.Error())
+				}
+				for m := 0; m < c.Mappings; m++ {
+					old, new := c.Key(m), c.Value(m)
+					if i%2 == 1 {
+						old, new = new, old
+					}
+					if err := rp.NewStringMapping(old, new); err != nil {
+						b.Fatal(err.Error())
+					}
+				}
+				_, err = replace(rp)
+				_ = rp.Config.File.Close()
+				if err != nil {
+					b.Fatal(err.Error())
+				}
+			}
+			b.StopTimer()
+			for stage, elapsed := range stages {
+				b.ReportMetric(float64(elapsed.Nanoseconds())/float64(b.N), gosed.TraceStage(stage).String()+"-ns/op")
+			}
+			// an odd number of iterations leaves the values in the file
+			if b.N%2 == 1 {
+				_ = os.Remove(path)
+			}
+		})
+	}
+}
+
+func BenchmarkReplace(b *testing.B) {
+	benchmark(b, (*gosed.Replacer).Replace)
+}
+
+func BenchmarkReplaceChained(b *testing.B) {
+	benchmark(b, (*gosed.Replacer).ReplaceChained)
+}
+
+func TestCorpus(t *testing.T) {
+	c := Corpus{Size: 100000, Mappings: 10, Density: 0.1, Seed: 1}
+	var first, second strings.Builder
+	if n, err := c.WriteTo(&first); err != nil || n != c.Size {
+		t.Fatal(fmt.Errorf("wrote %d bytes: %v", n, err))
+	}
+	if _, err := c.WriteTo(&second); err != nil || first.String() != second.String() {
+		t.Fatal(fmt.Errorf("corpus is not reproducible: %v", err))
+	}
+	words := strings.Fields(first.String())
+	keys := 0
+	for _, w := range words {
+		if strings.HasPrefix(w, "KEY") {
+			keys++
+		}
+	}
+	if share := float64(keys) / float64(len(words)); share < 0.08 || share > 0.12 {
+		t.Fatal(fmt.Errorf("unexpected density %g", share))
+	}
+}
@@ -0,0 +1,56 @@
+package gosed
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// DefaultSniffLength is the number of bytes sniffed at the start of a file to tell whether it is binary, as git does
+const DefaultSniffLength = 8000
+
+// BinaryFunc decides whether a file of a DirReplacer is skipped as binary, given its path, its first bytes and whether
+// they look binary
+type BinaryFunc func(path string, head []byte, binary bool) bool
+
+// IsBinary reports whether head, the first bytes of a file, look binary: they hold a NUL byte outside of UTF-16 text,
+// or http.DetectContentType recognizes them as anything but text, such as an image, an archive or an executable.
+func IsBinary(head []byte) bool {
+	contentType := http.DetectContentType(head)
+	if !strings.HasPrefix(contentType, "text/") {
+		return true
+	}
+	// the content type only depends on the first 512 bytes
+	return bytes.IndexByte(head, 0) >= 0 && !strings.Contains(contentType, "utf-16")
+}
+
+// skipBinary reports whether the file at path is left as it is as binary
+func (dr *DirReplacer) skipBinary(path string) (bool, error) {
+	if !dr.SkipBinary {
+		return false, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	n := dr.SniffLength
+	if n <= 0 {
+		n = DefaultSniffLength
+	}
+	head := make([]byte, n)
+	n, err = io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	head = head[:n]
+	binary := IsBinary(head)
+	if dr.BinaryFunc != nil {
+		return dr.BinaryFunc(path, head, binary), nil
+	}
+	return binary, nil
+}
@@ -0,0 +1,54 @@
+package gosed
+
+const (
+	// minBufferSize and maxAutoBufferSize bound the buffer size scaled to the file
+	minBufferSize     = 512
+	maxAutoBufferSize = 1 << 20
+	// streamBufferSize is the buffer size of streams, whose size is unknown
+	streamBufferSize = 8192
+	// defaultMaxMemory bounds the buffers scaled to the file when WithMaxMemory is not set
+	defaultMaxMemory = 64 << 20
+)
+
+// WithBufferSize sets the size of the buffers of a replace: the one every mapping of the chain holds, and those the
+// file is read and written with. By default it is scaled to the file, from 512 bytes for tiny files up to 1 MiB, so
+// that small files do not allocate a buffer larger than themselves per mapping and large ones are read in fewer,
+// larger calls. The buffer of a mapping still grows to hold twice its key and value.
+func WithBufferSize(n int) Option {
+	return func(c *replacerConfig) {
+		c.BufferSize = n
+	}
+}
+
+// WithMaxMemory bounds the memory the buffers of a replace take, shrinking them as the mappings add up, down to 512
+// bytes each. Without it, the buffers scaled to the file are kept within 64 MiB, while those set with WithBufferSize
+// are not bounded.
+func WithMaxMemory(bytes int64) Option {
+	return func(c *replacerConfig) {
+		c.MaxMemory = bytes
+	}
+}
+
+// bufferSize returns the size of the buffers of the replace
+func (rc *replacerConfig) bufferSize() int {
+	size, budget := rc.BufferSize, rc.MaxMemory
+	if size <= 0 {
+		size = minBufferSize
+		for size < maxAutoBufferSize && int64(size) < rc.FileSize {
+			size *= 2
+		}
+		if rc.FileSize <= 0 {
+			size = streamBufferSize
+		}
+		if budget <= 0 {
+			budget = defaultMaxMemory
+		}
+	}
+	if budget > 0 {
+		// every mapping of the chain holds a buffer, besides the read and the copy buffers
+		if share := budget / int64(len(rc.Mappings.Keys)+2); share < int64(size) {
+			size = int(share)
+		}
+	}
+	return max(size, minBufferSize)
+}
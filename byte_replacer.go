@@ -24,6 +24,44 @@ type BytesReplacer interface {
 	BestIndex(buf []byte) (int, []byte, []byte)
 }
 
+// BytesMatchFilter can optionally be implemented by a BytesReplacer to accept or reject each match
+// based on the bytes surrounding it.
+type BytesMatchFilter interface {
+	// LookaroundHints returns how many bytes before and after a match FilterMatch needs to see.
+	// will only be called once during BytesReplacingReader initialization/reset.
+	LookaroundHints() (int, int)
+	// FilterMatch reports whether the match should be replaced.
+	// `before` holds at least the hinted number of bytes preceding the match and `after` at least the hinted
+	// number following it, except at the start and the end of the stream, where they can be shorter.
+	// A rejected match is left as is and the search resumes at its second byte.
+	FilterMatch(before, match, after []byte) bool
+}
+
+// matchKeeper can optionally be implemented by a BytesReplacer to leave some accepted matches as they are.
+// Unlike a match rejected by a BytesMatchFilter, a kept match is skipped as a whole, so no later match overlaps it.
+type matchKeeper interface {
+	// Pass is called with the bytes of the stream the reader moves past, in order: the bytes between matches, and
+	// every accepted match as it was before its replacement
+	Pass(span []byte)
+	// KeepMatch is called for every accepted match, and reports whether it must be left as it is
+	KeepMatch() bool
+}
+
+// matchExpander can optionally be implemented by a BytesReplacer whose replacements depend on the match
+type matchExpander interface {
+	// ExpandMatch is called for every match that is replaced, once it has been accepted, and returns its replacement
+	// in place of `replace`, the one BestIndex returned
+	ExpandMatch(match, replace []byte) []byte
+}
+
+// expandMatch returns the replacement of an accepted match of br
+func expandMatch(br BytesReplacer, match, replace []byte) []byte {
+	if e, ok := br.(matchExpander); ok {
+		return e.ExpandMatch(match, replace)
+	}
+	return replace
+}
+
 // BytesReplacingReader allows transparent replacement of a given token during read operation.
 type BytesReplacingReader struct {
 	replacer          BytesReplacer
@@ -31,16 +69,32 @@ type BytesReplacingReader struct {
 	r                 io.Reader
 	err               error
 	buf               []byte
-	// buf[0:buf0]: bytes already processed; buf[buf0:buf1] bytes read in but not yet processed.
-	buf0, buf1 int
+	// buf[out:buf0]: bytes already processed, not handed out yet; buf[buf0:buf1] bytes read in but not yet processed.
+	out, buf0, buf1 int
+	// Set while the last read filled its whole chunk
+	filling bool
 	// Because we need to replace 'search' with 'replace', this marks the max bytes we can read into buf
 	max int
 	// Tracks the number of tokens found in the data stream
 	occurrences int
+	// Set if replacer implements BytesMatchFilter, along with the lookaround it asked for
+	filter        BytesMatchFilter
+	behind, ahead int
+	// The last `behind` bytes already handed out by Read, so lookbehind works across reads
+	tail    []byte
+	scratch []byte
+	// Set if replacer implements matchKeeper; buf[passed:] has not been passed to it yet
+	keeper matchKeeper
+	passed int
+	// Set if replacer implements matchExpander
+	expander matchExpander
 }
 
 const defaultBufSize = 4096
 
+// readChunk is the most a single read fills a buffer with
+const readChunk = 4096
+
 // SetBufferSize sets the buffer size of the current `*BytesReplacingReader`.
 // If newBufSize is smaller than the current buffer, nothing is changed.
 func (r *BytesReplacingReader) SetBufferSize(newBufSize int) {
@@ -63,12 +117,36 @@ func (r *BytesReplacingReader) ResetEx(r1 io.Reader, replacer BytesReplacer) *By
 	r.maxSearchTokenLen = maxSearchTokenLen
 	r.r = r1
 	r.err = nil
-	bufSize := max(defaultBufSize, max(maxSearchTokenLen, maxReplaceTokenLen))
+	r.occurrences = 0
+	r.filter, r.behind, r.ahead = nil, 0, 0
+	if filter, ok := replacer.(BytesMatchFilter); ok {
+		r.filter = filter
+		r.behind, r.ahead = filter.LookaroundHints()
+	}
+	r.tail = r.tail[:0]
+	r.keeper, _ = replacer.(matchKeeper)
+	r.passed = 0
+	r.expander, _ = replacer.(matchExpander)
+	// a buffer sized by SetBufferSize is kept as long as it holds twice the tokens, which leaves room to read into
+	bufSize := 2 * (maxSearchTokenLen + maxReplaceTokenLen)
+	if r.buf == nil {
+		bufSize = max(defaultBufSize, bufSize)
+	}
+	if r.filter != nil {
+		// A candidate waiting for lookahead stays in buf, so there must always be room left to read into.
+		need := 2 * (maxSearchTokenLen + r.ahead)
+		bufSize = max(bufSize, need)
+		if maxSearchOverReplaceLenRatio > 0 {
+			bufSize = max(bufSize, int(float64(need)/maxSearchOverReplaceLenRatio)+1)
+		}
+	}
 	if r.buf == nil || len(r.buf) < bufSize {
 		r.buf = make([]byte, bufSize)
 	}
+	r.out = 0
 	r.buf0 = 0
 	r.buf1 = 0
+	r.filling = false
 	r.max = len(r.buf)
 	if maxSearchOverReplaceLenRatio > 0 {
 		// If len(search) < len(replace), then we have to assume the worst case:
@@ -94,39 +172,88 @@ func (r *BytesReplacingReader) Reset(r1 io.Reader, search1, replace1 []byte) *By
 func (r *BytesReplacingReader) Read(p []byte) (int, error) {
 	n := 0
 	for {
-		if r.buf0 > 0 {
-			n = copy(p, r.buf[0:r.buf0])
-			r.buf0 -= n
-			r.buf1 -= n
-			if r.buf1 == 0 && r.err != nil {
+		// the processed bytes are handed out once no more can be read at once, and all of them before reading again
+		if r.buf0 > r.out && (r.out > 0 || r.err != nil || !r.filling) {
+			n = copy(p, r.buf[r.out:r.buf0])
+			r.keepTail(r.buf[r.out : r.out+n])
+			r.out += n
+			if r.out == r.buf1 && r.err != nil {
 				return n, r.err
 			}
-			copy(r.buf, r.buf[n:r.buf1+n])
+			if r.out == r.buf0 {
+				// the bytes left to process only move to the front once the processed ones are all handed out,
+				// rather than on every read
+				copy(r.buf, r.buf[r.out:r.buf1])
+				r.buf0 -= r.out
+				r.buf1 -= r.out
+				r.passed = max(0, r.passed-r.out)
+				r.out = 0
+			}
 			return n, nil
 		} else if r.err != nil {
 			return 0, r.err
 		}
-		n, r.err = r.r.Read(r.buf[r.buf1:r.max])
-		if n > 0 {
+		// large buffers are filled a chunk at a time, so that the bytes moved by every replacement that changes the
+		// length, and those replacers search for every match, do not add up as the buffer grows
+		end := min(r.max, r.buf1+readChunk)
+		if end <= r.buf1 && r.buf0 > r.out {
+			r.filling = false
+			continue
+		}
+		n, r.err = r.r.Read(r.buf[r.buf1:end])
+		// a reader that had the whole chunk at hand likely has more, which is read before handing anything out
+		r.filling = n == end-r.buf1
+		// a candidate deferred for lookahead has to be decided once the stream ends, even without new data
+		if n > 0 || (r.err != nil && r.filter != nil) {
 			r.buf1 += n
 			for {
 				index, search, replace := r.replacer.BestIndex(r.buf[r.buf0:r.buf1])
 				if index < 0 {
 					r.buf0 = max(r.buf0, r.buf1-r.maxSearchTokenLen+1)
+					r.pass(r.buf0)
 					break
 				}
-				r.occurrences++
 				searchTokenLen := len(search)
 				if searchTokenLen == 0 {
 					panic("search token cannot be nil/empty")
 				}
+				index += r.buf0
+				if r.filter != nil {
+					end := index + searchTokenLen
+					if r.buf1-end < r.ahead && r.err == nil {
+						// Not enough lookahead yet: keep the candidate unprocessed until more data arrives.
+						r.buf0 = index
+						break
+					}
+					if !r.filter.FilterMatch(r.before(index), r.buf[index:end], r.buf[end:min(end+r.ahead, r.buf1)]) {
+						r.buf0 = index + 1
+						continue
+					}
+				}
+				if r.keeper != nil {
+					r.pass(index)
+					keep := r.keeper.KeepMatch()
+					r.pass(index + searchTokenLen)
+					if keep {
+						r.buf0 = index + searchTokenLen
+						continue
+					}
+				}
+				r.occurrences++
+				if r.expander != nil {
+					replace = r.expander.ExpandMatch(r.buf[index:index+searchTokenLen], replace)
+				}
 				replaceTokenLen := len(replace)
 				lenDelta := replaceTokenLen - searchTokenLen
-				index += r.buf0
+				if r.buf1+lenDelta > len(r.buf) {
+					// the sizing hints do not bound the replacements of an expander
+					r.grow(r.buf1 + lenDelta)
+				}
 				copy(r.buf[index+replaceTokenLen:r.buf1+lenDelta], r.buf[index+searchTokenLen:r.buf1])
 				copy(r.buf[index:index+replaceTokenLen], replace)
 				r.buf0 = index + replaceTokenLen
 				r.buf1 += lenDelta
+				r.passed = r.buf0
 			}
 		}
 		if r.err != nil {
@@ -199,6 +326,54 @@ func (r *singleSearchReplaceReplacer) BestIndex(buf []byte) (int, []byte, []byte
 	}
 }
 
+// grow makes room for at least n bytes in buf, keeping the room left past r.max
+func (r *BytesReplacingReader) grow(n int) {
+	buf := make([]byte, 2*n)
+	copy(buf, r.buf[:r.buf1])
+	r.max += len(buf) - len(r.buf)
+	r.buf = buf
+}
+
+// pass passes the bytes up to buf[end] to the matchKeeper, if any
+func (r *BytesReplacingReader) pass(end int) {
+	if r.keeper == nil || end <= r.passed {
+		return
+	}
+	r.keeper.Pass(r.buf[r.passed:end])
+	r.passed = end
+}
+
+// before returns up to `r.behind` bytes preceding buf[index], reaching into bytes already handed out if needed.
+func (r *BytesReplacingReader) before(index int) []byte {
+	if index >= r.behind {
+		return r.buf[index-r.behind : index]
+	}
+	r.scratch = append(append(r.scratch[:0], r.tail...), r.buf[:index]...)
+	return r.scratch[max(0, len(r.scratch)-r.behind):]
+}
+
+// keepTail remembers the last `r.behind` bytes of the data handed out by Read.
+func (r *BytesReplacingReader) keepTail(out []byte) {
+	if r.behind == 0 {
+		return
+	}
+	if len(out) >= r.behind {
+		r.tail = append(r.tail[:0], out[len(out)-r.behind:]...)
+		return
+	}
+	r.tail = append(r.tail, out...)
+	if drop := len(r.tail) - r.behind; drop > 0 {
+		r.tail = r.tail[:copy(r.tail, r.tail[drop:])]
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 func max(a, b int) int {
 	if a > b {
 		return a
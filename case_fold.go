@@ -0,0 +1,231 @@
+package gosed
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// MatchCaseFold matches the key case-insensitively using full Unicode case folding, so "STRASSE" also matches "straße".
+// lang selects locale-specific rules: "tr" and "az" fold the dotted and dotless I the Turkic way ("I" matches "ı", "İ" matches "i").
+// Pass an empty lang for the default rules.
+func MatchCaseFold(lang string) MappingOption {
+	return func(o *mappingOptions) {
+		o.Fold = true
+		o.FoldLang = lang
+	}
+}
+
+// fullCaseFolds holds the multi-rune entries of the Unicode case folding table (status F) that simple folding misses.
+var fullCaseFolds = map[rune][]rune{
+	'ß': {'s', 's'},
+	'ẞ': {'s', 's'},
+	'İ': {'i', '̇'},
+	'ŉ': {'ʼ', 'n'},
+	'ǰ': {'j', '̌'},
+	'ΐ': {'ι', '̈', '́'},
+	'ΰ': {'υ', '̈', '́'},
+	'և': {'ե', 'ւ'},
+	'ẖ': {'h', '̱'},
+	'ẗ': {'t', '̈'},
+	'ẘ': {'w', '̊'},
+	'ẙ': {'y', '̊'},
+	'ẚ': {'a', 'ʾ'},
+	'ﬀ': {'f', 'f'},
+	'ﬁ': {'f', 'i'},
+	'ﬂ': {'f', 'l'},
+	'ﬃ': {'f', 'f', 'i'},
+	'ﬄ': {'f', 'f', 'l'},
+	'ﬅ': {'s', 't'},
+	'ﬆ': {'s', 't'},
+	'ὐ': {'υ', '̓'},
+}
+
+// turkicCaseFolds replaces the default folding of the four Latin I variants for the "tr" and "az" locales.
+var turkicCaseFolds = map[rune]rune{
+	'I': 'ı',
+	'ı': 'ı',
+	'İ': 'i',
+	'i': 'i',
+}
+
+// caseFolder folds runes to a canonical form, so that two strings match case-insensitively when their folded forms are equal.
+type caseFolder struct {
+	turkic bool
+}
+
+func newCaseFolder(lang string) caseFolder {
+	return caseFolder{turkic: lang == "tr" || lang == "az"}
+}
+
+// appendFold appends the folded form of r to dst.
+func (cf caseFolder) appendFold(dst []rune, r rune) []rune {
+	if cf.turkic {
+		if f, ok := turkicCaseFolds[r]; ok {
+			return append(dst, f)
+		}
+	}
+	if f, ok := fullCaseFolds[r]; ok {
+		for _, fr := range f {
+			dst = append(dst, simpleFold(fr))
+		}
+		return dst
+	}
+	return append(dst, simpleFold(r))
+}
+
+func (cf caseFolder) fold(b []byte) []rune {
+	folded := make([]rune, 0, len(b))
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		folded = cf.appendFold(folded, r)
+		b = b[size:]
+	}
+	return folded
+}
+
+// simpleFold returns the smallest rune of r's simple case folding orbit, which is the same for every member of the orbit.
+func simpleFold(r rune) rune {
+	smallest := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f < smallest {
+			smallest = f
+		}
+	}
+	return smallest
+}
+
+// foldingReplacer is a BytesReplacer that finds its search token case-insensitively.
+type foldingReplacer struct {
+	folder  caseFolder
+	key     []rune
+	replace []byte
+	tmp     []rune
+}
+
+func newFoldingReplacer(search, replace []byte, lang string) *foldingReplacer {
+	folder := newCaseFolder(lang)
+	return &foldingReplacer{
+		folder:  folder,
+		key:     folder.fold(search),
+		replace: replace,
+	}
+}
+
+func (r *foldingReplacer) GetSizingHints() (int, int, float64) {
+	// A folded rune comes from at most utf8.UTFMax bytes, and from at least 2/3 of a byte (e.g. "ΐ" is 2 bytes and folds to 3 runes).
+	maxLen := len(r.key) * utf8.UTFMax
+	minLen := max(1, 2*len(r.key)/3)
+	ratio := float64(-1)
+	if minLen < len(r.replace) {
+		ratio = float64(minLen) / float64(len(r.replace))
+	}
+	return maxLen, len(r.replace), ratio
+}
+
+// BestIndex returns the first match of the folded key in buf. A match always covers whole runes of buf.
+func (r *foldingReplacer) BestIndex(buf []byte) (int, []byte, []byte) {
+	for i := 0; i < len(buf); i++ {
+		if !utf8.RuneStart(buf[i]) {
+			continue
+		}
+		if end := r.matchAt(buf, i); end > 0 {
+			return i, buf[i:end], r.replace
+		}
+	}
+	return -1, nil, r.replace
+}
+
+// matchAt returns the end of the match starting at buf[i], or -1.
+func (r *foldingReplacer) matchAt(buf []byte, i int) int {
+	matched := 0
+	for matched < len(r.key) {
+		if i >= len(buf) {
+			return -1
+		}
+		c, size := rune(buf[i]), 1
+		if c >= utf8.RuneSelf {
+			c, size = utf8.DecodeRune(buf[i:])
+		}
+		r.tmp = r.folder.appendFold(r.tmp[:0], c)
+		if len(r.tmp) > len(r.key)-matched {
+			return -1
+		}
+		for j, fc := range r.tmp {
+			if r.key[matched+j] != fc {
+				return -1
+			}
+		}
+		matched += len(r.tmp)
+		i += size
+	}
+	return i
+}
+
+// MatchCaseInsensitive matches the key ignoring the case of ASCII letters only, so "Content-Type" also matches
+// "content-type" and "CONTENT-TYPE" but "STRASSE" does not match "straße". A match always has the length of the key,
+// so unlike MatchCaseFold it can be patched in place. MatchCaseFold and MatchIdentifierVariants take precedence over
+// this option.
+func MatchCaseInsensitive() MappingOption {
+	return func(o *mappingOptions) {
+		o.ASCIIFold = true
+	}
+}
+
+// asciiFoldingReplacer is a BytesReplacer matching its key regardless of the case of ASCII letters
+type asciiFoldingReplacer struct {
+	key     []byte
+	replace []byte
+	slide   [256]int
+}
+
+func newASCIIFoldingReplacer(search, replace []byte) *asciiFoldingReplacer {
+	r := &asciiFoldingReplacer{key: make([]byte, len(search)), replace: replace}
+	for i, c := range search {
+		r.key[i] = lowerASCII(c)
+	}
+	// the Horspool shift of every byte, for both cases of a letter
+	for i := range r.slide {
+		r.slide[i] = len(r.key)
+	}
+	for i, c := range r.key[:len(r.key)-1] {
+		r.slide[c] = len(r.key) - 1 - i
+		r.slide[upperASCII(c)] = len(r.key) - 1 - i
+	}
+	return r
+}
+
+func (r *asciiFoldingReplacer) GetSizingHints() (int, int, float64) {
+	ratio := float64(-1)
+	if len(r.key) < len(r.replace) {
+		ratio = float64(len(r.key)) / float64(len(r.replace))
+	}
+	return len(r.key), len(r.replace), ratio
+}
+
+// BestIndex returns the first match of the key in buf, ignoring the case of ASCII letters
+func (r *asciiFoldingReplacer) BestIndex(buf []byte) (int, []byte, []byte) {
+	n := len(r.key)
+	for i := 0; i+n <= len(buf); i += r.slide[buf[i+n-1]] {
+		j := n - 1
+		for ; j >= 0 && lowerASCII(buf[i+j]) == r.key[j]; j-- {
+		}
+		if j < 0 {
+			return i, buf[i : i+n], r.replace
+		}
+	}
+	return -1, r.key, r.replace
+}
+
+func lowerASCII(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+func upperASCII(c byte) byte {
+	if c >= 'a' && c <= 'z' {
+		return c - ('a' - 'A')
+	}
+	return c
+}
@@ -0,0 +1,66 @@
+package gosed
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// errCloneUnsupported is returned by cloneFile where the platform or filesystem cannot share extents between files
+var errCloneUnsupported = errors.New("file cloning is not supported")
+
+// WithReflinkCopy clones the file into the temporary file before replacing, on filesystems that support reflinks
+// (such as Btrfs and XFS), and then only rewrites the blocks whose content changes. The copy shares its unchanged
+// extents with the original, so a small edit to a huge file costs little time or space; once a replacement changes
+// the length of the content, everything after it is rewritten. Where cloning is not supported, the file is copied as usual.
+// Cloning is only implemented on Linux, with the FICLONE ioctl: on macOS, whose clonefile(2) can only create a new
+// file rather than clone into the temporary file, and on other platforms, the file is always copied.
+func WithReflinkCopy() Option {
+	return func(c *replacerConfig) {
+		c.Reflink = true
+	}
+}
+
+// cloneWriter writes the replaced content over a clone of the source, skipping the bytes the clone already holds
+type cloneWriter struct {
+	f      *os.File
+	offset int64
+	buf    []byte
+}
+
+// newCloneWriter clones src into dst and returns a writer over it, or nil if the file cannot be cloned
+func (rc *replacerConfig) newCloneWriter(dst, src *os.File) *cloneWriter {
+	if !rc.Reflink || cloneFile(dst, src) != nil {
+		return nil
+	}
+	return &cloneWriter{f: dst}
+}
+
+// Write implements the `io.Writer` interface.
+func (cw *cloneWriter) Write(p []byte) (int, error) {
+	if cap(cw.buf) < len(p) {
+		cw.buf = make([]byte, len(p))
+	}
+	// the clone still holds the original content from offset on
+	n, err := cw.f.ReadAt(cw.buf[:len(p)], cw.offset)
+	if err != nil && n < len(p) && err != io.EOF {
+		return 0, err
+	}
+	for first, last := nextDiff(cw.buf[:n], p[:n], 0); first >= 0; first, last = nextDiff(cw.buf[:n], p[:n], last) {
+		if _, err := cw.f.WriteAt(p[first:last], cw.offset+int64(first)); err != nil {
+			return 0, err
+		}
+	}
+	if n < len(p) {
+		if _, err := cw.f.WriteAt(p[n:], cw.offset+int64(n)); err != nil {
+			return 0, err
+		}
+	}
+	cw.offset += int64(len(p))
+	return len(p), nil
+}
+
+// finish cuts off what remains of the original content after the replaced content
+func (cw *cloneWriter) finish() error {
+	return cw.f.Truncate(cw.offset)
+}
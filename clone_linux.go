@@ -0,0 +1,14 @@
+package gosed
+
+import (
+	"os"
+	"syscall"
+)
+
+// cloneFile replaces the content of dst with a reflink clone of src
+func cloneFile(dst, src *os.File) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd()); errno != 0 {
+		return errCloneUnsupported
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package gosed
+
+import "os"
+
+// cloneFile replaces the content of dst with a reflink clone of src
+func cloneFile(dst, src *os.File) error {
+	return errCloneUnsupported
+}
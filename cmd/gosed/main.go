@@ -0,0 +1,362 @@
+// Command gosed is a sed-like front end to the gosed replace engine, for shell scripts and CI pipelines.
+//
+// Usage:
+//
+//	gosed [OPTION]... {SCRIPT | -e SCRIPT...} [FILE]...
+//
+// The script is a list of s commands separated by semicolons or line feeds, applied in order to every line. The
+// commands take the syntax of gosed.ParseExpression, plus the p flag, which prints the lines the command changes.
+// The files are written to the standard output one after the other, or the standard input if there are none or for
+// a FILE of "-", unless they are replaced in place.
+//
+//	-e SCRIPT, --expression=SCRIPT    adds the commands of SCRIPT; the first operand is the script if it is missing
+//	-n, --quiet, --silent             only prints the lines printed by the p flag
+//	-i[SUFFIX], --in-place[=SUFFIX]   replaces the files in place, keeping the originals with SUFFIX if given
+//	--dry-run                         prints what -i would change as a unified diff instead, and changes nothing
+//	-r, -R, --recursive               replaces the files of the directories given as FILE; unlike in GNU sed, -r is
+//	                                  not about extended regular expressions
+//	--include=GLOB, --exclude=GLOB    selects the files of those directories, as gosed.DirReplacer.Patterns
+//
+// gosed exits with 1 if the arguments or the script are invalid, and with 2 if a file could not be processed, after
+// processing the others.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/mohamed-essam/gosed"
+)
+
+// usage is printed by --help and after invalid arguments
+const usage = "Usage: gosed [OPTION]... {SCRIPT | -e SCRIPT...} [FILE]...\n"
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// options are the parsed arguments of a run
+type options struct {
+	scripts   []string
+	quiet     bool
+	inPlace   bool
+	suffix    string
+	dryRun    bool
+	recursive bool
+	patterns  []string
+	files     []string
+	help      bool
+}
+
+// command is a parsed s command of the script
+type command struct {
+	mapping gosed.Mapping
+	print   bool
+}
+
+// run runs gosed with args and returns its exit status
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	opts, err := parseArgs(args)
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "gosed: %v\n%s", err, usage)
+		return 1
+	}
+	if opts.help {
+		_, _ = io.WriteString(stdout, usage)
+		return 0
+	}
+	var commands []command
+	for _, script := range opts.scripts {
+		parsed, err := parseScript(script)
+		if err != nil {
+			_, _ = fmt.Fprintf(stderr, "gosed: %v\n", err)
+			return 1
+		}
+		commands = append(commands, parsed...)
+	}
+	lineWise := opts.quiet
+	for _, c := range commands {
+		lineWise = lineWise || c.print
+	}
+	if lineWise && (opts.inPlace || opts.dryRun) {
+		_, _ = fmt.Fprintln(stderr, "gosed: -n and the p flag cannot be combined with -i or --dry-run")
+		return 1
+	}
+	out := bufio.NewWriter(stdout)
+	status := 0
+	for _, operand := range opts.files {
+		// like GNU sed, an operand that cannot be processed is reported and the others are processed all the same
+		files, err := opts.expand(operand)
+		if err != nil {
+			_, _ = fmt.Fprintf(stderr, "gosed: %s: %v\n", operand, err)
+			status = 2
+			continue
+		}
+		for _, file := range files {
+			switch {
+			case opts.inPlace || opts.dryRun:
+				err = replaceFile(file, commands, opts, out)
+			case file == "-":
+				err = stream(stdin, commands, lineWise, opts.quiet, out)
+			default:
+				err = streamFile(file, commands, lineWise, opts.quiet, out)
+			}
+			if err != nil {
+				_, _ = fmt.Fprintf(stderr, "gosed: %s: %v\n", file, err)
+				status = 2
+			}
+		}
+	}
+	if err := out.Flush(); err != nil {
+		_, _ = fmt.Fprintf(stderr, "gosed: %v\n", err)
+		return 2
+	}
+	return status
+}
+
+// parseArgs parses the command line like GNU sed, with clustered short options but no abbreviated long options
+func parseArgs(args []string) (*options, error) {
+	opts := &options{}
+	var operands []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			operands = append(operands, args[i+1:]...)
+			i = len(args)
+		case strings.HasPrefix(arg, "--"):
+			name, value, hasValue := strings.Cut(arg[2:], "=")
+			switch name {
+			case "expression":
+				if !hasValue {
+					if i+1 == len(args) {
+						return nil, errors.New("option --expression requires an argument")
+					}
+					i++
+					value = args[i]
+				}
+				opts.scripts = append(opts.scripts, value)
+			case "in-place":
+				opts.inPlace, opts.suffix = true, value
+			case "quiet", "silent":
+				opts.quiet = true
+			case "dry-run":
+				opts.dryRun = true
+			case "recursive":
+				opts.recursive = true
+			case "include", "exclude":
+				if !hasValue || value == "" {
+					return nil, fmt.Errorf("option --%s requires a glob", name)
+				}
+				if name == "exclude" {
+					value = "!" + value
+				}
+				opts.patterns = append(opts.patterns, value)
+			case "help":
+				opts.help = true
+			default:
+				return nil, fmt.Errorf("unknown option %q", arg)
+			}
+		case strings.HasPrefix(arg, "-") && arg != "-":
+			for j := 1; j < len(arg); j++ {
+				switch arg[j] {
+				case 'n':
+					opts.quiet = true
+				case 'r', 'R':
+					opts.recursive = true
+				case 'h':
+					opts.help = true
+				case 'i':
+					// the rest of the cluster is the suffix
+					opts.inPlace, opts.suffix = true, arg[j+1:]
+					j = len(arg)
+				case 'e':
+					value := arg[j+1:]
+					if value == "" {
+						if i+1 == len(args) {
+							return nil, errors.New("option -e requires an argument")
+						}
+						i++
+						value = args[i]
+					}
+					opts.scripts = append(opts.scripts, value)
+					j = len(arg)
+				default:
+					return nil, fmt.Errorf("unknown option %q", "-"+string(arg[j]))
+				}
+			}
+		default:
+			operands = append(operands, arg)
+		}
+	}
+	if opts.help {
+		return opts, nil
+	}
+	if len(opts.scripts) == 0 {
+		if len(operands) == 0 {
+			return nil, errors.New("no script specified")
+		}
+		opts.scripts, operands = operands[:1], operands[1:]
+	}
+	opts.files = operands
+	if len(opts.files) == 0 && (opts.inPlace || opts.dryRun) {
+		return nil, errors.New("no input files to edit in place")
+	}
+	if len(opts.files) == 0 {
+		opts.files = []string{"-"}
+	}
+	return opts, nil
+}
+
+// parseScript parses the s commands of script
+func parseScript(script string) ([]command, error) {
+	var commands []command
+	for {
+		script = strings.TrimLeft(script, " \t\n;")
+		if script == "" {
+			return commands, nil
+		}
+		if len(script) < 2 || script[0] != 's' {
+			return nil, fmt.Errorf("unsupported command %q, only s commands are", strings.SplitN(script, "\n", 2)[0])
+		}
+		// the command ends with the flags following its third delimiter
+		delim, delims, end := script[1], 0, len(script)
+		for i := 2; i < len(script) && delims < 2; i++ {
+			switch script[i] {
+			case '\\':
+				i++
+			case delim:
+				delims++
+				if delims == 2 {
+					end = i + 1
+				}
+			}
+		}
+		if flags := strings.IndexAny(script[end:], ";\n"); flags >= 0 {
+			end += flags
+		} else {
+			end = len(script)
+		}
+		expr := strings.TrimSpace(script[:end])
+		script = script[end:]
+		c := command{}
+		// p is not a flag of the library, which prints nothing
+		if i := strings.LastIndexByte(expr, delim); i > 0 && strings.ContainsRune(expr[i+1:], 'p') {
+			c.print = true
+			expr = expr[:i+1] + strings.Replace(expr[i+1:], "p", "", 1)
+		}
+		mapping, err := gosed.ParseExpression(expr)
+		if err != nil {
+			return nil, err
+		}
+		c.mapping = mapping
+		commands = append(commands, c)
+	}
+}
+
+// expand returns the files of operand: those under it if it is a directory and recursive, or operand itself
+func (opts *options) expand(operand string) ([]string, error) {
+	info, err := os.Stat(operand)
+	if operand == "-" || err != nil || !info.IsDir() {
+		return []string{operand}, nil
+	}
+	if !opts.recursive {
+		return nil, errors.New("is a directory, use -r to replace the files under it")
+	}
+	dr := gosed.NewDirReplacer(operand)
+	dr.Patterns = opts.patterns
+	return dr.Files()
+}
+
+// replaceFile replaces file in place, or writes what would change to out on a dry run
+func replaceFile(file string, commands []command, opts *options, out io.Writer) error {
+	var replacerOpts []gosed.Option
+	if opts.suffix != "" {
+		replacerOpts = append(replacerOpts, gosed.WithBackup(opts.suffix))
+	}
+	rp, err := gosed.NewReplacer(file, replacerOpts...)
+	if err != nil {
+		return err
+	}
+	defer func(rp *gosed.Replacer) {
+		_ = rp.Config.File.Close()
+	}(rp)
+	for _, c := range commands {
+		if err := rp.NewMappingWithOptions(c.mapping.Old, c.mapping.New, c.mapping.Options...); err != nil {
+			return err
+		}
+	}
+	if !opts.dryRun {
+		_, err = rp.ReplaceChained()
+		return err
+	}
+	result, err := rp.Preview(nil)
+	if err != nil || len(result.Hunks) == 0 {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "--- %s\n+++ %s\n%s", file, file, result)
+	return err
+}
+
+// streamFile writes file, replaced, to out
+func streamFile(file string, commands []command, lineWise, quiet bool, out io.Writer) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	return stream(f, commands, lineWise, quiet, out)
+}
+
+// stream writes r, replaced, to out. Unless lineWise, the commands are chained over the whole stream; otherwise they
+// are applied to a line at a time, so that the lines they change can be printed.
+func stream(r io.Reader, commands []command, lineWise, quiet bool, out io.Writer) error {
+	if !lineWise {
+		mappings := make([]gosed.Mapping, len(commands))
+		for i, c := range commands {
+			mappings[i] = c.mapping
+		}
+		_, err := io.Copy(out, gosed.NewReader(r, mappings...))
+		return err
+	}
+	lines := bufio.NewReader(r)
+	for {
+		line, err := lines.ReadBytes('\n')
+		if len(line) > 0 {
+			var printed [][]byte
+			for _, c := range commands {
+				replaced, rerr := ioutil.ReadAll(gosed.NewReader(bytes.NewReader(line), c.mapping))
+				if rerr != nil {
+					return rerr
+				}
+				if c.print && !bytes.Equal(replaced, line) {
+					printed = append(printed, replaced)
+				}
+				line = replaced
+			}
+			// like sed, the p flag prints as the command runs, before the line is printed at the end of the script
+			if !quiet {
+				printed = append(printed, line)
+			}
+			for _, p := range printed {
+				if _, werr := out.Write(p); werr != nil {
+					return werr
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
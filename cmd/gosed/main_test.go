@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	root := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		return path
+	}
+	read := func(path string) string {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return string(content)
+	}
+	gosed := func(stdin string, args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		status := run(args, strings.NewReader(stdin), &stdout, &stderr)
+		return status, stdout.String(), stderr.String()
+	}
+
+	for _, tc := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"s/foo/bar/"}, "bar foo\nbaz\n"},
+		{[]string{"-e", "s/foo/bar/g", "-e", "s/baz/qux/"}, "bar bar\nqux\n"},
+		{[]string{"--expression=s/foo/bar/2; s|baz|/opt|"}, "foo bar\n/opt\n"},
+		{[]string{"-n", "s/ba\\(.\\)/[\\1]/p"}, "[z]\n"},
+		{[]string{"s/foo/X/p"}, "X foo\nX foo\nbaz\n"},
+	} {
+		status, stdout, stderr := gosed("foo foo\nbaz\n", tc.args...)
+		if status != 0 || stdout != tc.expected {
+			t.Fatalf("%q: status %d, output %q, expected %q: %s", tc.args, status, stdout, tc.expected, stderr)
+		}
+	}
+
+	config := write("config.txt", "host=db01\n")
+	if status, _, stderr := gosed("", "-i.bak", "s/db01/db02/", config); status != 0 {
+		t.Fatalf("in place: status %d: %s", status, stderr)
+	}
+	if read(config) != "host=db02\n" || read(config+".bak") != "host=db01\n" {
+		t.Fatalf("unexpected in place result %q", read(config))
+	}
+
+	status, stdout, stderr := gosed("", "--dry-run", "s/db02/db03/", config)
+	if status != 0 || !strings.Contains(stdout, "-host=db02\n+host=db03\n") || read(config) != "host=db02\n" {
+		t.Fatalf("dry run: status %d, output %q: %s", status, stdout, stderr)
+	}
+
+	tree := filepath.Join(root, "tree")
+	kept := write("tree/a.go", "old\n")
+	replaced := write("tree/sub/b.txt", "old\n")
+	excluded := write("tree/vendor/c.txt", "old\n")
+	other := write("other.txt", "old\n")
+	if status, _, stderr := gosed("", "-i", "s/old/new/", tree, other); status != 2 || !strings.Contains(stderr, "use -r") {
+		t.Fatalf("directory without -r: status %d: %s", status, stderr)
+	}
+	if read(other) != "new\n" || read(replaced) != "old\n" {
+		t.Fatal("unexpected files replaced next to a directory without -r")
+	}
+	if status, _, stderr := gosed("", "-ri", "--include=*.txt", "--exclude=vendor/**", "s/old/new/", tree); status != 0 {
+		t.Fatalf("recursive: status %d: %s", status, stderr)
+	}
+	if read(kept) != "old\n" || read(replaced) != "new\n" || read(excluded) != "old\n" {
+		t.Fatal("unexpected files replaced by the recursive run")
+	}
+
+	if status, _, _ := gosed("", "y/abc/xyz/"); status != 1 {
+		t.Fatalf("invalid script: status %d", status)
+	}
+	if status, _, _ := gosed("", "-n", "-i", "s/a/b/p", config); status != 1 {
+		t.Fatalf("-n with -i: status %d", status)
+	}
+	if status, _, _ := gosed("", "s/a/b/", filepath.Join(root, "missing.txt"), config); status != 2 {
+		t.Fatalf("missing file: status %d", status)
+	}
+}
@@ -0,0 +1,39 @@
+package gosed
+
+import (
+	"errors"
+	"io"
+)
+
+// Codec encrypts and decrypts the file, e.g. with age, GPG or a SOPS-style envelope, for WithCodec.
+type Codec interface {
+	// NewReader returns a reader of the plaintext of the ciphertext read from r
+	NewReader(r io.Reader) (io.ReadCloser, error)
+	// NewWriter returns a writer that encrypts to w; closing it flushes the remaining data but does not close w
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+// WithCodec decrypts the file with c before replacing and encrypts the result with c. The plaintext only ever
+// streams through memory: the temporary file the result is committed from holds the ciphertext. A Compression is
+// applied inside the encryption, so the plaintext is compressed before it is encrypted.
+// Zip members cannot be combined with a codec.
+func WithCodec(c Codec) Option {
+	return func(rc *replacerConfig) {
+		rc.Codec = c
+	}
+}
+
+// errCodecZip is returned when a codec is combined with zip members, whose replace does not go through the codec
+var errCodecZip = errors.New("zip members cannot be replaced in an encrypted file")
+
+// layers returns the codec and compression the file is wrapped in, outermost first
+func (rc *replacerConfig) layers() []Codec {
+	var layers []Codec
+	if rc.Codec != nil {
+		layers = append(layers, rc.Codec)
+	}
+	if rc.Compression != nil {
+		layers = append(layers, rc.Compression)
+	}
+	return layers
+}
@@ -0,0 +1,138 @@
+package gosed
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is a compressed container format the file is stored in.
+// With WithCompression, the file is decompressed before replacing and the result is compressed again.
+type Compression interface {
+	// NewReader returns a reader of the decompressed content of r
+	NewReader(r io.Reader) (io.ReadCloser, error)
+	// NewWriter returns a writer that compresses to w; closing it flushes the remaining data but does not close w
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+var (
+	// Gzip is the gzip Compression
+	Gzip Compression = gzipCompression{}
+	// Bzip2 is the bzip2 Compression
+	Bzip2 Compression = bzip2Compression{}
+	// Zstd is the Zstandard Compression
+	Zstd Compression = zstdCompression{}
+)
+
+// WithCompression decompresses the file with c before replacing and compresses the result with c.
+func WithCompression(c Compression) Option {
+	return func(rc *replacerConfig) {
+		rc.Compression = c
+	}
+}
+
+// WithDetectedCompression recognizes gzip, bzip2 and Zstandard files by their magic number and replaces them as
+// WithCompression does with Gzip, Bzip2 or Zstd, recompressing the result in the same format. Other files are
+// replaced as they are, though as WithCompression does, in a single pass and not in place.
+func WithDetectedCompression() Option {
+	return func(rc *replacerConfig) {
+		rc.Compression = &detectedCompression{}
+	}
+}
+
+// compressionMagic are the magic numbers of the compressions WithDetectedCompression recognizes
+var compressionMagic = []struct {
+	magic []byte
+	c     Compression
+}{
+	{[]byte{0x1f, 0x8b}, Gzip},
+	{[]byte("BZh"), Bzip2},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, Zstd},
+}
+
+// compressionFor returns the compression a file name ends with the extension of, or nil
+func compressionFor(name string) Compression {
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		return Gzip
+	case strings.HasSuffix(name, ".bz2"):
+		return Bzip2
+	case strings.HasSuffix(name, ".zst"):
+		return Zstd
+	}
+	return nil
+}
+
+// detectedCompression decompresses in the format its input starts with and compresses in the format it last
+// decompressed. The result is written after the file is read from, so the format is known by then.
+type detectedCompression struct {
+	c Compression
+}
+
+func (dc *detectedCompression) NewReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	dc.c = nil
+	for _, m := range compressionMagic {
+		if head, _ := br.Peek(len(m.magic)); bytes.Equal(head, m.magic) {
+			dc.c = m.c
+			return m.c.NewReader(br)
+		}
+	}
+	return ioutil.NopCloser(br), nil
+}
+
+func (dc *detectedCompression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	if dc.c == nil {
+		return uncompressedWriter{w}, nil
+	}
+	return dc.c.NewWriter(w)
+}
+
+// uncompressedWriter writes a file of no known compression as it is
+type uncompressedWriter struct {
+	io.Writer
+}
+
+func (uncompressedWriter) Close() error {
+	return nil
+}
+
+type gzipCompression struct{}
+
+func (gzipCompression) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func (gzipCompression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+type bzip2Compression struct{}
+
+func (bzip2Compression) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return bzip2.NewReader(r, nil)
+}
+
+func (bzip2Compression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return bzip2.NewWriter(w, nil)
+}
+
+type zstdCompression struct{}
+
+func (zstdCompression) NewReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+func (zstdCompression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w)
+}
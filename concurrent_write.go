@@ -0,0 +1,186 @@
+package gosed
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrConcurrentWrite is returned when the file was changed by another writer while it was being replaced
+var ErrConcurrentWrite = errors.New("file changed during replace")
+
+// ConcurrentWritePolicy controls what happens when the file changes while it is being replaced
+type ConcurrentWritePolicy int
+
+const (
+	// ConcurrentWriteIgnore replaces the file regardless, losing whatever was written to it meanwhile
+	ConcurrentWriteIgnore ConcurrentWritePolicy = iota
+	// ConcurrentWriteAbort keeps the file as the other writer left it and returns ErrConcurrentWrite
+	ConcurrentWriteAbort
+	// ConcurrentWriteRetry starts the replace over from the changed file
+	ConcurrentWriteRetry
+)
+
+// WithConcurrentWriteDetection checks, before the replaced copy is renamed over the file, that the file still has
+// the size, modification time and inode it had when reading began, and that the bytes read from it are unchanged.
+// If not, policy decides what happens; with ConcurrentWriteRetry the replace is attempted at most retries more times
+// before ErrConcurrentWrite is returned. The check narrows the window in which a write is lost, but cannot close it.
+func WithConcurrentWriteDetection(policy ConcurrentWritePolicy, retries int) Option {
+	return func(c *replacerConfig) {
+		c.ConcurrentWrites = policy
+		c.ConcurrentWriteRetries = retries
+	}
+}
+
+// sourceState is what the file looked like when reading it began
+type sourceState struct {
+	info os.FileInfo
+	hash hash.Hash
+	// regions are the spans of the file read so far, in the order they were hashed
+	regions []region
+}
+
+type region struct {
+	offset, length int64
+}
+
+// watchSource records the state of input, or returns nil if concurrent writes are ignored
+func (rc *replacerConfig) watchSource(input *os.File) (*sourceState, error) {
+	if rc.ConcurrentWrites == ConcurrentWriteIgnore {
+		return nil, nil
+	}
+	info, err := input.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &sourceState{info: info, hash: sha256.New()}, nil
+}
+
+// reader hashes everything read from r, so the scanned region can be verified on commit
+func (ss *sourceState) reader(r io.Reader) io.Reader {
+	if ss == nil {
+		return r
+	}
+	return io.TeeReader(r, ss)
+}
+
+// readerAt is reader for random access sources
+func (ss *sourceState) readerAt(ra io.ReaderAt) io.ReaderAt {
+	if ss == nil {
+		return ra
+	}
+	return &hashingReaderAt{ra: ra, ss: ss}
+}
+
+// Write implements the `io.Writer` interface, recording p as read right after the previous region.
+func (ss *sourceState) Write(p []byte) (int, error) {
+	var offset int64
+	if n := len(ss.regions); n > 0 {
+		offset = ss.regions[n-1].offset + ss.regions[n-1].length
+	}
+	ss.record(p, offset)
+	return len(p), nil
+}
+
+// record hashes p, read at offset
+func (ss *sourceState) record(p []byte, offset int64) {
+	if len(p) == 0 {
+		return
+	}
+	ss.hash.Write(p)
+	if n := len(ss.regions); n > 0 && ss.regions[n-1].offset+ss.regions[n-1].length == offset {
+		ss.regions[n-1].length += int64(len(p))
+		return
+	}
+	ss.regions = append(ss.regions, region{offset: offset, length: int64(len(p))})
+}
+
+// hashingReaderAt records everything read through it in a sourceState
+type hashingReaderAt struct {
+	ra io.ReaderAt
+	ss *sourceState
+}
+
+// ReadAt implements the `io.ReaderAt` interface.
+func (hr *hashingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := hr.ra.ReadAt(p, off)
+	hr.ss.record(p[:n], off)
+	return n, err
+}
+
+// changed reports whether the file differs from the recorded state
+func (ss *sourceState) changed(rc *replacerConfig) (bool, error) {
+	info, err := os.Stat(rc.FilePath)
+	if err != nil {
+		return false, err
+	}
+	if !os.SameFile(ss.info, info) || info.Size() != ss.info.Size() || !info.ModTime().Equal(ss.info.ModTime()) {
+		return true, nil
+	}
+	if len(ss.regions) == 0 {
+		return false, nil
+	}
+	fi, err := os.Open(rc.FilePath)
+	if err != nil {
+		return false, err
+	}
+	defer func(fi *os.File) {
+		_ = fi.Close()
+	}(fi)
+	h := sha256.New()
+	for _, r := range ss.regions {
+		n, err := io.Copy(h, rc.track(io.NewSectionReader(fi, r.offset, r.length)))
+		if err != nil {
+			return false, err
+		}
+		if n < r.length {
+			return true, nil
+		}
+	}
+	return !bytes.Equal(h.Sum(nil), ss.hash.Sum(nil)), nil
+}
+
+// commit renames tmpFile over the file, once it is verified that nobody wrote to the file since ss was recorded
+func (rp *Replacer) commit(tmpFile string, ss *sourceState) error {
+	unlock, err := rp.Config.lock()
+	if err != nil {
+		_ = os.Remove(tmpFile)
+		return err
+	}
+	defer unlock()
+	if ss != nil {
+		changed, err := ss.changed(rp.Config)
+		if err == nil && changed {
+			err = fmt.Errorf("%w: %s", ErrConcurrentWrite, rp.Config.FilePath)
+		}
+		if err != nil {
+			_ = os.Remove(tmpFile)
+			return err
+		}
+	}
+	if err := rp.Config.beginCommit(); err != nil {
+		_ = os.Remove(tmpFile)
+		return err
+	}
+	rp.Config.keepLinks()
+	if rp.Config.Tx != nil {
+		return rp.Config.Tx.stage(rp, tmpFile, ss)
+	}
+	return rp.install(tmpFile)
+}
+
+// retryConcurrentWrites runs replace again while it fails with ErrConcurrentWrite, as far as the policy allows
+func (rp *Replacer) retryConcurrentWrites(replace func() (int, error)) (int, error) {
+	for attempt := 0; ; attempt++ {
+		wrote, err := replace()
+		if !errors.Is(err, ErrConcurrentWrite) || rp.Config.ConcurrentWrites != ConcurrentWriteRetry || attempt >= rp.Config.ConcurrentWriteRetries {
+			return wrote, err
+		}
+		time.Sleep(time.Duration(attempt+1) * 10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,269 @@
+package gosed
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrDaemonClosed is returned by Daemon.Serve once the daemon is closed
+var ErrDaemonClosed = errors.New("daemon closed")
+
+// Daemon runs replace jobs sent over a local socket, so that other tools can delegate file edits without starting a
+// process per file. Every connection shares the same workers and the mapping sets of Pool.
+//
+// The protocol is line-delimited JSON: each line sent is a DaemonRequest, and every request is answered with a line
+// holding a DaemonResponse with the same ID. Replace jobs run concurrently, so their responses may come out of order.
+type Daemon struct {
+	Pool *ReplacerPool
+
+	jobs    chan daemonJob
+	workers sync.WaitGroup
+	// pending counts the requests submitted and not answered yet
+	pending sync.WaitGroup
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+
+	queued, running, completed, failed int64
+}
+
+// DaemonRequest is a request sent to a Daemon
+type DaemonRequest struct {
+	// ID is echoed in the response
+	ID string `json:"id,omitempty"`
+	// Op is "replace", the default, or "status"
+	Op string `json:"op,omitempty"`
+	// Path is the file to replace, and Set the name of the mapping set of the pool to replace it with
+	Path string `json:"path,omitempty"`
+	Set  string `json:"set,omitempty"`
+}
+
+// DaemonResponse answers a DaemonRequest
+type DaemonResponse struct {
+	ID   string `json:"id,omitempty"`
+	Path string `json:"path,omitempty"`
+	// Status is the FileStatus of a replace job, or "error" for a request that could not be run
+	Status string       `json:"status"`
+	Wrote  int          `json:"wrote,omitempty"`
+	Error  string       `json:"error,omitempty"`
+	Stats  *DaemonStats `json:"stats,omitempty"`
+}
+
+// DaemonStats counts the jobs of a Daemon, returned by the "status" request
+type DaemonStats struct {
+	Queued    int64 `json:"queued"`
+	Running   int64 `json:"running"`
+	Completed int64 `json:"completed"`
+	Failed    int64 `json:"failed"`
+}
+
+type daemonJob struct {
+	req   DaemonRequest
+	reply chan<- DaemonResponse
+}
+
+// NewDaemon returns a new *Daemon that replaces files with the mapping sets of pool, running up to workers jobs at once
+func NewDaemon(pool *ReplacerPool, workers int) *Daemon {
+	if workers < 1 {
+		workers = 1
+	}
+	d := &Daemon{
+		Pool:      pool,
+		jobs:      make(chan daemonJob),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+	d.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go d.work()
+	}
+	return d
+}
+
+// ListenAndServe listens on the unix socket at socketPath, replacing a stale socket left there, and serves it
+func (d *Daemon) ListenAndServe(socketPath string) error {
+	if fd, err := os.Lstat(socketPath); err == nil && fd.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", socketPath); err == nil {
+			_ = conn.Close()
+			return fmt.Errorf("%s is already being served", socketPath)
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return err
+		}
+	}
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	return d.Serve(l)
+}
+
+// Serve accepts connections on l until the daemon is closed, and then returns ErrDaemonClosed
+func (d *Daemon) Serve(l net.Listener) error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		_ = l.Close()
+		return ErrDaemonClosed
+	}
+	d.listeners[l] = struct{}{}
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.listeners, l)
+		d.mu.Unlock()
+		_ = l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if d.isClosed() {
+				return ErrDaemonClosed
+			}
+			return err
+		}
+		go d.serveConn(conn)
+	}
+}
+
+// Close stops accepting connections and closes the open ones, then waits for the jobs already submitted to finish.
+// A job is never interrupted, so that no file is left half replaced.
+func (d *Daemon) Close() error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil
+	}
+	d.closed = true
+	for l := range d.listeners {
+		_ = l.Close()
+	}
+	for conn := range d.conns {
+		_ = conn.Close()
+	}
+	d.mu.Unlock()
+	d.pending.Wait()
+	close(d.jobs)
+	d.workers.Wait()
+	return nil
+}
+
+// Stats returns the job counters of the daemon
+func (d *Daemon) Stats() DaemonStats {
+	return DaemonStats{
+		Queued:    atomic.LoadInt64(&d.queued),
+		Running:   atomic.LoadInt64(&d.running),
+		Completed: atomic.LoadInt64(&d.completed),
+		Failed:    atomic.LoadInt64(&d.failed),
+	}
+}
+
+func (d *Daemon) isClosed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.closed
+}
+
+func (d *Daemon) serveConn(conn net.Conn) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		_ = conn.Close()
+		return
+	}
+	d.conns[conn] = struct{}{}
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.conns, conn)
+		d.mu.Unlock()
+		_ = conn.Close()
+	}()
+	var wmu sync.Mutex
+	var answered sync.WaitGroup
+	enc := json.NewEncoder(conn)
+	reply := func(resp DaemonResponse) {
+		wmu.Lock()
+		defer wmu.Unlock()
+		_ = enc.Encode(resp)
+	}
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var req DaemonRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			reply(DaemonResponse{Status: "error", Error: err.Error()})
+			continue
+		}
+		switch req.Op {
+		case "", "replace":
+			if !d.submit(req, reply, &answered) {
+				reply(DaemonResponse{ID: req.ID, Path: req.Path, Status: "error", Error: ErrDaemonClosed.Error()})
+			}
+		case "status":
+			stats := d.Stats()
+			reply(DaemonResponse{ID: req.ID, Status: "ok", Stats: &stats})
+		default:
+			reply(DaemonResponse{ID: req.ID, Status: "error", Error: fmt.Sprintf("unknown op %q", req.Op)})
+		}
+	}
+	answered.Wait()
+}
+
+// submit queues req for the workers and answers it with reply once it has run, unless the daemon is closed
+func (d *Daemon) submit(req DaemonRequest, reply func(DaemonResponse), answered *sync.WaitGroup) bool {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return false
+	}
+	d.pending.Add(1)
+	d.mu.Unlock()
+	atomic.AddInt64(&d.queued, 1)
+	answered.Add(1)
+	go func() {
+		defer d.pending.Done()
+		defer answered.Done()
+		result := make(chan DaemonResponse, 1)
+		d.jobs <- daemonJob{req: req, reply: result}
+		reply(<-result)
+	}()
+	return true
+}
+
+func (d *Daemon) work() {
+	defer d.workers.Done()
+	for job := range d.jobs {
+		job.reply <- d.run(job.req)
+	}
+}
+
+// run replaces a single file
+func (d *Daemon) run(req DaemonRequest) DaemonResponse {
+	atomic.AddInt64(&d.queued, -1)
+	atomic.AddInt64(&d.running, 1)
+	defer atomic.AddInt64(&d.running, -1)
+	var wrote int
+	rp, err := d.Pool.Get(req.Set, req.Path)
+	if err == nil {
+		wrote, err = rp.ReplaceChained()
+		if perr := d.Pool.Put(rp); err == nil {
+			err = perr
+		}
+	}
+	resp := DaemonResponse{ID: req.ID, Path: req.Path, Status: FileReplaced.String(), Wrote: wrote}
+	if err != nil {
+		atomic.AddInt64(&d.failed, 1)
+		resp.Status, resp.Error = FileFailed.String(), err.Error()
+		return resp
+	}
+	atomic.AddInt64(&d.completed, 1)
+	return resp
+}
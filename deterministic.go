@@ -0,0 +1,72 @@
+package gosed
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrNondeterministic is returned when rendering the same file with the same mappings twice gave different results
+var ErrNondeterministic = errors.New("replace is not deterministic")
+
+// WithDeterministic makes a replace reproducible: the result is rendered a second time from the original file and
+// compared with the first before it replaces the file, failing with ErrNondeterministic and leaving the file
+// untouched if they differ, as they would with a Codec that draws a random nonce or a ReplaceLines function that
+// depends on outside state. If mtime is not zero, the replaced file is given it as its modification time, so that
+// identical inputs and mappings produce identical files. Replaces run in a single pass over the file in this mode.
+func WithDeterministic(mtime time.Time) Option {
+	return func(c *replacerConfig) {
+		c.Deterministic = true
+		c.FixedMTime = mtime
+	}
+}
+
+// selfCheck renders the file again and compares the result with what was written to output
+func (rp *Replacer) selfCheck(output *os.File) error {
+	input, err := os.Open(rp.Config.FilePath)
+	if err != nil {
+		return err
+	}
+	defer func(input *os.File) {
+		_ = input.Close()
+	}(input)
+	// the second rendering must not report its invalid UTF-8 again, nor count in the statistics
+	utf8Errors, stats := rp.Config.UTF8Errors, rp.Config.stats
+	rp.Config.stats = nil
+	defer func() {
+		rp.Config.UTF8Errors, rp.Config.stats = utf8Errors, stats
+	}()
+	again := sha256.New()
+	if len(rp.Config.ZipMembers) > 0 {
+		fd, err := input.Stat()
+		if err != nil {
+			return err
+		}
+		_, err = rp.render(nil, input, fd.Size(), again, nil)
+	} else {
+		_, err = rp.render(input, nil, 0, again, nil)
+	}
+	if err != nil {
+		return err
+	}
+	first := sha256.New()
+	if _, err := io.Copy(first, io.NewSectionReader(output, 0, 1<<63-1)); err != nil {
+		return err
+	}
+	if !bytes.Equal(first.Sum(nil), again.Sum(nil)) {
+		return fmt.Errorf("%w: %s rendered differently twice", ErrNondeterministic, rp.Config.FilePath)
+	}
+	return nil
+}
+
+// fixModTime gives the file the fixed modification time, if one is set
+func (rc *replacerConfig) fixModTime() error {
+	if rc.FixedMTime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(rc.FilePath, rc.FixedMTime, rc.FixedMTime)
+}
@@ -0,0 +1,120 @@
+package gosed
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// errDiffUnsupported is returned when a diff or an undo journal is asked of a replace whose result cannot be diffed
+// line by line
+var errDiffUnsupported = errors.New("diffs and undo journals cannot be recorded for zip members or files patched in place")
+
+// WithDiffWriter writes a unified diff of every replaced file to w, for code reviews of automated edits and audit
+// logs. The diff is computed in a streaming pass over the original and the result, as Preview computes its hunks: only
+// the changed lines and their context are held until the file is committed, after which its diff is written in a
+// single Write call, preceded by "---" and "+++" lines naming the file. Nothing is written for a file the mappings
+// leave unchanged. Replaces running at once, such as those of a DirReplacer with several workers, need a w that is safe for
+// concurrent use. An error writing the diff is returned, the file being replaced nonetheless.
+// The diffs of zip members and of files patched in place are not supported, and fail the replace.
+func WithDiffWriter(w io.Writer) Option {
+	return func(c *replacerConfig) {
+		c.DiffWriter = w
+	}
+}
+
+// openOriginal opens the file as the mappings read it, decompressed and decrypted, for it to be diffed against the
+// result, and returns the function closing it
+func (rc *replacerConfig) openOriginal() (io.Reader, func(), error) {
+	f, err := rc.open()
+	if err != nil {
+		return nil, nil, err
+	}
+	closers := []io.Closer{f}
+	closeAll := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			_ = closers[i].Close()
+		}
+	}
+	var r io.Reader = bufio.NewReaderSize(f, 8192)
+	for _, layer := range rc.layers() {
+		decoded, err := layer.NewReader(r)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		closers = append(closers, decoded)
+		r = decoded
+	}
+	return r, closeAll, nil
+}
+
+// newDiffer returns the lineDiffer of the replace, or nil if no diff is written, and the function closing the original
+// it reads
+func (rc *replacerConfig) newDiffer() (*lineDiffer, func(), error) {
+	if !rc.diffed() {
+		return nil, func() {}, nil
+	}
+	if rc.UndoJournal != "" && rc.Tx != nil {
+		return nil, nil, errTxUndoJournal
+	}
+	orig, closeOrig, err := rc.openOriginal()
+	if err != nil {
+		return nil, nil, err
+	}
+	return newLineDiffer(orig), closeOrig, nil
+}
+
+// diffed reports whether the replace is diffed, for WithDiffWriter or WithUndoJournal
+func (rc *replacerConfig) diffed() bool {
+	return rc.DiffWriter != nil || rc.UndoJournal != ""
+}
+
+// plain returns the writer render tees the plain result to, nil if ld is, so that it is not a non-nil interface
+func (ld *lineDiffer) plain() io.Writer {
+	if ld == nil {
+		return nil
+	}
+	return ld
+}
+
+// diffFile diffs the file against its replaced copy tmpFile, for the sequential replaces, whose result is only known
+// after their last pass
+func (rc *replacerConfig) diffFile(tmpFile string) (*lineDiffer, error) {
+	differ, closeOrig, err := rc.newDiffer()
+	if err != nil || differ == nil {
+		return nil, err
+	}
+	defer closeOrig()
+	result, err := os.Open(tmpFile)
+	if err != nil {
+		return nil, err
+	}
+	defer func(result *os.File) {
+		_ = result.Close()
+	}(result)
+	if _, err := io.Copy(differ, bufio.NewReaderSize(result, 8192)); err != nil {
+		return nil, err
+	}
+	return differ, differ.finish()
+}
+
+// writeDiff writes the diff of the committed file, if any
+func (rc *replacerConfig) writeDiff(ld *lineDiffer) error {
+	if rc.DiffWriter == nil || ld == nil || len(ld.hunks) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(rc.DiffWriter, formatDiff(rc.FilePath, ld.hunks))
+	return err
+}
+
+// formatDiff formats the hunks of the file path as a unified diff
+func formatDiff(path string, hunks []DiffHunk) string {
+	var sb strings.Builder
+	_, _ = fmt.Fprintf(&sb, "--- %s\n+++ %s\n", path, path)
+	sb.WriteString((&PreviewResult{Hunks: hunks}).String())
+	return sb.String()
+}
@@ -0,0 +1,219 @@
+package gosed
+
+import (
+	"context"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DirReplacer applies the same mappings to every file of a directory tree selected by glob patterns
+type DirReplacer struct {
+	Root    string
+	Options []Option
+	// Patterns select the files, by their slash-separated path relative to Root. A file is replaced if it matches
+	// any pattern, or if there are none but exclusions, and matches no exclusion, a pattern prefixed with "!".
+	// A pattern without a slash matches the name of a file at any depth ("*.go"); any other pattern matches from Root,
+	// with "**" standing for any number of directories ("!vendor/**"). Excluded directories are not walked.
+	Patterns []string
+	// Workers is the number of files replaced at once, 1 if not positive
+	Workers int
+	// SkipBinary leaves the files that look binary, by IsBinary, as they are, reporting them as FileBinary, so that
+	// images and compiled artifacts are not corrupted by keys they happen to contain.
+	// Only the first SniffLength bytes of a file are sniffed, DefaultSniffLength if not positive.
+	SkipBinary  bool
+	SniffLength int
+	// BinaryFunc, if set, overrides the decision of SkipBinary for every file
+	BinaryFunc BinaryFunc
+	MappingSet
+}
+
+// DirReport describes what a DirReplacer did
+type DirReport struct {
+	// Files holds the result of every selected file, in walk order
+	Files []FileResult
+	// Stats adds up the statistics of the replaced files; its Elapsed is the time the whole tree took
+	Stats Stats
+}
+
+// Err returns a *MultiError listing the files that were replaced and those that failed, or nil if none failed
+func (dr *DirReport) Err() error {
+	return newMultiError(dr.Files)
+}
+
+// NewDirReplacer returns a new *DirReplacer over the tree at root, whose replacers are configured with opts
+func NewDirReplacer(root string, opts ...Option) *DirReplacer {
+	return &DirReplacer{
+		Root:       root,
+		Options:    opts,
+		MappingSet: newMappingSet(),
+	}
+}
+
+// Replace walks the tree and replaces every selected file. It only returns an error if the tree cannot be walked, in
+// which case no file is touched; per-file errors are in the report.
+func (dr *DirReplacer) Replace() (*DirReport, error) {
+	return dr.ReplaceContext(context.Background())
+}
+
+// ReplaceContext is Replace, cancelled when ctx is done: the files in flight are rolled back, unless their commit has
+// already begun, and the remaining files are left untouched and reported as skipped.
+func (dr *DirReplacer) ReplaceContext(ctx context.Context) (*DirReport, error) {
+	start := time.Now()
+	files, err := dr.walk()
+	if err != nil {
+		return nil, err
+	}
+	report := &DirReport{Files: make([]FileResult, len(files))}
+	stats := make([]Stats, len(files))
+	workers := dr.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				report.Files[i], stats[i] = dr.replaceFile(ctx, files[i])
+			}
+		}()
+	}
+	for i, file := range files {
+		if ctx.Err() != nil {
+			report.Files[i] = FileResult{Path: file, Status: FileSkipped}
+			continue
+		}
+		select {
+		case indices <- i:
+		case <-ctx.Done():
+			report.Files[i] = FileResult{Path: file, Status: FileSkipped}
+		}
+	}
+	close(indices)
+	wg.Wait()
+	report.Stats.Mappings = make([]MappingStats, len(dr.mappings.Keys))
+	for i, key := range dr.mappings.Keys {
+		report.Stats.Mappings[i].Key = key
+	}
+	for i, s := range stats {
+		if report.Files[i].Status == FileReplaced {
+			addStats(&report.Stats, s)
+		}
+	}
+	report.Stats.Elapsed = time.Since(start)
+	return report, nil
+}
+
+// replaceFile replaces a single file of the tree
+func (dr *DirReplacer) replaceFile(ctx context.Context, file string) (FileResult, Stats) {
+	if skip, err := dr.skipBinary(file); err != nil || skip {
+		result := FileResult{Path: file, Status: FileBinary}
+		if err != nil {
+			result = FileResult{Path: file, Status: FileFailed, Err: err}
+		}
+		return result, Stats{}
+	}
+	rp, err := NewReplacer(file, dr.Options...)
+	if err != nil {
+		return FileResult{Path: file, Status: FileFailed, Err: err}, Stats{}
+	}
+	defer func(rp *Replacer) {
+		_ = rp.Config.File.Close()
+	}(rp)
+	rp.Config.Mappings = dr.mappings.clone()
+	wrote, err := rp.ReplaceChainedContext(ctx)
+	result := FileResult{Path: file, Status: FileReplaced, Wrote: wrote, Err: err}
+	switch {
+	case err != nil && ctx.Err() != nil:
+		result.Status = FileCancelled
+	case err != nil:
+		result.Status = FileFailed
+	}
+	return result, rp.Stats()
+}
+
+// Files returns the files the patterns select, in the order Replace goes through them, without touching any
+func (dr *DirReplacer) Files() ([]string, error) {
+	return dr.walk()
+}
+
+// walk returns the regular files of the tree selected by the patterns, in lexical order
+func (dr *DirReplacer) walk() ([]string, error) {
+	var include, exclude []string
+	for _, pattern := range dr.Patterns {
+		if strings.HasPrefix(pattern, "!") {
+			exclude = append(exclude, pattern[1:])
+		} else {
+			include = append(include, pattern)
+		}
+	}
+	var files []string
+	err := filepath.WalkDir(dr.Root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dr.Root, name)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if matchesAny(exclude, rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() && (len(include) == 0 || matchesAny(include, rel)) {
+			files = append(files, name)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// matchesAny reports whether the relative path rel matches any of patterns
+func matchesAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		if !strings.Contains(pattern, "/") {
+			if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+				return true
+			}
+			continue
+		}
+		if matchGlob(strings.Split(strings.TrimPrefix(pattern, "/"), "/"), strings.Split(rel, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob matches path segments against pattern segments, in which "**" matches any number of segments
+func matchGlob(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for skip := 0; skip <= len(segments); skip++ {
+				if matchGlob(pattern[1:], segments[skip:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
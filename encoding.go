@@ -0,0 +1,281 @@
+package gosed
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// WithEncoding decodes the file from enc before replacing and encodes the result back to enc, so that mappings are
+// matched as UTF-8 and keys and values are always given in UTF-8. Any golang.org/x/text encoding works, such as the
+// EBCDIC, DOS and ISO 8859 code pages of golang.org/x/text/encoding/charmap. Bytes a *charmap.Charmap leaves
+// undefined are carried through unchanged.
+// For the Unicode encodings of golang.org/x/text/encoding/unicode, UTF-16 as used by Windows configuration and log
+// files, and UTF-8, the byte order mark decides: a file starting with a UTF-8, UTF-16LE or UTF-16BE mark is decoded
+// as such whatever the endianness of enc, and the result starts with the same mark. A file without one is decoded as
+// enc and written back without one, whatever the BOM policy of enc.
+func WithEncoding(enc encoding.Encoding) Option {
+	return func(c *replacerConfig) {
+		if cm, ok := enc.(*charmap.Charmap); ok {
+			enc = passthroughCharmap{cm}
+		}
+		c.Encoding = enc
+	}
+}
+
+// undefinedByteBase is where passthroughCharmap maps undefined bytes to, in the private use area
+const undefinedByteBase = 0xf700
+
+// passthroughCharmap decodes the bytes its code page leaves undefined to private use runes and encodes them back,
+// where charmap.Charmap would decode them to U+FFFD and make the file impossible to write back.
+type passthroughCharmap struct {
+	cm *charmap.Charmap
+}
+
+func (pc passthroughCharmap) String() string {
+	return pc.cm.String()
+}
+
+func (pc passthroughCharmap) NewDecoder() *encoding.Decoder {
+	return &encoding.Decoder{Transformer: charmapDecoder{cm: pc.cm}}
+}
+
+func (pc passthroughCharmap) NewEncoder() *encoding.Encoder {
+	return &encoding.Encoder{Transformer: charmapEncoder{cm: pc.cm}}
+}
+
+type charmapDecoder struct {
+	transform.NopResetter
+	cm *charmap.Charmap
+}
+
+func (d charmapDecoder) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	for ; nSrc < len(src); nSrc++ {
+		r := d.cm.DecodeByte(src[nSrc])
+		if r == utf8.RuneError {
+			r = undefinedByteBase + rune(src[nSrc])
+		}
+		if nDst+utf8.RuneLen(r) > len(dst) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		nDst += utf8.EncodeRune(dst[nDst:], r)
+	}
+	return nDst, nSrc, nil
+}
+
+type charmapEncoder struct {
+	transform.NopResetter
+	cm *charmap.Charmap
+}
+
+func (e charmapEncoder) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	for nSrc < len(src) {
+		if nDst >= len(dst) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		if !atEOF && !utf8.FullRune(src[nSrc:]) {
+			return nDst, nSrc, transform.ErrShortSrc
+		}
+		r, size := utf8.DecodeRune(src[nSrc:])
+		b, ok := e.cm.EncodeRune(r)
+		switch {
+		case r >= undefinedByteBase && r <= undefinedByteBase+0xff && e.cm.DecodeByte(byte(r-undefinedByteBase)) == utf8.RuneError:
+			b = byte(r - undefinedByteBase)
+		case !ok || (r == utf8.RuneError && size == 1):
+			return nDst, nSrc, errUnmappable
+		}
+		dst[nDst] = b
+		nDst++
+		nSrc += size
+	}
+	return nDst, nSrc, nil
+}
+
+// errUnmappable is returned by encoders on a rune they cannot encode
+var errUnmappable = errors.New("rune cannot be encoded")
+
+// UnmappableRuneError is returned when the replaced output contains a rune the target encoding cannot represent
+type UnmappableRuneError struct {
+	Encoding string
+	Rune     rune
+	// Offset is the offset of the rune in the UTF-8 stream being encoded
+	Offset int64
+}
+
+func (e *UnmappableRuneError) Error() string {
+	return fmt.Sprintf("rune %U at offset %d cannot be encoded in %s", e.Rune, e.Offset, e.Encoding)
+}
+
+// encodingName returns a name for enc to report errors with
+func encodingName(enc encoding.Encoding) string {
+	if s, ok := enc.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", enc)
+}
+
+// newDecodingReader returns a reader that decodes r from enc to UTF-8, along with the byte order mark it finds when
+// enc is a Unicode encoding
+func newDecodingReader(r io.Reader, enc encoding.Encoding) (io.Reader, *byteOrderMark) {
+	// looking up an encoding of an incomparable type would panic
+	if !reflect.TypeOf(enc).Comparable() {
+		return transform.NewReader(r, enc.NewDecoder()), nil
+	}
+	plain, ok := unicodeEncodings[enc]
+	if !ok {
+		return transform.NewReader(r, enc.NewDecoder()), nil
+	}
+	bom := &byteOrderMark{enc: plain}
+	return &bomReader{r: r, bom: bom}, bom
+}
+
+// unicodeEncodings maps the Unicode encodings, whose files may start with a byte order mark, to the same encoding
+// neither reading nor writing one. UTF-8 is left as it is rather than decoded, so that invalid bytes are kept.
+var unicodeEncodings = map[encoding.Encoding]encoding.Encoding{
+	unicode.UTF8:    encoding.Nop,
+	unicode.UTF8BOM: encoding.Nop,
+	unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM): unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM),
+	unicode.UTF16(unicode.LittleEndian, unicode.UseBOM):    unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM),
+	unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM): unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM),
+	unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM):    unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM),
+	unicode.UTF16(unicode.BigEndian, unicode.UseBOM):       unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM),
+	unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM):    unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM),
+}
+
+// byteOrderMarks are the marks a file decoded from a Unicode encoding may start with, and the encoding each selects
+var byteOrderMarks = []struct {
+	mark []byte
+	enc  encoding.Encoding
+}{
+	{[]byte{0xef, 0xbb, 0xbf}, encoding.Nop},
+	{[]byte{0xff, 0xfe}, unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)},
+	{[]byte{0xfe, 0xff}, unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)},
+}
+
+// byteOrderMark is the mark found at the start of a file, nil if there is none, and the encoding of the file
+// without it. It is known once the file has been read from.
+type byteOrderMark struct {
+	mark []byte
+	enc  encoding.Encoding
+}
+
+// bomReader strips the byte order mark from the start of r and decodes the rest in the encoding it selects
+type bomReader struct {
+	r   io.Reader
+	bom *byteOrderMark
+	dec io.Reader
+}
+
+// Read implements the `io.Reader` interface.
+func (br *bomReader) Read(p []byte) (int, error) {
+	if br.dec == nil {
+		head := make([]byte, 3)
+		n, err := io.ReadFull(br.r, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		head = head[:n]
+		for _, m := range byteOrderMarks {
+			if bytes.HasPrefix(head, m.mark) {
+				br.bom.mark, br.bom.enc = m.mark, m.enc
+				head = head[len(m.mark):]
+				break
+			}
+		}
+		br.dec = transform.NewReader(io.MultiReader(bytes.NewReader(head), br.r), br.bom.enc.NewDecoder())
+	}
+	return br.dec.Read(p)
+}
+
+// encodingReader encodes the UTF-8 stream r to an encoding. Unlike transform.Reader, it reports the rune and offset
+// the encoding failed on.
+type encodingReader struct {
+	r    io.Reader
+	name string
+	t    transform.Transformer
+	// bom, if set, selects the encoding once the file is read from
+	bom *byteOrderMark
+	src []byte
+	// n is the length of the data in src
+	n      int
+	dst    []byte
+	out    []byte
+	offset int64
+	err    error
+}
+
+// newEncodingReader returns a reader that encodes r to enc, or to the encoding bom selects and starting with its
+// mark if bom is not nil
+func newEncodingReader(r io.Reader, enc encoding.Encoding, bom *byteOrderMark) *encodingReader {
+	er := &encodingReader{
+		r:    r,
+		name: encodingName(enc),
+		bom:  bom,
+		src:  make([]byte, defaultBufSize),
+		dst:  make([]byte, defaultBufSize),
+	}
+	if bom == nil {
+		er.t = enc.NewEncoder()
+	}
+	return er
+}
+
+// Read implements the `io.Reader` interface.
+func (er *encodingReader) Read(p []byte) (int, error) {
+	for len(er.out) == 0 {
+		if er.err != nil && er.n == 0 {
+			return 0, er.err
+		}
+		if er.err == nil && er.n < len(er.src) {
+			var n int
+			n, er.err = er.r.Read(er.src[er.n:])
+			er.n += n
+		}
+		if er.t == nil {
+			// reading the result has read the start of the file, so its byte order mark is known
+			er.t = er.bom.enc.NewEncoder()
+			if len(er.bom.mark) > 0 {
+				er.out = er.bom.mark
+				break
+			}
+		}
+		atEOF := er.err != nil
+		nDst, nSrc, err := er.t.Transform(er.dst, er.src[:er.n], atEOF)
+		er.out = er.dst[:nDst]
+		er.offset += int64(nSrc)
+		er.n = copy(er.src, er.src[nSrc:er.n])
+		switch err {
+		case nil, transform.ErrShortDst:
+		case transform.ErrShortSrc:
+			if atEOF {
+				// a truncated rune at the end of the stream cannot be encoded
+				er.err, er.n = er.unmappable(), 0
+			}
+		default:
+			er.err, er.n = er.unmappable(), 0
+			if len(er.out) == 0 {
+				return 0, er.err
+			}
+		}
+		if atEOF && er.n == 0 && nDst == 0 && err == nil {
+			return 0, er.err
+		}
+	}
+	n := copy(p, er.out)
+	er.out = er.out[n:]
+	return n, nil
+}
+
+// unmappable returns the error for the rune at the start of the pending source data
+func (er *encodingReader) unmappable() error {
+	r, _ := utf8.DecodeRune(er.src[:er.n])
+	return &UnmappableRuneError{Encoding: er.name, Rune: r, Offset: er.offset}
+}
@@ -0,0 +1,105 @@
+package gosed
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrEmptyKey is returned when mapping an empty string, which would match everywhere
+var ErrEmptyKey = errors.New("cannot replace empty string with new value")
+
+// ErrTempFileCreate is returned when the temporary file a replace writes to cannot be created next to the file,
+// typically for lack of permission on its directory or of space on its filesystem. The file is left as it was.
+type ErrTempFileCreate struct {
+	Dir string
+	Err error
+}
+
+func (e *ErrTempFileCreate) Error() string {
+	return fmt.Sprintf("cannot create temporary file in %s: %v", e.Dir, e.Err)
+}
+
+// Unwrap returns the error of the filesystem
+func (e *ErrTempFileCreate) Unwrap() error {
+	return e.Err
+}
+
+// ErrRenameFailed is returned when the replaced copy Tmp cannot be renamed over the file Dst. The copy is removed and
+// the file is left as it was.
+type ErrRenameFailed struct {
+	Tmp string
+	Dst string
+	Err error
+}
+
+func (e *ErrRenameFailed) Error() string {
+	return fmt.Sprintf("cannot rename %s over %s: %v", e.Tmp, e.Dst, e.Err)
+}
+
+// Unwrap returns the error of the filesystem
+func (e *ErrRenameFailed) Unwrap() error {
+	return e.Err
+}
+
+// MultiError is the error of a batch or directory replace some files of which failed, as returned by BatchReport.Err
+// and DirReport.Err. Succeeded lists the files that were replaced, Failed the results of those that returned an error.
+type MultiError struct {
+	Succeeded []string
+	Failed    []FileResult
+}
+
+// newMultiError returns the *MultiError of results, nil if none of them failed
+func newMultiError(results []FileResult) error {
+	e := &MultiError{}
+	for _, result := range results {
+		switch {
+		case result.Err != nil:
+			e.Failed = append(e.Failed, result)
+		case result.Status == FileReplaced:
+			e.Succeeded = append(e.Succeeded, result.Path)
+		}
+	}
+	if len(e.Failed) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e *MultiError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d files failed, %d replaced", len(e.Failed), len(e.Succeeded))
+	for _, result := range e.Failed {
+		fmt.Fprintf(&sb, "; %s: %v", result.Path, result.Err)
+	}
+	return sb.String()
+}
+
+// Is reports whether the error of any failed file is target, so that errors.Is goes through them
+func (e *MultiError) Is(target error) bool {
+	for _, result := range e.Failed {
+		if errors.Is(result.Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first error of a failed file that matches target, so that errors.As goes through them
+func (e *MultiError) As(target interface{}) bool {
+	for _, result := range e.Failed {
+		if errors.As(result.Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Unwrap returns the errors of the failed files
+func (e *MultiError) Unwrap() []error {
+	errs := make([]error, len(e.Failed))
+	for i, result := range e.Failed {
+		errs[i] = result.Err
+	}
+	return errs
+}
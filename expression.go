@@ -0,0 +1,284 @@
+package gosed
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidExpression is returned by AddExpression for expressions it cannot parse
+var ErrInvalidExpression = errors.New("invalid sed expression")
+
+// AddExpression adds the mapping of a sed substitution command, s/old/new/flags, so that sed one-liners can be ported
+// as they are. See ParseExpression for the syntax.
+func (rp *Replacer) AddExpression(expr string) error {
+	m, err := ParseExpression(expr)
+	if err != nil {
+		return err
+	}
+	return rp.NewMappingWithOptions(m.Old, m.New, m.Options...)
+}
+
+// ParseExpression returns the mapping of a sed substitution command, s/old/new/flags, for the APIs that take mappings
+// rather than expressions: streams, batches and directory replacers.
+// Any character but a backslash or a line feed can delimit the command, as in s|/usr|/opt|, and is escaped with a
+// backslash within it. old is a POSIX basic regular expression: \( \) \{ \} \+ \? and \| are operators, while
+// ( ) { } + ? and | match themselves; back-references are not supported. In new, & stands for the match and \1 to \9
+// for its groups. \n and \t are a line feed and a tab on either side. The flags are g to replace every match of a line
+// instead of the first, a number n to only replace the nth match of every line, or the nth and the ones after it
+// along with g, and i or I to ignore case. Like sed, the expression is matched one line at a time.
+// An expression without operators becomes a plain mapping, which is much faster than a regex mapping.
+func ParseExpression(expr string) (Mapping, error) {
+	pattern, replacement, flags, delim, err := splitExpression(expr)
+	if err != nil {
+		return Mapping{}, err
+	}
+	opts := mappingOptions{}
+	global, fold := false, false
+	for i := 0; i < len(flags); i++ {
+		switch c := flags[i]; {
+		case c == 'g':
+			global = true
+		case c == 'i' || c == 'I':
+			fold = true
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(flags) && flags[j] >= '0' && flags[j] <= '9' {
+				j++
+			}
+			n, err := strconv.Atoi(flags[i:j])
+			if err != nil || n == 0 || opts.LineOccurrence != 0 {
+				return Mapping{}, fmt.Errorf("%w: invalid occurrence %q in %q", ErrInvalidExpression, flags[i:j], expr)
+			}
+			opts.LineOccurrence = n
+			i = j - 1
+		default:
+			return Mapping{}, fmt.Errorf("%w: unsupported flag %q in %q", ErrInvalidExpression, c, expr)
+		}
+	}
+	switch {
+	case opts.LineOccurrence > 0:
+		opts.LineOccurrenceOnward = global
+	case !global:
+		opts.FirstPerLine = true
+	}
+	m := Mapping{Options: []MappingOption{func(o *mappingOptions) {
+		o.Regex = opts.Regex
+		o.FirstPerLine = opts.FirstPerLine
+		o.LineOccurrence = opts.LineOccurrence
+		o.LineOccurrenceOnward = opts.LineOccurrenceOnward
+	}}}
+	if key, ok := literalPattern(pattern, delim); ok && !fold {
+		if len(key) == 0 {
+			return Mapping{}, ErrEmptyKey
+		}
+		if m.New, err = expandReplacement(replacement, key); err != nil {
+			return Mapping{}, fmt.Errorf("%w: %v in %q", ErrInvalidExpression, err, expr)
+		}
+		m.Old = key
+		return m, nil
+	}
+	translated, err := translateBRE(pattern, delim)
+	if err != nil {
+		return Mapping{}, fmt.Errorf("%w: %v in %q", ErrInvalidExpression, err, expr)
+	}
+	if fold {
+		translated = "(?i)" + translated
+	}
+	if opts.Regex, err = regexp.Compile(translated); err != nil {
+		return Mapping{}, fmt.Errorf("%w: %v", ErrInvalidExpression, err)
+	}
+	if m.New, err = expandReplacement(replacement, nil); err != nil {
+		return Mapping{}, fmt.Errorf("%w: %v in %q", ErrInvalidExpression, err, expr)
+	}
+	m.Old = []byte(translated)
+	return m, nil
+}
+
+// splitExpression splits a substitution command into its pattern, replacement and flags, leaving escapes as they are
+func splitExpression(expr string) (pattern, replacement, flags string, delim byte, err error) {
+	expr = strings.TrimSpace(expr)
+	if len(expr) < 2 || expr[0] != 's' {
+		return "", "", "", 0, fmt.Errorf("%w: %q is not an s command", ErrInvalidExpression, expr)
+	}
+	delim = expr[1]
+	if delim == '\\' || delim == '\n' {
+		return "", "", "", 0, fmt.Errorf("%w: %q cannot delimit %q", ErrInvalidExpression, delim, expr)
+	}
+	var parts []string
+	start := 2
+	for i := start; i < len(expr) && len(parts) < 2; i++ {
+		switch expr[i] {
+		case '\\':
+			i++
+		case delim:
+			parts = append(parts, expr[start:i])
+			start = i + 1
+		}
+	}
+	if len(parts) < 2 {
+		return "", "", "", 0, fmt.Errorf("%w: unterminated s command %q", ErrInvalidExpression, expr)
+	}
+	return parts[0], parts[1], strings.TrimSpace(expr[start:]), delim, nil
+}
+
+// literalPattern returns what pattern matches if it has no operators
+func literalPattern(pattern string, delim byte) ([]byte, bool) {
+	var key []byte
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			switch e := pattern[i]; {
+			case e == delim || strings.IndexByte(`.*[]^$\/`, e) >= 0:
+				key = append(key, e)
+			case e == 'n':
+				key = append(key, '\n')
+			case e == 't':
+				key = append(key, '\t')
+			default:
+				return nil, false
+			}
+		case strings.IndexByte(`.*[^$\`, c) >= 0:
+			return nil, false
+		default:
+			key = append(key, c)
+		}
+	}
+	return key, true
+}
+
+// translateBRE translates a POSIX basic regular expression to the syntax of the regexp package
+func translateBRE(pattern string, delim byte) (string, error) {
+	var sb strings.Builder
+	// atStart is set where * and ^ start an expression, at its beginning or after \( or \|
+	atStart := true
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		wasStart := atStart
+		atStart = false
+		switch {
+		case c == '\\':
+			if i+1 == len(pattern) {
+				return "", errors.New("trailing backslash")
+			}
+			i++
+			switch e := pattern[i]; {
+			case e == delim:
+				sb.WriteString(regexp.QuoteMeta(string(e)))
+			case e == '(' || e == '|':
+				sb.WriteByte(e)
+				atStart = true
+			case strings.IndexByte(`){}+?`, e) >= 0:
+				sb.WriteByte(e)
+			case e == '<' || e == '>':
+				sb.WriteString(`\b`)
+			case e >= '1' && e <= '9':
+				return "", fmt.Errorf("back-reference \\%c is not supported", e)
+			case e == 'n' || e == 't' || strings.IndexByte(`wWsSbB.*[]^$\/`, e) >= 0:
+				sb.WriteByte('\\')
+				sb.WriteByte(e)
+			default:
+				sb.WriteString(regexp.QuoteMeta(string(e)))
+			}
+		case c == '[':
+			end := bracketEnd(pattern, i)
+			if end < 0 {
+				return "", errors.New("unterminated bracket expression")
+			}
+			// backslashes are literal within POSIX bracket expressions
+			sb.WriteString(strings.ReplaceAll(pattern[i:end+1], `\`, `\\`))
+			i = end
+		case c == '*' && wasStart, c == '^' && !wasStart:
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c == '^':
+			sb.WriteByte(c)
+			atStart = true
+		case c == '$':
+			rest := pattern[i+1:]
+			if rest == "" || strings.HasPrefix(rest, `\)`) || strings.HasPrefix(rest, `\|`) {
+				sb.WriteByte(c)
+			} else {
+				sb.WriteString(`\$`)
+			}
+		case strings.IndexByte(`(){}+?|`, c) >= 0:
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String(), nil
+}
+
+// bracketEnd returns the index of the ] closing the bracket expression opened at start, or -1
+func bracketEnd(pattern string, start int) int {
+	i := start + 1
+	if i < len(pattern) && pattern[i] == '^' {
+		i++
+	}
+	// a ] right after the opening bracket is a member of the expression
+	if i < len(pattern) && pattern[i] == ']' {
+		i++
+	}
+	for ; i < len(pattern); i++ {
+		switch {
+		case pattern[i] == '[' && i+1 < len(pattern) && strings.IndexByte(":.=", pattern[i+1]) >= 0:
+			// character classes, collating symbols and equivalence classes end with the same character and ]
+			end := strings.Index(pattern[i+2:], string(pattern[i+1])+"]")
+			if end < 0 {
+				return -1
+			}
+			i += end + 3
+		case pattern[i] == ']':
+			return i
+		}
+	}
+	return -1
+}
+
+// expandReplacement translates the replacement of a substitution command. If match is nil, it returns a template
+// for regexp.Expand; otherwise the replacement of a plain mapping matching match, which has no groups.
+func expandReplacement(replacement string, match []byte) ([]byte, error) {
+	var out []byte
+	for i := 0; i < len(replacement); i++ {
+		c := replacement[i]
+		switch {
+		case c == '&' && match != nil:
+			out = append(out, match...)
+		case c == '&':
+			out = append(out, "${0}"...)
+		case c == '$' && match == nil:
+			out = append(out, "$$"...)
+		case c == '\\' && i+1 < len(replacement):
+			i++
+			switch e := replacement[i]; {
+			case e >= '0' && e <= '9' && match != nil:
+				return nil, fmt.Errorf("invalid reference \\%c", e)
+			case e >= '0' && e <= '9':
+				out = append(out, "${"+string(e)+"}"...)
+			case e == 'n':
+				out = append(out, '\n')
+			case e == 't':
+				out = append(out, '\t')
+			case e == '$' && match == nil:
+				out = append(out, "$$"...)
+			default:
+				// \&, \\ and the escaped delimiter stand for themselves, like any other escaped character
+				out = append(out, e)
+			}
+		case c == '\\':
+			return nil, errors.New("trailing backslash")
+		default:
+			out = append(out, c)
+		}
+	}
+	if out == nil {
+		out = []byte{}
+	}
+	return out, nil
+}
@@ -0,0 +1,31 @@
+package gosed
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	// fallocKeepSize and fallocPunchHole are the FALLOC_FL_KEEP_SIZE and FALLOC_FL_PUNCH_HOLE modes of fallocate
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+)
+
+// preallocate allocates size bytes for f, extending it to size
+func preallocate(f *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	if err := syscall.Fallocate(int(f.Fd()), 0, 0, size); err != nil {
+		return f.Truncate(size)
+	}
+	return nil
+}
+
+// punchHole deallocates length bytes of f at offset, which then read as zeros
+func punchHole(f *os.File, offset, length int64) error {
+	if err := syscall.Fallocate(int(f.Fd()), fallocPunchHole|fallocKeepSize, offset, length); err != nil {
+		return errPunchUnsupported
+	}
+	return nil
+}
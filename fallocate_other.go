@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package gosed
+
+import "os"
+
+// preallocate extends f to size bytes, which lets some filesystems allocate them contiguously
+func preallocate(f *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	return f.Truncate(size)
+}
+
+// punchHole deallocates length bytes of f at offset, which then read as zeros
+func punchHole(f *os.File, offset, length int64) error {
+	return errPunchUnsupported
+}
@@ -0,0 +1,7 @@
+//go:build linux && (mips || mipsle || mips64 || mips64le || ppc64 || ppc64le || sparc64)
+
+package gosed
+
+// ficlone is the FICLONE ioctl request, which makes dst share all extents of src; _IOW sets the write direction
+// with another bit on these architectures
+const ficlone = 0x80049409
@@ -0,0 +1,6 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le && !ppc64 && !ppc64le && !sparc64
+
+package gosed
+
+// ficlone is the FICLONE ioctl request, which makes dst share all extents of src, _IOW(0x94, 9, int)
+const ficlone = 0x40049409
@@ -0,0 +1,125 @@
+package gosed
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// FrontMatterScope selects the part of a Markdown file the mappings apply to
+type FrontMatterScope int
+
+const (
+	// FrontMatterOnly applies the mappings to the front matter only
+	FrontMatterOnly FrontMatterScope = iota + 1
+	// FrontMatterExcluded applies the mappings to the body only
+	FrontMatterExcluded
+)
+
+// WithFrontMatter restricts the mappings to the YAML ("---") or TOML ("+++") front matter of a Markdown file, or
+// excludes it from them, according to scope. The part left out, delimiters included, is copied byte for byte. A file
+// without front matter is all body. The front matter is buffered whole, so it is bounded by the max record length.
+func WithFrontMatter(scope FrontMatterScope) Option {
+	return func(c *replacerConfig) {
+		c.FrontMatter = scope
+	}
+}
+
+// frontMatterReader applies the mappings to the front matter or the body of a Markdown file
+type frontMatterReader struct {
+	rr      *recordReader
+	rc      *replacerConfig
+	started bool
+	out     []byte
+	body    io.Reader
+}
+
+func newFrontMatterReader(r io.Reader, rc *replacerConfig) *frontMatterReader {
+	return &frontMatterReader{rr: newRecordReader(r, '\n', rc.MaxRecordLength), rc: rc}
+}
+
+// Read implements the `io.Reader` interface.
+func (fr *frontMatterReader) Read(p []byte) (int, error) {
+	if !fr.started {
+		fr.started = true
+		if err := fr.readFrontMatter(); err != nil {
+			return 0, err
+		}
+	}
+	if len(fr.out) > 0 {
+		n := copy(p, fr.out)
+		fr.out = fr.out[n:]
+		return n, nil
+	}
+	return fr.body.Read(p)
+}
+
+// readFrontMatter reads the front matter, if any, into fr.out and sets up the reader of the body after it
+func (fr *frontMatterReader) readFrontMatter() error {
+	first, err := fr.rr.ReadRecord()
+	head := append([]byte{}, first...)
+	opening := len(head)
+	closing := frontMatterCloser(first)
+	for closing != nil && err == nil {
+		var line []byte
+		line, err = fr.rr.ReadRecord()
+		head = append(head, line...)
+		if limit := fr.rc.MaxRecordLength; limit > 0 && len(head) > limit {
+			return fmt.Errorf("%w: front matter is longer than %d bytes", ErrRecordTooLong, limit)
+		}
+		if closes(line, closing) {
+			matter, err := fr.scope(head[opening : len(head)-len(line)])
+			if err != nil {
+				return err
+			}
+			fr.out = append(append(append(fr.out[:0], head[:opening]...), matter...), head[len(head)-len(line):]...)
+			// the record reader buffers the stream, so the body is read through it
+			fr.setBody(fr.rr.r)
+			return nil
+		}
+	}
+	if err != nil && err != io.EOF {
+		return err
+	}
+	// there is no front matter, or it is never closed, so what was read ahead is the start of the body
+	fr.setBody(io.MultiReader(bytes.NewReader(head), fr.rr.r))
+	return nil
+}
+
+// setBody sets the reader of the body, replaced if it is in scope
+func (fr *frontMatterReader) setBody(r io.Reader) {
+	if fr.rc.FrontMatter == FrontMatterExcluded {
+		r = fr.rc.chain(r)
+	}
+	fr.body = r
+}
+
+// scope applies the mappings to the front matter if it is in scope
+func (fr *frontMatterReader) scope(matter []byte) ([]byte, error) {
+	if fr.rc.FrontMatter != FrontMatterOnly {
+		return matter, nil
+	}
+	return fr.rc.apply(matter)
+}
+
+// frontMatterCloser returns the delimiters that close the front matter opened by line, nil if line opens none
+func frontMatterCloser(line []byte) [][]byte {
+	switch string(bytes.TrimRight(line, "\r\n")) {
+	case "---":
+		return [][]byte{[]byte("---"), []byte("...")}
+	case "+++":
+		return [][]byte{[]byte("+++")}
+	}
+	return nil
+}
+
+// closes reports whether line is one of the closing delimiters
+func closes(line []byte, closing [][]byte) bool {
+	line = bytes.TrimRight(line, "\r\n")
+	for _, delimiter := range closing {
+		if bytes.Equal(line, delimiter) {
+			return true
+		}
+	}
+	return false
+}
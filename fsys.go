@@ -0,0 +1,174 @@
+package gosed
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// errFSFileOptions is returned by FSReplacer.Replace for options that act on the file rather than its content
+var errFSFileOptions = errors.New("options acting on the file rather than its content are not supported on virtual filesystems")
+
+// WriteFS is a filesystem whose files can be replaced, such as an in-memory filesystem in tests or an adapter to SFTP
+// or an object store
+type WriteFS interface {
+	fs.FS
+	// WriteFile replaces the content of the file name with what r reads, creating it with perm if it does not exist.
+	// If reading r fails, it must return an error and leave the file as it was.
+	WriteFile(name string, r io.Reader, perm fs.FileMode) error
+}
+
+// FSReplacer replaces files of an fs.FS rather than of the operating system, such as those of an embed.FS, an
+// in-memory filesystem in tests or a remote one. The files are streamed through the mappings into Target without
+// a local copy. The options acting on the file itself rather than its content fail the replace: WithPatchInPlace,
+// WithInodePreservation, WithPreserveMetadata, WithBackup, WithReflinkCopy, WithFileLock, WithTx,
+// WithConcurrentWriteDetection, WithDeterministic, WithZipMembers, WithUndoJournal, AfterFile, WithSymlinkPolicy and
+// WithHardlinkPolicy.
+type FSReplacer struct {
+	// Source holds the files to replace, by their fs.FS names
+	Source fs.FS
+	// Target receives the replaced files, under the same names; if nil, Source must be a WriteFS, whose files are
+	// then replaced
+	Target  WriteFS
+	Options []Option
+	MappingSet
+}
+
+// NewFSReplacer returns a new *FSReplacer over the files of source, whose replaces are configured with opts
+func NewFSReplacer(source fs.FS, opts ...Option) *FSReplacer {
+	return &FSReplacer{
+		Source:     source,
+		Options:    opts,
+		MappingSet: newMappingSet(),
+	}
+}
+
+// Replace replaces the file name and returns the number of bytes of the result, before any compression or encryption.
+// The mappings stay registered, so that other files can be replaced with them.
+func (fr *FSReplacer) Replace(ctx context.Context, name string) (int, error) {
+	target := fr.Target
+	if target == nil {
+		var ok bool
+		if target, ok = fr.Source.(WriteFS); !ok {
+			return 0, errors.New("the source filesystem is read-only and no target is set")
+		}
+	}
+	rp := &Replacer{Config: &replacerConfig{Mappings: fr.mappings.clone(), MaxRecordLength: DefaultMaxRecordLength, RecordSeparator: '\n', fsys: fr.Source}}
+	for _, opt := range fr.Options {
+		opt(rp.Config)
+	}
+	rc := rp.Config
+	if rc.PatchInPlace || rc.PreserveInode || rc.PreserveMetadata || rc.BackupSuffix != "" || rc.Reflink || rc.Lock ||
+		rc.Tx != nil || rc.ConcurrentWrites != ConcurrentWriteIgnore || rc.Deterministic || !rc.FixedMTime.IsZero() || len(rc.ZipMembers) > 0 || rc.UndoJournal != "" ||
+		len(rc.AfterHooks) > 0 || rc.Symlinks != LinkReplace || rc.Hardlinks != LinkReplace {
+		return 0, errFSFileOptions
+	}
+	defer rc.withContext(ctx)()
+	src, err := fr.Source.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer func(src fs.File) {
+		_ = src.Close()
+	}(src)
+	info, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.IsDir() {
+		return 0, &fs.PathError{Op: "replace", Path: name, Err: errors.New("is a directory")}
+	}
+	rc.FilePath, rc.FileSize, rc.FilePerm = name, info.Size(), info.Mode().Perm()
+	if err := rc.beforeFile(); err != nil {
+		return 0, err
+	}
+	if skipped, err := rp.guarded(); err != nil || skipped {
+		return 0, err
+	}
+	differ, closeOrig, err := rc.newDiffer()
+	if err != nil {
+		return 0, err
+	}
+	defer closeOrig()
+	rc.UTF8Errors = nil
+	rc.beginStats()
+	rc.beginProgress(1)
+	// the target pulls the result as the source is rendered into the pipe
+	pr, pw := io.Pipe()
+	var wrote int64
+	rendered := make(chan error, 1)
+	go func() {
+		var err error
+		wrote, err = rp.render(rc.track(src), nil, 0, pw, differ.plain())
+		if err == nil && differ != nil {
+			err = differ.finish()
+		}
+		_ = pw.CloseWithError(err)
+		rendered <- err
+	}()
+	err = target.WriteFile(name, pr, rc.FilePerm)
+	// a target that stopped reading early must not leave the rendering blocked
+	_ = pr.Close()
+	if rerr := <-rendered; rerr != nil {
+		return 0, rerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	rc.finishStats(wrote)
+	rc.finishProgress()
+	return int(wrote), rc.writeDiff(differ)
+}
+
+// open opens the file for reading, from the fs.FS of an FSReplacer if set
+func (rc *replacerConfig) open() (io.ReadCloser, error) {
+	if rc.fsys != nil {
+		return rc.fsys.Open(rc.FilePath)
+	}
+	return os.Open(rc.FilePath)
+}
+
+// stat returns the file info of the file, from the fs.FS of an FSReplacer if set
+func (rc *replacerConfig) stat() (fs.FileInfo, error) {
+	if rc.fsys != nil {
+		return fs.Stat(rc.fsys, rc.FilePath)
+	}
+	return os.Stat(rc.FilePath)
+}
+
+// WritableDirFS returns the WriteFS of the files under dir, like os.DirFS, whose files are replaced atomically by
+// renaming a copy over them
+func WritableDirFS(dir string) WriteFS {
+	return dirFS{FS: os.DirFS(dir), dir: dir}
+}
+
+// dirFS is the WriteFS of WritableDirFS
+type dirFS struct {
+	fs.FS
+	dir string
+}
+
+// WriteFile implements WriteFS
+func (d dirFS) WriteFile(name string, r io.Reader, perm fs.FileMode) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "write", Path: name, Err: fs.ErrInvalid}
+	}
+	path := filepath.Join(d.dir, filepath.FromSlash(name))
+	rc := &replacerConfig{FilePath: path, FilePerm: perm}
+	tmp, err := rc.createTemp(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return rc.rename(tmp.Name())
+}
@@ -0,0 +1,52 @@
+package gosed
+
+// ReplaceFunc computes the replacement of a match of a function mapping. match is a copy the function may keep, and n
+// is the number of matches replaced before it, counting from 0.
+type ReplaceFunc func(match []byte, n int) []byte
+
+// NewFuncMapping replaces every occurrence of old with the result of fn, for replacements that static values cannot
+// express, such as counters, timestamps or templated values. fn is only called for the matches that are replaced, in
+// the order they appear in the file, once the matching options in opts have accepted them; it is called afresh by
+// every replace, so a Preview calls it as well.
+// Function mappings cannot be patched in place, since their replacements may differ in length from the matches.
+func (rp *Replacer) NewFuncMapping(old []byte, fn func(match []byte, n int) []byte, opts ...MappingOption) error {
+	switch len(old) {
+	case 0:
+		return ErrEmptyKey
+	}
+	mo := &mappingOptions{}
+	for _, opt := range opts {
+		opt(mo)
+	}
+	mo.Func = fn
+	rp.Config.Mappings.add(old, nil, mo)
+	return nil
+}
+
+// funcReplacer is a BytesReplacer whose replacements are computed by a ReplaceFunc once the match is accepted
+type funcReplacer struct {
+	BytesReplacer
+	fn ReplaceFunc
+	n  int
+}
+
+func (f *funcReplacer) LookaroundHints() (int, int) {
+	if filter, ok := f.BytesReplacer.(BytesMatchFilter); ok {
+		return filter.LookaroundHints()
+	}
+	return 0, 0
+}
+
+func (f *funcReplacer) FilterMatch(before, match, after []byte) bool {
+	if filter, ok := f.BytesReplacer.(BytesMatchFilter); ok {
+		return filter.FilterMatch(before, match, after)
+	}
+	return true
+}
+
+// ExpandMatch implements matchExpander
+func (f *funcReplacer) ExpandMatch(match, replace []byte) []byte {
+	replacement := f.fn(append([]byte{}, match...), f.n)
+	f.n++
+	return replacement
+}
@@ -5,8 +5,12 @@ go 1.18
 require (
 	github.com/carterpeel/go-corelib/ios v0.0.0-20210731145529-7bb373ddaf51
 	github.com/docker/go-units v0.5.0
+	github.com/dsnet/compress v0.0.1
+	github.com/klauspost/compress v1.16.7
 	github.com/tjarratt/babble v0.0.0-20210505082055-cbca2a4833c1
 	github.com/zenthangplus/goccm v1.1.2
+	golang.org/x/text v0.14.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
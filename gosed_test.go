@@ -1,23 +1,48 @@
 package gosed
 
 import (
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/carterpeel/go-corelib/ios"
 	"github.com/docker/go-units"
 	"github.com/tjarratt/babble"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"log"
 	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
 	"time"
+	"unicode/utf16"
 )
 
 func TestTiny(t *testing.T) {
@@ -380,44 +405,3958 @@ func TestFullSequential(t *testing.T) {
 	}
 }
 
-func Cleanup() {
-	files, err := filepath.Glob("*.txt")
+func TestRecordReaderLongRecord(t *testing.T) {
+	long := bytes.Repeat([]byte{'x'}, 3*defaultRecordBufSize)
+	input := append(append([]byte("short\n"), long...), []byte("\nlast")...)
+	rr := newRecordReader(bytes.NewReader(input), '\n', 0)
+	var segments int
+	var total int
+	for {
+		seg, more, err := rr.readSegment()
+		total += len(seg)
+		if len(seg) > defaultRecordBufSize {
+			t.Fatal(fmt.Errorf("segment of %d bytes exceeds the record buffer", len(seg)))
+		}
+		if more {
+			segments++
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if total != len(input) || segments == 0 {
+		t.Fatal(fmt.Errorf("read %d bytes in %d spilled segments, expected %d bytes", total, segments, len(input)))
+	}
+	rr = newRecordReader(bytes.NewReader(input), '\n', 2*defaultRecordBufSize)
+	if rec, err := rr.ReadRecord(); err != nil || string(rec) != "short\n" {
+		t.Fatal(fmt.Errorf("unexpected first record %q: %v", rec, err))
+	}
+	if _, err := rr.ReadRecord(); !errors.Is(err, ErrRecordTooLong) {
+		t.Fatal(fmt.Errorf("expected ErrRecordTooLong, got %v", err))
+	}
+	if rec, err := rr.ReadRecord(); err != io.EOF || string(rec) != "last" || rr.record != 3 {
+		t.Fatal(fmt.Errorf("unexpected record %d after the long one: %q, %v", rr.record, rec, err))
+	}
+
+	// the error met while skipping the long record is not lost, although the reads after it succeed
+	rr = newRecordReader(iotest.TimeoutReader(bytes.NewReader(long)), '\n', 1024)
+	if _, err := rr.ReadRecord(); !errors.Is(err, ErrRecordTooLong) {
+		t.Fatal(fmt.Errorf("expected ErrRecordTooLong, got %v", err))
+	}
+	for i := 0; i < 2; i++ {
+		if rec, err := rr.ReadRecord(); err != iotest.ErrTimeout {
+			t.Fatal(fmt.Errorf("expected the skipping error, got %q, %v", rec, err))
+		}
+	}
+}
+
+func TestUTF8Validation(t *testing.T) {
+	defer Cleanup()
+	if err := ioutil.WriteFile("test-utf8.txt", []byte("h\xc3\xa9llo \xffw\xc3rld"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	replacer, err := NewReplacer("test-utf8.txt", WithUTF8Validation(UTF8Fail))
 	if err != nil {
-		panic(err.Error())
+		t.Fatal(err.Error())
 	}
-	for _, fi := range files {
-		_ = os.Remove(fi)
+	if err := replacer.NewStringMapping("llo", "LLO"); err != nil {
+		t.Fatal(err.Error())
 	}
-	files, err = filepath.Glob("*.sh")
+	var invalid *InvalidUTF8Error
+	if _, err := replacer.ReplaceChained(); !errors.As(err, &invalid) || invalid.Offset != 7 || invalid.Output {
+		t.Fatal(fmt.Errorf("expected invalid input at offset 7, got %v", err))
+	}
+	replacer, err = NewReplacer("test-utf8.txt", WithUTF8Validation(UTF8Report))
 	if err != nil {
-		panic(err.Error())
+		t.Fatal(err.Error())
 	}
-	for _, fi := range files {
-		_ = os.Remove(fi)
+	if err := replacer.NewStringMapping("h\xc3\xa9", "h\xc3"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := replacer.Replace(); err != nil {
+		t.Fatal(err.Error())
+	}
+	var input, output []int64
+	for _, e := range replacer.InvalidUTF8() {
+		if e.Output {
+			output = append(output, e.Offset)
+		} else {
+			input = append(input, e.Offset)
+		}
+	}
+	if fmt.Sprint(input) != "[7 9]" || fmt.Sprint(output) != "[1 6 8]" {
+		t.Fatal(fmt.Errorf("unexpected invalid offsets: input %v, output %v", input, output))
 	}
 }
 
-func copyFileContents(src, dst string) (err error) {
-	in, err := os.Open(src)
+func TestGraphemeSafeMatching(t *testing.T) {
+	input := strings.Repeat("cafe\u0301 cafe \U0001f44d\U0001f3fd \U0001f44d e\u0301", 500)
+	expected := strings.Repeat("cafe\u0301 CAFE \U0001f44d\U0001f3fd OK e\u0301", 500)
+	for _, src := range []io.Reader{strings.NewReader(input), iotest.OneByteReader(strings.NewReader(input))} {
+		r := NewBytesReplacingReaderEx(src, &graphemeSafeReplacer{&singleSearchReplaceReplacer{search: []byte("cafe"), replace: []byte("CAFE")}})
+		r = NewBytesReplacingReaderEx(r, &graphemeSafeReplacer{&singleSearchReplaceReplacer{search: []byte("\U0001f44d"), replace: []byte("OK")}})
+		r = NewBytesReplacingReaderEx(r, &graphemeSafeReplacer{&singleSearchReplaceReplacer{search: []byte("e"), replace: []byte("E")}})
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(out) != expected {
+			t.Fatal(fmt.Errorf("grapheme-safe replacement split a cluster: %q", out[:64]))
+		}
+	}
+}
+
+func TestCaseFoldMapping(t *testing.T) {
+	defer Cleanup()
+	if err := ioutil.WriteFile("test-fold.txt", []byte("Straße STRASSE strasse | İstanbul istanbul ISTANBUL ıstanbul"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	for lang, expected := range map[string]string{
+		"":   "road road road | İstanbul city city ıstanbul",
+		"tr": "Straße STRASSE strasse | city city ISTANBUL ıstanbul",
+	} {
+		if err := copyFileContents("test-fold.txt", "test-fold-out.txt"); err != nil {
+			t.Fatal(err.Error())
+		}
+		replacer, err := NewReplacer("test-fold-out.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if lang == "" {
+			if err := replacer.NewMappingWithOptions([]byte("STRASSE"), []byte("road"), MatchCaseFold(lang)); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		if err := replacer.NewMappingWithOptions([]byte("istanbul"), []byte("city"), MatchCaseFold(lang)); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := replacer.ReplaceChained(); err != nil {
+			t.Fatal(err.Error())
+		}
+		out, err := ioutil.ReadFile("test-fold-out.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(out) != expected {
+			t.Fatal(fmt.Errorf("lang %q: got %q, expected %q", lang, out, expected))
+		}
+	}
+}
+
+func TestEBCDICEncoding(t *testing.T) {
+	defer Cleanup()
+	// "HELLO [WORLD]" in IBM-1047
+	ebcdic := []byte{0xc8, 0xc5, 0xd3, 0xd3, 0xd6, 0x40, 0xad, 0xe6, 0xd6, 0xd9, 0xd3, 0xc4, 0xbd}
+	if err := ioutil.WriteFile("test-ebcdic.txt", ebcdic, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	replacer, err := NewReplacer("test-ebcdic.txt", WithEncoding(charmap.CodePage1047))
 	if err != nil {
-		return
+		t.Fatal(err.Error())
 	}
-	defer func(in *os.File) {
-		_ = in.Close()
-	}(in)
-	out, err := os.Create(dst)
+	if err := replacer.NewStringMapping("[WORLD]", "MAINFRAME"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := replacer.ReplaceChained(); err != nil {
+		t.Fatal(err.Error())
+	}
+	out, err := ioutil.ReadFile("test-ebcdic.txt")
 	if err != nil {
-		return
+		t.Fatal(err.Error())
+	}
+	expected := []byte{0xc8, 0xc5, 0xd3, 0xd3, 0xd6, 0x40, 0xd4, 0xc1, 0xc9, 0xd5, 0xc6, 0xd9, 0xc1, 0xd4, 0xc5}
+	if !bytes.Equal(out, expected) {
+		t.Fatal(fmt.Errorf("got % x, expected % x", out, expected))
+	}
+	replacer, err = NewReplacer("test-ebcdic.txt", WithEncoding(charmap.CodePage1047))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := replacer.NewStringMapping("MAINFRAME", "\u20ac"); err != nil {
+		t.Fatal(err.Error())
+	}
+	var unmappable *UnmappableRuneError
+	if _, err := replacer.ReplaceChained(); !errors.As(err, &unmappable) || unmappable.Rune != '\u20ac' {
+		t.Fatal(fmt.Errorf("expected an unmappable euro sign, got %v", err))
+	}
+	// bytes a code page leaves undefined survive the round trip
+	legacy := []byte("caf\xe9 \x81\x8d\x90 price")
+	if err := ioutil.WriteFile("test-cp1252.txt", legacy, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	replacer, err = NewReplacer("test-cp1252.txt", WithEncoding(charmap.Windows1252))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := replacer.NewStringMapping("café", "bistro"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := replacer.ReplaceChained(); err != nil {
+		t.Fatal(err.Error())
+	}
+	out, err = ioutil.ReadFile("test-cp1252.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if expected := []byte("bistro \x81\x8d\x90 price"); !bytes.Equal(out, expected) {
+		t.Fatal(fmt.Errorf("got % x, expected % x", out, expected))
+	}
+}
+
+func TestUnicodeEncodings(t *testing.T) {
+	defer Cleanup()
+	utf16le := func(s string) []byte {
+		var b []byte
+		for _, u := range utf16.Encode([]rune(s)) {
+			b = append(b, byte(u), byte(u>>8))
+		}
+		return b
+	}
+	utf16be := func(s string) []byte {
+		var b []byte
+		for _, u := range utf16.Encode([]rune(s)) {
+			b = append(b, byte(u>>8), byte(u))
+		}
+		return b
+	}
+	for _, tc := range []struct {
+		enc                 encoding.Encoding
+		original, expected []byte
+	}{
+		// the mark wins over the endianness of the encoding, and is kept
+		{unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), append([]byte{0xff, 0xfe}, utf16le("Path=C:\\old")...), append([]byte{0xff, 0xfe}, utf16le("Path=C:\\new")...)},
+		{unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), append([]byte{0xfe, 0xff}, utf16be("Path=C:\\old")...), append([]byte{0xfe, 0xff}, utf16be("Path=C:\\new")...)},
+		// without a mark, none is added
+		{unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), utf16le("Path=C:\\old"), utf16le("Path=C:\\new")},
+		{unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM), utf16be("Path=C:\\old"), utf16be("Path=C:\\new")},
+		// UTF-8 keeps its mark and invalid bytes
+		{unicode.UTF8, []byte("\xef\xbb\xbfold \xff"), []byte("\xef\xbb\xbfnew \xff")},
+		{unicode.UTF8BOM, []byte("old"), []byte("new")},
+	} {
+		if err := ioutil.WriteFile("test-utf16.txt", tc.original, 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, replace := range []func(rp *Replacer) (int, error){(*Replacer).Replace, (*Replacer).ReplaceChained} {
+			rp, err := NewReplacer("test-utf16.txt", WithEncoding(tc.enc))
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if err := rp.NewStringMapping("old", "new"); err != nil {
+				t.Fatal(err.Error())
+			}
+			if _, err := replace(rp); err != nil {
+				t.Fatal(err.Error())
+			}
+			_ = rp.Config.File.Close()
+			out, err := ioutil.ReadFile("test-utf16.txt")
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if !bytes.Equal(out, tc.expected) {
+				t.Fatal(fmt.Errorf("got % x, expected % x", out, tc.expected))
+			}
+		}
+	}
+}
+
+func TestBase64Regions(t *testing.T) {
+	defer Cleanup()
+	secret := base64.StdEncoding.EncodeToString([]byte("user=admin password=hunter2"))
+	pem := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("hunter2 "), 20))
+	var wrapped string
+	for len(pem) > 64 {
+		wrapped, pem = wrapped+pem[:64]+"\n", pem[64:]
+	}
+	wrapped += pem
+	input := fmt.Sprintf("<a href=\"data:text/plain;base64,%s\">hunter2</a>\n-----BEGIN SECRET-----\n%s\n-----END SECRET-----\n", secret, wrapped)
+	if err := ioutil.WriteFile("test-base64.txt", []byte(input), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	replacer, err := NewReplacer("test-base64.txt", WithBase64Regions(DataURIRegion, PEMRegion("SECRET")))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := replacer.NewStringMapping("hunter2", "*******"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := replacer.ReplaceChained(); err != nil {
+		t.Fatal(err.Error())
+	}
+	out, err := ioutil.ReadFile("test-base64.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	lines := strings.Split(string(out), "\n")
+	uri := strings.TrimSuffix(strings.TrimPrefix(lines[0], `<a href="data:text/plain;base64,`), `">*******</a>`)
+	if decoded, err := base64.StdEncoding.DecodeString(uri); err != nil || string(decoded) != "user=admin password=*******" {
+		t.Fatal(fmt.Errorf("data URI was not rewritten: %q", lines[0]))
+	}
+	block := strings.Join(lines[2:len(lines)-2], "")
+	if decoded, err := base64.StdEncoding.DecodeString(block); err != nil || !bytes.Equal(decoded, bytes.Repeat([]byte("******* "), 20)) {
+		t.Fatal(fmt.Errorf("PEM block was not rewritten: %q", block))
+	}
+	if len(lines[2]) != 64 {
+		t.Fatal(fmt.Errorf("PEM line width was not kept: %d", len(lines[2])))
+	}
+}
+
+func TestMIMEMessage(t *testing.T) {
+	defer Cleanup()
+	message := "From: ops@example.com\r\n" +
+		"Subject: secret rotation\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed;\r\n boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"preamble\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"The password is secret=3D PLACEHOLDER caf=C3=A9\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/html\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64.StdEncoding.EncodeToString([]byte("<p>secret</p>")) + "\r\n" +
+		"--b1\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"\r\n" +
+		"secret\r\n" +
+		"--b1--\r\n"
+	if err := ioutil.WriteFile("test-mime.txt", []byte(message), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	replacer, err := NewReplacer("test-mime.txt", WithMIMEMessage())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := replacer.NewStringMapping("secret", "hidden"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := replacer.NewStringMapping("PLACEHOLDER", "--b1"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := replacer.Replace(); err != nil {
+		t.Fatal(err.Error())
+	}
+	out, err := ioutil.ReadFile("test-mime.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if msg.Header.Get("Subject") != "secret rotation" {
+		t.Fatal(fmt.Errorf("header was rewritten: %q", msg.Header.Get("Subject")))
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "b1" {
+		t.Fatal(fmt.Errorf("boundary was not recalculated: %v %v", params, err))
+	}
+	var bodies []string
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		body, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if part.Header.Get("Content-Transfer-Encoding") == "base64" {
+			body, _ = base64.StdEncoding.DecodeString(string(body))
+		}
+		bodies = append(bodies, string(body))
+	}
+	expected := []string{"The password is hidden= --b1 caf\u00e9", "<p>hidden</p>", "secret"}
+	if fmt.Sprintf("%q", bodies) != fmt.Sprintf("%q", expected) {
+		t.Fatal(fmt.Errorf("got parts %q, expected %q", bodies, expected))
+	}
+}
+
+func TestMIMEMessageEdgeCases(t *testing.T) {
+	defer Cleanup()
+	// a body line starting with "From " does not split a single message
+	single := "Subject: hi\n\nsecret one\nFrom here on, secret two\nsecret three\n"
+	// a boundary short enough to appear inside the media type itself
+	multipart := "Content-Type: multipart/mixed; boundary=a\n\n--a\nContent-Type: text/plain\n\nsecret\n--a--\n"
+	for _, message := range []string{single, multipart} {
+		if err := ioutil.WriteFile("test-mime-edge.txt", []byte(message), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		replacer, err := NewReplacer("test-mime-edge.txt", WithMIMEMessage())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := replacer.NewStringMapping("secret", "--a"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := replacer.Replace(); err != nil {
+			t.Fatal(err.Error())
+		}
+		out, err := ioutil.ReadFile("test-mime-edge.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if bytes.Contains(out, []byte("secret")) {
+			t.Fatal(fmt.Errorf("secret left in %q", out))
+		}
+		msg, err := mail.ReadMessage(bytes.NewReader(out))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if message == multipart {
+			mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+			if err != nil || mediaType != "multipart/mixed" || params["boundary"] == "a" {
+				t.Fatal(fmt.Errorf("bad Content-Type %q", msg.Header.Get("Content-Type")))
+			}
+		}
+	}
+}
+
+func TestOfficeDocument(t *testing.T) {
+	defer Cleanup()
+	parts := map[string]string{
+		"word/document.xml": `<?xml version="1.0"?><w:document><w:p w:rsidR="ACME"><w:r><w:t>Hello ACME &amp; Co</w:t></w:r></w:p></w:document>`,
+		"docProps/core.xml": `<dc:creator>ACME &amp; Co</dc:creator>`,
+	}
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for _, name := range []string{"word/document.xml", "docProps/core.xml"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := w.Write([]byte(parts[name])); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ioutil.WriteFile("test-docx.txt", archive.Bytes(), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	replacer, err := NewReplacer("test-docx.txt", WithOfficeDocument())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := replacer.NewStringMapping("ACME & Co", "Globex <Corp>"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := replacer.NewStringMapping("ACME", "Initech"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := replacer.Replace(); err != nil {
+		t.Fatal(err.Error())
+	}
+	zr, err := zip.OpenReader("test-docx.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func(zr *zip.ReadCloser) {
+		_ = zr.Close()
+	}(zr)
+	expected := map[string]string{
+		"word/document.xml": `<?xml version="1.0"?><w:document><w:p w:rsidR="ACME"><w:r><w:t>Hello Globex &lt;Corp&gt;</w:t></w:r></w:p></w:document>`,
+		"docProps/core.xml": parts["docProps/core.xml"],
+	}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		content, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = rc.Close()
+		if string(content) != expected[f.Name] {
+			t.Fatal(fmt.Errorf("%s: got %s, expected %s", f.Name, content, expected[f.Name]))
+		}
+	}
+}
+
+func TestRewriteXMLText(t *testing.T) {
+	src := `<w:t w:val="a>ACME" x='b>ACME'>ACME &#65;&#x43;ME &amp; &nbsp;</w:t>`
+	out, err := rewriteXMLText([]byte(src), func(text []byte) ([]byte, error) {
+		return bytes.ReplaceAll(text, []byte("ACME"), []byte("Initech")), nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
 	}
+	expected := `<w:t w:val="a>ACME" x='b>ACME'>Initech Initech &amp; &amp;nbsp;</w:t>`
+	if string(out) != expected {
+		t.Fatal(fmt.Errorf("got %s, expected %s", out, expected))
+	}
+}
+
+func TestRotatedLogs(t *testing.T) {
+	defer Cleanup()
 	defer func() {
-		cerr := out.Close()
-		if err == nil {
-			err = cerr
+		_ = os.Remove("test-app.txt.2.gz")
+	}()
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write([]byte("user=alice old\n")); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	logs := map[string][]byte{
+		"test-app.txt":      []byte("user=alice now\n"),
+		"test-app.txt.1":    []byte("user=alice earlier\n"),
+		"test-app.txt.2.gz": compressed.Bytes(),
+		"test-apps.txt":     []byte("user=alice unrelated\n"),
+	}
+	for name, content := range logs {
+		if err := ioutil.WriteFile(name, content, 0644); err != nil {
+			t.Fatal(err.Error())
 		}
+	}
+	defer func() {
+		_ = os.Remove("test-app.txt.1")
 	}()
-	if _, err = io.Copy(out, in); err != nil {
-		return
+	replacer, err := NewReplacer("test-app.txt")
+	if err != nil {
+		t.Fatal(err.Error())
 	}
-	err = out.Sync()
-	return
-}
\ No newline at end of file
+	if err := replacer.NewStringMapping("alice", "REDACTED"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := replacer.ReplaceRotated(); err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := map[string]string{
+		"test-app.txt":   "user=REDACTED now\n",
+		"test-app.txt.1": "user=REDACTED earlier\n",
+		"test-apps.txt":  "user=alice unrelated\n",
+	}
+	for name, want := range expected {
+		content, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(content) != want {
+			t.Fatal(fmt.Errorf("%s: got %q, expected %q", name, content, want))
+		}
+	}
+	fi, err := os.Open("test-app.txt.2.gz")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func(fi *os.File) {
+		_ = fi.Close()
+	}(fi)
+	zr, err := gzip.NewReader(fi)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	content, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(content) != "user=REDACTED old\n" {
+		t.Fatal(fmt.Errorf("test-app.txt.2.gz: got %q", content))
+	}
+}
+
+// hookEncoding is an identity encoding that calls hook with every chunk of data it decodes, to simulate what other
+// processes do to a file while it is being replaced
+type hookEncoding struct {
+	hook func(src []byte)
+}
+
+func (he hookEncoding) NewDecoder() *encoding.Decoder {
+	return &encoding.Decoder{Transformer: hookTransformer{hook: he.hook}}
+}
+
+func (he hookEncoding) NewEncoder() *encoding.Encoder {
+	return &encoding.Encoder{Transformer: transform.Nop}
+}
+
+type hookTransformer struct {
+	transform.NopResetter
+	hook func(src []byte)
+}
+
+func (ht hookTransformer) Transform(dst, src []byte, atEOF bool) (int, int, error) {
+	n := copy(dst, src)
+	ht.hook(src[:n])
+	if n < len(src) {
+		return n, n, transform.ErrShortDst
+	}
+	return n, n, nil
+}
+
+// appendingEncoding simulates a concurrent writer by appending to path the first writes times data is decoded
+func appendingEncoding(path string, writes int) hookEncoding {
+	return hookEncoding{hook: func(src []byte) {
+		if len(src) == 0 || writes == 0 {
+			return
+		}
+		writes--
+		if fi, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644); err == nil {
+			_, _ = fi.WriteString("late foo\n")
+			_ = fi.Close()
+		}
+	}}
+}
+
+func TestConcurrentWriteDetection(t *testing.T) {
+	defer Cleanup()
+	for _, policy := range []ConcurrentWritePolicy{ConcurrentWriteAbort, ConcurrentWriteRetry} {
+		if err := ioutil.WriteFile("test-concurrent.txt", []byte("foo bar\n"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		replacer, err := NewReplacer("test-concurrent.txt",
+			WithEncoding(appendingEncoding("test-concurrent.txt", 1)),
+			WithConcurrentWriteDetection(policy, 2))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := replacer.NewStringMapping("foo", "baz"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := replacer.NewStringMapping("bar", "qux"); err != nil {
+			t.Fatal(err.Error())
+		}
+		_, err = replacer.Replace()
+		content, rerr := ioutil.ReadFile("test-concurrent.txt")
+		if rerr != nil {
+			t.Fatal(rerr.Error())
+		}
+		switch policy {
+		case ConcurrentWriteAbort:
+			if !errors.Is(err, ErrConcurrentWrite) {
+				t.Fatal(fmt.Errorf("expected ErrConcurrentWrite, got %v", err))
+			}
+			if string(content) != "foo bar\nlate foo\n" {
+				t.Fatal(fmt.Errorf("aborted replace changed the file: %q", content))
+			}
+		case ConcurrentWriteRetry:
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if string(content) != "baz qux\nlate baz\n" {
+				t.Fatal(fmt.Errorf("got %q after retry", content))
+			}
+		}
+		if tmp, _ := filepath.Glob("tmp-gosed-*"); len(tmp) > 0 {
+			t.Fatal(fmt.Errorf("temporary files left behind: %v", tmp))
+		}
+	}
+}
+
+// tamperingEncoding overwrites the last byte of path the first time data is decoded, keeping its size and mtime
+func tamperingEncoding(path string) hookEncoding {
+	done := false
+	return hookEncoding{hook: func(src []byte) {
+		if done {
+			return
+		}
+		done = true
+		info, err := os.Stat(path)
+		if err != nil {
+			return
+		}
+		if fi, err := os.OpenFile(path, os.O_WRONLY, 0644); err == nil {
+			_, _ = fi.WriteAt([]byte("!"), info.Size()-1)
+			_ = fi.Close()
+		}
+		_ = os.Chtimes(path, info.ModTime(), info.ModTime())
+	}}
+}
+
+func TestConcurrentWriteDetectionZip(t *testing.T) {
+	defer Cleanup()
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	w, err := zw.Create("notes.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := w.Write([]byte("foo")); err != nil {
+		t.Fatal(err.Error())
+	}
+	// the archive comment is read with the central directory, before any member is rewritten
+	if err := zw.SetComment("archive comment."); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ioutil.WriteFile("test-concurrent-zip.txt", archive.Bytes(), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	replacer, err := NewReplacer("test-concurrent-zip.txt", WithZipMembers("*.txt"),
+		WithEncoding(tamperingEncoding("test-concurrent-zip.txt")),
+		WithConcurrentWriteDetection(ConcurrentWriteAbort, 0))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := replacer.NewStringMapping("foo", "bar"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := replacer.Replace(); !errors.Is(err, ErrConcurrentWrite) {
+		t.Fatal(fmt.Errorf("expected ErrConcurrentWrite, got %v", err))
+	}
+}
+
+func TestInodePreservation(t *testing.T) {
+	defer Cleanup()
+	if err := ioutil.WriteFile("test-inode.txt", []byte("a long line of text\nsecond line\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	before, err := os.Stat("test-inode.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	held, err := os.Open("test-inode.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func(held *os.File) {
+		_ = held.Close()
+	}(held)
+	replacer, err := NewReplacer("test-inode.txt", WithInodePreservation())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := replacer.NewStringMapping("a long line of text", "short"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := replacer.ReplaceChained(); err != nil {
+		t.Fatal(err.Error())
+	}
+	after, err := os.Stat("test-inode.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !os.SameFile(before, after) {
+		t.Fatal(fmt.Errorf("file was replaced by a new inode"))
+	}
+	content, err := ioutil.ReadAll(held)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(content) != "short\nsecond line\n" {
+		t.Fatal(fmt.Errorf("got %q through the held handle", content))
+	}
+}
+
+func TestPatchInPlace(t *testing.T) {
+	defer Cleanup()
+	original := strings.Repeat("id=0001 status=open\n", 1000)
+	if err := ioutil.WriteFile("test-patch.txt", []byte(original), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	replacer, err := NewReplacer("test-patch.txt", WithPatchInPlace())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := replacer.NewStringMapping("open", "shut"); err != nil {
+		t.Fatal(err.Error())
+	}
+	patched, err := replacer.Replace()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	content, err := ioutil.ReadFile("test-patch.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(content) != strings.ReplaceAll(original, "open", "shut") {
+		t.Fatal(fmt.Errorf("file was not patched"))
+	}
+	if patched > 4*1000 {
+		t.Fatal(fmt.Errorf("rewrote %d bytes for 1000 four byte matches", patched))
+	}
+	if err := replacer.NewStringMapping("shut", "closed"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := replacer.Replace(); !errors.Is(err, ErrLengthChange) {
+		t.Fatal(fmt.Errorf("expected ErrLengthChange, got %v", err))
+	}
+	unchanged, err := ioutil.ReadFile("test-patch.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(unchanged, content) {
+		t.Fatal(fmt.Errorf("refused replace changed the file"))
+	}
+}
+
+func TestReflinkCopy(t *testing.T) {
+	defer Cleanup()
+	original := strings.Repeat("keep this line\n", 100) + "change me\n" + strings.Repeat("tail\n", 10)
+	for _, replacement := range []string{"changed!!", "shorter", "much longer than before"} {
+		if err := ioutil.WriteFile("test-reflink.txt", []byte(original), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		// cloneWriter over a file that already holds the original content, as a clone would
+		clone, err := os.OpenFile("test-reflink-clone.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := clone.WriteString(original); err != nil {
+			t.Fatal(err.Error())
+		}
+		cw := &cloneWriter{f: clone}
+		expected := strings.Replace(original, "change me", replacement, 1)
+		for _, chunk := range []string{expected[:700], expected[700:]} {
+			if _, err := cw.Write([]byte(chunk)); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		if err := cw.finish(); err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = clone.Close()
+		replacer, err := NewReplacer("test-reflink.txt", WithReflinkCopy())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := replacer.NewStringMapping("change me", replacement); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := replacer.ReplaceChained(); err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, name := range []string{"test-reflink-clone.txt", "test-reflink.txt"} {
+			content, err := ioutil.ReadFile(name)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if string(content) != expected {
+				t.Fatal(fmt.Errorf("%s: wrong content replacing with %q", name, replacement))
+			}
+		}
+	}
+}
+
+func TestBatchSnapshot(t *testing.T) {
+	defer Cleanup()
+	for _, name := range []string{"test-batch-1.txt", "test-batch-2.txt"} {
+		if err := ioutil.WriteFile(name, []byte("host=db01\n"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	var snapshotted []string
+	batch := NewBatch([]string{"test-batch-1.txt", "test-batch-missing.txt", "test-batch-2.txt"})
+	batch.Snapshotter = SnapshotFunc(func(files []string) (string, error) {
+		snapshotted = files
+		return "tank/etc@gosed-1", nil
+	})
+	if err := batch.NewStringMapping("db01", "db02"); err != nil {
+		t.Fatal(err.Error())
+	}
+	report, err := batch.Replace()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if report.Snapshot != "tank/etc@gosed-1" || len(snapshotted) != 3 {
+		t.Fatal(fmt.Errorf("snapshot not recorded: %q", report.Snapshot))
+	}
+	if failed := report.Failed(); len(failed) != 1 || failed[0].Path != "test-batch-missing.txt" {
+		t.Fatal(fmt.Errorf("unexpected failures: %v", failed))
+	}
+	for _, name := range []string{"test-batch-1.txt", "test-batch-2.txt"} {
+		content, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(content) != "host=db02\n" {
+			t.Fatal(fmt.Errorf("%s: got %q", name, content))
+		}
+	}
+	batch.Snapshotter = SnapshotFunc(func(files []string) (string, error) {
+		return "", fmt.Errorf("pool is read-only")
+	})
+	if err := batch.NewStringMapping("db02", "db03"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := batch.Replace(); err == nil {
+		t.Fatal(fmt.Errorf("expected the snapshot error"))
+	}
+	content, err := ioutil.ReadFile("test-batch-1.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(content) != "host=db02\n" {
+		t.Fatal(fmt.Errorf("file touched after failed snapshot: %q", content))
+	}
+}
+
+// blockingEncoding simulates a dead mount: decoding data containing "stall" blocks until release is closed
+func blockingEncoding(release chan struct{}) hookEncoding {
+	return hookEncoding{hook: func(src []byte) {
+		if bytes.Contains(src, []byte("stall")) {
+			<-release
+		}
+	}}
+}
+
+func TestBatchStall(t *testing.T) {
+	defer Cleanup()
+	if err := ioutil.WriteFile("test-stall-1.txt", []byte("stall foo\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ioutil.WriteFile("test-stall-2.txt", []byte("foo\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	release := make(chan struct{})
+	batch := NewBatch([]string{"test-stall-1.txt", "test-stall-2.txt"}, WithEncoding(blockingEncoding(release)))
+	batch.StallTimeout = 50 * time.Millisecond
+	if err := batch.NewStringMapping("foo", "bar"); err != nil {
+		t.Fatal(err.Error())
+	}
+	report, err := batch.Replace()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if report.Files[0].Status != FileStalled || !errors.Is(report.Files[0].Err, ErrStalled) {
+		t.Fatal(fmt.Errorf("expected the first file to stall, got %v", report.Files[0]))
+	}
+	if report.Files[1].Status != FileReplaced {
+		t.Fatal(fmt.Errorf("expected the second file to be replaced, got %v", report.Files[1]))
+	}
+	close(release)
+	if tmp := tempFilesLeft(); len(tmp) > 0 {
+		t.Fatal(fmt.Errorf("stalled file left %v behind", tmp))
+	}
+	content, err := ioutil.ReadFile("test-stall-1.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(content) != "stall foo\n" {
+		t.Fatal(fmt.Errorf("stalled file was committed: %q", content))
+	}
+}
+
+func TestBatchShutdown(t *testing.T) {
+	defer Cleanup()
+	files := []string{"test-shutdown-1.txt", "test-shutdown-2.txt", "test-shutdown-3.txt"}
+	for _, grace := range []time.Duration{20 * time.Millisecond, time.Minute} {
+		for i, name := range files {
+			content := "foo\n"
+			if i == 0 {
+				content = "stall foo\n"
+			}
+			if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		release := make(chan struct{})
+		batch := NewBatch(files, WithEncoding(blockingEncoding(release)))
+		if err := batch.NewStringMapping("foo", "bar"); err != nil {
+			t.Fatal(err.Error())
+		}
+		replaced := make(chan *BatchReport, 1)
+		go func() {
+			report, _ := batch.Replace()
+			replaced <- report
+		}()
+		// let the first file block before shutting down
+		time.Sleep(20 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		// the blocked read returns after the short grace period has expired, but within the long one
+		time.AfterFunc(50*time.Millisecond, func() { close(release) })
+		report, err := batch.Shutdown(ctx)
+		cancel()
+		if report != <-replaced {
+			t.Fatal(fmt.Errorf("Shutdown and Replace returned different reports"))
+		}
+		expected := []FileStatus{FileReplaced, FileSkipped, FileSkipped}
+		if grace < time.Second {
+			expected[0] = FileCancelled
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatal(fmt.Errorf("expected the grace period to expire, got %v", err))
+			}
+		} else if err != nil {
+			t.Fatal(err.Error())
+		}
+		for i, result := range report.Files {
+			if result.Status != expected[i] {
+				t.Fatal(fmt.Errorf("grace %s: %s is %s, expected %s", grace, result.Path, result.Status, expected[i]))
+			}
+		}
+		if tmp := tempFilesLeft(); len(tmp) > 0 {
+			t.Fatal(fmt.Errorf("temporary files left behind: %v", tmp))
+		}
+	}
+}
+
+func TestBatchReplaceContext(t *testing.T) {
+	defer Cleanup()
+	files := []string{"test-partial-1.txt", "test-partial-2.txt", "test-partial-3.txt"}
+	contents := []string{"foo\n", "stall foo\n", "foo\n"}
+	for i, name := range files {
+		if err := ioutil.WriteFile(name, []byte(contents[i]), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	release := make(chan struct{})
+	defer close(release)
+	batch := NewBatch(files, WithEncoding(blockingEncoding(release)))
+	if err := batch.NewStringMapping("foo", "bar"); err != nil {
+		t.Fatal(err.Error())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	report, err := batch.ReplaceContext(ctx)
+	var partial *BatchCancelledError
+	if !errors.As(err, &partial) || !errors.Is(err, context.DeadlineExceeded) || partial.Report != report {
+		t.Fatal(fmt.Errorf("expected a partial result, got %v", err))
+	}
+	if completed := report.Completed(); len(completed) != 1 || completed[0].Path != files[0] {
+		t.Fatal(fmt.Errorf("expected %s to be completed, got %v", files[0], completed))
+	}
+	if rolledBack := report.RolledBack(); len(rolledBack) != 1 || rolledBack[0].Path != files[1] {
+		t.Fatal(fmt.Errorf("expected %s to be rolled back, got %v", files[1], rolledBack))
+	}
+	if untouched := report.Untouched(); len(untouched) != 1 || untouched[0].Path != files[2] {
+		t.Fatal(fmt.Errorf("expected %s to be untouched, got %v", files[2], untouched))
+	}
+	expected := []string{"bar\n", "stall foo\n", "foo\n"}
+	for i, name := range files {
+		content, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(content) != expected[i] {
+			t.Fatal(fmt.Errorf("%s: expected %q, got %q", name, expected[i], content))
+		}
+	}
+
+	report, err = batch.ReplaceContext(ctx)
+	if !errors.As(err, &partial) || len(report.Untouched()) != len(files) {
+		t.Fatal(fmt.Errorf("expected every file to be untouched on a done context, got %v", err))
+	}
+}
+
+func TestBatchStallDuringCommit(t *testing.T) {
+	defer Cleanup()
+	original := bytes.Repeat([]byte("secret padding line\n"), 400000)
+	for i := 0; i < 5; i++ {
+		if err := ioutil.WriteFile("test-commit-stall.txt", original, 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		batch := NewBatch([]string{"test-commit-stall.txt"},
+			WithConcurrentWriteDetection(ConcurrentWriteAbort, 0), WithInodePreservation())
+		// short enough to expire while the file is re-hashed and written back
+		batch.StallTimeout = time.Millisecond
+		if err := batch.NewStringMapping("secret", "public"); err != nil {
+			t.Fatal(err.Error())
+		}
+		report, err := batch.Replace()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if tmp := tempFilesLeft(); len(tmp) > 0 {
+			t.Fatal(fmt.Errorf("temporary files left behind: %v", tmp))
+		}
+		content, err := ioutil.ReadFile("test-commit-stall.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		rewritten := !bytes.Equal(content, original)
+		if status := report.Files[0].Status; rewritten != (status == FileReplaced) {
+			t.Fatal(fmt.Errorf("file reported %s, but rewritten is %v", status, rewritten))
+		}
+	}
+}
+
+// tempFilesLeft waits a little for abandoned replaces to remove their temporary files and returns those still left
+func tempFilesLeft() []string {
+	for i := 0; i < 100; i++ {
+		if tmp, _ := filepath.Glob("tmp-gosed-*"); len(tmp) == 0 {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tmp, _ := filepath.Glob("tmp-gosed-*")
+	return tmp
+}
+
+func Cleanup() {
+	files, err := filepath.Glob("*.txt")
+	if err != nil {
+		panic(err.Error())
+	}
+	for _, fi := range files {
+		_ = os.Remove(fi)
+	}
+	files, err = filepath.Glob("*.sh")
+	if err != nil {
+		panic(err.Error())
+	}
+	for _, fi := range files {
+		_ = os.Remove(fi)
+	}
+}
+
+func copyFileContents(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer func(in *os.File) {
+		_ = in.Close()
+	}(in)
+	out, err := os.Create(dst)
+	if err != nil {
+		return
+	}
+	defer func() {
+		cerr := out.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+	if _, err = io.Copy(out, in); err != nil {
+		return
+	}
+	err = out.Sync()
+	return
+}
+func TestRetarget(t *testing.T) {
+	defer Cleanup()
+	files := []string{"test-retarget-1.txt", "test-retarget-2.txt"}
+	for _, name := range files {
+		if err := ioutil.WriteFile(name, []byte("foo baz foo\n"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	rp, err := NewReplacer(files[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func() {
+		_ = rp.Config.File.Close()
+	}()
+	if err := rp.NewStringMapping("foo", "bar"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := rp.NewStringMapping("baz", "quux"); err != nil {
+		t.Fatal(err.Error())
+	}
+	for i, name := range files {
+		if i > 0 {
+			if err := rp.Retarget(name); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		if _, err := rp.ReplaceChained(); err != nil {
+			t.Fatal(err.Error())
+		}
+		content, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(content) != "bar quux bar\n" {
+			t.Fatal(fmt.Errorf("%s: unexpected content %q", name, content))
+		}
+	}
+	if err := rp.Retarget("test-retarget-missing.txt"); err == nil {
+		t.Fatal(fmt.Errorf("expected an error retargeting a missing file"))
+	}
+	if rp.Config.FilePath != files[1] {
+		t.Fatal(fmt.Errorf("a failed Retarget changed the file to %s", rp.Config.FilePath))
+	}
+}
+
+func TestReplacerPool(t *testing.T) {
+	defer Cleanup()
+	pool := NewReplacerPool()
+	if err := pool.NewStringMapping("rename", "foo", "bar"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := pool.NewStringMapping("rename", "baz", "quux"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := pool.NewStringMapping("upper", "foo", "FOO"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := pool.Get("missing", "test-pool-0.txt"); err == nil {
+		t.Fatal(fmt.Errorf("expected an error for an unknown mapping set"))
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		name := fmt.Sprintf("test-pool-%d.txt", i)
+		if err := ioutil.WriteFile(name, []byte("foo baz foo\n"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		set, expected := "rename", "bar quux bar\n"
+		if i%2 == 1 {
+			set, expected = "upper", "FOO baz FOO\n"
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := 0; round < 2; round++ {
+				rp, err := pool.Get(set, name)
+				if err != nil {
+					errs <- err
+					return
+				}
+				_, err = rp.ReplaceChained()
+				if err2 := pool.Put(rp); err == nil {
+					err = err2
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			content, err := ioutil.ReadFile(name)
+			if err != nil {
+				errs <- err
+			} else if string(content) != expected {
+				errs <- fmt.Errorf("%s: unexpected content %q", name, content)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestReplacerPoolSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("links are not supported here")
+	}
+	defer Cleanup()
+	pool := NewReplacerPool(WithSymlinkPolicy(LinkFollow))
+	if err := pool.NewStringMapping("rename", "old", "new"); err != nil {
+		t.Fatal(err.Error())
+	}
+	// the second link is replaced with the Replacer the first gives back to the pool
+	for i := 0; i < 2; i++ {
+		target, link := fmt.Sprintf("test-pool-target-%d.txt", i), fmt.Sprintf("test-pool-link-%d.txt", i)
+		_ = os.Remove(link)
+		if err := ioutil.WriteFile(target, []byte("old\n"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err.Error())
+		}
+		rp, err := pool.Get("rename", link)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_, err = rp.ReplaceChained()
+		if err2 := pool.Put(rp); err == nil {
+			err = err2
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+			t.Fatal(fmt.Errorf("%s replaced", link))
+		}
+		if content, _ := ioutil.ReadFile(target); string(content) != "new\n" {
+			t.Fatal(fmt.Errorf("unexpected content of %s: %q", target, content))
+		}
+		_ = os.Remove(link)
+	}
+}
+
+func TestDaemon(t *testing.T) {
+	defer Cleanup()
+	pool := NewReplacerPool()
+	if err := pool.NewStringMapping("rename", "foo", "bar"); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, name := range []string{"test-daemon-1.txt", "test-daemon-2.txt"} {
+		if err := ioutil.WriteFile(name, []byte("foo\n"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	daemon := NewDaemon(pool, 2)
+	socket := filepath.Join(t.TempDir(), "gosed.sock")
+	served := make(chan error, 1)
+	go func() {
+		served <- daemon.ListenAndServe(socket)
+	}()
+	var conn net.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("unix", socket); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	requests := []DaemonRequest{
+		{ID: "1", Path: "test-daemon-1.txt", Set: "rename"},
+		{ID: "2", Path: "test-daemon-2.txt", Set: "rename"},
+		{ID: "3", Path: "test-daemon-1.txt", Set: "missing"},
+	}
+	enc := json.NewEncoder(conn)
+	for _, req := range requests {
+		if err := enc.Encode(req); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	dec := json.NewDecoder(conn)
+	responses := make(map[string]DaemonResponse)
+	for range requests {
+		var resp DaemonResponse
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatal(err.Error())
+		}
+		responses[resp.ID] = resp
+	}
+	if responses["1"].Status != "replaced" || responses["2"].Status != "replaced" {
+		t.Fatal(fmt.Errorf("expected both files to be replaced, got %v", responses))
+	}
+	if responses["3"].Status != "failed" || responses["3"].Error == "" {
+		t.Fatal(fmt.Errorf("expected the unknown mapping set to fail, got %v", responses["3"]))
+	}
+	if err := enc.Encode(DaemonRequest{ID: "4", Op: "status"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	var status DaemonResponse
+	if err := dec.Decode(&status); err != nil {
+		t.Fatal(err.Error())
+	}
+	if status.Stats == nil || status.Stats.Completed != 2 || status.Stats.Failed != 1 {
+		t.Fatal(fmt.Errorf("unexpected status %v", status.Stats))
+	}
+	for _, name := range []string{"test-daemon-1.txt", "test-daemon-2.txt"} {
+		content, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(content) != "bar\n" {
+			t.Fatal(fmt.Errorf("%s: unexpected content %q", name, content))
+		}
+	}
+	if err := daemon.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := <-served; !errors.Is(err, ErrDaemonClosed) {
+		t.Fatal(fmt.Errorf("expected ErrDaemonClosed, got %v", err))
+	}
+}
+
+// etagServer serves a single resource with an ETag, accepting conditional and ranged PUTs
+type etagServer struct {
+	mu      sync.Mutex
+	content []byte
+	version int
+}
+
+func (es *etagServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	etag := fmt.Sprintf(`"v%d"`, es.version)
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(es.content))
+	case http.MethodPut:
+		if r.Header.Get("If-Match") != etag {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/*", &start, &end); err == nil {
+			copy(es.content[start:end+1], body)
+		} else {
+			es.content = body
+		}
+		es.version++
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestRemoteReplacer(t *testing.T) {
+	es := &etagServer{content: []byte("foo bar foo bar foo")}
+	srv := httptest.NewServer(es)
+	defer srv.Close()
+
+	rr := NewRemoteReplacer(srv.URL)
+	if err := rr.NewStringMapping("foo", "quux"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := rr.Replace(context.Background()); err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(es.content) != "quux bar quux bar quux" {
+		t.Fatal(fmt.Errorf("unexpected content %q", es.content))
+	}
+
+	ranged := NewRemoteReplacer(srv.URL)
+	ranged.Offset, ranged.Length = 5, 8
+	if err := ranged.NewStringMapping("bar", "BAR"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := ranged.Replace(context.Background()); err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(es.content) != "quux BAR quux bar quux" {
+		t.Fatal(fmt.Errorf("unexpected content after a ranged replace %q", es.content))
+	}
+
+	// a resource changed between the GET and the PUT is not overwritten
+	changing := NewRemoteReplacer(srv.URL, WithEncoding(hookEncoding{hook: func([]byte) {
+		es.mu.Lock()
+		es.version++
+		es.mu.Unlock()
+	}}))
+	if err := changing.NewStringMapping("quux", "foo"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := changing.Replace(context.Background()); !errors.Is(err, ErrRemoteChanged) {
+		t.Fatal(fmt.Errorf("expected ErrRemoteChanged, got %v", err))
+	}
+	if string(es.content) != "quux BAR quux bar quux" {
+		t.Fatal(fmt.Errorf("a changed resource was overwritten with %q", es.content))
+	}
+}
+
+func TestReplaceLines(t *testing.T) {
+	defer Cleanup()
+	if err := ioutil.WriteFile("test-lines.txt", []byte("keep foo\n# drop\nkeep\n\nlast foo"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	rp, err := NewReplacer("test-lines.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func() {
+		_ = rp.Config.File.Close()
+	}()
+	if err := rp.NewStringMapping("foo", "bar"); err != nil {
+		t.Fatal(err.Error())
+	}
+	var numbers []int
+	if _, err := rp.ReplaceLines(func(lineNum int, line []byte) ([]byte, bool) {
+		numbers = append(numbers, lineNum)
+		if bytes.HasPrefix(line, []byte("#")) {
+			return nil, false
+		}
+		return append([]byte(fmt.Sprintf("%d: ", lineNum)), line...), true
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+	content, err := ioutil.ReadFile("test-lines.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if expected := "1: keep bar\n3: keep\n4: \n5: last bar"; string(content) != expected {
+		t.Fatal(fmt.Errorf("expected %q, got %q", expected, content))
+	}
+	if fmt.Sprint(numbers) != "[1 2 3 4 5]" {
+		t.Fatal(fmt.Errorf("unexpected line numbers %v", numbers))
+	}
+}
+
+func TestIdentifierVariants(t *testing.T) {
+	defer Cleanup()
+	for ident, expected := range map[string]string{
+		"oldWidget":       "old widget",
+		"OLD_WIDGET":      "old widget",
+		"old-widget":      "old widget",
+		"HTTPServer":      "http server",
+		"parseV2Response": "parse v2 response",
+	} {
+		if words := strings.Join(identifierWords(ident), " "); words != expected {
+			t.Fatal(fmt.Errorf("%s: expected words %q, got %q", ident, expected, words))
+		}
+	}
+	input := "oldWidget OldWidget old_widget OLD_WIDGET old-widget oldwidget"
+	if err := ioutil.WriteFile("test-variants.txt", []byte(input), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	rp, err := NewReplacer("test-variants.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func() {
+		_ = rp.Config.File.Close()
+	}()
+	if err := rp.NewMappingWithOptions([]byte("oldWidget"), []byte("newGadget"), MatchIdentifierVariants()); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := rp.ReplaceChained(); err != nil {
+		t.Fatal(err.Error())
+	}
+	content, err := ioutil.ReadFile("test-variants.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if expected := "newGadget NewGadget new_gadget NEW_GADGET new-gadget oldwidget"; string(content) != expected {
+		t.Fatal(fmt.Errorf("expected %q, got %q", expected, content))
+	}
+}
+
+func TestNumericMapping(t *testing.T) {
+	defer Cleanup()
+	for _, tc := range []struct {
+		transform NumberTransform
+		in, out   string
+	}{
+		{Add(1000), "8080", "9080"},
+		{Add(-1), "-3", "-4"},
+		{Multiply(3), "12", "36"},
+		{ZeroPad(4), "7", "0007"},
+		{ZeroPad(4), "-7", "-0007"},
+		{BumpSemver(SemverMinor), "1.4.2", "1.5.0"},
+		{Add(1), "1.4.2", "1.4.2"},
+	} {
+		if out := string(tc.transform([]byte(tc.in))); out != tc.out {
+			t.Fatal(fmt.Errorf("%s: expected %s, got %s", tc.in, tc.out, out))
+		}
+	}
+
+	var input, expected strings.Builder
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&input, "port = %d\nversion: 1.%d.9.\n", 8000+i, i)
+		fmt.Fprintf(&expected, "port = %d\nversion: 1.%d.0.\n", 9000+i, i+1)
+	}
+	// a number at the very end of the file
+	input.WriteString("port = 1")
+	expected.WriteString("port = 1001")
+	if err := ioutil.WriteFile("test-numeric.txt", []byte(input.String()), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	rp, err := NewReplacer("test-numeric.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func() {
+		_ = rp.Config.File.Close()
+	}()
+	if err := rp.NewNumericMapping([]byte("port = "), Add(1000)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := rp.NewNumericMapping([]byte("version: "), BumpSemver(SemverMinor)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := rp.ReplaceChained(); err != nil {
+		t.Fatal(err.Error())
+	}
+	content, err := ioutil.ReadFile("test-numeric.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(content) != expected.String() {
+		t.Fatal(fmt.Errorf("numeric mappings were not applied as expected"))
+	}
+}
+
+func TestFrontMatter(t *testing.T) {
+	defer Cleanup()
+	const post = "---\ntitle: old title\nlayout: old\n---\nThe old body, old and\r\nbyte for byte.\n"
+	for _, tc := range []struct {
+		name     string
+		content  string
+		scope    FrontMatterScope
+		expected string
+	}{
+		{"yaml only", post, FrontMatterOnly, "---\ntitle: new title\nlayout: new\n---\nThe old body, old and\r\nbyte for byte.\n"},
+		{"yaml excluded", post, FrontMatterExcluded, "---\ntitle: old title\nlayout: old\n---\nThe new body, new and\r\nbyte for byte.\n"},
+		{"toml only", "+++\ntitle = \"old\"\n+++\nold", FrontMatterOnly, "+++\ntitle = \"new\"\n+++\nold"},
+		{"none only", "old body\n---\nold\n---\n", FrontMatterOnly, "old body\n---\nold\n---\n"},
+		{"none excluded", "old body\n", FrontMatterExcluded, "new body\n"},
+		{"unclosed excluded", "---\nold\n", FrontMatterExcluded, "---\nnew\n"},
+	} {
+		if err := ioutil.WriteFile("test-front-matter.txt", []byte(tc.content), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		rp, err := NewReplacer("test-front-matter.txt", WithFrontMatter(tc.scope))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewStringMapping("old", "new"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := rp.Replace(); err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = rp.Config.File.Close()
+		content, err := ioutil.ReadFile("test-front-matter.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(content) != tc.expected {
+			t.Fatal(fmt.Errorf("%s: expected %q, got %q", tc.name, tc.expected, content))
+		}
+	}
+}
+
+func TestTokenScope(t *testing.T) {
+	defer Cleanup()
+	const source = "package main\n\n// oldName is used /* oldName */\nfunc oldName() string {\n\treturn \"oldName\" + `oldName\r\n` /* oldName\r\n */\n}\n"
+	for _, tc := range []struct {
+		scopes   TokenScope
+		expected string
+	}{
+		{ScopeCode, "package main\n\n// oldName is used /* oldName */\nfunc newName() string {\n\treturn \"oldName\" + `oldName\r\n` /* oldName\r\n */\n}\n"},
+		{ScopeCode | ScopeString, "package main\n\n// oldName is used /* oldName */\nfunc newName() string {\n\treturn \"newName\" + `newName\r\n` /* oldName\r\n */\n}\n"},
+		{ScopeComment, "package main\n\n// newName is used /* newName */\nfunc oldName() string {\n\treturn \"oldName\" + `oldName\r\n` /* newName\r\n */\n}\n"},
+	} {
+		if err := ioutil.WriteFile("test-token-scope.go.txt", []byte(source), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		rp, err := NewReplacer("test-token-scope.go.txt", WithTokenScope(GoLexer, tc.scopes))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewStringMapping("oldName", "newName"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := rp.Replace(); err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = rp.Config.File.Close()
+		content, err := ioutil.ReadFile("test-token-scope.go.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(content) != tc.expected {
+			t.Fatal(fmt.Errorf("scopes %b: expected %q, got %q", tc.scopes, tc.expected, content))
+		}
+	}
+	if _, err := GoLexer.Lex([]byte("package main\nvar s = \"unterminated\n")); err == nil {
+		t.Fatal(fmt.Errorf("expected an error lexing invalid source"))
+	}
+}
+
+func TestValuesOnly(t *testing.T) {
+	defer Cleanup()
+	for _, tc := range []struct {
+		name     string
+		format   KeyValueFormat
+		keys     []string
+		content  string
+		expected string
+	}{
+		{"env", FormatEnv, nil,
+			"# secret rotation\nSECRET=secret\nexport SECRET_KEY=\"secret\"\r\n",
+			"# secret rotation\nSECRET=rotated\nexport SECRET_KEY=\"rotated\"\r\n"},
+		{"env keys", FormatEnv, []string{"SECRET"},
+			"SECRET=secret\nOTHER=secret\n",
+			"SECRET=rotated\nOTHER=secret\n"},
+		{"properties", FormatProperties, nil,
+			"! secret\nsecret.key = secret\nsecret:secret\nsecret secret, \\\n    secret\n",
+			"! secret\nsecret.key = rotated\nsecret:rotated\nsecret rotated, \\\n    rotated\n"},
+		{"ini", FormatINI, []string{"db.secret"},
+			"; secret\n[secret]\nsecret = secret\n[db]\nsecret = secret\n",
+			"; secret\n[secret]\nsecret = secret\n[db]\nsecret = rotated\n"},
+	} {
+		if err := ioutil.WriteFile("test-values.txt", []byte(tc.content), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		rp, err := NewReplacer("test-values.txt", WithValuesOnly(tc.format, tc.keys...))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewStringMapping("secret", "rotated"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := rp.ReplaceChained(); err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = rp.Config.File.Close()
+		content, err := ioutil.ReadFile("test-values.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(content) != tc.expected {
+			t.Fatal(fmt.Errorf("%s: expected %q, got %q", tc.name, tc.expected, content))
+		}
+	}
+}
+
+// ctrCodec is a test Codec encrypting with AES-CTR under a fixed key, with a random IV in front of the ciphertext
+type ctrCodec struct {
+	key []byte
+}
+
+func (c ctrCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	block, err := aes.NewCipher(c.key)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, block.BlockSize())
+	if _, err := io.ReadFull(r, iv); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(cipher.StreamReader{S: cipher.NewCTR(block, iv), R: r}), nil
+}
+
+func (c ctrCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	block, err := aes.NewCipher(c.key)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, block.BlockSize())
+	if _, err := crand.Read(iv); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(iv); err != nil {
+		return nil, err
+	}
+	return nopWriteCloser{cipher.StreamWriter{S: cipher.NewCTR(block, iv), W: w}}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func TestCodec(t *testing.T) {
+	defer Cleanup()
+	codec := ctrCodec{key: bytes.Repeat([]byte{7}, 32)}
+	encrypt := func(plaintext string, layers ...Codec) []byte {
+		var buf bytes.Buffer
+		var w io.Writer = &buf
+		var closers []io.Closer
+		for _, layer := range layers {
+			lw, err := layer.NewWriter(w)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			closers = append(closers, lw)
+			w = lw
+		}
+		if _, err := io.WriteString(w, plaintext); err != nil {
+			t.Fatal(err.Error())
+		}
+		for i := len(closers) - 1; i >= 0; i-- {
+			if err := closers[i].Close(); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		return buf.Bytes()
+	}
+	decrypt := func(ciphertext []byte, layers ...Codec) string {
+		var r io.Reader = bytes.NewReader(ciphertext)
+		for _, layer := range layers {
+			lr, err := layer.NewReader(r)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			r = lr
+		}
+		plaintext, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return string(plaintext)
+	}
+	for _, layers := range [][]Codec{{codec}, {codec, Gzip}} {
+		if err := ioutil.WriteFile("test-codec.txt", encrypt("password=hunter2\n", layers...), 0600); err != nil {
+			t.Fatal(err.Error())
+		}
+		opts := []Option{WithCodec(codec)}
+		if len(layers) > 1 {
+			opts = append(opts, WithCompression(Gzip))
+		}
+		rp, err := NewReplacer("test-codec.txt", opts...)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewStringMapping("hunter2", "correct horse"); err != nil {
+			t.Fatal(err.Error())
+		}
+		// the sequential replace would write plaintext passes, so it goes through the chain as well
+		if _, err := rp.Replace(); err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = rp.Config.File.Close()
+		content, err := ioutil.ReadFile("test-codec.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if bytes.Contains(content, []byte("password")) {
+			t.Fatal(fmt.Errorf("plaintext was written to the file"))
+		}
+		if plaintext := decrypt(content, layers...); plaintext != "password=correct horse\n" {
+			t.Fatal(fmt.Errorf("unexpected plaintext %q", plaintext))
+		}
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	defer Cleanup()
+	mtime := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	var outputs [][]byte
+	for i := 0; i < 2; i++ {
+		if err := ioutil.WriteFile("test-deterministic.txt", []byte("alpha beta gamma\n"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		rp, err := NewReplacer("test-deterministic.txt", WithDeterministic(mtime))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewStringMapping("beta", "delta"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewStringMapping("gamma", "epsilon"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := rp.Replace(); err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = rp.Config.File.Close()
+		info, err := os.Stat("test-deterministic.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !info.ModTime().Equal(mtime) {
+			t.Fatal(fmt.Errorf("modification time is %v, not %v", info.ModTime(), mtime))
+		}
+		content, err := ioutil.ReadFile("test-deterministic.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		outputs = append(outputs, content)
+	}
+	if string(outputs[0]) != "alpha delta epsilon\n" || !bytes.Equal(outputs[0], outputs[1]) {
+		t.Fatal(fmt.Errorf("unexpected outputs %q", outputs))
+	}
+	// the codec draws a random nonce, so the self-check catches it and the file is left alone
+	codec := ctrCodec{key: bytes.Repeat([]byte{7}, 32)}
+	var buf bytes.Buffer
+	w, err := codec.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := io.WriteString(w, "alpha beta\n"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ioutil.WriteFile("test-deterministic.txt", buf.Bytes(), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	rp, err := NewReplacer("test-deterministic.txt", WithCodec(codec), WithDeterministic(time.Time{}))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer rp.Config.File.Close()
+	if err := rp.NewStringMapping("beta", "delta"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := rp.Replace(); !errors.Is(err, ErrNondeterministic) {
+		t.Fatal(fmt.Errorf("expected ErrNondeterministic, got %v", err))
+	}
+	content, err := ioutil.ReadFile("test-deterministic.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(content, buf.Bytes()) {
+		t.Fatal(fmt.Errorf("file was changed by a failed self-check"))
+	}
+	if matches, _ := filepath.Glob("tmp-gosed-*"); len(matches) > 0 {
+		t.Fatal(fmt.Errorf("temporary files left behind: %v", matches))
+	}
+}
+
+func TestRegexMapping(t *testing.T) {
+	defer Cleanup()
+	for _, chained := range []bool{false, true} {
+		if err := ioutil.WriteFile("test-regex.txt", []byte("version = 1.2.3\nname: gosed\nversion 4.5.6"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		rp, err := NewReplacer("test-regex.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewRegexMapping(`^version = (\d+)\.(\d+)\.\d+$`, []byte("version = $1.$2.0")); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewRegexMapping(`(?P<key>\w+): (\w+)`, []byte("${key}=$2")); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewStringMapping("gosed", "sed"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if chained {
+			_, err = rp.ReplaceChained()
+		} else {
+			_, err = rp.Replace()
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = rp.Config.File.Close()
+		content, err := ioutil.ReadFile("test-regex.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if expected := "version = 1.2.0\nname=sed\nversion 4.5.6"; string(content) != expected {
+			t.Fatal(fmt.Errorf("expected %q, got %q", expected, content))
+		}
+	}
+	rp, err := NewReplacer("test-regex.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer rp.Config.File.Close()
+	if err := rp.NewRegexMapping(`(unclosed`, nil); err == nil {
+		t.Fatal(fmt.Errorf("invalid pattern was accepted"))
+	}
+}
+
+func TestLineOperations(t *testing.T) {
+	defer Cleanup()
+	if err := ioutil.WriteFile("test-line-ops.txt", []byte("[main]\n# debug\nlevel=1\nmode=fast"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	rp, err := NewReplacer("test-line-ops.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer rp.Config.File.Close()
+	if err := rp.DeleteLinesMatching(`^#`); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := rp.InsertBefore(`^\[main\]$`, []byte("; generated")); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := rp.AppendAfter(`^\[main\]$`, []byte("name=gosed")); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := rp.ChangeLines(`^level=`, []byte("level=2")); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := rp.AppendAfter(`^mode=`, []byte("color=auto")); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := rp.NewStringMapping("gosed", "sed"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := rp.Replace(); err != nil {
+		t.Fatal(err.Error())
+	}
+	content, err := ioutil.ReadFile("test-line-ops.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if expected := "; generated\n[main]\nname=sed\nlevel=2\nmode=fast\ncolor=auto"; string(content) != expected {
+		t.Fatal(fmt.Errorf("expected %q, got %q", expected, content))
+	}
+}
+
+func TestReplaceContext(t *testing.T) {
+	defer Cleanup()
+	original := bytes.Repeat([]byte("alpha beta\n"), 100000)
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+	for i, tc := range []struct {
+		ctx     context.Context
+		chained bool
+		err     error
+	}{
+		{cancelled, false, context.Canceled},
+		{cancelled, true, context.Canceled},
+		{expired, false, context.DeadlineExceeded},
+		{expired, true, context.DeadlineExceeded},
+	} {
+		if err := ioutil.WriteFile("test-context.txt", original, 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		rp, err := NewReplacer("test-context.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewStringMapping("beta", "gamma"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if tc.chained {
+			_, err = rp.ReplaceChainedContext(tc.ctx)
+		} else {
+			_, err = rp.ReplaceContext(tc.ctx)
+		}
+		if !errors.Is(err, tc.err) {
+			t.Fatal(fmt.Errorf("case %d: expected %v, got %v", i, tc.err, err))
+		}
+		content, err := ioutil.ReadFile("test-context.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !bytes.Equal(content, original) {
+			t.Fatal(fmt.Errorf("case %d: interrupted replace changed the file", i))
+		}
+		if matches, _ := filepath.Glob("tmp-gosed-*"); len(matches) > 0 {
+			t.Fatal(fmt.Errorf("case %d: temporary files left behind: %v", i, matches))
+		}
+		// the context only applies to that replace
+		if _, err := rp.Replace(); err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = rp.Config.File.Close()
+	}
+}
+
+func TestStats(t *testing.T) {
+	defer Cleanup()
+	for _, chained := range []bool{false, true} {
+		if err := ioutil.WriteFile("test-stats.txt", []byte("red green red\nblue red\n"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		rp, err := NewReplacer("test-stats.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if stats := rp.Stats(); stats.Mappings != nil {
+			t.Fatal(fmt.Errorf("stats before any replace: %+v", stats))
+		}
+		if err := rp.NewStringMapping("red", "orange"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewStringMapping("purple", "violet"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewRegexMapping(`b(l)ue`, []byte("c${1}ear")); err != nil {
+			t.Fatal(err.Error())
+		}
+		if chained {
+			_, err = rp.ReplaceChained()
+		} else {
+			_, err = rp.Replace()
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = rp.Config.File.Close()
+		stats := rp.Stats()
+		if stats.BytesRead != 23 || stats.BytesWritten != 33 || len(stats.Mappings) != 3 {
+			t.Fatal(fmt.Errorf("unexpected stats %+v", stats))
+		}
+		for i, expected := range []struct {
+			key         string
+			occurrences int
+			read        int64
+			written     int64
+		}{
+			{"red", 3, 23, 32},
+			{"purple", 0, 32, 32},
+			{`b(l)ue`, 1, 32, 33},
+		} {
+			m := stats.Mappings[i]
+			if string(m.Key) != expected.key || m.Occurrences != expected.occurrences || m.BytesRead != expected.read || m.BytesWritten != expected.written {
+				t.Fatal(fmt.Errorf("unexpected stats of mapping %d: %+v", i, m))
+			}
+		}
+	}
+}
+
+func TestPreview(t *testing.T) {
+	defer Cleanup()
+	var lines []string
+	for i := 1; i <= 20; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	original := strings.Join(lines, "\n") + "\nold tail"
+	if err := ioutil.WriteFile("test-preview.txt", []byte(original), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	rp, err := NewReplacer("test-preview.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer rp.Config.File.Close()
+	if err := rp.NewRegexMapping(`^line 2$`, []byte("line two")); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := rp.DeleteLinesMatching(`^line 5$`); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := rp.AppendAfter(`^line 15$`, []byte("line 15.5")); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := rp.NewStringMapping("old tail", "new tail"); err != nil {
+		t.Fatal(err.Error())
+	}
+	var out bytes.Buffer
+	result, err := rp.Preview(&out)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	content, err := ioutil.ReadFile("test-preview.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(content) != original {
+		t.Fatal(fmt.Errorf("preview changed the file"))
+	}
+	expected := `@@ -1,8 +1,7 @@
+ line 1
+-line 2
++line two
+ line 3
+ line 4
+-line 5
+ line 6
+ line 7
+ line 8
+@@ -13,9 +12,10 @@
+ line 13
+ line 14
+ line 15
++line 15.5
+ line 16
+ line 17
+ line 18
+ line 19
+ line 20
+-old tail
+\ No newline at end of file
++new tail
+\ No newline at end of file
+`
+	if diff := result.String(); diff != expected {
+		t.Fatal(fmt.Errorf("unexpected diff:\n%s", diff))
+	}
+	if result.Stats.Mappings[1].Occurrences != 1 || result.Stats.BytesWritten != int64(out.Len()) {
+		t.Fatal(fmt.Errorf("unexpected stats %+v", result.Stats))
+	}
+	// the mappings are still registered, and the replace writes what the preview showed
+	if _, err := rp.ReplaceChained(); err != nil {
+		t.Fatal(err.Error())
+	}
+	content, err = ioutil.ReadFile("test-preview.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(content, out.Bytes()) {
+		t.Fatal(fmt.Errorf("replace wrote %q, preview showed %q", content, out.Bytes()))
+	}
+}
+
+func TestDirReplacer(t *testing.T) {
+	defer os.RemoveAll("test-dir")
+	files := map[string]string{
+		"test-dir/main.go":              "package main // old\n",
+		"test-dir/README.md":            "old docs\n",
+		"test-dir/pkg/util.go":          "var x = old + old\n",
+		"test-dir/vendor/dep/dep.go":    "old vendored\n",
+		"test-dir/pkg/testdata/fake.go": "old fixture\n",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	dr := NewDirReplacer("test-dir")
+	dr.Patterns = []string{"*.go", "!vendor/**", "!**/testdata"}
+	dr.Workers = 2
+	if err := dr.NewStringMapping("old", "new"); err != nil {
+		t.Fatal(err.Error())
+	}
+	report, err := dr.Replace()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(report.Files) != 2 {
+		t.Fatal(fmt.Errorf("unexpected report %+v", report.Files))
+	}
+	for _, result := range report.Files {
+		if result.Status != FileReplaced {
+			t.Fatal(fmt.Errorf("unexpected result %+v", result))
+		}
+	}
+	if report.Stats.Mappings[0].Occurrences != 3 || report.Stats.BytesRead != 38 {
+		t.Fatal(fmt.Errorf("unexpected stats %+v", report.Stats))
+	}
+	expected := map[string]string{
+		"test-dir/main.go":              "package main // new\n",
+		"test-dir/README.md":            "old docs\n",
+		"test-dir/pkg/util.go":          "var x = new + new\n",
+		"test-dir/vendor/dep/dep.go":    "old vendored\n",
+		"test-dir/pkg/testdata/fake.go": "old fixture\n",
+	}
+	for name, content := range expected {
+		actual, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(actual) != content {
+			t.Fatal(fmt.Errorf("%s: expected %q, got %q", name, content, actual))
+		}
+	}
+}
+
+func TestStreams(t *testing.T) {
+	mappings := []Mapping{
+		{Old: []byte("hello"), New: []byte("goodbye")},
+		{Old: []byte("WORLD"), New: []byte("moon"), Options: []MappingOption{MatchCaseFold("")}},
+	}
+	out, err := ioutil.ReadAll(NewReader(strings.NewReader("hello world, hello World"), mappings...))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(out) != "goodbye moon, goodbye moon" {
+		t.Fatal(fmt.Errorf("unexpected reader output %q", out))
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	w := NewWriter(gz, mappings...)
+	for _, chunk := range []string{"hel", "lo wor", "ld\n"} {
+		if _, err := io.WriteString(w, chunk); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	gr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if out, err = ioutil.ReadAll(gr); err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(out) != "goodbye moon\n" {
+		t.Fatal(fmt.Errorf("unexpected writer output %q", out))
+	}
+
+	// empty keys fail the reads and writes instead of panicking
+	empty := append(mappings, Mapping{Old: nil, New: []byte("x")})
+	if _, err := ioutil.ReadAll(NewReader(strings.NewReader("hello"), empty...)); err != ErrEmptyKey {
+		t.Fatal(fmt.Errorf("unexpected reader error %v", err))
+	}
+	w = NewWriter(ioutil.Discard, empty...)
+	if _, err := io.WriteString(w, "hello"); err != ErrEmptyKey {
+		t.Fatal(fmt.Errorf("unexpected write error %v", err))
+	}
+	if err := w.Close(); err != ErrEmptyKey {
+		t.Fatal(fmt.Errorf("unexpected close error %v", err))
+	}
+}
+
+func TestPreserveMetadata(t *testing.T) {
+	defer Cleanup()
+	dir := t.TempDir()
+	name := filepath.Join(dir, "test-metadata.txt")
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	for _, preserve := range []bool{false, true} {
+		if err := ioutil.WriteFile(name, []byte("old content\n"), 0640); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err.Error())
+		}
+		var opts []Option
+		if preserve {
+			opts = append(opts, WithPreserveMetadata())
+		}
+		rp, err := NewReplacer(name, opts...)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewStringMapping("old", "new"); err != nil {
+			t.Fatal(err.Error())
+		}
+		// the temporary file is created next to the file, not in the working directory
+		if _, err := rp.ReplaceChained(); err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = rp.Config.File.Close()
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if info.Mode().Perm() != 0640 {
+			t.Fatal(fmt.Errorf("mode is %v", info.Mode()))
+		}
+		if info.ModTime().Equal(mtime) != preserve {
+			t.Fatal(fmt.Errorf("modification time is %v with preservation %v", info.ModTime(), preserve))
+		}
+		if matches, _ := filepath.Glob(filepath.Join(dir, "tmp-gosed-*")); len(matches) > 0 {
+			t.Fatal(fmt.Errorf("temporary files left behind: %v", matches))
+		}
+	}
+}
+
+func TestBackup(t *testing.T) {
+	defer Cleanup()
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "bak"), 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	name := filepath.Join(dir, "test-backup.txt")
+	for _, tc := range []struct {
+		suffix string
+		backup string
+		opts   []Option
+	}{
+		{".bak", name + ".bak", nil},
+		{"bak/*.orig", filepath.Join(dir, "bak", "test-backup.txt.orig"), nil},
+		{".bak", name + ".bak", []Option{WithPatchInPlace()}},
+		{".bak", name + ".bak", []Option{WithInodePreservation()}},
+	} {
+		if err := ioutil.WriteFile(name, []byte("old content\n"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := ioutil.WriteFile(tc.backup, []byte("stale backup\n"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		rp, err := NewReplacer(name, append(tc.opts, WithBackup(tc.suffix))...)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewStringMapping("old", "new"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := rp.Replace(); err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = rp.Config.File.Close()
+		for file, expected := range map[string]string{name: "new content\n", tc.backup: "old content\n"} {
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if string(content) != expected {
+				t.Fatal(fmt.Errorf("%s: expected %q, got %q", file, expected, content))
+			}
+		}
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	defer Cleanup()
+	original := strings.Repeat("Content-Type CONTENT-TYPE content-type STRASSE straße ", 500)
+	expected := strings.Repeat("Media-Class! Media-Class! Media-Class! STRASSE straße ", 500)
+	for _, patch := range []bool{false, true} {
+		if err := ioutil.WriteFile("test-case-insensitive.txt", []byte(original), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		var opts []Option
+		if patch {
+			opts = append(opts, WithPatchInPlace())
+		}
+		rp, err := NewReplacer("test-case-insensitive.txt", opts...)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewMappingWithOptions([]byte("content-type"), []byte("Media-Class!"), MatchCaseInsensitive()); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewMappingWithOptions([]byte("strasse"), []byte("avenue!"), MatchCaseInsensitive()); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := rp.Replace(); err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = rp.Config.File.Close()
+		content, err := ioutil.ReadFile("test-case-insensitive.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		expected := strings.ReplaceAll(expected, "STRASSE", "avenue!")
+		if string(content) != expected {
+			t.Fatal(fmt.Errorf("unexpected content %q", content[:64]))
+		}
+	}
+}
+
+func TestWholeWord(t *testing.T) {
+	defer Cleanup()
+	original := strings.Repeat("cat catalog bobcat (cat) Cat_x CAT chat-cat é-cat écat\n", 300)
+	expected := strings.Repeat("dog catalog bobcat (dog) Cat_x dog chat-dog é-dog écat\n", 300)
+	for _, chained := range []bool{false, true} {
+		if err := ioutil.WriteFile("test-whole-word.txt", []byte(original), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		rp, err := NewReplacer("test-whole-word.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewMappingWithOptions([]byte("cat"), []byte("dog"), MatchWholeWord(), MatchCaseInsensitive()); err != nil {
+			t.Fatal(err.Error())
+		}
+		if chained {
+			_, err = rp.ReplaceChained()
+		} else {
+			_, err = rp.Replace()
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = rp.Config.File.Close()
+		content, err := ioutil.ReadFile("test-whole-word.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(content) != expected {
+			t.Fatal(fmt.Errorf("unexpected content %q", content[:120]))
+		}
+	}
+}
+
+func TestOccurrences(t *testing.T) {
+	defer Cleanup()
+	for _, tc := range []struct {
+		opts     []MappingOption
+		expected string
+	}{
+		{[]MappingOption{Limit(3)}, "XX X aa aa\naa aa aa\n"},
+		{[]MappingOption{Occurrence(2)}, "aaX aa aa aa\naa aa aa\n"},
+		{[]MappingOption{FirstPerLine()}, "Xaa aa aa aa\nX aa aa\n"},
+		{[]MappingOption{FirstPerLine(), Limit(1)}, "Xaa aa aa aa\naa aa aa\n"},
+		{[]MappingOption{Occurrence(5), MatchWholeWord()}, "aaaa aa aa aa\naa X aa\n"},
+	} {
+		if err := ioutil.WriteFile("test-occurrences.txt", []byte("aaaa aa aa aa\naa aa aa\n"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		rp, err := NewReplacer("test-occurrences.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewMappingWithOptions([]byte("aa"), []byte("X"), tc.opts...); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := rp.Replace(); err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = rp.Config.File.Close()
+		content, err := ioutil.ReadFile("test-occurrences.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(content) != tc.expected {
+			t.Fatal(fmt.Errorf("expected %q, got %q", tc.expected, content))
+		}
+	}
+	// lines are tracked across the buffers of the reader
+	if err := ioutil.WriteFile("test-occurrences.txt", []byte(strings.Repeat("key key\n", 5000)), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	rp, err := NewReplacer("test-occurrences.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer rp.Config.File.Close()
+	if err := rp.NewMappingWithOptions([]byte("key"), []byte("value"), FirstPerLine()); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := rp.ReplaceChained(); err != nil {
+		t.Fatal(err.Error())
+	}
+	content, err := ioutil.ReadFile("test-occurrences.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(content) != strings.Repeat("value key\n", 5000) {
+		t.Fatal(fmt.Errorf("unexpected content"))
+	}
+}
+
+func TestAddresses(t *testing.T) {
+	defer Cleanup()
+	original := "a=1\n[server]\na=2\na=3\n[client]\na=4\n[server]\na=5"
+	for _, tc := range []struct {
+		opts     []MappingOption
+		expected string
+	}{
+		{[]MappingOption{InLines(3, 4)}, "a=1\n[server]\nb=2\nb=3\n[client]\na=4\n[server]\na=5"},
+		{[]MappingOption{InLines(6, 0)}, "a=1\n[server]\na=2\na=3\n[client]\nb=4\n[server]\nb=5"},
+		{[]MappingOption{Between(`^\[server\]$`, `^\[`)}, "a=1\n[server]\nb=2\nb=3\n[client]\na=4\n[server]\nb=5"},
+		{[]MappingOption{Between(`^\[server\]$`, `^\[`), InLines(1, 5), Limit(1)}, "a=1\n[server]\nb=2\na=3\n[client]\na=4\n[server]\na=5"},
+	} {
+		if err := ioutil.WriteFile("test-addresses.txt", []byte(original), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		rp, err := NewReplacer("test-addresses.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewMappingWithOptions([]byte("a="), []byte("b="), tc.opts...); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := rp.Replace(); err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = rp.Config.File.Close()
+		content, err := ioutil.ReadFile("test-addresses.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(content) != tc.expected {
+			t.Fatal(fmt.Errorf("expected %q, got %q", tc.expected, content))
+		}
+		if occurrences := rp.Stats().Mappings[0].Occurrences; occurrences != strings.Count(tc.expected, "b=") {
+			t.Fatal(fmt.Errorf("unexpected occurrences %d", occurrences))
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	defer Cleanup()
+	original := bytes.Repeat([]byte("foo bar baz\n"), 300000)
+	if err := ioutil.WriteFile("test-progress.txt", original, 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	var processed, totals []int64
+	rp, err := NewReplacer("test-progress.txt", WithProgress(func(bytesProcessed, totalBytes int64) {
+		processed = append(processed, bytesProcessed)
+		totals = append(totals, totalBytes)
+	}))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := rp.NewStringMapping("bar", "qux"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := rp.ReplaceChained(); err != nil {
+		t.Fatal(err.Error())
+	}
+	_ = rp.Config.File.Close()
+	if len(processed) < 3 {
+		t.Fatal(fmt.Errorf("expected periodic reports, got %v", processed))
+	}
+	for i := range processed {
+		if totals[i] != int64(len(original)) {
+			t.Fatal(fmt.Errorf("unexpected total %d", totals[i]))
+		}
+		if i > 0 && processed[i] < processed[i-1] {
+			t.Fatal(fmt.Errorf("progress went back from %d to %d", processed[i-1], processed[i]))
+		}
+	}
+	if last := processed[len(processed)-1]; last != int64(len(original)) {
+		t.Fatal(fmt.Errorf("expected a final report of %d, got %d", len(original), last))
+	}
+}
+
+func TestParallel(t *testing.T) {
+	defer Cleanup()
+	var sb strings.Builder
+	for i := 0; i < 20000; i++ {
+		_, _ = fmt.Fprintf(&sb, "line %d: foo bar foobar fooBar\tbaz\n", i)
+	}
+	original := []byte(sb.String())
+	for _, tc := range []struct {
+		key, value string
+		opts       []MappingOption
+	}{
+		{"foo", "qux", nil},
+		{"bar", "foo bar", []MappingOption{MatchWholeWord()}},
+		{"foo_bar", "baz", []MappingOption{MatchIdentifierVariants()}},
+		// keys with a line feed make the chunks end with a NUL, which this file lacks, so it is a single chunk
+		{"baz\nrow", "end\nrow", nil},
+	} {
+		var results [2][]byte
+		var occurrences [2]int
+		for i, opts := range [][]Option{nil, {WithParallel(4, 4096)}} {
+			if err := ioutil.WriteFile("test-parallel.txt", original, 0644); err != nil {
+				t.Fatal(err.Error())
+			}
+			rp, err := NewReplacer("test-parallel.txt", opts...)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if err := rp.NewStringMapping("line", "row"); err != nil {
+				t.Fatal(err.Error())
+			}
+			if err := rp.NewMappingWithOptions([]byte(tc.key), []byte(tc.value), tc.opts...); err != nil {
+				t.Fatal(err.Error())
+			}
+			if sep, ok := rp.Config.chunkSeparator(); ok != (i == 1) || ok && sep != '\n' && !strings.Contains(tc.key, "\n") {
+				t.Fatal(fmt.Errorf("unexpected chunk separator %q for %q", sep, tc.key))
+			}
+			if _, err := rp.Replace(); err != nil {
+				t.Fatal(err.Error())
+			}
+			_ = rp.Config.File.Close()
+			if results[i], err = ioutil.ReadFile("test-parallel.txt"); err != nil {
+				t.Fatal(err.Error())
+			}
+			occurrences[i] = rp.Stats().Mappings[1].Occurrences
+		}
+		if !bytes.Equal(results[0], results[1]) {
+			t.Fatal(fmt.Errorf("parallel replace of %q differs", tc.key))
+		}
+		if occurrences[0] != occurrences[1] {
+			t.Fatal(fmt.Errorf("parallel replace of %q counted %d occurrences instead of %d", tc.key, occurrences[1], occurrences[0]))
+		}
+	}
+}
+
+func TestTx(t *testing.T) {
+	defer Cleanup()
+	names := []string{"test-tx-1.txt", "test-tx-2.txt"}
+	expect := func(content string) {
+		t.Helper()
+		for _, name := range names {
+			got, err := ioutil.ReadFile(name)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if string(got) != content {
+				t.Fatal(fmt.Errorf("%s: expected %q, got %q", name, content, got))
+			}
+		}
+		if staged, _ := filepath.Glob("tmp-gosed-*"); len(staged) > 0 {
+			t.Fatal(fmt.Errorf("temporary files left behind: %v", staged))
+		}
+	}
+	for _, name := range names {
+		if err := ioutil.WriteFile(name, []byte("host=db01\n"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	replace := func(tx *Tx, files []string) {
+		t.Helper()
+		batch := NewBatch(files, WithTx(tx))
+		if err := batch.NewStringMapping("db01", "db02"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := batch.Replace(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	tx := NewTx()
+	replace(tx, append([]string{"test-tx-missing.txt"}, names...))
+	if err := tx.Apply(); !errors.Is(err, ErrTxAborted) {
+		t.Fatal(fmt.Errorf("expected ErrTxAborted, got %v", err))
+	}
+	expect("host=db01\n")
+	if err := tx.Rollback(); err != ErrTxDone {
+		t.Fatal(fmt.Errorf("expected ErrTxDone, got %v", err))
+	}
+
+	tx = NewTx()
+	replace(tx, names)
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err.Error())
+	}
+	expect("host=db01\n")
+
+	tx = NewTx()
+	replace(tx, names)
+	got, err := ioutil.ReadFile("test-tx-1.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(got) != "host=db01\n" {
+		t.Fatal(fmt.Errorf("file replaced before the transaction was applied: %q", got))
+	}
+	if err := tx.Apply(); err != nil {
+		t.Fatal(err.Error())
+	}
+	expect("host=db02\n")
+}
+
+func TestExpressions(t *testing.T) {
+	defer Cleanup()
+	original := "foo foo foo\n/usr/lib (a+b) Foo\nx=1, y=22\n"
+	for _, tc := range []struct {
+		expr, expected string
+	}{
+		{"s/foo/bar/", "bar foo foo\n/usr/lib (a+b) Foo\nx=1, y=22\n"},
+		{"s/foo/bar/g", "bar bar bar\n/usr/lib (a+b) Foo\nx=1, y=22\n"},
+		{"s/foo/bar/2", "foo bar foo\n/usr/lib (a+b) Foo\nx=1, y=22\n"},
+		{"s/foo/bar/2g", "foo bar bar\n/usr/lib (a+b) Foo\nx=1, y=22\n"},
+		{"s/foo/[&]/gI", "[foo] [foo] [foo]\n/usr/lib (a+b) [Foo]\nx=1, y=22\n"},
+		{"s|/usr|/opt|", "foo foo foo\n/opt/lib (a+b) Foo\nx=1, y=22\n"},
+		{`s/\/usr\/lib/\/lib/`, "foo foo foo\n/lib (a+b) Foo\nx=1, y=22\n"},
+		{"s/(a+b)/(c)/", "foo foo foo\n/usr/lib (c) Foo\nx=1, y=22\n"},
+		{`s/\([a-z]\)=\([0-9]\+\)/\2=\1/g`, "foo foo foo\n/usr/lib (a+b) Foo\n1=x, 22=y\n"},
+		{`s/^\(.*\)$/> \1/`, "> foo foo foo\n> /usr/lib (a+b) Foo\n> x=1, y=22\n"},
+		{`s/o\{2\}/0/g`, "f0 f0 f0\n/usr/lib (a+b) F0\nx=1, y=22\n"},
+		{`s/foo\|lib/$&/2`, "foo $foo foo\n/usr/lib (a+b) Foo\nx=1, y=22\n"},
+		{`s/, /\n/`, "foo foo foo\n/usr/lib (a+b) Foo\nx=1\ny=22\n"},
+	} {
+		if err := ioutil.WriteFile("test-expressions.txt", []byte(original), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		rp, err := NewReplacer("test-expressions.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.AddExpression(tc.expr); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := rp.Replace(); err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = rp.Config.File.Close()
+		content, err := ioutil.ReadFile("test-expressions.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(content) != tc.expected {
+			t.Fatal(fmt.Errorf("%s: expected %q, got %q", tc.expr, tc.expected, content))
+		}
+	}
+	if err := ioutil.WriteFile("test-expressions.txt", []byte(original), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	rp, err := NewReplacer("test-expressions.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func(rp *Replacer) {
+		_ = rp.Config.File.Close()
+	}(rp)
+	for _, expr := range []string{"y/abc/xyz/", "s/foo/bar", "s/foo/bar/p", "s/foo/\\1/", `s/\(a\)\1/b/`, "s/[a-z/b/"} {
+		if err := rp.AddExpression(expr); !errors.Is(err, ErrInvalidExpression) {
+			t.Fatal(fmt.Errorf("%s: expected ErrInvalidExpression, got %v", expr, err))
+		}
+	}
+}
+
+func TestDetectedCompression(t *testing.T) {
+	defer Cleanup()
+	original := []byte(strings.Repeat("host=db01 level=info\n", 100))
+	for _, c := range []Compression{Gzip, Bzip2, Zstd, nil} {
+		var stored bytes.Buffer
+		if c == nil {
+			stored.Write(original)
+		} else {
+			w, err := c.NewWriter(&stored)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if _, err := w.Write(original); err != nil {
+				t.Fatal(err.Error())
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		if err := ioutil.WriteFile("test-compressed.txt", stored.Bytes(), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		rp, err := NewReplacer("test-compressed.txt", WithDetectedCompression())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewStringMapping("db01", "db02"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := rp.Replace(); err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = rp.Config.File.Close()
+		f, err := os.Open("test-compressed.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		var r io.ReadCloser = f
+		if c != nil {
+			if r, err = c.NewReader(f); err != nil {
+				_ = f.Close()
+				t.Fatal(fmt.Errorf("%T: result not recompressed: %v", c, err))
+			}
+		}
+		content, err := ioutil.ReadAll(r)
+		_ = r.Close()
+		_ = f.Close()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if expected := bytes.ReplaceAll(original, []byte("db01"), []byte("db02")); !bytes.Equal(content, expected) {
+			t.Fatal(fmt.Errorf("%T: got %q", c, content))
+		}
+	}
+}
+
+func TestFuncMapping(t *testing.T) {
+	defer Cleanup()
+	var input, expected strings.Builder
+	for i := 0; i < 3000; i++ {
+		fmt.Fprintf(&input, "id=ID cat catalog\n")
+		// the replacements of every third match outgrow the buffer of the reader
+		fmt.Fprintf(&expected, "id=%d%s dog catalog\n", i, strings.Repeat("#", 5000*(i%3/2)))
+	}
+	if err := ioutil.WriteFile("test-func.txt", []byte(input.String()), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	rp, err := NewReplacer("test-func.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func() {
+		_ = rp.Config.File.Close()
+	}()
+	if err := rp.NewFuncMapping([]byte("ID"), func(match []byte, n int) []byte {
+		return []byte(fmt.Sprintf("%d%s", n, strings.Repeat("#", 5000*(n%3/2))))
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+	calls := 0
+	if err := rp.NewFuncMapping([]byte("cat"), func(match []byte, n int) []byte {
+		calls++
+		return []byte("dog")
+	}, MatchWholeWord()); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := rp.NewFuncMapping(nil, func([]byte, int) []byte { return nil }); err == nil {
+		t.Fatal("expected an error for an empty key")
+	}
+	if _, err := rp.ReplaceChained(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if content, _ := ioutil.ReadFile("test-func.txt"); string(content) != expected.String() {
+		t.Fatal(fmt.Errorf("unexpected result, %d bytes instead of %d", len(content), expected.Len()))
+	}
+	// rejected matches are not handed to the function
+	if calls != 3000 {
+		t.Fatal(fmt.Errorf("function called %d times", calls))
+	}
+}
+
+func TestSkipBinary(t *testing.T) {
+	defer os.RemoveAll("test-binary")
+	png := append([]byte("\x89PNG\r\n\x1a\n"), "old"...)
+	files := map[string][]byte{
+		"test-binary/a.txt":     []byte("old text\n"),
+		"test-binary/b.png":     png,
+		"test-binary/c.o":       []byte("old\x00\x01\x02"),
+		"test-binary/d.txt":     append([]byte("\xff\xfe"), "o\x00l\x00d\x00"...),
+		"test-binary/e.bin":     []byte("old\x00forced"),
+		"test-binary/f.txt":     append([]byte(strings.Repeat("text ", 200)), "\x00old"...),
+		"test-binary/empty.txt": {},
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := ioutil.WriteFile(name, content, 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	dr := NewDirReplacer("test-binary")
+	dr.SkipBinary = true
+	dr.BinaryFunc = func(path string, head []byte, binary bool) bool {
+		return binary && filepath.Ext(path) != ".bin"
+	}
+	if err := dr.NewStringMapping("old", "new"); err != nil {
+		t.Fatal(err.Error())
+	}
+	report, err := dr.Replace()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := []FileStatus{FileReplaced, FileBinary, FileBinary, FileReplaced, FileReplaced, FileReplaced, FileBinary}
+	for i, result := range report.Files {
+		if result.Status != expected[i] {
+			t.Fatal(fmt.Errorf("%s: %v instead of %v", result.Path, result.Status, expected[i]))
+		}
+	}
+	if content, _ := ioutil.ReadFile("test-binary/b.png"); !bytes.Equal(content, png) {
+		t.Fatal("binary file replaced")
+	}
+	if content, _ := ioutil.ReadFile("test-binary/e.bin"); string(content) != "new\x00forced" {
+		t.Fatal(fmt.Errorf("overridden file not replaced: %q", content))
+	}
+}
+
+func TestSparseFiles(t *testing.T) {
+	defer Cleanup()
+	const size = 64 << 20
+	f, err := os.Create("test-sparse.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := f.WriteString("disk=old\n"); err == nil {
+		_, err = f.WriteAt([]byte("disk=old\n"), size-9)
+	}
+	_ = f.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	info, err := os.Stat("test-sparse.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if allocated, ok := allocatedSize(info); !ok || allocated >= size {
+		t.Skip("sparse files are not supported here")
+	}
+	for _, opts := range [][]Option{nil, {WithPreallocation()}, {WithInodePreservation(), WithBackup(".bak")}} {
+		rp, err := NewReplacer("test-sparse.txt", opts...)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewStringMapping("=old", "=new"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewStringMapping("=new", "=old"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := rp.Replace(); err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = rp.Config.File.Close()
+		for _, name := range []string{"test-sparse.txt", "test-sparse.txt.bak"} {
+			info, err := os.Stat(name)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if allocated, _ := allocatedSize(info); info.Size() != size || allocated >= size/2 {
+				t.Fatal(fmt.Errorf("%s: %d bytes allocated for %d", name, allocated, info.Size()))
+			}
+		}
+	}
+	_ = os.Remove("test-sparse.txt.bak")
+
+	// a preallocated copy is cut to the size of its content
+	if err := ioutil.WriteFile("test-preallocated.txt", []byte(strings.Repeat("a long key\n", 1000)), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	rp, err := NewReplacer("test-preallocated.txt", WithPreallocation())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func() {
+		_ = rp.Config.File.Close()
+	}()
+	if err := rp.NewStringMapping("a long key", "k"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := rp.ReplaceChained(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if content, _ := ioutil.ReadFile("test-preallocated.txt"); string(content) != strings.Repeat("k\n", 1000) {
+		t.Fatal(fmt.Errorf("unexpected preallocated result of %d bytes", len(content)))
+	}
+}
+
+func TestFileLock(t *testing.T) {
+	defer Cleanup()
+	if err := ioutil.WriteFile("test-lock.txt", []byte("owner=old\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	rp, err := NewReplacer("test-lock.txt", WithFileLock())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func() {
+		_ = rp.Config.File.Close()
+	}()
+	if err := rp.NewStringMapping("old", "new"); err != nil {
+		t.Fatal(err.Error())
+	}
+	unlock, err := lockFile("test-lock.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	done := make(chan error)
+	go func() {
+		_, err := rp.ReplaceChained()
+		done <- err
+	}()
+	switch runtime.GOOS {
+	case "darwin", "dragonfly", "freebsd", "linux", "netbsd", "openbsd":
+		select {
+		case <-done:
+			t.Fatal("file replaced while locked")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err.Error())
+	}
+	// the handle of the replacer is on the replaced file
+	content, err := ioutil.ReadAll(rp.Config.File)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(content) != "owner=new\n" {
+		t.Fatal(fmt.Errorf("unexpected content %q", content))
+	}
+}
+
+func TestLoadMappings(t *testing.T) {
+	defer Cleanup()
+	for _, tc := range []struct {
+		format MappingFormat
+		data   string
+	}{
+		{MappingJSON, `{"db01": "db02", "<user>": "admin", "port": "8080"}`},
+		{MappingYAML, "db01: db02\n\"<user>\": admin\nport: 8080\n"},
+		{MappingCSV, "db01,db02\n<user>,admin\nport,\"8080\"\n"},
+	} {
+		if err := ioutil.WriteFile("test-mappings.txt", []byte("db01 <user> port\n"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		rp, err := NewReplacer("test-mappings.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.LoadMappings(strings.NewReader(tc.data), tc.format); err != nil {
+			t.Fatal(fmt.Errorf("%v: %v", tc.format, err))
+		}
+		// the export reads back to the same mappings, in order
+		var exported bytes.Buffer
+		if err := rp.ExportMappings(&exported, tc.format); err != nil {
+			t.Fatal(err.Error())
+		}
+		reloaded, err := NewReplacer("test-mappings.txt")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := reloaded.LoadMappings(&exported, tc.format); err != nil {
+			t.Fatal(fmt.Errorf("%v: %v in %q", tc.format, err, exported.String()))
+		}
+		if !reflect.DeepEqual(reloaded.Config.Mappings, rp.Config.Mappings) {
+			t.Fatal(fmt.Errorf("%v: export %q does not read back", tc.format, exported.String()))
+		}
+		_ = reloaded.Config.File.Close()
+		if _, err := rp.Replace(); err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = rp.Config.File.Close()
+		if content, _ := ioutil.ReadFile("test-mappings.txt"); string(content) != "db02 admin 8080\n" {
+			t.Fatal(fmt.Errorf("%v: unexpected result %q", tc.format, content))
+		}
+	}
+
+	rp, err := NewReplacer("test-mappings.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func() {
+		_ = rp.Config.File.Close()
+	}()
+	for _, tc := range []struct {
+		format MappingFormat
+		data   string
+	}{
+		{MappingJSON, `["db01", "db02"]`},
+		{MappingJSON, `{"db01": 2}`},
+		{MappingYAML, "db01: [db02]\n"},
+		{MappingCSV, "db01,db02,db03\n"},
+	} {
+		if err := rp.LoadMappings(strings.NewReader(tc.data), tc.format); !errors.Is(err, ErrInvalidMappingFile) {
+			t.Fatal(fmt.Errorf("%v %q: expected ErrInvalidMappingFile, got %v", tc.format, tc.data, err))
+		}
+	}
+	if err := rp.LoadMappings(strings.NewReader("a,b\n,c\n"), MappingCSV); err == nil || len(rp.Config.Mappings.Keys) != 0 {
+		t.Fatal("expected an empty key to add no mapping")
+	}
+}
+
+func TestReplaceBytes(t *testing.T) {
+	src := []byte("host=db01 port=8080 host=db01\n")
+	out, stats, err := ReplaceBytes(src,
+		Mapping{Old: []byte("db01"), New: []byte("db02")},
+		Mapping{Old: []byte("host=db02"), New: []byte("h=db02"), Options: []MappingOption{Limit(1)}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(out) != "h=db02 port=8080 host=db02\n" || string(src) != "host=db01 port=8080 host=db01\n" {
+		t.Fatal(fmt.Errorf("unexpected result %q", out))
+	}
+	if stats.BytesRead != int64(len(src)) || stats.BytesWritten != int64(len(out)) || len(stats.Mappings) != 2 ||
+		stats.Mappings[0].Occurrences != 2 || stats.Mappings[1].Occurrences != 1 {
+		t.Fatal(fmt.Errorf("unexpected stats %+v", stats))
+	}
+	if s, _, err := ReplaceString("a.b.c", Mapping{Old: []byte("."), New: []byte("::")}); err != nil || s != "a::b::c" {
+		t.Fatal(fmt.Errorf("unexpected result %q: %v", s, err))
+	}
+	if _, _, err := ReplaceString("abc", Mapping{New: []byte("x")}); err == nil {
+		t.Fatal("expected an error for an empty key")
+	}
+}
+
+func TestGuards(t *testing.T) {
+	defer Cleanup()
+	if err := ioutil.WriteFile("test-guards.txt", []byte("[mysqld]\nport=3306\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	// inserting a line only if it is not there yet makes the patch idempotent
+	for run := 0; run < 2; run++ {
+		rp, err := NewReplacer("test-guards.txt", OnlyIfContains([]byte("[mysqld]")), SkipIfContains([]byte("max_connections=")))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.AppendAfter(`^\[mysqld\]$`, []byte("max_connections=100")); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := rp.ReplaceChained(); err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = rp.Config.File.Close()
+		if rp.Stats().Skipped != (run == 1) {
+			t.Fatal(fmt.Errorf("run %d: unexpected stats %+v", run, rp.Stats()))
+		}
+		if content, _ := ioutil.ReadFile("test-guards.txt"); string(content) != "[mysqld]\nmax_connections=100\nport=3306\n" {
+			t.Fatal(fmt.Errorf("run %d: unexpected result %q", run, content))
+		}
+	}
+
+	// a pattern cut by the chunks the guards are searched in
+	content := strings.Repeat("x", guardChunkSize-3) + "needle" + strings.Repeat("y", guardChunkSize)
+	if err := ioutil.WriteFile("test-guards.txt", []byte(content), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, tc := range []struct {
+		opt      Option
+		replaced bool
+	}{
+		{OnlyIfContains([]byte("needle")), true},
+		{OnlyIfContains([]byte("needles")), false},
+		{SkipIfContains([]byte("needle")), false},
+	} {
+		rp, err := NewReplacer("test-guards.txt", tc.opt)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewStringMapping("y", "y"); err != nil {
+			t.Fatal(err.Error())
+		}
+		preview, err := rp.Preview(nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := rp.Replace(); err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = rp.Config.File.Close()
+		if preview.Stats.Skipped == tc.replaced || rp.Stats().Skipped == tc.replaced {
+			t.Fatal(fmt.Errorf("replaced %v, expected %v", !rp.Stats().Skipped, tc.replaced))
+		}
+	}
+}
+
+// memFS is a WriteFS in memory, over an fstest.MapFS
+type memFS struct {
+	fstest.MapFS
+}
+
+func (m memFS) WriteFile(name string, r io.Reader, perm fs.FileMode) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.MapFS[name] = &fstest.MapFile{Data: data, Mode: perm}
+	return nil
+}
+
+func TestFSReplacer(t *testing.T) {
+	defer Cleanup()
+	// files of an in-memory filesystem are replaced in place
+	mem := memFS{fstest.MapFS{"conf/app.ini": {Data: []byte("host=localhost\nport=80\n"), Mode: 0600}}}
+	fr := NewFSReplacer(mem, OnlyIfContains([]byte("host=")))
+	if err := fr.NewStringMapping("localhost", "example.com"); err != nil {
+		t.Fatal(err.Error())
+	}
+	n, err := fr.Replace(context.Background(), "conf/app.ini")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if got := string(mem.MapFS["conf/app.ini"].Data); got != "host=example.com\nport=80\n" || n != len(got) {
+		t.Fatal(fmt.Errorf("unexpected result %q, %d bytes", got, n))
+	}
+	if mem.MapFS["conf/app.ini"].Mode != 0600 {
+		t.Fatal(fmt.Errorf("unexpected mode %v", mem.MapFS["conf/app.ini"].Mode))
+	}
+	if _, err := fr.Replace(context.Background(), "conf/missing.ini"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal(fmt.Errorf("unexpected error %v", err))
+	}
+
+	// files of a read-only filesystem are written to the target
+	dir := t.TempDir()
+	fr = NewFSReplacer(fstest.MapFS{"a.txt": {Data: []byte("hello world")}})
+	if err := fr.NewStringMapping("world", "gosed"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := fr.Replace(context.Background(), "a.txt"); err == nil {
+		t.Fatal(errors.New("replaced a read-only filesystem without a target"))
+	}
+	fr.Target = WritableDirFS(dir)
+	if _, err := fr.Replace(context.Background(), "a.txt"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(dir, "a.txt")); string(content) != "hello gosed" {
+		t.Fatal(fmt.Errorf("unexpected result %q", content))
+	}
+
+	// options acting on the file itself are rejected
+	fr.Options = []Option{WithBackup(".bak")}
+	if _, err := fr.Replace(context.Background(), "a.txt"); err != errFSFileOptions {
+		t.Fatal(fmt.Errorf("unexpected error %v", err))
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	defer Cleanup()
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "b.txt"), []byte("hello \xff"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	dr := NewDirReplacer(dir, WithUTF8Validation(UTF8Fail))
+	if err := dr.NewStringMapping("", "x"); !errors.Is(err, ErrEmptyKey) {
+		t.Fatal(fmt.Errorf("unexpected error %v", err))
+	}
+	if err := dr.NewStringMapping("hello", "world"); err != nil {
+		t.Fatal(err.Error())
+	}
+	report, err := dr.Replace()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var multi *MultiError
+	if !errors.As(report.Err(), &multi) {
+		t.Fatal(fmt.Errorf("unexpected error %v", report.Err()))
+	}
+	if len(multi.Succeeded) != 1 || filepath.Base(multi.Succeeded[0]) != "a.txt" ||
+		len(multi.Failed) != 1 || filepath.Base(multi.Failed[0].Path) != "b.txt" {
+		t.Fatal(fmt.Errorf("unexpected error %+v", multi))
+	}
+	var invalid *InvalidUTF8Error
+	if !errors.As(multi, &invalid) || invalid != multi.Failed[0].Err {
+		t.Fatal(fmt.Errorf("unexpected error %v", multi.Failed[0].Err))
+	}
+	if !errors.Is(multi, multi.Failed[0].Err) || errors.Is(multi, ErrEmptyKey) {
+		t.Fatal(fmt.Errorf("unexpected match of %v", multi))
+	}
+
+	// the directory of the file is gone by the time the temporary file is created
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ioutil.WriteFile(filepath.Join(sub, "c.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	rp, err := NewReplacer(filepath.Join(sub, "c.txt"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func(rp *Replacer) {
+		_ = rp.Config.File.Close()
+	}(rp)
+	if err := rp.NewStringMapping("hello", "world"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := os.RemoveAll(sub); err != nil {
+		t.Fatal(err.Error())
+	}
+	var create *ErrTempFileCreate
+	if _, err := rp.Replace(); !errors.As(err, &create) || create.Dir != sub || !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal(fmt.Errorf("unexpected error %v", err))
+	}
+}
+
+func TestDiffWriter(t *testing.T) {
+	defer Cleanup()
+	lines := make([]string, 12)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d\n", i+1)
+	}
+	lines[1], lines[10] = "old 2\n", "old 11\n"
+	expected := "--- test-diff.txt\n+++ test-diff.txt\n" +
+		"@@ -1,5 +1,5 @@\n line 1\n-old 2\n+new 2\n line 3\n line 4\n line 5\n" +
+		"@@ -8,5 +8,5 @@\n line 8\n line 9\n line 10\n-old 11\n+new 11\n line 12\n"
+	for _, chained := range []bool{true, false} {
+		if err := ioutil.WriteFile("test-diff.txt", []byte(strings.Join(lines, "")), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		var diff bytes.Buffer
+		rp, err := NewReplacer("test-diff.txt", WithDiffWriter(&diff))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewStringMapping("old", "new"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewStringMapping("missing", "absent"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if chained {
+			_, err = rp.ReplaceChained()
+		} else {
+			_, err = rp.Replace()
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = rp.Config.File.Close()
+		if diff.String() != expected {
+			t.Fatal(fmt.Errorf("chained %v: unexpected diff %q", chained, diff.String()))
+		}
+
+		// nothing is written for an unchanged file
+		diff.Reset()
+		rp, err = NewReplacer("test-diff.txt", WithDiffWriter(&diff))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewStringMapping("missing", "absent"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := rp.ReplaceChained(); err != nil {
+			t.Fatal(err.Error())
+		}
+		_ = rp.Config.File.Close()
+		if diff.Len() != 0 {
+			t.Fatal(fmt.Errorf("unexpected diff %q", diff.String()))
+		}
+	}
+
+	rp, err := NewReplacer("test-diff.txt", WithDiffWriter(ioutil.Discard), WithPatchInPlace())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func(rp *Replacer) {
+		_ = rp.Config.File.Close()
+	}(rp)
+	if err := rp.NewStringMapping("new", "old"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := rp.ReplaceChained(); err != errDiffUnsupported {
+		t.Fatal(fmt.Errorf("unexpected error %v", err))
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	defer Cleanup()
+	long := strings.Repeat("k", 3000)
+	content := strings.Repeat("tiny ", 20) + long + strings.Repeat(" tiny", 2000)
+	expected := strings.Repeat("small ", 20) + "v" + strings.Repeat(" small", 2000)
+	for _, tc := range []struct {
+		opts []Option
+		size int
+	}{
+		{nil, 16384},
+		{[]Option{WithBufferSize(1 << 16)}, 1 << 16},
+		{[]Option{WithMaxMemory(4 << 10)}, 1024},
+		{[]Option{WithBufferSize(1 << 16), WithMaxMemory(1)}, minBufferSize},
+	} {
+		if err := ioutil.WriteFile("test-buffer.txt", []byte(content), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, chained := range []bool{true, false} {
+			rp, err := NewReplacer("test-buffer.txt", tc.opts...)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if err := rp.NewStringMapping("tiny", "small"); err != nil {
+				t.Fatal(err.Error())
+			}
+			if err := rp.NewStringMapping(long, "v"); err != nil {
+				t.Fatal(err.Error())
+			}
+			if size := rp.Config.bufferSize(); size != tc.size {
+				t.Fatal(fmt.Errorf("unexpected buffer size %d, expected %d", size, tc.size))
+			}
+			if chained {
+				_, err = rp.ReplaceChained()
+			} else {
+				_, err = rp.Replace()
+			}
+			_ = rp.Config.File.Close()
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if got, _ := ioutil.ReadFile("test-buffer.txt"); string(got) != expected {
+				t.Fatal(fmt.Errorf("unexpected result with buffer size %d", tc.size))
+			}
+			if err := ioutil.WriteFile("test-buffer.txt", []byte(content), 0644); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+	}
+
+	// tiny files get small buffers
+	if err := ioutil.WriteFile("test-buffer.txt", []byte("tiny"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	rp, err := NewReplacer("test-buffer.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func(rp *Replacer) {
+		_ = rp.Config.File.Close()
+	}(rp)
+	if size := rp.Config.bufferSize(); size != minBufferSize {
+		t.Fatal(fmt.Errorf("unexpected buffer size %d", size))
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	defer Cleanup()
+	files := []string{"test-pipeline-1.txt", "test-pipeline-2.txt"}
+	for _, file := range files {
+		if err := ioutil.WriteFile(file, []byte("import old/pkg\nold_name := oldValue\n"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	imports, names := NewRuleSet("imports"), NewRuleSet("names")
+	if err := imports.AddExpression("s|old/pkg|new/pkg|"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := names.NewStringMapping("old_name", "new_name"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := names.NewStringMapping("oldValue", "newValue"); err != nil {
+		t.Fatal(err.Error())
+	}
+	// the last rule set sees what the ones before it left
+	cleanup := NewRuleSet("cleanup")
+	if err := cleanup.NewStringMapping("new", "next"); err != nil {
+		t.Fatal(err.Error())
+	}
+	p := NewPipeline()
+	if err := p.Add(imports, names, cleanup); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := p.Add(NewRuleSet("names")); err == nil {
+		t.Fatal(errors.New("added a rule set twice"))
+	}
+	if err := p.Disable("cleanup"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := p.Move("names", 0); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := p.Enable("missing"); !errors.Is(err, ErrUnknownRuleSet) {
+		t.Fatal(fmt.Errorf("unexpected error %v", err))
+	}
+	if names := p.RuleSets(); !reflect.DeepEqual(names, []string{"names", "imports", "cleanup"}) || p.Enabled("cleanup") {
+		t.Fatal(fmt.Errorf("unexpected rule sets %v", names))
+	}
+	report, err := p.Replace(append(files, "test-pipeline-missing.txt")...)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, file := range files {
+		if content, _ := ioutil.ReadFile(file); string(content) != "import new/pkg\nnew_name := newValue\n" {
+			t.Fatal(fmt.Errorf("unexpected result %q", content))
+		}
+	}
+	if len(report.RuleSets) != 2 || report.RuleSets[0].Name != "names" || report.RuleSets[0].Occurrences != 4 ||
+		report.RuleSets[1].Name != "imports" || report.RuleSets[1].Occurrences != 2 {
+		t.Fatal(fmt.Errorf("unexpected rule set stats %+v", report.RuleSets))
+	}
+	var multi *MultiError
+	if !errors.As(report.Err(), &multi) || len(multi.Succeeded) != 2 || len(multi.Failed) != 1 {
+		t.Fatal(fmt.Errorf("unexpected error %v", report.Err()))
+	}
+
+	if err := p.Enable("cleanup"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := p.Remove("imports"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := p.Replace(files[0]); err != nil {
+		t.Fatal(err.Error())
+	}
+	if content, _ := ioutil.ReadFile(files[0]); string(content) != "import next/pkg\nnext_name := nextValue\n" {
+		t.Fatal(fmt.Errorf("unexpected result %q", content))
+	}
+}
+
+func TestUndoJournal(t *testing.T) {
+	defer Cleanup()
+	journal := filepath.Join(t.TempDir(), "undo.diff")
+	var sb strings.Builder
+	for i := 0; i < 30; i++ {
+		_, _ = fmt.Fprintf(&sb, "key %d = old\n", i)
+	}
+	// lines that look like the headers of a diff, and a last line without a line feed
+	original := "--- old\n+++ old\n@@ old\n" + sb.String() + "\\ old"
+	if err := ioutil.WriteFile("test-undo.txt", []byte(original), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := ioutil.WriteFile("test-undo-other.txt", []byte("old\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	for i, tc := range []struct {
+		file     string
+		old, new string
+		chained  bool
+	}{
+		{"test-undo.txt", "old", "new value", true},
+		{"test-undo-other.txt", "old", "new", true},
+		{"test-undo.txt", "key 1", "k1", false},
+		// a replace that changes nothing is not recorded
+		{"test-undo.txt", "missing", "absent", true},
+	} {
+		rp, err := NewReplacer(tc.file, WithUndoJournal(journal))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewStringMapping(tc.old, tc.new); err != nil {
+			t.Fatal(err.Error())
+		}
+		if tc.chained {
+			_, err = rp.ReplaceChained()
+		} else {
+			_, err = rp.Replace()
+		}
+		_ = rp.Config.File.Close()
+		if err != nil {
+			t.Fatal(fmt.Errorf("replace %d: %v", i, err))
+		}
+	}
+	if content, _ := ioutil.ReadFile("test-undo.txt"); !strings.Contains(string(content), "k10 = new value\n") {
+		t.Fatal(fmt.Errorf("unexpected result %q", content))
+	}
+
+	rp, err := NewReplacer("test-undo.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func(rp *Replacer) {
+		_ = rp.Config.File.Close()
+	}(rp)
+	if err := rp.Undo(journal); err != nil {
+		t.Fatal(err.Error())
+	}
+	if content, _ := ioutil.ReadFile("test-undo.txt"); string(content) != original {
+		t.Fatal(fmt.Errorf("unexpected undone content %q", content))
+	}
+	if content, _ := ioutil.ReadFile("test-undo-other.txt"); string(content) != "new\n" {
+		t.Fatal(fmt.Errorf("unexpected content of the other file %q", content))
+	}
+	// the file is already undone
+	if err := rp.Undo(journal); !errors.Is(err, ErrJournalMismatch) {
+		t.Fatal(fmt.Errorf("unexpected error %v", err))
+	}
+	if content, _ := ioutil.ReadFile("test-undo.txt"); string(content) != original {
+		t.Fatal(fmt.Errorf("unexpected content after a mismatch %q", content))
+	}
+}
+
+func TestHooks(t *testing.T) {
+	defer Cleanup()
+	original := `{"name": "old"}`
+	for i, tc := range []struct {
+		new     string
+		before  error
+		chained bool
+		want    string
+	}{
+		{"new", nil, true, `{"name": "new"}`},
+		{"new", nil, false, `{"name": "new"}`},
+		// the result is not valid JSON and fails the replace
+		{`"new`, nil, true, original},
+		{`"new`, nil, false, original},
+		{"new", errors.New("vetoed"), true, original},
+		{"new", errors.New("vetoed"), false, original},
+	} {
+		if err := ioutil.WriteFile("test-hooks.txt", []byte(original), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		var before []string
+		var after []Stats
+		rp, err := NewReplacer("test-hooks.txt",
+			BeforeFile(func(path string) error {
+				before = append(before, path)
+				return tc.before
+			}),
+			AfterFile(func(path string, stats Stats) error {
+				after = append(after, stats)
+				if path == "test-hooks.txt" {
+					return errors.New("hook given the file rather than its copy")
+				}
+				content, err := ioutil.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				if !json.Valid(content) {
+					return errors.New("invalid JSON")
+				}
+				return nil
+			}))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.NewStringMapping("old", tc.new); err != nil {
+			t.Fatal(err.Error())
+		}
+		if tc.chained {
+			_, err = rp.ReplaceChained()
+		} else {
+			_, err = rp.Replace()
+		}
+		_ = rp.Config.File.Close()
+		if (err == nil) != (tc.want != original) {
+			t.Fatal(fmt.Errorf("case %d: unexpected error %v", i, err))
+		}
+		if tc.before != nil && !errors.Is(err, tc.before) {
+			t.Fatal(fmt.Errorf("case %d: unexpected error %v", i, err))
+		}
+		if len(before) != 1 || before[0] != "test-hooks.txt" {
+			t.Fatal(fmt.Errorf("case %d: unexpected BeforeFile calls %q", i, before))
+		}
+		switch {
+		case tc.before != nil && len(after) != 0:
+			t.Fatal(fmt.Errorf("case %d: AfterFile called after BeforeFile failed", i))
+		case tc.before == nil && (len(after) != 1 || after[0].Mappings[0].Occurrences != 1 || after[0].BytesWritten != int64(len(original)-len("old")+len(tc.new))):
+			t.Fatal(fmt.Errorf("case %d: unexpected AfterFile calls %+v", i, after))
+		}
+		if content, _ := ioutil.ReadFile("test-hooks.txt"); string(content) != tc.want {
+			t.Fatal(fmt.Errorf("case %d: unexpected content %q", i, content))
+		}
+		if matches, _ := filepath.Glob("tmp-gosed-*"); len(matches) != 0 {
+			t.Fatal(fmt.Errorf("case %d: temporary files left %q", i, matches))
+		}
+	}
+
+	rp, err := NewReplacer("test-hooks.txt", WithPatchInPlace(), AfterFile(func(string, Stats) error { return nil }))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func(rp *Replacer) {
+		_ = rp.Config.File.Close()
+	}(rp)
+	if err := rp.NewStringMapping("old", "new"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := rp.ReplaceChained(); err != errHookPatchInPlace {
+		t.Fatal(fmt.Errorf("unexpected error %v", err))
+	}
+}
+
+func TestRecordSeparator(t *testing.T) {
+	defer Cleanup()
+	// NUL-delimited records holding line feeds, like the output of find -print0
+	original := "a/old old\x00b/old\nold\x00c/keep\x00d/old"
+	for i, tc := range []struct {
+		expr string
+		want string
+	}{
+		{"s/old/new/", "a/new old\x00b/new\nold\x00c/keep\x00d/new"},
+		{"s/old/new/2", "a/old new\x00b/old\nnew\x00c/keep\x00d/old"},
+		// $ anchors to the end of the record, not of the line
+		{"s/old$/x/", "a/old x\x00b/old\nx\x00c/keep\x00d/x"},
+	} {
+		if err := ioutil.WriteFile("test-record-separator.txt", []byte(original), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		rp, err := NewReplacer("test-record-separator.txt", WithRecordSeparator(0))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := rp.AddExpression(tc.expr); err != nil {
+			t.Fatal(err.Error())
+		}
+		_, err = rp.ReplaceChained()
+		_ = rp.Config.File.Close()
+		if err != nil {
+			t.Fatal(fmt.Errorf("case %d: %v", i, err))
+		}
+		if content, _ := ioutil.ReadFile("test-record-separator.txt"); string(content) != tc.want {
+			t.Fatal(fmt.Errorf("case %d: unexpected content %q", i, content))
+		}
+	}
+
+	if err := ioutil.WriteFile("test-record-separator.txt", []byte(original), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	rp, err := NewReplacer("test-record-separator.txt", WithRecordSeparator(0))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func(rp *Replacer) {
+		_ = rp.Config.File.Close()
+	}(rp)
+	// the addresses count the records ReplaceLines keeps
+	if err := rp.NewMappingWithOptions([]byte("old"), []byte("new"), InLines(2, 3)); err != nil {
+		t.Fatal(err.Error())
+	}
+	var records []string
+	if _, err := rp.ReplaceLines(func(lineNum int, line []byte) ([]byte, bool) {
+		records = append(records, string(line))
+		return line, lineNum != 3
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(records) != 4 || records[1] != "b/old\nold" {
+		t.Fatal(fmt.Errorf("unexpected records %q", records))
+	}
+	if content, _ := ioutil.ReadFile("test-record-separator.txt"); string(content) != "a/old old\x00b/new\nnew\x00d/new" {
+		t.Fatal(fmt.Errorf("unexpected content %q", content))
+	}
+}
+
+func TestTracer(t *testing.T) {
+	defer Cleanup()
+	for _, chained := range []bool{true, false} {
+		if err := ioutil.WriteFile("test-tracer.txt", []byte(strings.Repeat("old value\n", 1000)), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		var stages []TraceStage
+		rp, err := NewReplacer("test-tracer.txt", WithTracer(func(path string, stage TraceStage, elapsed time.Duration) {
+			if path != "test-tracer.txt" || elapsed < 0 {
+				t.Errorf("unexpected trace of %s: %v %v", path, stage, elapsed)
+			}
+			stages = append(stages, stage)
+		}))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, m := range [][2]string{{"old", "new"}, {"value", "v"}} {
+			if err := rp.NewStringMapping(m[0], m[1]); err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		if chained {
+			_, err = rp.ReplaceChained()
+		} else {
+			_, err = rp.Replace()
+		}
+		_ = rp.Config.File.Close()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if fmt.Sprint(stages) != "[read match write rename]" {
+			t.Fatal(fmt.Errorf("unexpected stages %v", stages))
+		}
+		if content, _ := ioutil.ReadFile("test-tracer.txt"); string(content) != strings.Repeat("new v\n", 1000) {
+			t.Fatal(fmt.Errorf("unexpected content %q", content[:20]))
+		}
+	}
+
+	// failed replaces are not traced
+	traced := false
+	rp, err := NewReplacer("test-tracer.txt", AfterFile(func(string, Stats) error { return errors.New("rejected") }),
+		WithTracer(func(string, TraceStage, time.Duration) { traced = true }))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func(rp *Replacer) {
+		_ = rp.Config.File.Close()
+	}(rp)
+	if err := rp.NewStringMapping("new", "old"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := rp.ReplaceChained(); err == nil || traced {
+		t.Fatal(fmt.Errorf("unexpected error %v, traced %v", err, traced))
+	}
+}
+
+func TestLinkPolicy(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("links are not supported here")
+	}
+	defer Cleanup()
+	replace := func(path string, opts ...Option) *Replacer {
+		rp, err := NewReplacer(path, opts...)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer func(rp *Replacer) {
+			_ = rp.Config.File.Close()
+		}(rp)
+		if err := rp.NewStringMapping("old", "new"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := rp.ReplaceChained(); err != nil {
+			t.Fatal(err.Error())
+		}
+		return rp
+	}
+	expect := func(path, want string) {
+		t.Helper()
+		if content, _ := ioutil.ReadFile(path); string(content) != want {
+			t.Fatal(fmt.Errorf("unexpected content of %s: %q", path, content))
+		}
+	}
+	isLink := func(path string) bool {
+		info, err := os.Lstat(path)
+		return err == nil && info.Mode()&os.ModeSymlink != 0
+	}
+	reset := func() {
+		for _, name := range []string{"test-link-target.txt", "test-link-symlink.txt", "test-link-hardlink.txt"} {
+			_ = os.Remove(name)
+		}
+		if err := ioutil.WriteFile("test-link-target.txt", []byte("old\n"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := os.Symlink("test-link-target.txt", "test-link-symlink.txt"); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := os.Link("test-link-target.txt", "test-link-hardlink.txt"); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// by default the links are replaced, as before
+	reset()
+	replace("test-link-symlink.txt")
+	if isLink("test-link-symlink.txt") {
+		t.Fatal("symbolic link kept")
+	}
+	expect("test-link-symlink.txt", "new\n")
+	expect("test-link-target.txt", "old\n")
+	replace("test-link-hardlink.txt")
+	expect("test-link-hardlink.txt", "new\n")
+	expect("test-link-target.txt", "old\n")
+
+	// followed links replace what they lead to, keeping the links
+	reset()
+	if rp := replace("test-link-symlink.txt", WithSymlinkPolicy(LinkFollow)); rp.Config.FilePath != "test-link-target.txt" {
+		t.Fatal(fmt.Errorf("unexpected path %s", rp.Config.FilePath))
+	}
+	if !isLink("test-link-symlink.txt") {
+		t.Fatal("symbolic link replaced")
+	}
+	expect("test-link-target.txt", "new\n")
+	reset()
+	replace("test-link-hardlink.txt", WithHardlinkPolicy(LinkFollow), WithBackup(".bak"))
+	expect("test-link-target.txt", "new\n")
+	expect("test-link-hardlink.txt.bak", "old\n")
+	target, _ := os.Stat("test-link-target.txt")
+	if hardlink, _ := os.Stat("test-link-hardlink.txt"); !os.SameFile(target, hardlink) {
+		t.Fatal("hard link detached")
+	}
+	_ = os.Remove("test-link-hardlink.txt.bak")
+
+	// skipped links are left alone
+	reset()
+	for _, tc := range []struct {
+		path string
+		opt  Option
+	}{
+		{"test-link-symlink.txt", WithSymlinkPolicy(LinkSkip)},
+		{"test-link-hardlink.txt", WithHardlinkPolicy(LinkSkip)},
+		// with both names, the file has two links
+		{"test-link-target.txt", WithHardlinkPolicy(LinkSkip)},
+	} {
+		if rp := replace(tc.path, tc.opt); !rp.Stats().Skipped {
+			t.Fatal(fmt.Errorf("%s not skipped", tc.path))
+		}
+	}
+	if !isLink("test-link-symlink.txt") {
+		t.Fatal("symbolic link replaced")
+	}
+	expect("test-link-target.txt", "old\n")
+	// a file with a single name is not skipped
+	_ = os.Remove("test-link-hardlink.txt")
+	replace("test-link-target.txt", WithHardlinkPolicy(LinkSkip))
+	expect("test-link-target.txt", "new\n")
+}
+
+func TestPatchJournal(t *testing.T) {
+	defer Cleanup()
+	journal := filepath.Join(t.TempDir(), "patch.journal")
+	original := strings.Repeat("token=AAAA;", 300000)
+	patch := func(ctx context.Context, opts ...Option) (int, error) {
+		rp, err := NewReplacer("test-patch-journal.txt", append([]Option{WithPatchJournal(journal), WithBufferSize(64 << 10)}, opts...)...)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer func(rp *Replacer) {
+			_ = rp.Config.File.Close()
+		}(rp)
+		if err := rp.NewStringMapping("AAAA", "BBBB"); err != nil {
+			t.Fatal(err.Error())
+		}
+		return rp.ReplaceChainedContext(ctx)
+	}
+	if err := ioutil.WriteFile("test-patch-journal.txt", []byte(original), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// a cancelled replace restores what it overwrote
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := patch(ctx, WithProgress(func(done, total int64) {
+		if done > 0 {
+			cancel()
+		}
+	})); !errors.Is(err, context.Canceled) {
+		t.Fatal(fmt.Errorf("unexpected error %v", err))
+	}
+	if content, _ := ioutil.ReadFile("test-patch-journal.txt"); string(content) != original {
+		t.Fatal("cancelled replace left the file patched")
+	}
+	if _, err := os.Stat(journal); !os.IsNotExist(err) {
+		t.Fatal(fmt.Errorf("journal left behind: %v", err))
+	}
+
+	// a completed replace removes its journal
+	if patched, err := patch(context.Background()); err != nil || patched != len(original)*4/11 {
+		t.Fatal(fmt.Errorf("patched %d bytes: %v", patched, err))
+	}
+	if content, _ := ioutil.ReadFile("test-patch-journal.txt"); string(content) != strings.ReplaceAll(original, "AAAA", "BBBB") {
+		t.Fatal("file not patched")
+	}
+	if _, err := os.Stat(journal); !os.IsNotExist(err) {
+		t.Fatal(fmt.Errorf("journal left behind: %v", err))
+	}
+
+	// a crash leaves the journal, with a record cut short, for RollbackPatch
+	rp, err := NewReplacer("test-patch-journal.txt", WithPatchJournal(journal))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer func(rp *Replacer) {
+		_ = rp.Config.File.Close()
+	}(rp)
+	pj, err := rp.Config.openPatchJournal()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pj.add(6, []byte("BBBB"))
+	pj.add(17, []byte("BBBB"))
+	if err := pj.sync(); err != nil {
+		t.Fatal(err.Error())
+	}
+	pj.add(28, []byte("BBBB"))
+	_, _ = pj.f.Write(pj.pending[:10])
+	_ = pj.f.Close()
+	for _, offset := range []int64{6, 17, 28} {
+		if _, err := rp.Config.File.WriteAt([]byte("CCCC"), offset); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if _, err := patch(context.Background()); !errors.Is(err, ErrPatchJournalPending) {
+		t.Fatal(fmt.Errorf("unexpected error %v", err))
+	}
+	if err := RollbackPatch(journal); err != nil {
+		t.Fatal(err.Error())
+	}
+	want := strings.ReplaceAll(original, "AAAA", "BBBB")
+	if content, _ := ioutil.ReadFile("test-patch-journal.txt"); string(content) != want[:28]+"CCCC"+want[32:] {
+		t.Fatal(fmt.Errorf("unexpected rolled back content %q", content[:40]))
+	}
+	if _, err := os.Stat(journal); !os.IsNotExist(err) {
+		t.Fatal(fmt.Errorf("journal left behind: %v", err))
+	}
+}
@@ -0,0 +1,106 @@
+package gosed
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	zeroWidthJoiner = '\u200d'
+	// graphemeLookaround is enough to see one whole rune on either side of a match
+	graphemeLookaround = utf8.UTFMax
+)
+
+// WithGraphemeSafeMatching skips matches that would split a multi-byte rune or a combining sequence
+// (combining marks, ZWJ emoji sequences, emoji modifiers, variation selectors, regional indicator pairs,
+// Hangul jamo and Indic virama conjuncts), so replacements cannot produce mojibake at their boundaries.
+func WithGraphemeSafeMatching() Option {
+	return func(c *replacerConfig) {
+		c.GraphemeSafe = true
+	}
+}
+
+// graphemeSafeReplacer rejects matches of the wrapped BytesReplacer that do not start and end on a grapheme cluster boundary.
+type graphemeSafeReplacer struct {
+	BytesReplacer
+}
+
+func (g *graphemeSafeReplacer) LookaroundHints() (int, int) {
+	behind, ahead := graphemeLookaround, graphemeLookaround
+	if f, ok := g.BytesReplacer.(BytesMatchFilter); ok {
+		b, a := f.LookaroundHints()
+		behind, ahead = max(behind, b), max(ahead, a)
+	}
+	return behind, ahead
+}
+
+func (g *graphemeSafeReplacer) FilterMatch(before, match, after []byte) bool {
+	if f, ok := g.BytesReplacer.(BytesMatchFilter); ok && !f.FilterMatch(before, match, after) {
+		return false
+	}
+	return isGraphemeBoundary(before, match) && isGraphemeBoundary(match, after)
+}
+
+func (g *graphemeSafeReplacer) ExpandMatch(match, replace []byte) []byte {
+	return expandMatch(g.BytesReplacer, match, replace)
+}
+
+// isGraphemeBoundary reports whether a grapheme cluster can end with `left` and the next one start with `right`.
+// It covers the rules that matter for splitting text, not the full UAX #29 algorithm.
+func isGraphemeBoundary(left, right []byte) bool {
+	if len(left) == 0 || len(right) == 0 {
+		return true
+	}
+	if !utf8.RuneStart(right[0]) {
+		return false
+	}
+	r1, _ := utf8.DecodeLastRune(left)
+	r2, _ := utf8.DecodeRune(right)
+	switch {
+	case r1 == '\r' && r2 == '\n':
+		return false
+	case isGraphemeExtend(r2), r1 == zeroWidthJoiner:
+		return false
+	case isRegionalIndicator(r1) && isRegionalIndicator(r2):
+		return false
+	case isHangulLeading(r1) && isHangul(r2), isHangul(r1) && isHangulTrailing(r2):
+		return false
+	case isVirama(r1) && unicode.IsLetter(r2):
+		return false
+	}
+	return true
+}
+
+// isGraphemeExtend reports whether r never starts a grapheme cluster of its own.
+func isGraphemeExtend(r rune) bool {
+	return unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc, unicode.Variation_Selector) ||
+		r == zeroWidthJoiner ||
+		(r >= 0x1f3fb && r <= 0x1f3ff) // emoji skin tone modifiers
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+func isHangul(r rune) bool {
+	return isHangulLeading(r) || isHangulTrailing(r)
+}
+
+// isHangulLeading reports leading jamo and precomposed syllables, which can be followed by more jamo.
+func isHangulLeading(r rune) bool {
+	return (r >= 0x1100 && r <= 0x115f) || (r >= 0xa960 && r <= 0xa97f) || (r >= 0xac00 && r <= 0xd7a3)
+}
+
+// isHangulTrailing reports vowel and trailing consonant jamo.
+func isHangulTrailing(r rune) bool {
+	return (r >= 0x1160 && r <= 0x11ff) || (r >= 0xd7b0 && r <= 0xd7ff)
+}
+
+// isVirama reports the viramas of the major Indic scripts, which join the following consonant into a conjunct.
+func isVirama(r rune) bool {
+	switch r {
+	case 0x094d, 0x09cd, 0x0a4d, 0x0acd, 0x0b4d, 0x0bcd, 0x0c4d, 0x0ccd, 0x0d4d, 0x0dca, 0x1039, 0x17d2:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package gosed
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// guardChunkSize is the size of the chunks guards are searched in
+const guardChunkSize = 64 << 10
+
+// OnlyIfContains only replaces the file if it contains pattern, so that a patch is only applied where it belongs.
+// SkipIfContains leaves the file alone if it contains pattern, so that re-running a patch, such as inserting a line
+// that is already there, changes nothing. Every OnlyIfContains pattern must be found and no SkipIfContains pattern
+// for the file to be replaced.
+// The guards are searched in a first pass over the file, as the mappings read it: decompressed, decrypted and decoded.
+// A guarded replace that leaves the file alone returns no error, and Stats reports it as Skipped.
+func OnlyIfContains(pattern []byte) Option {
+	return func(c *replacerConfig) {
+		c.RequirePatterns = append(c.RequirePatterns, pattern)
+	}
+}
+
+// SkipIfContains leaves the file alone if it contains pattern, see OnlyIfContains
+func SkipIfContains(pattern []byte) Option {
+	return func(c *replacerConfig) {
+		c.SkipPatterns = append(c.SkipPatterns, pattern)
+	}
+}
+
+// guarded reports whether the link policies or the guards leave the file alone, in which case it records the skipped
+// replace
+func (rp *Replacer) guarded() (bool, error) {
+	hold, err := rp.Config.linksHold()
+	if err == nil && hold {
+		hold, err = rp.guardsHold()
+	}
+	if err != nil || hold {
+		return false, err
+	}
+	rp.Config.skip()
+	rp.Config.spend()
+	return true, nil
+}
+
+// skip records the statistics of a replace the guards skipped
+func (rc *replacerConfig) skip() {
+	rc.beginStats()
+	rc.stats.skipped = true
+	rc.finishStats(0)
+}
+
+// guardsHold searches the file for the guards, and reports whether it is to be replaced
+func (rp *Replacer) guardsHold() (bool, error) {
+	if len(rp.Config.RequirePatterns) == 0 && len(rp.Config.SkipPatterns) == 0 {
+		return true, nil
+	}
+	f, err := rp.Config.open()
+	if err != nil {
+		return false, err
+	}
+	defer func(f io.Closer) {
+		_ = f.Close()
+	}(f)
+	var r io.Reader = bufio.NewReaderSize(f, 8192)
+	for _, layer := range rp.Config.layers() {
+		decoded, err := layer.NewReader(r)
+		if err != nil {
+			return false, err
+		}
+		defer func(decoded io.Closer) {
+			_ = decoded.Close()
+		}(decoded)
+		r = decoded
+	}
+	if rp.Config.Encoding != nil {
+		r, _ = newDecodingReader(r, rp.Config.Encoding)
+	}
+	required := append([][]byte{}, rp.Config.RequirePatterns...)
+	overlap := 0
+	for _, pattern := range append(required, rp.Config.SkipPatterns...) {
+		overlap = max(overlap, len(pattern)-1)
+	}
+	// every chunk is searched along with the end of the one before, for the patterns it cuts
+	buf := make([]byte, overlap+guardChunkSize)
+	kept := 0
+	for {
+		n, err := io.ReadFull(r, buf[kept:])
+		window := buf[:kept+n]
+		for _, pattern := range rp.Config.SkipPatterns {
+			if bytes.Contains(window, pattern) {
+				return false, nil
+			}
+		}
+		pending := required[:0]
+		for _, pattern := range required {
+			if !bytes.Contains(window, pattern) {
+				pending = append(pending, pattern)
+			}
+		}
+		required = pending
+		if len(required) == 0 && len(rp.Config.SkipPatterns) == 0 {
+			return true, nil
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return len(required) == 0, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		kept = min(overlap, len(window))
+		copy(buf, window[len(window)-kept:])
+	}
+}
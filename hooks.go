@@ -0,0 +1,57 @@
+package gosed
+
+import (
+	"errors"
+	"os"
+)
+
+// errHookPatchInPlace is returned when an AfterFile hook is set on a file patched in place, whose changes are written
+// as they are found rather than committed at once
+var errHookPatchInPlace = errors.New("AfterFile hooks cannot be run on files patched in place")
+
+// BeforeFile calls fn with the path of every file before it is read, so that integrations can check or prepare it.
+// An error fails the replace of the file, which is left as it was. The hooks run in the order they were set, before
+// the guards of OnlyIfContains and SkipIfContains.
+func BeforeFile(fn func(path string) error) Option {
+	return func(c *replacerConfig) {
+		c.BeforeHooks = append(c.BeforeHooks, fn)
+	}
+}
+
+// AfterFile calls fn once the replaced copy of every file is written, before it is committed, with the path of the
+// copy and the statistics of the replace, so that integrations can validate the result, such as with json.Valid, or
+// change its mode. An error fails the replace: the copy is removed and the file is left as it was.
+// The copy is the one renamed over the file, or written back to it with WithInodePreservation, holding the result as
+// stored, compressed or encrypted if it is. Files skipped by guards are not passed to the hooks, and files patched
+// in place fail the replace.
+func AfterFile(fn func(path string, stats Stats) error) Option {
+	return func(c *replacerConfig) {
+		c.AfterHooks = append(c.AfterHooks, fn)
+	}
+}
+
+// beforeFile runs the BeforeFile hooks
+func (rc *replacerConfig) beforeFile() error {
+	for _, hook := range rc.BeforeHooks {
+		if err := hook(rc.FilePath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// afterFile runs the AfterFile hooks on the replaced copy tmpFile of wrote bytes, removing it if one fails
+func (rp *Replacer) afterFile(tmpFile string, wrote int64) error {
+	if len(rp.Config.AfterHooks) == 0 {
+		return nil
+	}
+	rp.Config.finishStats(wrote)
+	stats := rp.Stats()
+	for _, hook := range rp.Config.AfterHooks {
+		if err := hook(tmpFile, stats); err != nil {
+			_ = os.Remove(tmpFile)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package gosed
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MatchIdentifierVariants also matches the camelCase, PascalCase, snake_case, SCREAMING_SNAKE_CASE and kebab-case
+// spellings of the key, and replaces each with the same spelling of the value, all in a single pass: oldWidget→newGadget
+// then also renames OldWidget to NewGadget, old_widget to new_gadget, OLD_WIDGET to NEW_GADGET and old-widget to
+// new-gadget. Key and value are split into words at case changes, underscores and hyphens, so either may be given in
+// any of these spellings. MatchCaseFold takes precedence over this option.
+func MatchIdentifierVariants() MappingOption {
+	return func(o *mappingOptions) {
+		o.Variants = true
+	}
+}
+
+// identifierWords splits an identifier into its lowercased words: "HTTPServer_v2" is "http", "server", "v2"
+func identifierWords(ident string) []string {
+	var words []string
+	runes := []rune(ident)
+	start := 0
+	flush := func(end int) {
+		if end > start {
+			words = append(words, strings.ToLower(string(runes[start:end])))
+		}
+	}
+	for i, r := range runes {
+		switch {
+		case r == '_' || r == '-':
+			flush(i)
+			start = i + 1
+		case i > start && unicode.IsUpper(r):
+			prev := runes[i-1]
+			// a word starts at an upper case letter following a lower case one, or ending an acronym ("HTTPServer")
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) ||
+				(unicode.IsUpper(prev) && i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				flush(i)
+				start = i
+			}
+		}
+	}
+	flush(len(runes))
+	return words
+}
+
+// capitalize upper cases the first rune of word
+func capitalize(word string) string {
+	r, size := utf8.DecodeRuneInString(word)
+	return string(unicode.ToUpper(r)) + word[size:]
+}
+
+// identifierStyles spell a list of words in the supported identifier conventions
+var identifierStyles = []func(words []string) string{
+	// camelCase
+	func(words []string) string {
+		for i := 1; i < len(words); i++ {
+			words[i] = capitalize(words[i])
+		}
+		return strings.Join(words, "")
+	},
+	// PascalCase
+	func(words []string) string {
+		for i := range words {
+			words[i] = capitalize(words[i])
+		}
+		return strings.Join(words, "")
+	},
+	// snake_case
+	func(words []string) string {
+		return strings.Join(words, "_")
+	},
+	// SCREAMING_SNAKE_CASE
+	func(words []string) string {
+		return strings.ToUpper(strings.Join(words, "_"))
+	},
+	// kebab-case
+	func(words []string) string {
+		return strings.Join(words, "-")
+	},
+}
+
+// identifierVariants returns the key as given followed by its spellings in every identifier style, each paired with
+// the same spelling of value. Spellings that coincide are only returned once.
+func identifierVariants(key, value []byte) (keys, values [][]byte) {
+	keys, values = [][]byte{key}, [][]byte{value}
+	keyWords, valueWords := identifierWords(string(key)), identifierWords(string(value))
+	if len(keyWords) == 0 || len(valueWords) == 0 {
+		return keys, values
+	}
+	for _, style := range identifierStyles {
+		k := []byte(style(append([]string{}, keyWords...)))
+		duplicate := false
+		for _, seen := range keys {
+			duplicate = duplicate || bytes.Equal(seen, k)
+		}
+		if !duplicate {
+			keys = append(keys, k)
+			values = append(values, []byte(style(append([]string{}, valueWords...))))
+		}
+	}
+	return keys, values
+}
+
+// variantReplacer is a BytesReplacer that finds any of several keys, replacing each with its own value
+type variantReplacer struct {
+	keys, values [][]byte
+}
+
+func newVariantReplacer(key, value []byte) *variantReplacer {
+	keys, values := identifierVariants(key, value)
+	return &variantReplacer{keys: keys, values: values}
+}
+
+func (r *variantReplacer) GetSizingHints() (int, int, float64) {
+	maxSearch, maxReplace, ratio := 0, 0, float64(-1)
+	for i, key := range r.keys {
+		maxSearch, maxReplace = max(maxSearch, len(key)), max(maxReplace, len(r.values[i]))
+		if len(key) < len(r.values[i]) {
+			if keyRatio := float64(len(key)) / float64(len(r.values[i])); ratio < 0 || keyRatio < ratio {
+				ratio = keyRatio
+			}
+		}
+	}
+	return maxSearch, maxReplace, ratio
+}
+
+// BestIndex returns the first match of any key in buf, the longest one if several start at the same index
+func (r *variantReplacer) BestIndex(buf []byte) (int, []byte, []byte) {
+	best, key := -1, 0
+	for i, k := range r.keys {
+		index := bytes.Index(buf, k)
+		if index >= 0 && (best < 0 || index < best || (index == best && len(k) > len(r.keys[key]))) {
+			best, key = index, i
+		}
+	}
+	return best, r.keys[key], r.values[key]
+}
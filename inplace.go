@@ -0,0 +1,63 @@
+package gosed
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// WithInodePreservation writes the replaced content back into the original file instead of renaming a copy over it,
+// so the file keeps its inode: processes holding it open, bind mounts and inotify watches keep seeing it.
+// The content is still staged in a temporary file first; if writing it back fails, the temporary file is kept
+// and named in the error, since the original may then be partially rewritten.
+func WithInodePreservation() Option {
+	return func(c *replacerConfig) {
+		c.PreserveInode = true
+	}
+}
+
+// writeBack copies tmpFile over the content of the file, truncates the file to the new length and removes tmpFile
+func (rp *Replacer) writeBack(tmpFile string) error {
+	src, err := os.Open(tmpFile)
+	if err != nil {
+		return err
+	}
+	defer func(src *os.File) {
+		_ = src.Close()
+	}(src)
+	dst, err := os.OpenFile(rp.Config.FilePath, os.O_WRONLY, rp.Config.FilePerm)
+	if err != nil {
+		_ = os.Remove(tmpFile)
+		return err
+	}
+	defer func(dst *os.File) {
+		_ = dst.Close()
+	}(dst)
+	info, err := dst.Stat()
+	if err != nil {
+		_ = os.Remove(tmpFile)
+		return err
+	}
+	var sink io.Writer = dst
+	if isSparse(src) {
+		// the original still holds its content where the copy has holes, so they are punched through
+		sink = &sparseWriter{f: dst, sparse: true, punch: true}
+	}
+	wrote, err := io.CopyBuffer(sink, rp.Config.count(src), make([]byte, 8192))
+	if err == nil {
+		err = dst.Truncate(wrote)
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("writing back %s: %w (replaced content kept in %s)", rp.Config.FilePath, err, tmpFile)
+	}
+	if rp.Config.PreserveMetadata {
+		if err := os.Chtimes(rp.Config.FilePath, time.Now(), info.ModTime()); err != nil {
+			return err
+		}
+	}
+	return os.Remove(tmpFile)
+}
@@ -0,0 +1,253 @@
+package gosed
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrJournalMismatch is returned by Undo when the file no longer holds what the undo journal recorded
+var ErrJournalMismatch = errors.New("file does not match the undo journal")
+
+// errTxUndoJournal is returned when an undo journal is asked of a replace staged in a transaction, which could still
+// be rolled back once the journal has recorded it
+var errTxUndoJournal = errors.New("undo journals cannot be recorded for replaces staged in a transaction")
+
+// journalMu serializes the replaces appending to undo journals, held from the append until the commit is done
+var journalMu sync.Mutex
+
+// WithUndoJournal appends what every replace changes to the undo journal at path, so that Undo can restore the file
+// later without a full backup of it: only the changed lines are recorded, along with a few lines of context.
+// The journal is a unified diff of every replaced file, named by its absolute path, so that it can be reviewed, or
+// reverted with `patch -R file journal` when it holds a single replace. The changes are appended and synced before the
+// file is committed, and dropped again if the commit fails. Many files, and many replaces of the same file, can share
+// a journal. Files the mappings leave unchanged are not recorded.
+// Like diffs, undo journals are not supported for zip members, files patched in place and transactions.
+func WithUndoJournal(path string) Option {
+	return func(c *replacerConfig) {
+		c.UndoJournal = path
+	}
+}
+
+// Undo restores the file as it was before the replaces recorded for it in the undo journal at journalPath, undoing
+// the last one first. The file is only replaced once it was checked to hold what the journal recorded, and fails with
+// ErrJournalMismatch otherwise. The journal is left as it is.
+func (rp *Replacer) Undo(journalPath string) error {
+	path, err := filepath.Abs(rp.Config.FilePath)
+	if err != nil {
+		return err
+	}
+	sections, err := readJournal(journalPath, path)
+	if err != nil {
+		return err
+	}
+	if len(sections) == 0 {
+		return fmt.Errorf("%s records no replace of %s", journalPath, path)
+	}
+	current, closeCurrent, err := rp.Config.openOriginal()
+	if err != nil {
+		return err
+	}
+	defer closeCurrent()
+	// every replace is undone in a stage of its own, reading the output of the one undoing the replace after it
+	var stages []*io.PipeReader
+	defer func() {
+		for _, pr := range stages {
+			_ = pr.Close()
+		}
+	}()
+	for i := len(sections) - 1; i >= 0; i-- {
+		pr, pw := io.Pipe()
+		go func(src io.Reader, hunks []DiffHunk) {
+			_ = pw.CloseWithError(undoHunks(bufio.NewReader(src), hunks, pw))
+		}(current, sections[i])
+		stages = append(stages, pr)
+		current = pr
+	}
+	output, err := rp.Config.createTemp(filepath.Dir(rp.Config.FilePath))
+	if err != nil {
+		return err
+	}
+	tmpFile := output.Name()
+	_, err = rp.Config.encodeLayers(output, current)
+	if cerr := output.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile)
+		return err
+	}
+	if err := rp.commit(tmpFile, nil); err != nil {
+		return err
+	}
+	if info, err := os.Stat(rp.Config.FilePath); err == nil {
+		rp.Config.FileSize = info.Size()
+	}
+	return nil
+}
+
+// recordUndo appends the changes of the replace to the undo journal, synced, before the file is committed, and
+// returns the function to call with the outcome of the commit, which drops them again if it failed
+func (rc *replacerConfig) recordUndo(ld *lineDiffer) (func(error), error) {
+	if rc.UndoJournal == "" || ld == nil || len(ld.hunks) == 0 {
+		return func(error) {}, nil
+	}
+	path, err := filepath.Abs(rc.FilePath)
+	if err != nil {
+		return nil, err
+	}
+	journalMu.Lock()
+	f, err := os.OpenFile(rc.UndoJournal, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		journalMu.Unlock()
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		_, err = io.WriteString(f, formatDiff(path, ld.hunks))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		if info != nil {
+			_ = f.Truncate(info.Size())
+		}
+		_ = f.Close()
+		journalMu.Unlock()
+		return nil, err
+	}
+	return func(commitErr error) {
+		if commitErr != nil {
+			_ = f.Truncate(info.Size())
+		}
+		_ = f.Close()
+		journalMu.Unlock()
+	}, nil
+}
+
+// readJournal returns the hunks of every replace of the file path recorded in the journal, in order
+func readJournal(journalPath, path string) ([][]DiffHunk, error) {
+	f, err := os.Open(journalPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	br := bufio.NewReader(f)
+	var sections [][]DiffHunk
+	// matching is set while reading the replaces of path; origLeft and newLeft count the lines the hunk being read
+	// still spans, which tell its lines from the headers they may look like
+	var hunk DiffHunk
+	matching := false
+	origLeft, newLeft := 0, 0
+	for lineNum := 1; ; lineNum++ {
+		line, err := br.ReadString('\n')
+		if err == io.EOF && line == "" {
+			if origLeft > 0 || newLeft > 0 {
+				return nil, fmt.Errorf("%s:%d: truncated hunk", journalPath, lineNum)
+			}
+			return sections, nil
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		switch {
+		case strings.HasPrefix(line, "\\"):
+			// the line before lacks a line feed; the hunks kept share their lines with hunk
+			if len(hunk.Lines) > 0 {
+				hunk.Lines[len(hunk.Lines)-1] = strings.TrimSuffix(hunk.Lines[len(hunk.Lines)-1], "\n")
+			}
+		case origLeft > 0 || newLeft > 0:
+			switch line[0] {
+			case ' ':
+				origLeft--
+				newLeft--
+			case '-':
+				origLeft--
+			case '+':
+				newLeft--
+			default:
+				return nil, fmt.Errorf("%s:%d: invalid hunk line", journalPath, lineNum)
+			}
+			if origLeft < 0 || newLeft < 0 {
+				return nil, fmt.Errorf("%s:%d: hunk longer than its header", journalPath, lineNum)
+			}
+			hunk.Lines = append(hunk.Lines, line)
+			if origLeft == 0 && newLeft == 0 && matching {
+				last := &sections[len(sections)-1]
+				*last = append(*last, hunk)
+			}
+		case strings.HasPrefix(line, "--- "):
+			hunk = DiffHunk{}
+			matching = strings.TrimSuffix(line[4:], "\n") == path
+			if matching {
+				sections = append(sections, nil)
+			}
+		case strings.HasPrefix(line, "+++ "):
+		case strings.HasPrefix(line, "@@ "):
+			hunk = DiffHunk{}
+			if _, err := fmt.Sscanf(line, "@@ -%d,%d +%d,%d @@", &hunk.OrigStart, &hunk.OrigLines, &hunk.NewStart, &hunk.NewLines); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid hunk header", journalPath, lineNum)
+			}
+			origLeft, newLeft = hunk.OrigLines, hunk.NewLines
+		default:
+			return nil, fmt.Errorf("%s:%d: invalid journal line", journalPath, lineNum)
+		}
+	}
+}
+
+// undoHunks copies src, a file as a replace left it, to dst as it was before, by reverting the hunks of the replace
+func undoHunks(src *bufio.Reader, hunks []DiffHunk, dst io.Writer) error {
+	line := 0
+	for _, hunk := range hunks {
+		// unified diffs number an empty side by the line before it
+		first := hunk.NewStart
+		if hunk.NewLines == 0 {
+			first++
+		}
+		for ; line < first-1; line++ {
+			s, err := src.ReadString('\n')
+			if err != nil && (err != io.EOF || s == "") {
+				return mismatch(err)
+			}
+			if _, err := io.WriteString(dst, s); err != nil {
+				return err
+			}
+		}
+		for _, l := range hunk.Lines {
+			if l[0] == '-' {
+				if _, err := io.WriteString(dst, l[1:]); err != nil {
+					return err
+				}
+				continue
+			}
+			s, err := src.ReadString('\n')
+			if s != l[1:] || (err != nil && err != io.EOF) {
+				return mismatch(err)
+			}
+			line++
+			if l[0] == ' ' {
+				if _, err := io.WriteString(dst, s); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	_, err := io.Copy(dst, src)
+	return err
+}
+
+// mismatch returns ErrJournalMismatch, or the error reading the file if it is not its end
+func mismatch(err error) error {
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return ErrJournalMismatch
+}
@@ -0,0 +1,188 @@
+package gosed
+
+import (
+	"bytes"
+	"io"
+)
+
+// KeyValueFormat is a key/value configuration file format
+type KeyValueFormat int
+
+const (
+	// FormatEnv is a .env file: KEY=value lines, optionally prefixed with "export", and # comments
+	FormatEnv KeyValueFormat = iota + 1
+	// FormatProperties is a Java properties file: key=value, key:value or "key value" lines, # and ! comments, and
+	// values continued on the next line after a trailing backslash
+	FormatProperties
+	// FormatINI is an INI file: [section] headers, key=value or key:value lines, and ; and # comments
+	FormatINI
+)
+
+// WithValuesOnly applies the mappings to the values of a key/value configuration file only, never to key names,
+// comments or section headers, so that rotating a credential cannot rename a key. If keys are given, only the values
+// of those keys are replaced; in an INI file, a key can be given as "section.key" to select it in a single section.
+func WithValuesOnly(format KeyValueFormat, keys ...string) Option {
+	return func(c *replacerConfig) {
+		c.KeyValueFormat = format
+		c.KeyValueKeys = keys
+	}
+}
+
+// keyValueReader applies the mappings to the values of a key/value configuration file
+type keyValueReader struct {
+	rr      *recordReader
+	rc      *replacerConfig
+	section []byte
+	// continued is set while the value of the last line goes on on the next one, selected if that value is replaced
+	continued, selected bool
+	buf                 []byte
+	out                 []byte
+	err                 error
+}
+
+func newKeyValueReader(r io.Reader, rc *replacerConfig) *keyValueReader {
+	return &keyValueReader{rr: newRecordReader(r, '\n', rc.MaxRecordLength), rc: rc}
+}
+
+// Read implements the `io.Reader` interface.
+func (kr *keyValueReader) Read(p []byte) (int, error) {
+	for len(kr.out) == 0 {
+		if kr.err != nil {
+			return 0, kr.err
+		}
+		var line []byte
+		line, kr.err = kr.rr.ReadRecord()
+		if len(line) == 0 {
+			continue
+		}
+		if err := kr.rewrite(line); err != nil {
+			kr.err = err
+			return 0, err
+		}
+	}
+	n := copy(p, kr.out)
+	kr.out = kr.out[n:]
+	return n, nil
+}
+
+// rewrite puts line into kr.out, with its value replaced if it has one in scope
+func (kr *keyValueReader) rewrite(line []byte) error {
+	content := bytes.TrimRight(line, "\r\n")
+	valueStart, selected := -1, false
+	if kr.continued {
+		valueStart, selected = len(content)-len(bytes.TrimLeft(content, " \t\f")), kr.selected
+	} else {
+		var key []byte
+		key, valueStart = kr.parse(content)
+		selected = valueStart >= 0 && kr.selects(key)
+	}
+	kr.continued = kr.rc.KeyValueFormat == FormatProperties && valueStart >= 0 && continues(content)
+	kr.selected = selected
+	if !selected || valueStart >= len(content) {
+		kr.out = append(kr.buf[:0], line...)
+		kr.buf = kr.out
+		return nil
+	}
+	value := content[valueStart:]
+	if kr.continued {
+		// the backslash is part of the syntax, not of the value
+		value = value[:len(value)-1]
+	}
+	replaced, err := kr.rc.apply(value)
+	if err != nil {
+		return err
+	}
+	out := append(kr.buf[:0], line[:valueStart]...)
+	out = append(out, replaced...)
+	out = append(out, line[valueStart+len(value):]...)
+	kr.out, kr.buf = out, out
+	return nil
+}
+
+// parse returns the key of a line and the offset of its value, -1 if the line has none
+func (kr *keyValueReader) parse(content []byte) ([]byte, int) {
+	trimmed := bytes.TrimLeft(content, " \t\f")
+	indent := len(content) - len(trimmed)
+	if len(trimmed) == 0 {
+		return nil, -1
+	}
+	switch kr.rc.KeyValueFormat {
+	case FormatEnv:
+		if trimmed[0] == '#' {
+			return nil, -1
+		}
+		if rest := bytes.TrimPrefix(trimmed, []byte("export")); len(rest) < len(trimmed) && len(rest) > 0 && (rest[0] == ' ' || rest[0] == '\t') {
+			trimmed = bytes.TrimLeft(rest, " \t")
+			indent = len(content) - len(trimmed)
+		}
+		eq := bytes.IndexByte(trimmed, '=')
+		if eq < 0 {
+			return nil, -1
+		}
+		return bytes.TrimSpace(trimmed[:eq]), indent + eq + 1
+	case FormatProperties:
+		if trimmed[0] == '#' || trimmed[0] == '!' {
+			return nil, -1
+		}
+		end := 0
+		for end < len(trimmed) && !bytes.ContainsAny(trimmed[end:end+1], "=: \t\f") {
+			if trimmed[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		end = min(end, len(trimmed))
+		value := end
+		for value < len(trimmed) && (trimmed[value] == ' ' || trimmed[value] == '\t' || trimmed[value] == '\f') {
+			value++
+		}
+		if value < len(trimmed) && (trimmed[value] == '=' || trimmed[value] == ':') {
+			value++
+		}
+		for value < len(trimmed) && (trimmed[value] == ' ' || trimmed[value] == '\t' || trimmed[value] == '\f') {
+			value++
+		}
+		return trimmed[:end], indent + value
+	case FormatINI:
+		switch trimmed[0] {
+		case ';', '#':
+			return nil, -1
+		case '[':
+			if end := bytes.IndexByte(trimmed, ']'); end > 0 {
+				kr.section = append(kr.section[:0], bytes.TrimSpace(trimmed[1:end])...)
+			}
+			return nil, -1
+		}
+		sep := bytes.IndexAny(trimmed, "=:")
+		if sep < 0 {
+			return nil, -1
+		}
+		return bytes.TrimSpace(trimmed[:sep]), indent + sep + 1
+	}
+	return nil, -1
+}
+
+// selects reports whether the value of key is in scope
+func (kr *keyValueReader) selects(key []byte) bool {
+	if len(kr.rc.KeyValueKeys) == 0 {
+		return true
+	}
+	for _, selected := range kr.rc.KeyValueKeys {
+		if string(key) == selected {
+			return true
+		}
+		if kr.rc.KeyValueFormat == FormatINI && len(kr.section) > 0 && selected == string(kr.section)+"."+string(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// continues reports whether a properties line ends with an odd number of backslashes, continuing its value
+func continues(content []byte) bool {
+	n := 0
+	for n < len(content) && content[len(content)-1-n] == '\\' {
+		n++
+	}
+	return n%2 == 1
+}
@@ -0,0 +1,61 @@
+package gosed
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// ReplaceLines streams the file line by line through fn and commits the result like ReplaceChained, for edits that
+// mappings cannot express. fn receives the 1-based number of each line and its content without the line feed, or
+// the separator of WithRecordSeparator, and returns the line to write in its place, or false to drop the line. The
+// line passed to fn is only valid during the call. The mappings, if any, are applied to the lines fn returns.
+// Lines longer than the maximum record length fail the replace with ErrRecordTooLong.
+func (rp *Replacer) ReplaceLines(fn func(lineNum int, line []byte) ([]byte, bool)) (int, error) {
+	if rp.Config.PatchInPlace {
+		return 0, fmt.Errorf("%w: lines replaced by a function cannot be patched in place", ErrLengthChange)
+	}
+	rp.Config.lineFunc = fn
+	defer func() {
+		rp.Config.lineFunc = nil
+	}()
+	return DoChainReplace(rp)
+}
+
+// lineFuncReader rewrites every line of r with the line function of a ReplaceLines
+type lineFuncReader struct {
+	rr  *recordReader
+	fn  func(lineNum int, line []byte) ([]byte, bool)
+	buf []byte
+	out []byte
+	err error
+}
+
+func newLineFuncReader(r io.Reader, rc *replacerConfig) *lineFuncReader {
+	return &lineFuncReader{rr: newRecordReader(r, rc.RecordSeparator, rc.MaxRecordLength), fn: rc.lineFunc}
+}
+
+// Read implements the `io.Reader` interface.
+func (lr *lineFuncReader) Read(p []byte) (int, error) {
+	for len(lr.out) == 0 {
+		if lr.err != nil {
+			return 0, lr.err
+		}
+		var record []byte
+		record, lr.err = lr.rr.ReadRecord()
+		if len(record) == 0 {
+			continue
+		}
+		line := bytes.TrimSuffix(record, []byte{lr.rr.sep})
+		if replaced, keep := lr.fn(lr.rr.record, line); keep {
+			lr.buf = append(lr.buf[:0], replaced...)
+			if len(line) < len(record) {
+				lr.buf = append(lr.buf, lr.rr.sep)
+			}
+			lr.out = lr.buf
+		}
+	}
+	n := copy(p, lr.out)
+	lr.out = lr.out[n:]
+	return n, nil
+}
@@ -0,0 +1,85 @@
+package gosed
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// LinkPolicy controls how a replace treats a file that is a symbolic link, or that has several hard links
+type LinkPolicy int
+
+const (
+	// LinkReplace replaces the link itself, as a copy is renamed over it: a symbolic link becomes a regular file
+	// holding the replaced content of its target, which is left as it was, and a hard-linked file is detached from its
+	// other names, which keep the original content
+	LinkReplace LinkPolicy = iota
+	// LinkFollow replaces what the link leads to: the target of a symbolic link, resolved when the Replacer is created
+	// or retargeted, so that the link is kept; and the file shared by every name of a hard-linked one, which is written
+	// back in place, as with WithInodePreservation, so that all of them see the replaced content
+	LinkFollow
+	// LinkSkip leaves the link and what it leads to alone: the replace returns no error, and Stats reports it as
+	// Skipped
+	LinkSkip
+)
+
+// WithSymlinkPolicy sets how a file path that is a symbolic link is replaced, LinkReplace by default
+func WithSymlinkPolicy(policy LinkPolicy) Option {
+	return func(c *replacerConfig) {
+		c.Symlinks = policy
+	}
+}
+
+// WithHardlinkPolicy sets how a file with several hard links is replaced, LinkReplace by default. Hard links are not
+// counted on Windows and Plan 9, where every file is taken to have a single name.
+func WithHardlinkPolicy(policy LinkPolicy) Option {
+	return func(c *replacerConfig) {
+		c.Hardlinks = policy
+	}
+}
+
+// followSymlink makes the target of the file the file to replace, if it is a symbolic link to follow
+func (rc *replacerConfig) followSymlink() error {
+	if rc.Symlinks != LinkFollow {
+		return nil
+	}
+	if info, err := os.Lstat(rc.FilePath); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return err
+	}
+	target, err := filepath.EvalSymlinks(rc.FilePath)
+	if err != nil {
+		return err
+	}
+	rc.FilePath = target
+	return nil
+}
+
+// linksHold reports whether the link policies let the file be replaced
+func (rc *replacerConfig) linksHold() (bool, error) {
+	if rc.fsys != nil || (rc.Symlinks != LinkSkip && rc.Hardlinks != LinkSkip) {
+		return true, nil
+	}
+	info, err := os.Lstat(rc.FilePath)
+	if err != nil {
+		return false, err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return rc.Symlinks != LinkSkip, nil
+	}
+	return rc.Hardlinks != LinkSkip || linkCount(info) < 2, nil
+}
+
+// keepLinks decides, as the file is committed, whether it is written back in place to keep its hard links
+func (rc *replacerConfig) keepLinks() {
+	rc.linked = false
+	if rc.Hardlinks != LinkFollow {
+		return
+	}
+	if info, err := os.Stat(rc.FilePath); err == nil {
+		rc.linked = linkCount(info) > 1
+	}
+}
+
+// inPlace reports whether the result is written back into the file rather than renamed over it
+func (rc *replacerConfig) inPlace() bool {
+	return rc.PreserveInode || rc.linked
+}
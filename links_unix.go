@@ -0,0 +1,17 @@
+//go:build !windows && !plan9
+
+package gosed
+
+import (
+	"os"
+	"syscall"
+)
+
+// linkCount returns the number of hard links of the file described by info
+func linkCount(info os.FileInfo) uint64 {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 1
+	}
+	return uint64(st.Nlink)
+}
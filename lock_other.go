@@ -0,0 +1,9 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+
+package gosed
+
+// lockFile does nothing, as advisory locks are not available here; on Windows, locks are mandatory and would keep
+// the file from being replaced
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
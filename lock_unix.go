@@ -0,0 +1,31 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package gosed
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive flock on the file at path, waiting for other holders to release it, and returns the
+// function releasing it
+func lockFile(path string) (func(), error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	// closing the file releases the lock
+	return func() {
+		_ = f.Close()
+	}, nil
+}
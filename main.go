@@ -6,16 +6,23 @@ package gosed
 import (
 	"bufio"
 	"bytes"
-	"fmt"
+	"context"
 	"io"
+	"io/fs"
+	"io/ioutil"
 	"os"
-	"path"
+	"path/filepath"
+	"regexp"
 	"time"
+
+	"golang.org/x/text/encoding"
 )
 
 // Replacer contains all of the methods needed to properly execute replace operations
 type Replacer struct {
 	Config *replacerConfig
+	// set is the mapping set of a Replacer handed out by a ReplacerPool
+	set string
 }
 
 // replacerConfig contains all of the config variables
@@ -26,25 +33,190 @@ type replacerConfig struct {
 	FilePerm     os.FileMode
 	Asynchronous bool
 	Mappings     *replacerMappings
+	// MaxRecordLength bounds how long a single record may grow in record-oriented operations, and RecordSeparator
+	// ends the records of the line-oriented ones
+	MaxRecordLength int
+	RecordSeparator byte
+	UTF8Policy      UTF8Policy
+	UTF8Errors      []InvalidUTF8Error
+	GraphemeSafe    bool
+	Encoding        encoding.Encoding
+	Base64Regions   []Base64Region
+	MIME            bool
+	ZipMembers      []string
+	OfficeXML       bool
+	Compression     Compression
+	Codec           Codec
+	FrontMatter     FrontMatterScope
+	Lexer           Lexer
+	TokenScopes     TokenScope
+	KeyValueFormat  KeyValueFormat
+	KeyValueKeys    []string
+	// ConcurrentWrites and ConcurrentWriteRetries decide what happens when the file changes during a replace
+	ConcurrentWrites       ConcurrentWritePolicy
+	ConcurrentWriteRetries int
+	PreserveInode          bool
+	PreserveMetadata       bool
+	BackupSuffix           string
+	ProgressFunc           func(bytesProcessed, totalBytes int64)
+	Tx                     *Tx
+	Workers                int
+	ChunkSize              int
+	PatchInPlace           bool
+	PatchJournal           string
+	Reflink                bool
+	Preallocate            bool
+	Lock                   bool
+	DiffWriter             io.Writer
+	UndoJournal            string
+	BufferSize             int
+	MaxMemory              int64
+	// BeforeHooks and AfterHooks are the hooks of BeforeFile and AfterFile
+	BeforeHooks []func(path string) error
+	AfterHooks  []func(path string, stats Stats) error
+	Tracer      func(path string, stage TraceStage, elapsed time.Duration)
+	// Symlinks and Hardlinks are the link policies of WithSymlinkPolicy and WithHardlinkPolicy
+	Symlinks, Hardlinks LinkPolicy
+	// RequirePatterns and SkipPatterns are the guards of OnlyIfContains and SkipIfContains
+	RequirePatterns, SkipPatterns [][]byte
+	// Deterministic verifies every result by rendering it twice, and FixedMTime, when not zero, is given to the file
+	Deterministic bool
+	FixedMTime    time.Time
+	// ctx cancels the replace in progress, progress counts the bytes it reads, and gate keeps an abandoned replace
+	// from committing, when set
+	ctx      context.Context
+	progress *int64
+	gate     *commitGate
+	// applyChain holds the readers reused by apply
+	applyChain []*BytesReplacingReader
+	// spent holds the mappings earlier replaces have applied, which Retarget registers again
+	spent *replacerMappings
+	// copyBuf is the copy buffer reused by every replace
+	copyBuf []byte
+	// stats collects the statistics of the last replace
+	stats *replaceStats
+	// progressReport is the progress of the replace in flight reported to ProgressFunc
+	progressReport progressReport
+	// trace times the stages of the replace in flight for Tracer
+	trace *replaceTrace
+	// linked is set when the file being committed is written back in place to keep its hard links
+	linked bool
+	// bom is the byte order mark of the file being replaced from a Unicode encoding
+	bom *byteOrderMark
+	// fsys holds the file of an FSReplacer
+	fsys fs.FS
+	// lineFunc rewrites every line during a ReplaceLines
+	lineFunc func(lineNum int, line []byte) ([]byte, bool)
+}
+
+// Option configures optional behaviour of a Replacer
+type Option func(*replacerConfig)
+
+// WithMaxRecordLength sets the longest record (line) record-oriented operations will buffer before failing with ErrRecordTooLong.
+// A limit of 0 or less disables the guard.
+func WithMaxRecordLength(n int) Option {
+	return func(c *replacerConfig) {
+		c.MaxRecordLength = n
+	}
+}
+
+// WithRecordSeparator sets the byte that ends the lines of line-oriented mappings, '\n' by default, so that
+// NUL-delimited data, such as the output of find -print0, or records ending with another byte are replaced a record
+// at a time: the lines of InLines, Between and the line operations, those ReplaceLines passes to its function, and
+// those the per-line occurrences of FirstPerLine and ParseExpression's flags are counted on are then its records.
+func WithRecordSeparator(sep byte) Option {
+	return func(c *replacerConfig) {
+		c.RecordSeparator = sep
+	}
 }
 
 // replacerStringMappings maps old byte sequences to new byte sequences
 type replacerMappings struct {
 	Keys    [][]byte
 	Indices [][]byte
+	// Options holds the matching options of each mapping, nil for plain byte-for-byte matching
+	Options []*mappingOptions
 }
 
-// NewReplacer returns a new *Replacer type
-func NewReplacer(fileName string) (*Replacer, error) {
-	fd, err := os.Stat(fileName)
-	if err != nil {
-		return nil, err
+// mappingOptions contains the matching options of a single mapping
+type mappingOptions struct {
+	Fold     bool
+	FoldLang string
+	Variants bool
+	// ASCIIFold matches regardless of the case of ASCII letters
+	ASCIIFold bool
+	// WholeWord only replaces matches that are whole words
+	WholeWord bool
+	// Limit, Occurrence and FirstPerLine select which matches are replaced
+	Limit, Occurrence int
+	FirstPerLine      bool
+	// LineOccurrence only replaces the nth match of every line, and the ones after it if LineOccurrenceOnward
+	LineOccurrence       int
+	LineOccurrenceOnward bool
+	// FromLine, ToLine, Start and End restrict the mapping to some lines
+	FromLine, ToLine int
+	Start, End       *regexp.Regexp
+	// Number holds the transforms of a numeric mapping, whose key is the prefix of the number
+	Number []NumberTransform
+	// Regex is the compiled expression of a regex mapping, whose key is the pattern
+	Regex *regexp.Regexp
+	// Line is what a regex mapping does to the lines it matches
+	Line lineOp
+	// Func computes the replacement of every match of a function mapping
+	Func ReplaceFunc
+}
+
+// MappingOption configures how a single mapping matches
+type MappingOption func(*mappingOptions)
+
+func (rm *replacerMappings) add(oldString, newString []byte, opts *mappingOptions) {
+	rm.Keys = append(rm.Keys, oldString)
+	rm.Indices = append(rm.Indices, newString)
+	rm.Options = append(rm.Options, opts)
+}
+
+func (rm *replacerMappings) clone() *replacerMappings {
+	return &replacerMappings{
+		Keys:    append([][]byte{}, rm.Keys...),
+		Indices: append([][]byte{}, rm.Indices...),
+		Options: append([]*mappingOptions{}, rm.Options...),
 	}
-	fi, err := os.OpenFile(fileName, os.O_RDWR, fd.Mode().Perm())
+}
+
+func (rm *replacerMappings) clear() {
+	rm.Keys = rm.Keys[:0]
+	rm.Indices = rm.Indices[:0]
+	rm.Options = rm.Options[:0]
+}
+
+func (rm *replacerMappings) extend(other *replacerMappings) {
+	for index := range other.Keys {
+		rm.add(other.Keys[index], other.Indices[index], other.Options[index])
+	}
+}
+
+// spend clears the mappings once a replace has applied them, keeping them aside for Retarget
+func (rc *replacerConfig) spend() {
+	if rc.spent == nil {
+		rc.spent = &replacerMappings{}
+	}
+	rc.spent.extend(rc.Mappings)
+	rc.Mappings.clear()
+}
+
+// NewReplacer returns a new *Replacer type
+func NewReplacer(fileName string, opts ...Option) (*Replacer, error) {
+	fi, fd, err := openTarget(fileName)
 	if err != nil {
+		// a file of a transaction that cannot be opened aborts it like a failed replace
+		rc := &replacerConfig{}
+		for _, opt := range opts {
+			opt(rc)
+		}
+		rc.Tx.record(fileName, err)
 		return nil, err
 	}
-	return &Replacer{
+	rp := &Replacer{
 		Config: &replacerConfig{
 			File:     fi,
 			FilePath: fileName,
@@ -53,19 +225,65 @@ func NewReplacer(fileName string) (*Replacer, error) {
 			Mappings: &replacerMappings{
 				Keys:    make([][]byte, 0),
 				Indices: make([][]byte, 0),
+				Options: make([]*mappingOptions, 0),
 			},
+			MaxRecordLength: DefaultMaxRecordLength,
+			RecordSeparator: '\n',
 		},
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(rp.Config)
+	}
+	if err := rp.Config.followSymlink(); err != nil {
+		_ = fi.Close()
+		rp.Config.Tx.record(fileName, err)
+		return nil, err
+	}
+	return rp, nil
+}
+
+// openTarget opens the file to replace
+func openTarget(fileName string) (*os.File, os.FileInfo, error) {
+	fd, err := os.Stat(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := os.OpenFile(fileName, os.O_RDWR, fd.Mode().Perm())
+	if err != nil {
+		return nil, nil, err
+	}
+	return fi, fd, nil
+}
+
+// setTarget makes fi, opened by openTarget, the file to replace
+func (rc *replacerConfig) setTarget(fileName string, fi *os.File, fd os.FileInfo) {
+	rc.File = fi
+	rc.FilePath = fileName
+	rc.FileSize = fd.Size()
+	rc.FilePerm = fd.Mode().Perm()
 }
 
 // NewMapping maps a new oldString:newString []byte entry
 func (rp *Replacer) NewMapping(oldString, newString []byte) error {
 	switch len(oldString) {
 	case 0:
-		return fmt.Errorf("cannot replace empty string with new value")
+		return ErrEmptyKey
+	}
+	rp.Config.Mappings.add(oldString, newString, nil)
+	return nil
+}
+
+// NewMappingWithOptions maps a new oldString:newString []byte entry that matches according to opts
+func (rp *Replacer) NewMappingWithOptions(oldString, newString []byte, opts ...MappingOption) error {
+	switch len(oldString) {
+	case 0:
+		return ErrEmptyKey
 	}
-	rp.Config.Mappings.Keys = append(rp.Config.Mappings.Keys, oldString)
-	rp.Config.Mappings.Indices = append(rp.Config.Mappings.Indices, newString)
+	mo := &mappingOptions{}
+	for _, opt := range opts {
+		opt(mo)
+	}
+	rp.Config.Mappings.add(oldString, newString, mo)
 	return nil
 }
 
@@ -73,10 +291,9 @@ func (rp *Replacer) NewMapping(oldString, newString []byte) error {
 func (rp *Replacer) NewStringMapping(oldString, newString string) error {
 	switch oldString {
 	case "":
-		return fmt.Errorf("cannot replace empty string with new value")
+		return ErrEmptyKey
 	}
-	rp.Config.Mappings.Keys = append(rp.Config.Mappings.Keys, []byte(oldString))
-	rp.Config.Mappings.Indices = append(rp.Config.Mappings.Indices, []byte(newString))
+	rp.Config.Mappings.add([]byte(oldString), []byte(newString), nil)
 	return nil
 }
 
@@ -93,12 +310,35 @@ func (rp *Replacer) Reset() error {
 	if err != nil {
 		return err
 	}
-	rp.Config.Mappings.Keys = rp.Config.Mappings.Keys[:0]
-	rp.Config.Mappings.Indices = rp.Config.Mappings.Indices[:0]
+	rp.Config.Mappings.clear()
+	rp.Config.spent = nil
 	rp.Config.FilePerm = fd.Mode().Perm()
 	return nil
 }
 
+// Retarget points the Replacer at another file, keeping its options and registering again the mappings earlier
+// replaces have applied, ahead of any added since, so that the same substitutions can be applied to many files
+// without rebuilding the Replacer. If path cannot be opened, the Replacer keeps its current file.
+func (rp *Replacer) Retarget(path string) error {
+	fi, fd, err := openTarget(path)
+	if err != nil {
+		return err
+	}
+	if err := rp.Config.File.Close(); err != nil {
+		_ = fi.Close()
+		return err
+	}
+	rp.Config.setTarget(path, fi, fd)
+	if err := rp.Config.followSymlink(); err != nil {
+		return err
+	}
+	if spent := rp.Config.spent; spent != nil {
+		spent.extend(rp.Config.Mappings)
+		rp.Config.Mappings, rp.Config.spent = spent, nil
+	}
+	return nil
+}
+
 // ReplaceChained does the replace operation with a chained reader model
 func (rp *Replacer) ReplaceChained() (int, error) {
 	return DoChainReplace(rp)
@@ -109,85 +349,461 @@ func (rp *Replacer) Replace() (int, error) {
 	return DoSequentialReplace(rp)
 }
 
+// ReplaceContext is Replace, interrupted when ctx is cancelled or its deadline passes. The file is checked between
+// reads; an interrupted replace removes its temporary files, leaves the file untouched and returns ctx.Err().
+// Once the file is being written, the replace is no longer interrupted, so that the file is never left half replaced.
+func (rp *Replacer) ReplaceContext(ctx context.Context) (int, error) {
+	defer rp.Config.withContext(ctx)()
+	return DoSequentialReplace(rp)
+}
+
+// ReplaceChainedContext is ReplaceChained, interrupted when ctx is cancelled like ReplaceContext.
+func (rp *Replacer) ReplaceChainedContext(ctx context.Context) (int, error) {
+	defer rp.Config.withContext(ctx)()
+	return DoChainReplace(rp)
+}
+
+// withContext makes ctx cancel the replaces until the returned function restores the previous context
+func (rc *replacerConfig) withContext(ctx context.Context) func() {
+	previous := rc.ctx
+	rc.ctx = ctx
+	return func() {
+		rc.ctx = previous
+	}
+}
+
+// replacer returns the BytesReplacer for the mapping at index
+func (rc *replacerConfig) replacer(index int) BytesReplacer {
+	var br BytesReplacer
+	switch opts := rc.Mappings.Options[index]; {
+	case opts != nil && opts.Fold:
+		br = newFoldingReplacer(rc.Mappings.Keys[index], rc.Mappings.Indices[index], opts.FoldLang)
+	case opts != nil && opts.Number != nil:
+		br = newNumericReplacer(rc.Mappings.Keys[index], opts.Number)
+	case opts != nil && opts.Variants:
+		br = newVariantReplacer(rc.Mappings.Keys[index], rc.Mappings.Indices[index])
+	case opts != nil && opts.ASCIIFold:
+		br = newASCIIFoldingReplacer(rc.Mappings.Keys[index], rc.Mappings.Indices[index])
+	default:
+		br = &singleSearchReplaceReplacer{search: rc.Mappings.Keys[index], replace: rc.Mappings.Indices[index]}
+	}
+	if opts := rc.Mappings.Options[index]; opts != nil && opts.Func != nil {
+		br = &funcReplacer{BytesReplacer: br, fn: opts.Func}
+	}
+	if opts := rc.Mappings.Options[index]; opts != nil && opts.WholeWord {
+		br = &wordBoundaryReplacer{BytesReplacer: br}
+	}
+	if rc.GraphemeSafe {
+		br = &graphemeSafeReplacer{BytesReplacer: br}
+	}
+	// matches are counted once every other option has accepted them
+	if opts := rc.Mappings.Options[index]; opts != nil && opts.limited() {
+		br = &occurrenceReplacer{BytesReplacer: br, occurrenceFilter: occurrenceFilter{opts: opts}, sep: rc.RecordSeparator}
+	}
+	return br
+}
+
+// chain wraps r with a replacing reader for every mapping, in order
+func (rc *replacerConfig) chain(r io.Reader) io.Reader {
+	size := rc.bufferSize()
+	for index := range rc.Mappings.Keys {
+		replacer := &BytesReplacingReader{}
+		replacer.SetBufferSize(size)
+		r = rc.stage(r, index, replacer)
+	}
+	return r
+}
+
+// transform wraps r with the stage that applies the mappings to the whole stream
+func (rc *replacerConfig) transform(r io.Reader) io.Reader {
+	if rc.lineFunc != nil {
+		r = newLineFuncReader(r, rc)
+	}
+	if rc.FrontMatter != 0 {
+		return newFrontMatterReader(r, rc)
+	}
+	if rc.Lexer != nil {
+		return newTokenScopeReader(r, rc)
+	}
+	if rc.KeyValueFormat != 0 {
+		return newKeyValueReader(r, rc)
+	}
+	if rc.MIME {
+		return newMIMEReader(r, rc)
+	}
+	return rc.chain(r)
+}
+
+// render writes the replaced file to dst, reading the original from src, or from the archive ra of the given size
+// when replacing zip members. If plain is not nil, the replaced file is also written to it before it is encoded.
+func (rp *Replacer) render(src io.Reader, ra io.ReaderAt, size int64, dst, plain io.Writer) (int64, error) {
+	var result io.Reader
+	if ra != nil {
+		archive := rp.zipReader(ra, size)
+		defer func(archive io.Closer) {
+			_ = archive.Close()
+		}(archive)
+		result = archive
+	} else {
+		src = bufio.NewReaderSize(src, rp.Config.bufferSize())
+		for _, layer := range rp.Config.layers() {
+			decoded, err := layer.NewReader(src)
+			if err != nil {
+				return 0, err
+			}
+			defer func(decoded io.Closer) {
+				_ = decoded.Close()
+			}(decoded)
+			src = decoded
+		}
+		if sep, ok := rp.Config.chunkSeparator(); ok {
+			result = newParallelReader(src, rp.Config, sep)
+		} else {
+			result = rp.resultReader(rp.Config.transform(rp.sourceReader(src)))
+		}
+	}
+	if plain != nil {
+		result = io.TeeReader(result, plain)
+	}
+	return rp.Config.encodeLayers(dst, result)
+}
+
+// encodeLayers copies src to dst through the encoders of the compression and encryption layers, and returns the number
+// of bytes copied before encoding
+func (rc *replacerConfig) encodeLayers(dst io.Writer, src io.Reader) (int64, error) {
+	var encoders []io.Closer
+	for _, layer := range rc.layers() {
+		encoder, err := layer.NewWriter(dst)
+		if err != nil {
+			return 0, err
+		}
+		encoders = append(encoders, encoder)
+		dst = encoder
+	}
+	wrote, err := io.CopyBuffer(dst, src, rc.copyBuffer())
+	// the innermost encoder flushes into the ones around it, so it is closed first
+	for i := len(encoders) - 1; i >= 0 && err == nil; i-- {
+		err = encoders[i].Close()
+	}
+	return wrote, err
+}
+
+// createTemp creates the temporary file a replaced copy is written to in dir, with the permissions of the file.
+// Replaces create it next to the file, so that it is renamed over the file within a single filesystem.
+// Its name is random rather than taken from the clock, so that concurrent replaces never collide and nothing
+// observable depends on when a replace ran.
+func (rc *replacerConfig) createTemp(dir string) (*os.File, error) {
+	output, err := os.CreateTemp(dir, "tmp-gosed-*")
+	if err != nil {
+		return nil, &ErrTempFileCreate{Dir: dir, Err: err}
+	}
+	if err := output.Chmod(rc.FilePerm); err != nil {
+		_ = output.Close()
+		_ = os.Remove(output.Name())
+		return nil, &ErrTempFileCreate{Dir: dir, Err: err}
+	}
+	return output, nil
+}
+
+// copyBuffer returns the buffer replaces copy their result with
+func (rc *replacerConfig) copyBuffer() []byte {
+	if size := rc.bufferSize(); len(rc.copyBuf) != size {
+		rc.copyBuf = make([]byte, size)
+	}
+	return rc.copyBuf
+}
+
+// singlePass reports whether the configuration needs all mappings applied in a single pass over the file
+func (rc *replacerConfig) singlePass() bool {
+	return rc.MIME || len(rc.ZipMembers) > 0 || rc.Compression != nil || rc.Codec != nil || rc.FrontMatter != 0 || rc.Lexer != nil || rc.KeyValueFormat != 0
+}
+
+// apply runs src through every mapping in memory, reusing the buffers of previous calls
+func (rc *replacerConfig) apply(src []byte) ([]byte, error) {
+	var r io.Reader = bytes.NewReader(src)
+	for index := range rc.Mappings.Keys {
+		if index == len(rc.applyChain) {
+			rc.applyChain = append(rc.applyChain, &BytesReplacingReader{})
+		}
+		r = rc.stage(r, index, rc.applyChain[index])
+	}
+	return ioutil.ReadAll(r)
+}
+
+// sourceReader wraps the reader of the original file with the configured input stages
+func (rp *Replacer) sourceReader(r io.Reader) io.Reader {
+	if rp.Config.Encoding != nil {
+		r, rp.Config.bom = newDecodingReader(r, rp.Config.Encoding)
+	}
+	if rp.Config.UTF8Policy != UTF8Ignore {
+		r = newUTF8ValidatingReader(r, rp.Config, false)
+	}
+	if len(rp.Config.Base64Regions) > 0 {
+		r = newBase64RegionReader(r, rp.Config)
+	}
+	return r
+}
+
+// resultReader wraps the fully replaced stream with the configured output stages
+func (rp *Replacer) resultReader(r io.Reader) io.Reader {
+	if rp.Config.UTF8Policy != UTF8Ignore {
+		r = newUTF8ValidatingReader(r, rp.Config, true)
+	}
+	if rp.Config.Encoding != nil {
+		r = newEncodingReader(r, rp.Config.Encoding, rp.Config.bom)
+	}
+	return r
+}
+
 // DoSequentialReplace does the replace operation without reader chaining, which is slower but less resource intensive.
 func DoSequentialReplace(rp *Replacer) (int, error) {
-	buf := bytes.NewBuffer(make([]byte, 8192))
+	if rp.Config.singlePass() || rp.Config.PatchInPlace || rp.Config.Deterministic || rp.Config.parallel() {
+		return DoChainReplace(rp)
+	}
+	if err := rp.Config.beforeFile(); err != nil {
+		rp.Config.Tx.record(rp.Config.FilePath, err)
+		return 0, err
+	}
+	if skipped, err := rp.guarded(); err != nil || skipped {
+		rp.Config.Tx.record(rp.Config.FilePath, err)
+		return 0, err
+	}
+	wrote, err := rp.retryConcurrentWrites(rp.sequentialReplace)
+	rp.Config.Tx.record(rp.Config.FilePath, err)
+	return wrote, err
+}
+
+// sequentialReplace applies one mapping per pass, each pass reading the copy written by the previous one.
+// Only the copy written by the last pass replaces the file.
+func (rp *Replacer) sequentialReplace() (int, error) {
+	rp.Config.UTF8Errors = nil
+	rp.Config.beginStats()
+	rp.Config.beginProgress(len(rp.Config.Mappings.Keys))
+	rp.Config.beginTrace()
 	replacer := BytesReplacingReader{}
-	DoSingleReplace := func(old, new []byte) (int, error) {
-		tmpFile := path.Join(path.Dir(rp.Config.FilePath), fmt.Sprintf("tmp-gosed-%d", time.Now().UnixNano()))
-		input, err := os.OpenFile(rp.Config.FilePath, os.O_RDWR, rp.Config.FilePerm)
+	replacer.SetBufferSize(rp.Config.bufferSize())
+	last := len(rp.Config.Mappings.Keys) - 1
+	var state *sourceState
+	DoSingleReplace := func(index int, source string, output *os.File) (int64, error) {
+		input, err := os.OpenFile(source, os.O_RDWR, rp.Config.FilePerm)
 		if err != nil {
 			return 0, err
 		}
-		output, err := os.OpenFile(tmpFile, os.O_RDWR|os.O_CREATE, rp.Config.FilePerm)
+		defer func(input *os.File) {
+			_ = input.Close()
+		}(input)
+		var src io.Reader = rp.Config.track(rp.Config.timeRead(input))
+		if index == 0 {
+			if state, err = rp.Config.watchSource(input); err != nil {
+				return 0, err
+			}
+			src = state.reader(src)
+		}
+		src = bufio.NewReaderSize(src, rp.Config.bufferSize())
+		if index == 0 {
+			src = rp.sourceReader(src)
+		}
+		result := rp.Config.stage(src, index, &replacer)
+		if index == last {
+			result = rp.resultReader(result)
+		}
+		if cw := rp.Config.newCloneWriter(output, input); cw != nil {
+			wrote, err := io.CopyBuffer(rp.Config.timeWrite(cw), result, rp.Config.copyBuffer())
+			if err != nil {
+				return 0, err
+			}
+			return wrote, cw.finish()
+		}
+		if sw := rp.Config.newSparseWriter(output, input); sw != nil {
+			wrote, err := io.CopyBuffer(rp.Config.timeWrite(sw), result, rp.Config.copyBuffer())
+			if err != nil {
+				return 0, err
+			}
+			return wrote, sw.finish()
+		}
+		return io.CopyBuffer(rp.Config.timeWrite(output), result, rp.Config.copyBuffer())
+	}
+	var count int
+	var wrote int64
+	source := rp.Config.FilePath
+	for index := range rp.Config.Mappings.Keys {
+		output, err := rp.Config.createTemp(filepath.Dir(rp.Config.FilePath))
+		if err != nil {
+			if source != rp.Config.FilePath {
+				_ = os.Remove(source)
+			}
+			return count, err
+		}
+		tmpFile := output.Name()
+		wrote, err = DoSingleReplace(index, source, output)
+		_ = output.Close()
+		if source != rp.Config.FilePath {
+			_ = os.Remove(source)
+		}
 		if err != nil {
+			_ = os.Remove(tmpFile)
+			return count, err
+		}
+		source = tmpFile
+		count += int(wrote)
+	}
+	var differ *lineDiffer
+	if source != rp.Config.FilePath {
+		var err error
+		if differ, err = rp.Config.diffFile(source); err != nil {
+			_ = os.Remove(source)
 			return 0, err
 		}
-		defer func(input, output *os.File) {
-			_ = input.Close()
-			_ = input.Close()
-		}(input, output)
-		replacer.Reset(bufio.NewReaderSize(input, 8192), old, new)
-		wrote, err := io.CopyBuffer(output, &replacer, buf.Bytes())
-		if err != nil {
+		rp.Config.rendered()
+		if err := rp.afterFile(source, wrote); err != nil {
 			return 0, err
 		}
-		if err := os.Rename(tmpFile, rp.Config.FilePath); err != nil {
+		committed, err := rp.Config.recordUndo(differ)
+		if err != nil {
+			_ = os.Remove(source)
 			return 0, err
 		}
-		rp.Config.FileSize = wrote
-		return int(wrote), nil
-	}
-	var count int
-	for index, key := range rp.Config.Mappings.Keys {
-		wrote, err := DoSingleReplace(key, rp.Config.Mappings.Indices[index])
+		err = rp.commit(source, state)
+		committed(err)
 		if err != nil {
-			return count, err
+			return 0, err
 		}
-		count += wrote
-		rp.Config.FileSize = int64(wrote)
+		rp.Config.FileSize = wrote
 	}
-	rp.Config.Mappings.Indices = rp.Config.Mappings.Indices[:0]
-	rp.Config.Mappings.Keys = rp.Config.Mappings.Keys[:0]
-	return count, nil
+	rp.Config.finishStats(wrote)
+	rp.Config.finishProgress()
+	rp.Config.finishTrace()
+	rp.Config.spend()
+	return count, rp.Config.writeDiff(differ)
 
 }
 
 // DoChainReplace does the replace operation with reader chaining, which is faster but more resource intensive.
 func DoChainReplace(rp *Replacer) (int, error) {
-	tmpfile := fmt.Sprintf("tmp-gosed-%d", time.Now().UnixNano())
+	var wrote int
+	err := rp.Config.beforeFile()
+	skipped := false
+	if err == nil {
+		skipped, err = rp.guarded()
+	}
+	switch {
+	case skipped:
+		// the file is left as it was, modification time included
+		return 0, nil
+	case err != nil:
+	case rp.Config.PatchInPlace && rp.Config.Tx != nil:
+		err = errTxPatchInPlace
+	case rp.Config.PatchInPlace && len(rp.Config.AfterHooks) > 0:
+		err = errHookPatchInPlace
+	case rp.Config.PatchInPlace && rp.Config.diffed():
+		err = errDiffUnsupported
+	case rp.Config.PatchInPlace:
+		wrote, err = rp.patchInPlace()
+	default:
+		wrote, err = rp.retryConcurrentWrites(rp.chainReplace)
+	}
+	if err != nil {
+		rp.Config.Tx.record(rp.Config.FilePath, err)
+		return wrote, err
+	}
+	// a staged file gets its modification time once the transaction is applied
+	if rp.Config.Tx != nil {
+		return wrote, nil
+	}
+	return wrote, rp.Config.fixModTime()
+}
+
+func (rp *Replacer) chainReplace() (int, error) {
+	if rp.Config.Codec != nil && len(rp.Config.ZipMembers) > 0 {
+		return 0, errCodecZip
+	}
+	if rp.Config.diffed() && len(rp.Config.ZipMembers) > 0 {
+		return 0, errDiffUnsupported
+	}
 	input, err := os.OpenFile(rp.Config.FilePath, os.O_RDWR, rp.Config.FilePerm)
 	if err != nil {
 		return 0, err
 	}
-	output, err := os.OpenFile(tmpfile, os.O_RDWR|os.O_CREATE, rp.Config.FilePerm)
+	defer func(input *os.File) {
+		_ = input.Close()
+	}(input)
+	output, err := rp.Config.createTemp(filepath.Dir(rp.Config.FilePath))
 	if err != nil {
 		return 0, err
 	}
-	defer func(input, output *os.File) {
-		_ = input.Close()
-		_ = input.Close()
-	}(input, output)
-	var replacer = NewBytesReplacingReader(bufio.NewReaderSize(input, 8192), rp.Config.Mappings.Keys[0], rp.Config.Mappings.Indices[0])
-	//replacer.SetBufferSize(8192*4)
-	for index, key := range rp.Config.Mappings.Keys {
-		if index == 0 {
-			continue
+	tmpfile := output.Name()
+	defer func(output *os.File) {
+		_ = output.Close()
+	}(output)
+	state, err := rp.Config.watchSource(input)
+	if err != nil {
+		_ = os.Remove(tmpfile)
+		return 0, err
+	}
+	rp.Config.UTF8Errors = nil
+	rp.Config.beginStats()
+	rp.Config.beginProgress(1)
+	rp.Config.beginTrace()
+	var sink io.Writer = output
+	cw := rp.Config.newCloneWriter(output, input)
+	var sw *sparseWriter
+	if cw != nil {
+		sink = cw
+	} else if sw = rp.Config.newSparseWriter(output, input); sw != nil {
+		sink = sw
+	}
+	sink = rp.Config.timeWrite(sink)
+	differ, closeOrig, err := rp.Config.newDiffer()
+	if err != nil {
+		_ = os.Remove(tmpfile)
+		return 0, err
+	}
+	defer closeOrig()
+	var wrote int64
+	if len(rp.Config.ZipMembers) > 0 {
+		var fd os.FileInfo
+		if fd, err = input.Stat(); err != nil {
+			_ = os.Remove(tmpfile)
+			return 0, err
 		}
-		replacer = NewBytesReplacingReader(replacer, key, rp.Config.Mappings.Indices[index])
+		wrote, err = rp.render(nil, rp.Config.trackAt(rp.Config.timeReadAt(state.readerAt(input))), fd.Size(), sink, nil)
+	} else {
+		wrote, err = rp.render(state.reader(rp.Config.track(rp.Config.timeRead(input))), nil, 0, sink, differ.plain())
+	}
+	if err == nil && differ != nil {
+		err = differ.finish()
+	}
+	if err == nil && cw != nil {
+		err = cw.finish()
+	}
+	if err == nil && sw != nil {
+		err = sw.finish()
+	}
+	if err == nil && rp.Config.Deterministic {
+		err = rp.selfCheck(output)
 	}
-	wrote, err := io.CopyBuffer(output, replacer, make([]byte, 8192))
 	if err != nil {
+		_ = os.Remove(tmpfile)
 		return 0, err
 	}
-	if err := os.Remove(rp.Config.FilePath); err != nil {
+	rp.Config.rendered()
+	if err := rp.afterFile(tmpfile, wrote); err != nil {
 		return 0, err
 	}
-	if err := os.Rename(tmpfile, rp.Config.FilePath); err != nil {
+	committed, err := rp.Config.recordUndo(differ)
+	if err != nil {
+		_ = os.Remove(tmpfile)
+		return 0, err
+	}
+	err = rp.commit(tmpfile, state)
+	committed(err)
+	if err != nil {
 		return 0, err
 	}
 	rp.Config.FileSize = wrote
-	rp.Config.Mappings.Indices = rp.Config.Mappings.Indices[:0]
-	rp.Config.Mappings.Keys = rp.Config.Mappings.Keys[:0]
-	return int(wrote), nil
+	rp.Config.finishStats(wrote)
+	rp.Config.finishProgress()
+	rp.Config.finishTrace()
+	rp.Config.spend()
+	return int(wrote), rp.Config.writeDiff(differ)
 }
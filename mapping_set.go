@@ -0,0 +1,48 @@
+package gosed
+
+// MappingSet holds the mappings of the replacers that apply the same substitutions to several files or resources,
+// such as Batch, DirReplacer, FSReplacer, RemoteReplacer and RuleSet, which embed it. A ReplacerPool keeps one for
+// every named mapping set.
+type MappingSet struct {
+	mappings *replacerMappings
+}
+
+// newMappingSet returns an empty MappingSet
+func newMappingSet() MappingSet {
+	return MappingSet{
+		mappings: &replacerMappings{
+			Keys:    make([][]byte, 0),
+			Indices: make([][]byte, 0),
+			Options: make([]*mappingOptions, 0),
+		},
+	}
+}
+
+// NewMapping maps a new oldString:newString []byte entry
+func (ms *MappingSet) NewMapping(oldString, newString []byte) error {
+	switch len(oldString) {
+	case 0:
+		return ErrEmptyKey
+	}
+	ms.mappings.add(oldString, newString, nil)
+	return nil
+}
+
+// NewMappingWithOptions maps a new oldString:newString []byte entry that matches according to opts
+func (ms *MappingSet) NewMappingWithOptions(oldString, newString []byte, opts ...MappingOption) error {
+	switch len(oldString) {
+	case 0:
+		return ErrEmptyKey
+	}
+	mo := &mappingOptions{}
+	for _, opt := range opts {
+		opt(mo)
+	}
+	ms.mappings.add(oldString, newString, mo)
+	return nil
+}
+
+// NewStringMapping maps a new oldString:newString string entry
+func (ms *MappingSet) NewStringMapping(oldString, newString string) error {
+	return ms.NewMapping([]byte(oldString), []byte(newString))
+}
@@ -0,0 +1,231 @@
+package gosed
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrInvalidMappingFile is returned by LoadMappings for data it cannot parse
+var ErrInvalidMappingFile = errors.New("invalid mapping file")
+
+// MappingFormat is the format of a file of mappings
+type MappingFormat int
+
+const (
+	// MappingJSON is a JSON object of old strings to new ones: {"old": "new"}
+	MappingJSON MappingFormat = iota + 1
+	// MappingYAML is a YAML mapping of old strings to new ones; any scalar value stands for its text
+	MappingYAML
+	// MappingCSV is a CSV file of two columns, the old string and the new one, without a header
+	MappingCSV
+)
+
+func (f MappingFormat) String() string {
+	switch f {
+	case MappingJSON:
+		return "JSON"
+	case MappingYAML:
+		return "YAML"
+	case MappingCSV:
+		return "CSV"
+	}
+	return fmt.Sprintf("MappingFormat(%d)", int(f))
+}
+
+// LoadMappings adds the mappings read from r, so that large substitution tables can be kept as data files. They are
+// added in the order of the file, duplicate keys included, and all or none of them are: if the data is invalid or
+// holds an empty key, an error is returned and no mapping is added.
+func (rp *Replacer) LoadMappings(r io.Reader, format MappingFormat) error {
+	var pairs [][2][]byte
+	var err error
+	switch format {
+	case MappingJSON:
+		pairs, err = readJSONMappings(r)
+	case MappingYAML:
+		pairs, err = readYAMLMappings(r)
+	case MappingCSV:
+		pairs, err = readCSVMappings(r)
+	default:
+		return fmt.Errorf("unknown mapping format %v", format)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidMappingFile, err)
+	}
+	for _, pair := range pairs {
+		if len(pair[0]) == 0 {
+			return ErrEmptyKey
+		}
+	}
+	for _, pair := range pairs {
+		rp.Config.Mappings.add(pair[0], pair[1], nil)
+	}
+	return nil
+}
+
+// ExportMappings writes the mappings in a form LoadMappings reads back. Only plain mappings can be written; JSON and
+// YAML can only hold valid UTF-8.
+func (rp *Replacer) ExportMappings(w io.Writer, format MappingFormat) error {
+	rm := rp.Config.Mappings
+	for index, key := range rm.Keys {
+		if rm.Options[index] != nil {
+			return fmt.Errorf("the mapping of %q has matching options and cannot be exported", key)
+		}
+		if format != MappingCSV && (!utf8.Valid(key) || !utf8.Valid(rm.Indices[index])) {
+			return fmt.Errorf("the mapping of %q is not valid UTF-8 and cannot be exported as %v", key, format)
+		}
+	}
+	switch format {
+	case MappingJSON:
+		return writeJSONMappings(w, rm)
+	case MappingYAML:
+		return writeYAMLMappings(w, rm)
+	case MappingCSV:
+		return writeCSVMappings(w, rm)
+	}
+	return fmt.Errorf("unknown mapping format %v", format)
+}
+
+// readJSONMappings reads the members of a JSON object in order, which decoding into a map would lose
+func readJSONMappings(r io.Reader) ([][2][]byte, error) {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, errors.New("expected a JSON object")
+	}
+	var pairs [][2][]byte
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var value string
+		if err := dec.Decode(&value); err != nil {
+			return nil, fmt.Errorf("value of %q: %v", key, err)
+		}
+		pairs = append(pairs, [2][]byte{[]byte(key.(string)), []byte(value)})
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("data after the JSON object")
+	}
+	return pairs, nil
+}
+
+// readYAMLMappings reads the pairs of a YAML mapping in order
+func readYAMLMappings(r io.Reader) ([][2][]byte, error) {
+	var doc yaml.Node
+	if err := yaml.NewDecoder(r).Decode(&doc); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	root := resolveYAML(&doc)
+	if root.Kind == yaml.DocumentNode && len(root.Content) == 1 {
+		root = resolveYAML(root.Content[0])
+	}
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: expected a YAML mapping", root.Line)
+	}
+	var pairs [][2][]byte
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := resolveYAML(root.Content[i]), resolveYAML(root.Content[i+1])
+		if key.Kind != yaml.ScalarNode || value.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("line %d: keys and values must be scalars", key.Line)
+		}
+		if value.Tag == "!!null" {
+			value = &yaml.Node{}
+		}
+		pairs = append(pairs, [2][]byte{[]byte(key.Value), []byte(value.Value)})
+	}
+	return pairs, nil
+}
+
+// resolveYAML returns the node an alias stands for
+func resolveYAML(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	return node
+}
+
+// readCSVMappings reads the records of a two-column CSV file
+func readCSVMappings(r io.Reader) ([][2][]byte, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 2
+	var pairs [][2][]byte
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return pairs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, [2][]byte{[]byte(record[0]), []byte(record[1])})
+	}
+}
+
+// writeJSONMappings writes the mappings as a JSON object, one member per line
+func writeJSONMappings(w io.Writer, rm *replacerMappings) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	buf.WriteString("{")
+	for index, key := range rm.Keys {
+		if index > 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n  ")
+		// the encoder ends every value with a line feed, which is dropped
+		for _, s := range [][]byte{key, rm.Indices[index]} {
+			if err := enc.Encode(string(s)); err != nil {
+				return err
+			}
+			buf.Truncate(buf.Len() - 1)
+			buf.WriteString(": ")
+		}
+		buf.Truncate(buf.Len() - 2)
+	}
+	if len(rm.Keys) > 0 {
+		buf.WriteString("\n")
+	}
+	buf.WriteString("}\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeYAMLMappings writes the mappings as a YAML mapping of strings
+func writeYAMLMappings(w io.Writer, rm *replacerMappings) error {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	for index, key := range rm.Keys {
+		root.Content = append(root.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: string(key)},
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: string(rm.Indices[index])})
+	}
+	enc := yaml.NewEncoder(w)
+	if err := enc.Encode(root); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// writeCSVMappings writes the mappings as two-column CSV records
+func writeCSVMappings(w io.Writer, rm *replacerMappings) error {
+	cw := csv.NewWriter(w)
+	for index, key := range rm.Keys {
+		if err := cw.Write([]string{string(key), string(rm.Indices[index])}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
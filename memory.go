@@ -0,0 +1,31 @@
+package gosed
+
+import (
+	"bytes"
+	"io/ioutil"
+)
+
+// ReplaceBytes returns src with the mappings applied in order, as ReplaceChained applies them to a file, along with
+// the statistics of the replace, for content already in memory: small payloads, and tests that would otherwise go
+// through temporary files. src is left as it is.
+func ReplaceBytes(src []byte, mappings ...Mapping) ([]byte, Stats, error) {
+	if err := checkMappings(mappings); err != nil {
+		return nil, Stats{}, err
+	}
+	rc := newStreamConfig(mappings)
+	rc.FileSize = int64(len(src))
+	rc.beginStats()
+	rc.stats.read = int64(len(src))
+	out, err := ioutil.ReadAll(rc.chain(bytes.NewReader(src)))
+	if err != nil {
+		return nil, Stats{}, err
+	}
+	rc.finishStats(int64(len(out)))
+	return out, (&Replacer{Config: rc}).Stats(), nil
+}
+
+// ReplaceString is ReplaceBytes for strings
+func ReplaceString(src string, mappings ...Mapping) (string, Stats, error) {
+	out, stats, err := ReplaceBytes([]byte(src), mappings...)
+	return string(out), stats, err
+}
@@ -0,0 +1,327 @@
+package gosed
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+)
+
+// WithMIMEMessage treats the file as an RFC 2822 message, or an mbox archive of them, and applies the mappings to the
+// decoded bodies of its text parts only. Headers and non-text parts are left untouched, quoted-printable and base64 parts
+// are re-encoded, and multipart boundaries are recalculated when a rewritten part would collide with them.
+// Messages are buffered whole, so they are bounded by the max record length.
+func WithMIMEMessage() Option {
+	return func(c *replacerConfig) {
+		c.MIME = true
+	}
+}
+
+// mimeReader rewrites a stream of messages one at a time
+type mimeReader struct {
+	rr  *recordReader
+	rc  *replacerConfig
+	out []byte
+	// next holds the line that starts the next message of an mbox archive
+	next []byte
+	msg  []byte
+	err  error
+	// mbox is set when the file starts with a "From " line, blank when the last line read was empty
+	mbox, started, blank bool
+}
+
+func newMIMEReader(r io.Reader, rc *replacerConfig) *mimeReader {
+	return &mimeReader{rr: newRecordReader(r, '\n', rc.MaxRecordLength), rc: rc}
+}
+
+// Read implements the `io.Reader` interface.
+func (mr *mimeReader) Read(p []byte) (int, error) {
+	for len(mr.out) == 0 {
+		if mr.err != nil {
+			return 0, mr.err
+		}
+		mr.err = mr.readMessage()
+		if len(mr.msg) == 0 {
+			continue
+		}
+		from, msg := []byte(nil), mr.msg
+		if bytes.HasPrefix(msg, []byte("From ")) {
+			i := bytes.IndexByte(msg, '\n') + 1
+			from, msg = msg[:i], msg[i:]
+		}
+		rewritten, err := rewriteMIMEEntity(msg, mr.rc.apply)
+		if err != nil {
+			mr.err = err
+			return 0, err
+		}
+		mr.out = append(append(mr.out, from...), rewritten...)
+	}
+	n := copy(p, mr.out)
+	mr.out = mr.out[n:]
+	return n, nil
+}
+
+// readMessage collects the next message into mr.msg. In an mbox archive, that is a file starting with a "From " line,
+// every line starting with "From " after an empty line begins a new message.
+func (mr *mimeReader) readMessage() error {
+	mr.msg = append(mr.msg[:0], mr.next...)
+	mr.next = mr.next[:0]
+	for {
+		line, err := mr.rr.ReadRecord()
+		from := bytes.HasPrefix(line, []byte("From "))
+		if !mr.started && len(line) > 0 {
+			mr.started, mr.mbox = true, from
+		}
+		if mr.mbox && from && mr.blank && len(mr.msg) > 0 {
+			mr.next = append(mr.next, line...)
+			mr.blank = false
+			return err
+		}
+		mr.blank = len(bytes.TrimRight(line, "\r\n")) == 0
+		mr.msg = append(mr.msg, line...)
+		if limit := mr.rc.MaxRecordLength; limit > 0 && len(mr.msg) > limit {
+			return fmt.Errorf("%w: message is longer than %d bytes", ErrRecordTooLong, limit)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// rewriteMIMEEntity applies fn to the text of a message or body part and returns the re-encoded entity.
+func rewriteMIMEEntity(raw []byte, fn func([]byte) ([]byte, error)) ([]byte, error) {
+	header, body := splitMIMEHeader(raw)
+	fields, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(header))).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		// not a parsable header block, so there is nothing we can safely scope the mappings to
+		return raw, nil
+	}
+	mediaType, params, err := mime.ParseMediaType(fields.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	var rewritten []byte
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "":
+		rewritten, header, err = rewriteMultipart(header, body, params["boundary"], fn)
+	case mediaType == "message/rfc822":
+		rewritten, err = rewriteMIMEEntity(body, fn)
+	case strings.HasPrefix(mediaType, "text/"):
+		rewritten, err = rewriteMIMEText(body, strings.ToLower(fields.Get("Content-Transfer-Encoding")), fn)
+	default:
+		return raw, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, header...), rewritten...), nil
+}
+
+// splitMIMEHeader splits an entity after the empty line that ends its header.
+func splitMIMEHeader(raw []byte) ([]byte, []byte) {
+	for i := 0; i < len(raw); {
+		end := bytes.IndexByte(raw[i:], '\n')
+		if end < 0 {
+			break
+		}
+		line := raw[i : i+end+1]
+		i += end + 1
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return raw[:i], raw[i:]
+		}
+	}
+	return raw, nil
+}
+
+// rewriteMIMEText decodes a text body according to its transfer encoding, applies fn and encodes it again.
+func rewriteMIMEText(body []byte, cte string, fn func([]byte) ([]byte, error)) ([]byte, error) {
+	nl := []byte("\n")
+	if bytes.Contains(body, []byte("\r\n")) {
+		nl = []byte("\r\n")
+	}
+	var decoded []byte
+	var err error
+	switch cte {
+	case "quoted-printable":
+		decoded, err = ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+	case "base64":
+		compact := bytes.Join(bytes.Fields(body), nil)
+		decoded = make([]byte, base64.StdEncoding.DecodedLen(len(compact)))
+		var n int
+		n, err = base64.StdEncoding.Decode(decoded, compact)
+		decoded = decoded[:n]
+	default:
+		return fn(body)
+	}
+	if err != nil {
+		return body, nil
+	}
+	replaced, err := fn(decoded)
+	if err != nil || bytes.Equal(replaced, decoded) {
+		return body, err
+	}
+	var out bytes.Buffer
+	switch cte {
+	case "quoted-printable":
+		w := quotedprintable.NewWriter(&out)
+		if _, err := w.Write(replaced); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		encoded := bytes.ReplaceAll(out.Bytes(), []byte("\r\n"), nl)
+		if bytes.HasSuffix(body, nl) && !bytes.HasSuffix(encoded, nl) {
+			encoded = append(encoded, nl...)
+		}
+		return encoded, nil
+	default:
+		encoded := base64.StdEncoding.EncodeToString(replaced)
+		for len(encoded) > 76 {
+			out.WriteString(encoded[:76])
+			out.Write(nl)
+			encoded = encoded[76:]
+		}
+		out.WriteString(encoded)
+		out.Write(nl)
+		return out.Bytes(), nil
+	}
+}
+
+// rewriteMultipart rewrites every part of a multipart body. If a rewritten part now contains the delimiter,
+// a new boundary derived from the content is chosen and the Content-Type header is updated to match.
+func rewriteMultipart(header, body []byte, boundary string, fn func([]byte) ([]byte, error)) ([]byte, []byte, error) {
+	delimiter := []byte("--" + boundary)
+	closing := []byte("--" + boundary + "--")
+	// separators[i] holds the raw text before parts[i]: the preamble or previous line break, and the delimiter line
+	var separators, parts [][]byte
+	last := 0
+	for i := 0; i < len(body); {
+		end := bytes.IndexByte(body[i:], '\n')
+		if end < 0 {
+			end = len(body) - i - 1
+		}
+		line := body[i : i+end+1]
+		start := i
+		i += end + 1
+		trimmed := bytes.TrimRight(line, " \t\r\n")
+		if !bytes.Equal(trimmed, delimiter) && !bytes.Equal(trimmed, closing) {
+			continue
+		}
+		if len(separators) > 0 {
+			// the line break before a delimiter belongs to the delimiter
+			partEnd := start
+			if partEnd > last && body[partEnd-1] == '\n' {
+				partEnd--
+				if partEnd > last && body[partEnd-1] == '\r' {
+					partEnd--
+				}
+			}
+			parts = append(parts, body[last:partEnd])
+			start = partEnd
+		}
+		separators = append(separators, body[start:i])
+		last = i
+		if len(trimmed) > len(delimiter) {
+			break
+		}
+	}
+	if len(separators) == 0 || len(parts) != len(separators)-1 {
+		return body, header, nil
+	}
+	epilogue := body[last:]
+	collides := false
+	hash := sha256.New()
+	for i, part := range parts {
+		rewritten, err := rewriteMIMEEntity(part, fn)
+		if err != nil {
+			return nil, nil, err
+		}
+		parts[i] = rewritten
+		collides = collides || bytes.Contains(rewritten, delimiter)
+		hash.Write(rewritten)
+	}
+	newBoundary := boundary
+	for collides {
+		newBoundary = "gosed-" + hex.EncodeToString(hash.Sum(nil))[:32]
+		collides = false
+		for _, part := range parts {
+			collides = collides || bytes.Contains(part, []byte("--"+newBoundary))
+		}
+		hash.Write([]byte(newBoundary))
+	}
+	var out bytes.Buffer
+	for i, sep := range separators {
+		at := bytes.LastIndex(sep, delimiter)
+		out.Write(sep[:at])
+		out.WriteString("--" + newBoundary)
+		out.Write(sep[at+len(delimiter):])
+		if i < len(parts) {
+			out.Write(parts[i])
+		}
+	}
+	out.Write(epilogue)
+	if newBoundary != boundary {
+		header = replaceMIMEBoundary(header, newBoundary)
+	}
+	return out.Bytes(), header, nil
+}
+
+// replaceMIMEBoundary sets the boundary parameter of the (possibly folded) Content-Type field of header.
+// The field is rebuilt from its parsed value, so it is no longer folded.
+func replaceMIMEBoundary(header []byte, newBoundary string) []byte {
+	out := make([]byte, 0, len(header)+len(newBoundary))
+	var field []byte
+	flush := func() {
+		if field == nil {
+			return
+		}
+		colon := bytes.IndexByte(field, ':')
+		value := strings.TrimSpace(strings.NewReplacer("\r\n", "", "\n", "").Replace(string(field[colon+1:])))
+		mediaType, params, err := mime.ParseMediaType(value)
+		formatted := ""
+		if err == nil {
+			params["boundary"] = newBoundary
+			formatted = mime.FormatMediaType(mediaType, params)
+		}
+		if formatted == "" {
+			out = append(out, field...)
+		} else {
+			nl := "\n"
+			if bytes.HasSuffix(field, []byte("\r\n")) {
+				nl = "\r\n"
+			}
+			out = append(out, field[:colon+1]...)
+			out = append(out, " "+formatted+nl...)
+		}
+		field = nil
+	}
+	for len(header) > 0 {
+		end := bytes.IndexByte(header, '\n') + 1
+		if end == 0 {
+			end = len(header)
+		}
+		line := header[:end]
+		header = header[end:]
+		if field != nil && len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			field = append(field, line...)
+			continue
+		}
+		flush()
+		if bytes.HasPrefix(bytes.ToLower(line), []byte("content-type:")) {
+			field = append([]byte{}, line...)
+			continue
+		}
+		out = append(out, line...)
+	}
+	flush()
+	return out
+}
@@ -0,0 +1,182 @@
+package gosed
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// maxNumberLen bounds the length of a number matched by a numeric mapping, and of its replacement
+const maxNumberLen = 32
+
+// NumberTransform computes the replacement of a number matched by a numeric mapping. It returns the number unchanged
+// if it does not apply to it, e.g. Add on a version number.
+type NumberTransform func(number []byte) []byte
+
+// Add adds n to an integer
+func Add(n int64) NumberTransform {
+	return func(number []byte) []byte {
+		v, err := strconv.ParseInt(string(number), 10, 64)
+		if err != nil || (n > 0 && v > v+n) || (n < 0 && v < v+n) {
+			return number
+		}
+		return strconv.AppendInt(nil, v+n, 10)
+	}
+}
+
+// Multiply multiplies an integer by n
+func Multiply(n int64) NumberTransform {
+	return func(number []byte) []byte {
+		v, err := strconv.ParseInt(string(number), 10, 64)
+		if err != nil || (v != 0 && (v*n)/v != n) {
+			return number
+		}
+		return strconv.AppendInt(nil, v*n, 10)
+	}
+}
+
+// ZeroPad pads an integer with leading zeros to width digits
+func ZeroPad(width int) NumberTransform {
+	return func(number []byte) []byte {
+		digits, sign := number, []byte(nil)
+		if len(digits) > 0 && digits[0] == '-' {
+			digits, sign = digits[1:], digits[:1]
+		}
+		if len(digits) == 0 || len(digits) >= width || bytes.IndexByte(digits, '.') >= 0 {
+			return number
+		}
+		padded := append([]byte{}, sign...)
+		padded = append(padded, bytes.Repeat([]byte{'0'}, width-len(digits))...)
+		return append(padded, digits...)
+	}
+}
+
+// SemverPart is a component of a semantic version
+type SemverPart int
+
+const (
+	SemverMajor SemverPart = iota
+	SemverMinor
+	SemverPatch
+)
+
+// BumpSemver increments a component of a MAJOR.MINOR.PATCH version and resets the components after it to 0
+func BumpSemver(part SemverPart) NumberTransform {
+	return func(number []byte) []byte {
+		fields := bytes.Split(number, []byte{'.'})
+		if len(fields) != 3 {
+			return number
+		}
+		var version [3]uint64
+		for i, field := range fields {
+			v, err := strconv.ParseUint(string(field), 10, 64)
+			if err != nil {
+				return number
+			}
+			version[i] = v
+		}
+		version[part]++
+		for i := int(part) + 1; i < len(version); i++ {
+			version[i] = 0
+		}
+		return []byte(fmt.Sprintf("%d.%d.%d", version[0], version[1], version[2]))
+	}
+}
+
+// NewNumericMapping replaces the number following every occurrence of prefix with the result of the transforms,
+// applied in order: with the prefix "port = " and Add(1000), "port = 8080" becomes "port = 9080". A number is an
+// optional minus sign and digits, possibly separated by single dots, such as a version; numbers longer than
+// 32 bytes, and results that would be, are left as they are.
+func (rp *Replacer) NewNumericMapping(prefix []byte, transforms ...NumberTransform) error {
+	switch len(prefix) {
+	case 0:
+		return ErrEmptyKey
+	}
+	rp.Config.Mappings.add(prefix, nil, &mappingOptions{Number: append([]NumberTransform{}, transforms...)})
+	return nil
+}
+
+// numericReplacer is a BytesReplacer that matches a prefix followed by a number, and replaces the number
+type numericReplacer struct {
+	prefix     []byte
+	transforms []NumberTransform
+	replace    []byte
+}
+
+func newNumericReplacer(prefix []byte, transforms []NumberTransform) *numericReplacer {
+	return &numericReplacer{prefix: prefix, transforms: transforms}
+}
+
+func (r *numericReplacer) GetSizingHints() (int, int, float64) {
+	return len(r.prefix) + maxNumberLen, len(r.prefix) + maxNumberLen, float64(len(r.prefix)+1) / float64(len(r.prefix)+maxNumberLen)
+}
+
+// LookaroundHints asks for the two bytes after a number, to tell whether it continues with more digits or a dot
+func (r *numericReplacer) LookaroundHints() (int, int) {
+	return 0, 2
+}
+
+// FilterMatch rejects numbers that were cut at the maximum number length
+func (r *numericReplacer) FilterMatch(before, match, after []byte) bool {
+	return len(after) == 0 || !isDigit(after[0])
+}
+
+// BestIndex returns the first occurrence of the prefix followed by a number, and its replacement
+func (r *numericReplacer) BestIndex(buf []byte) (int, []byte, []byte) {
+	for from := 0; ; {
+		index := bytes.Index(buf[from:], r.prefix)
+		if index < 0 {
+			return -1, r.prefix, nil
+		}
+		index += from
+		start := index + len(r.prefix)
+		if end := numberEnd(buf, start); end > start {
+			r.replace = append(append(r.replace[:0], r.prefix...), r.transform(buf[start:end])...)
+			return index, buf[index:end], r.replace
+		}
+		from = index + 1
+	}
+}
+
+// transform applies the transforms to number
+func (r *numericReplacer) transform(number []byte) []byte {
+	result := number
+	for _, t := range r.transforms {
+		result = t(result)
+	}
+	if len(result) > maxNumberLen {
+		return number
+	}
+	return result
+}
+
+// numberEnd returns the end of the number starting at buf[start], or start if there is none there
+func numberEnd(buf []byte, start int) int {
+	i := start
+	if i < len(buf) && buf[i] == '-' {
+		i++
+	}
+	digits := i
+	for i < len(buf) && i-start < maxNumberLen {
+		switch {
+		case isDigit(buf[i]):
+			i++
+		case buf[i] == '.' && i > digits && isDigit(buf[i-1]) && i+1 < len(buf) && isDigit(buf[i+1]):
+			i++
+		default:
+			return endOfDigits(i, digits, start)
+		}
+	}
+	return endOfDigits(i, digits, start)
+}
+
+func endOfDigits(i, digits, start int) int {
+	if i == digits {
+		return start
+	}
+	return i
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
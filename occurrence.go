@@ -0,0 +1,101 @@
+package gosed
+
+import (
+	"bytes"
+)
+
+// Limit replaces at most the first n matches of the key, like sed's s command without the g flag for n = 1.
+func Limit(n int) MappingOption {
+	return func(o *mappingOptions) {
+		o.Limit = n
+	}
+}
+
+// Occurrence only replaces the nth match of the key, counting from 1, like sed's s/old/new/N.
+func Occurrence(n int) MappingOption {
+	return func(o *mappingOptions) {
+		o.Occurrence = n
+	}
+}
+
+// FirstPerLine only replaces the first match of the key on every line.
+func FirstPerLine() MappingOption {
+	return func(o *mappingOptions) {
+		o.FirstPerLine = true
+	}
+}
+
+// limited reports whether the options restrict which matches of the key are replaced
+func (o *mappingOptions) limited() bool {
+	return o.Limit > 0 || o.Occurrence > 0 || o.perLine()
+}
+
+// perLine reports whether the options count matches per line
+func (o *mappingOptions) perLine() bool {
+	return o.FirstPerLine || o.LineOccurrence > 0
+}
+
+// occurrenceFilter decides which matches the occurrence options replace
+type occurrenceFilter struct {
+	opts *mappingOptions
+	// seen counts the matches, onLine those on the current line, and replaced the matches replaced
+	seen, onLine, replaced int
+}
+
+// newLine starts counting the matches of a new line
+func (f *occurrenceFilter) newLine() {
+	f.onLine = 0
+}
+
+// keep counts the next match and reports whether it is left as it is
+func (f *occurrenceFilter) keep() bool {
+	f.seen++
+	f.onLine++
+	keep := (f.opts.Occurrence > 0 && f.seen != f.opts.Occurrence) ||
+		(f.opts.FirstPerLine && f.onLine > 1) ||
+		(f.opts.LineOccurrence > 0 && (f.onLine < f.opts.LineOccurrence || f.onLine > f.opts.LineOccurrence && !f.opts.LineOccurrenceOnward)) ||
+		(f.opts.Limit > 0 && f.replaced >= f.opts.Limit)
+	if !keep {
+		f.replaced++
+	}
+	return keep
+}
+
+// occurrenceReplacer leaves the matches of the wrapped BytesReplacer the occurrence options exclude as they are.
+// Matches are counted over everything a reader sees, so in scoped replaces they are counted per scope.
+type occurrenceReplacer struct {
+	BytesReplacer
+	occurrenceFilter
+	// sep ends the lines matches are counted on
+	sep byte
+}
+
+func (o *occurrenceReplacer) LookaroundHints() (int, int) {
+	if f, ok := o.BytesReplacer.(BytesMatchFilter); ok {
+		return f.LookaroundHints()
+	}
+	return 0, 0
+}
+
+func (o *occurrenceReplacer) FilterMatch(before, match, after []byte) bool {
+	if f, ok := o.BytesReplacer.(BytesMatchFilter); ok {
+		return f.FilterMatch(before, match, after)
+	}
+	return true
+}
+
+func (o *occurrenceReplacer) ExpandMatch(match, replace []byte) []byte {
+	return expandMatch(o.BytesReplacer, match, replace)
+}
+
+// Pass implements matchKeeper, starting a new line after every separator
+func (o *occurrenceReplacer) Pass(span []byte) {
+	if o.opts.perLine() && bytes.IndexByte(span, o.sep) >= 0 {
+		o.newLine()
+	}
+}
+
+// KeepMatch implements matchKeeper
+func (o *occurrenceReplacer) KeepMatch() bool {
+	return o.keep()
+}
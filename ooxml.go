@@ -0,0 +1,180 @@
+package gosed
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// officeXMLParts are the parts of .docx, .xlsx and .pptx packages that hold document text
+var officeXMLParts = []string{
+	"word/document.xml",
+	"word/header*.xml",
+	"word/footer*.xml",
+	"word/footnotes.xml",
+	"word/endnotes.xml",
+	"word/comments.xml",
+	"xl/sharedStrings.xml",
+	"xl/worksheets/sheet*.xml",
+	"ppt/slides/slide*.xml",
+	"ppt/notesSlides/notesSlide*.xml",
+}
+
+// WithOfficeDocument treats the file as an Office Open XML package (.docx, .xlsx or .pptx) and applies the mappings to
+// the text of its document parts only: element names, attributes and markup are never touched.
+// Word processors may split a phrase across several runs of differently formatted text, and a key only matches
+// inside a single text node.
+func WithOfficeDocument() Option {
+	return func(c *replacerConfig) {
+		c.ZipMembers = append(c.ZipMembers, officeXMLParts...)
+		c.OfficeXML = true
+	}
+}
+
+// xmlTextReader reads an XML part whole and returns it with the mappings applied to its character data
+func (rc *replacerConfig) xmlTextReader(r io.Reader) (io.Reader, error) {
+	limit := int64(rc.MaxRecordLength)
+	if limit > 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && int64(len(src)) > limit {
+		return nil, fmt.Errorf("%w: XML part is longer than %d bytes", ErrRecordTooLong, limit)
+	}
+	out, err := rewriteXMLText(src, rc.apply)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(out), nil
+}
+
+// rewriteXMLText applies fn to the unescaped content of every text node of src. Markup, comments, CDATA sections and
+// processing instructions are copied as is, and text nodes fn leaves unchanged keep their original escaping.
+func rewriteXMLText(src []byte, fn func([]byte) ([]byte, error)) ([]byte, error) {
+	out := make([]byte, 0, len(src))
+	for len(src) > 0 {
+		if src[0] == '<' {
+			end := xmlMarkupEnd(src)
+			out = append(out, src[:end]...)
+			src = src[end:]
+			continue
+		}
+		end := bytes.IndexByte(src, '<')
+		if end < 0 {
+			end = len(src)
+		}
+		text := src[:end]
+		src = src[end:]
+		unescaped := unescapeXMLText(text)
+		replaced, err := fn(unescaped)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(replaced, unescaped) {
+			out = append(out, text...)
+			continue
+		}
+		out = append(out, xmlTextEscaper.Replace(string(replaced))...)
+	}
+	return out, nil
+}
+
+var xmlTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// xmlMarkupEnd returns the length of the markup at the start of src.
+func xmlMarkupEnd(src []byte) int {
+	var terminator []byte
+	switch {
+	case bytes.HasPrefix(src, []byte("<!--")):
+		terminator = []byte("-->")
+	case bytes.HasPrefix(src, []byte("<![CDATA[")):
+		terminator = []byte("]]>")
+	case bytes.HasPrefix(src, []byte("<?")):
+		terminator = []byte("?>")
+	}
+	if terminator != nil {
+		if i := bytes.Index(src[1:], terminator); i >= 0 {
+			return 1 + i + len(terminator)
+		}
+		return len(src)
+	}
+	// a tag ends at the first '>' outside of a quoted attribute value
+	var quote byte
+	for i := 1; i < len(src); i++ {
+		switch c := src[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return i + 1
+		}
+	}
+	return len(src)
+}
+
+// unescapeXMLText replaces the predefined XML entities and character references of text with the characters they stand for.
+// Anything else that looks like a reference is left as is.
+func unescapeXMLText(text []byte) []byte {
+	if bytes.IndexByte(text, '&') < 0 {
+		return text
+	}
+	out := make([]byte, 0, len(text))
+	for len(text) > 0 {
+		amp := bytes.IndexByte(text, '&')
+		if amp < 0 {
+			return append(out, text...)
+		}
+		out = append(out, text[:amp]...)
+		text = text[amp:]
+		end := bytes.IndexByte(text, ';')
+		if end < 0 {
+			return append(out, text...)
+		}
+		if r, ok := xmlReference(string(text[1:end])); ok {
+			out = append(out, string(r)...)
+			text = text[end+1:]
+			continue
+		}
+		out = append(out, '&')
+		text = text[1:]
+	}
+	return out
+}
+
+// xmlReference resolves the name of an entity or character reference, without the '&' and ';'
+func xmlReference(name string) (rune, bool) {
+	switch name {
+	case "amp":
+		return '&', true
+	case "lt":
+		return '<', true
+	case "gt":
+		return '>', true
+	case "quot":
+		return '"', true
+	case "apos":
+		return '\'', true
+	}
+	if !strings.HasPrefix(name, "#") {
+		return 0, false
+	}
+	base, digits := 10, name[1:]
+	if strings.HasPrefix(digits, "x") {
+		base, digits = 16, digits[1:]
+	}
+	n, err := strconv.ParseUint(digits, base, 32)
+	if err != nil || !utf8.ValidRune(rune(n)) {
+		return 0, false
+	}
+	return rune(n), true
+}
@@ -0,0 +1,181 @@
+package gosed
+
+import (
+	"bytes"
+	"io"
+)
+
+// defaultChunkSize is the size of the chunks of a parallel replace when none is given
+const defaultChunkSize = 16 << 20
+
+// chunkSeparators are the bytes a chunk may end with, in order of preference. None of them is part of a word or of a
+// grapheme cluster with the byte after it, so whole word and grapheme safe matches are decided the same in a chunk.
+var chunkSeparators = []byte("\n\x00\t")
+
+// WithParallel replaces files of at least two chunks of chunkSize bytes (16 MiB if not positive) on workers
+// goroutines. The file is read in chunks that end just after a byte no key contains, a line feed when possible, so
+// that no match of any mapping can straddle two chunks; the chunks are replaced concurrently and the results written
+// in order, giving the same file as a replace on a single goroutine. A file without such a byte within a chunk makes
+// that chunk grow until one is found, so at most workers chunks, plus their results, are held in memory at once.
+// Replace runs the mappings as ReplaceChained does when this applies. It does not apply to options that need to see
+// the file as a whole: encodings, compression, containers, scoped replaces, UTF-8 validation, base64 regions,
+// and mappings that are case-folded, numeric, regular expressions, line operations, limited or addressed.
+func WithParallel(workers, chunkSize int) Option {
+	return func(c *replacerConfig) {
+		c.Workers = workers
+		c.ChunkSize = chunkSize
+	}
+}
+
+// parallel reports whether the file is replaced in chunks on several goroutines
+func (rc *replacerConfig) parallel() bool {
+	_, ok := rc.chunkSeparator()
+	return ok
+}
+
+// chunkSeparator returns the byte chunks end with, if the file is replaced in chunks
+func (rc *replacerConfig) chunkSeparator() (byte, bool) {
+	if rc.Workers < 2 || rc.FileSize < 2*int64(rc.chunkSize()) || len(rc.layers()) > 0 || rc.singlePass() ||
+		rc.Encoding != nil || rc.UTF8Policy != UTF8Ignore || len(rc.Base64Regions) > 0 || rc.lineFunc != nil {
+		return 0, false
+	}
+	var keys [][]byte
+	for index, key := range rc.Mappings.Keys {
+		opts := rc.Mappings.Options[index]
+		switch {
+		case opts == nil:
+			keys = append(keys, key)
+		case opts.Fold || opts.Number != nil || opts.Func != nil || opts.Regex != nil || opts.limited() || opts.addressed():
+			return 0, false
+		case opts.Variants:
+			variants, _ := identifierVariants(key, rc.Mappings.Indices[index])
+			keys = append(keys, variants...)
+		default:
+			keys = append(keys, key)
+		}
+	}
+	for _, sep := range chunkSeparators {
+		found := false
+		for _, key := range keys {
+			if bytes.IndexByte(key, sep) >= 0 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return sep, true
+		}
+	}
+	return 0, false
+}
+
+// chunkSize returns the size of the chunks of a parallel replace
+func (rc *replacerConfig) chunkSize() int {
+	if rc.ChunkSize <= 0 {
+		return defaultChunkSize
+	}
+	return rc.ChunkSize
+}
+
+// chunkResult is a replaced chunk, with the statistics of replacing it
+type chunkResult struct {
+	data  []byte
+	stats *replaceStats
+	err   error
+}
+
+// parallelReader reads src in chunks, replaces up to Workers of them at once and returns the results in order.
+// src is only read from the goroutine reading the parallelReader, so that progress is reported from it.
+type parallelReader struct {
+	src     io.Reader
+	rc      *replacerConfig
+	sep     byte
+	carry   []byte
+	eof     bool
+	err     error
+	pending []chan chunkResult
+	out     []byte
+}
+
+func newParallelReader(src io.Reader, rc *replacerConfig, sep byte) *parallelReader {
+	return &parallelReader{src: src, rc: rc, sep: sep}
+}
+
+// Read implements the `io.Reader` interface.
+func (pr *parallelReader) Read(p []byte) (int, error) {
+	for len(pr.out) == 0 {
+		if pr.err != nil {
+			return 0, pr.err
+		}
+		pr.fill()
+		if len(pr.pending) == 0 {
+			if pr.err != nil {
+				return 0, pr.err
+			}
+			return 0, io.EOF
+		}
+		// the channels are buffered, so the chunks still pending after an error do not block their goroutines
+		result := <-pr.pending[0]
+		pr.pending = pr.pending[1:]
+		if result.err != nil {
+			pr.err = result.err
+			return 0, pr.err
+		}
+		pr.rc.stats.merge(result.stats)
+		pr.out = result.data
+	}
+	n := copy(p, pr.out)
+	pr.out = pr.out[n:]
+	return n, nil
+}
+
+// fill starts replacing chunks until Workers of them are pending or src is exhausted
+func (pr *parallelReader) fill() {
+	for !pr.eof && pr.err == nil && len(pr.pending) < pr.rc.Workers {
+		chunk, err := pr.next()
+		if err != nil {
+			pr.err = err
+			return
+		}
+		if len(chunk) == 0 {
+			continue
+		}
+		done := make(chan chunkResult, 1)
+		pr.pending = append(pr.pending, done)
+		go pr.rc.replaceChunk(chunk, done)
+	}
+}
+
+// next reads the next chunk, which ends with the separator unless it is the last one
+func (pr *parallelReader) next() ([]byte, error) {
+	chunk := pr.carry
+	pr.carry = nil
+	for {
+		start := len(chunk)
+		chunk = append(chunk, make([]byte, pr.rc.chunkSize())...)
+		n, err := io.ReadFull(pr.src, chunk[start:])
+		chunk = chunk[:start+n]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			pr.eof = true
+			return chunk, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if i := bytes.LastIndexByte(chunk[start:], pr.sep); i >= 0 {
+			pr.carry = append([]byte(nil), chunk[start+i+1:]...)
+			return chunk[:start+i+1], nil
+		}
+	}
+}
+
+// replaceChunk runs chunk through every mapping and sends the result to done
+func (rc *replacerConfig) replaceChunk(chunk []byte, done chan<- chunkResult) {
+	// the readers of a chunk are its own, and so are the meters they add to
+	wc := &replacerConfig{Mappings: rc.Mappings, GraphemeSafe: rc.GraphemeSafe}
+	if rc.stats != nil {
+		wc.stats = &replaceStats{mappings: make([]mappingMeter, len(rc.stats.mappings))}
+	}
+	data, err := wc.apply(chunk)
+	done <- chunkResult{data: data, stats: wc.stats, err: err}
+}
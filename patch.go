@@ -0,0 +1,179 @@
+package gosed
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// patchGap is the longest run of unchanged bytes written along with the changed spans around it, so that dense
+// changes are patched in a few writes rather than one per match
+const patchGap = 512
+
+// ErrLengthChange is returned when patching in place with a mapping or option that may change the length of the file
+var ErrLengthChange = errors.New("replace would change the length of the file")
+
+// WithPatchInPlace overwrites the changed bytes of the file directly with WriteAt, without a temporary file or rename,
+// for targets that cannot be renamed over, such as block devices and preallocated database files.
+// Every mapping must replace its key with a value of the same length; otherwise the replace fails with ErrLengthChange
+// before anything is written. Options that transform the whole file (encodings, compression, base64 regions, MIME
+// and zip modes, case-folded matches) are refused the same way. Replace then returns the number of bytes rewritten.
+// The file is rewritten while it is read, so an interrupted replace leaves it partially patched, unless a journal is
+// kept with WithPatchJournal.
+func WithPatchInPlace() Option {
+	return func(c *replacerConfig) {
+		c.PatchInPlace = true
+	}
+}
+
+// checkLengthPreserving returns an ErrLengthChange error if the configuration could change the length of the file
+func (rc *replacerConfig) checkLengthPreserving() error {
+	switch {
+	case rc.Encoding != nil:
+		return fmt.Errorf("%w: encodings cannot be patched in place", ErrLengthChange)
+	case rc.Compression != nil || rc.Codec != nil:
+		return fmt.Errorf("%w: compressed and encrypted files cannot be patched in place", ErrLengthChange)
+	case len(rc.Base64Regions) > 0:
+		return fmt.Errorf("%w: base64 regions cannot be patched in place", ErrLengthChange)
+	case rc.MIME || len(rc.ZipMembers) > 0:
+		return fmt.Errorf("%w: containers cannot be patched in place", ErrLengthChange)
+	case rc.FrontMatter != 0 || rc.Lexer != nil || rc.KeyValueFormat != 0:
+		return fmt.Errorf("%w: scoped replaces cannot be patched in place", ErrLengthChange)
+	}
+	for index, key := range rc.Mappings.Keys {
+		if opts := rc.Mappings.Options[index]; opts != nil && opts.Fold {
+			return fmt.Errorf("%w: case-folded matches of %q may differ in length", ErrLengthChange, key)
+		}
+		if opts := rc.Mappings.Options[index]; opts != nil && opts.Regex != nil {
+			return fmt.Errorf("%w: matches of %q may differ in length from their replacement", ErrLengthChange, key)
+		}
+		if opts := rc.Mappings.Options[index]; opts != nil && opts.Number != nil {
+			return fmt.Errorf("%w: numbers following %q may change length", ErrLengthChange, key)
+		}
+		if opts := rc.Mappings.Options[index]; opts != nil && opts.Func != nil {
+			return fmt.Errorf("%w: the replacements of %q are computed by a function", ErrLengthChange, key)
+		}
+		keys, values := [][]byte{key}, [][]byte{rc.Mappings.Indices[index]}
+		if opts := rc.Mappings.Options[index]; opts != nil && opts.Variants {
+			keys, values = identifierVariants(key, values[0])
+		}
+		for i, value := range values {
+			if len(value) != len(keys[i]) {
+				return fmt.Errorf("%w: %q is replaced by %d bytes instead of %d", ErrLengthChange, keys[i], len(value), len(keys[i]))
+			}
+		}
+	}
+	return nil
+}
+
+// patchInPlace streams the file through the mappings and writes every changed span back at the offset it was read from.
+func (rp *Replacer) patchInPlace() (int, error) {
+	if err := rp.Config.checkLengthPreserving(); err != nil {
+		return 0, err
+	}
+	target, err := os.OpenFile(rp.Config.FilePath, os.O_RDWR, rp.Config.FilePerm)
+	if err != nil {
+		return 0, err
+	}
+	defer func(target *os.File) {
+		_ = target.Close()
+	}(target)
+	journal, err := rp.Config.openPatchJournal()
+	if err != nil {
+		return 0, err
+	}
+	rp.Config.UTF8Errors = nil
+	rp.Config.beginStats()
+	rp.Config.beginProgress(1)
+	// the section reader keeps its own offset, so reads and the WriteAt calls behind them do not disturb each other
+	src := io.NewSectionReader(target, 0, 1<<63-1)
+	result := rp.resultReader(rp.Config.chain(rp.sourceReader(bufio.NewReaderSize(rp.Config.track(src), rp.Config.bufferSize()))))
+	out := make([]byte, rp.Config.bufferSize())
+	original := make([]byte, len(out))
+	var offset int64
+	patched := 0
+	committing := false
+	// fail restores what was overwritten when a journal is kept, in which case nothing is patched
+	fail := func(err error) (int, error) {
+		if journal != nil {
+			return 0, journal.abort(target, err)
+		}
+		return patched, err
+	}
+	var spans [][2]int
+	for {
+		n, rerr := io.ReadFull(result, out)
+		if n > 0 {
+			// the chain reads ahead of its output, so the original bytes at offset have not been overwritten yet
+			if _, err := target.ReadAt(original[:n], offset); err != nil {
+				if err == io.EOF {
+					err = fmt.Errorf("%w: replaced content is longer than %s", ErrLengthChange, rp.Config.FilePath)
+				}
+				return fail(err)
+			}
+			spans = spans[:0]
+			changed := 0
+			for first, last := nextDiff(original[:n], out[:n], 0); first >= 0; first, last = nextDiff(original[:n], out[:n], last) {
+				changed += last - first
+				if len(spans) > 0 && first-spans[len(spans)-1][1] <= patchGap {
+					spans[len(spans)-1][1] = last
+					continue
+				}
+				spans = append(spans, [2]int{first, last})
+			}
+			for _, span := range spans {
+				journal.add(offset+int64(span[0]), original[span[0]:span[1]])
+			}
+			if len(spans) > 0 && !committing {
+				if err := rp.Config.beginCommit(); err != nil {
+					return fail(err)
+				}
+				if err := rp.Config.backup(); err != nil {
+					return fail(err)
+				}
+				committing = true
+			}
+			if err := journal.sync(); err != nil {
+				return fail(err)
+			}
+			for _, span := range spans {
+				if _, err := target.WriteAt(out[span[0]:span[1]], offset+int64(span[0])); err != nil {
+					return fail(err)
+				}
+			}
+			patched += changed
+			offset += int64(n)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return fail(rerr)
+		}
+	}
+	if err := journal.finish(target); err != nil {
+		return 0, err
+	}
+	rp.Config.finishStats(offset)
+	rp.Config.finishProgress()
+	rp.Config.spend()
+	return patched, nil
+}
+
+// nextDiff returns the next run [first, last) at or after from in which a and b differ, or -1 if there is none
+func nextDiff(a, b []byte, from int) (int, int) {
+	first := from
+	for first < len(a) && a[first] == b[first] {
+		first++
+	}
+	if first == len(a) {
+		return -1, -1
+	}
+	last := first + 1
+	for last < len(a) && a[last] != b[last] {
+		last++
+	}
+	return first, last
+}
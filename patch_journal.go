@@ -0,0 +1,229 @@
+package gosed
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrPatchJournalPending is returned when a replace would patch a file in place while the journal of an earlier one
+// is still there, as an interrupted replace leaves it; RollbackPatch restores the file it names and removes it.
+var ErrPatchJournalPending = errors.New("patch journal of an interrupted replace is pending")
+
+// patchJournalHeader starts every patch journal, followed by the absolute path of the patched file on a line of its own
+const patchJournalHeader = "gosed patch journal\n"
+
+// WithPatchJournal patches the file in place, as WithPatchInPlace, keeping a write-ahead journal at path for crash
+// safety: the bytes every chunk of the replace overwrites are appended to the journal and synced before the chunk is
+// written, and the journal is removed once the whole file is patched and synced. A replace that fails or is cancelled
+// restores what it overwrote from the journal; one that is interrupted, as by a crash, leaves the journal behind for
+// RollbackPatch. The journal only grows with the bytes the mappings change, not with the size of the file.
+// The journal must not exist when the replace begins, which otherwise fails with ErrPatchJournalPending.
+func WithPatchJournal(path string) Option {
+	return func(c *replacerConfig) {
+		c.PatchInPlace = true
+		c.PatchJournal = path
+	}
+}
+
+// RollbackPatch restores the file named in the patch journal at journalPath, left by an interrupted replace with
+// WithPatchJournal, to what it was before the replace, and removes the journal. A record the interruption cut short
+// was never applied to the file, and is ignored.
+func RollbackPatch(journalPath string) error {
+	path, err := patchJournalTarget(journalPath)
+	if err != nil {
+		return err
+	}
+	target, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer func(target *os.File) {
+		_ = target.Close()
+	}(target)
+	if err := rollbackPatch(journalPath, target); err != nil {
+		return err
+	}
+	if err := os.Remove(journalPath); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(journalPath))
+}
+
+// patchJournal is the write-ahead journal of a replace patching the file in place
+type patchJournal struct {
+	f    *os.File
+	name string
+	// pending holds the records of the chunk about to be written, and synced counts the chunks recorded
+	pending []byte
+	synced  int
+}
+
+// openPatchJournal creates the patch journal of the replace, or returns nil if it keeps none
+func (rc *replacerConfig) openPatchJournal() (*patchJournal, error) {
+	if rc.PatchJournal == "" {
+		return nil, nil
+	}
+	path, err := filepath.Abs(rc.FilePath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(rc.PatchJournal, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return nil, fmt.Errorf("%w: %s", ErrPatchJournalPending, rc.PatchJournal)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pj := &patchJournal{f: f, name: rc.PatchJournal}
+	if _, err = io.WriteString(f, patchJournalHeader+path+"\n"); err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(pj.name))
+	}
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(pj.name)
+		return nil, err
+	}
+	return pj, nil
+}
+
+// add records the original bytes of the span at offset, which the chunk being written overwrites
+func (pj *patchJournal) add(offset int64, original []byte) {
+	if pj == nil {
+		return
+	}
+	var head [12]byte
+	binary.BigEndian.PutUint64(head[:8], uint64(offset))
+	binary.BigEndian.PutUint32(head[8:], uint32(len(original)))
+	start := len(pj.pending)
+	pj.pending = append(append(pj.pending, head[:]...), original...)
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(pj.pending[start:]))
+	pj.pending = append(pj.pending, sum[:]...)
+}
+
+// sync appends the records of the chunk to the journal and syncs it, before the chunk is written
+func (pj *patchJournal) sync() error {
+	if pj == nil || len(pj.pending) == 0 {
+		return nil
+	}
+	if _, err := pj.f.Write(pj.pending); err != nil {
+		return err
+	}
+	if err := pj.f.Sync(); err != nil {
+		return err
+	}
+	pj.synced++
+	pj.pending = pj.pending[:0]
+	return nil
+}
+
+// finish removes the journal once the patched file is synced
+func (pj *patchJournal) finish(target *os.File) error {
+	if pj == nil {
+		return nil
+	}
+	if err := target.Sync(); err != nil {
+		return pj.abort(target, err)
+	}
+	_ = pj.f.Close()
+	if err := os.Remove(pj.name); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(pj.name))
+}
+
+// abort restores what the failed replace overwrote and removes the journal, returning err. The journal is kept if
+// the file cannot be restored, for RollbackPatch to retry.
+func (pj *patchJournal) abort(target *os.File, err error) error {
+	if pj == nil {
+		return err
+	}
+	_ = pj.f.Close()
+	if pj.synced > 0 {
+		if rerr := rollbackPatch(pj.name, target); rerr != nil {
+			return fmt.Errorf("%w; restoring the file from %s failed, retry with RollbackPatch: %v", err, pj.name, rerr)
+		}
+	}
+	_ = os.Remove(pj.name)
+	return err
+}
+
+// patchJournalTarget returns the path of the file the patch journal at journalPath was kept for
+func patchJournalTarget(journalPath string) (string, error) {
+	f, err := os.Open(journalPath)
+	if err != nil {
+		return "", err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	br := bufio.NewReader(f)
+	header, err := br.ReadString('\n')
+	if err != nil || header != patchJournalHeader {
+		return "", fmt.Errorf("%s is not a patch journal", journalPath)
+	}
+	path, err := br.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("%s is not a patch journal", journalPath)
+	}
+	return strings.TrimSuffix(path, "\n"), nil
+}
+
+// rollbackPatch writes the original bytes recorded in the patch journal at journalPath back into target, and syncs it
+func rollbackPatch(journalPath string, target *os.File) error {
+	f, err := os.Open(journalPath)
+	if err != nil {
+		return err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(f)
+	for i := 0; i < 2; i++ {
+		if _, err := br.ReadString('\n'); err != nil {
+			return fmt.Errorf("%s is not a patch journal", journalPath)
+		}
+	}
+	head := make([]byte, 12)
+	var record []byte
+	for {
+		// the journal ends, possibly with a record cut short before it was synced, where a record is missing or corrupt
+		if _, err := io.ReadFull(br, head); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		length := binary.BigEndian.Uint32(head[8:])
+		if int64(length) > info.Size() {
+			break
+		}
+		record = append(append(record[:0], head...), make([]byte, int(length)+4)...)
+		if _, err := io.ReadFull(br, record[12:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		data := record[12 : 12+length]
+		if binary.BigEndian.Uint32(record[12+length:]) != crc32.ChecksumIEEE(record[:12+length]) {
+			break
+		}
+		if _, err := target.WriteAt(data, int64(binary.BigEndian.Uint64(head))); err != nil {
+			return err
+		}
+	}
+	return target.Sync()
+}
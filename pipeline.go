@@ -0,0 +1,242 @@
+package gosed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrUnknownRuleSet is returned by the methods of a Pipeline for a rule set it does not hold
+var ErrUnknownRuleSet = errors.New("unknown rule set")
+
+// RuleSet is a named group of mappings, such as those of a migration or of a naming convention, that a Pipeline
+// applies together and can toggle or reorder as a whole
+type RuleSet struct {
+	Name string
+	MappingSet
+}
+
+// NewRuleSet returns a new, empty *RuleSet
+func NewRuleSet(name string) *RuleSet {
+	return &RuleSet{
+		Name:       name,
+		MappingSet: newMappingSet(),
+	}
+}
+
+// AddExpression adds the mapping of a sed substitution command, see ParseExpression
+func (rs *RuleSet) AddExpression(expr string) error {
+	m, err := ParseExpression(expr)
+	if err != nil {
+		return err
+	}
+	return rs.NewMappingWithOptions(m.Old, m.New, m.Options...)
+}
+
+// Pipeline applies rule sets to files in a single chained pass, in the order they were added or moved to. Rule sets
+// can be disabled and enabled again by name, so that a group of mappings is toggled without rebuilding the others.
+// A Pipeline is not safe for concurrent use, but the same *RuleSet can be shared by several of them.
+type Pipeline struct {
+	Options []Option
+	stages  []pipelineStage
+}
+
+// pipelineStage is a rule set of a pipeline and whether it is applied
+type pipelineStage struct {
+	set     *RuleSet
+	enabled bool
+}
+
+// RuleSetStats is what the mappings of a rule set did
+type RuleSetStats struct {
+	Name string
+	// Mappings holds the statistics of the mappings of the rule set, in order
+	Mappings []MappingStats
+	// Occurrences and Elapsed add up those of the mappings
+	Occurrences int
+	Elapsed     time.Duration
+}
+
+// PipelineReport describes what a Pipeline did
+type PipelineReport struct {
+	Files []FileResult
+	// RuleSets holds the statistics of the enabled rule sets, in order, added up over the replaced files
+	RuleSets []RuleSetStats
+	// Stats adds up the statistics of the replaced files; its Elapsed is the time all of them took
+	Stats Stats
+}
+
+// Err returns a *MultiError listing the files that were replaced and those that failed, or nil if none failed
+func (pr *PipelineReport) Err() error {
+	return newMultiError(pr.Files)
+}
+
+// NewPipeline returns a new *Pipeline without rule sets, whose replacers are configured with opts
+func NewPipeline(opts ...Option) *Pipeline {
+	return &Pipeline{Options: opts}
+}
+
+// Add appends the rule sets to the pipeline, enabled. Their names must be unique within the pipeline.
+func (p *Pipeline) Add(sets ...*RuleSet) error {
+	for i, set := range sets {
+		if p.index(set.Name) >= 0 {
+			return fmt.Errorf("rule set %q is already in the pipeline", set.Name)
+		}
+		for _, other := range sets[:i] {
+			if other.Name == set.Name {
+				return fmt.Errorf("rule set %q is added twice", set.Name)
+			}
+		}
+	}
+	for _, set := range sets {
+		p.stages = append(p.stages, pipelineStage{set: set, enabled: true})
+	}
+	return nil
+}
+
+// Remove removes the rule set name from the pipeline
+func (p *Pipeline) Remove(name string) error {
+	i, err := p.find(name)
+	if err != nil {
+		return err
+	}
+	p.stages = append(p.stages[:i], p.stages[i+1:]...)
+	return nil
+}
+
+// Enable applies the rule set name again after Disable
+func (p *Pipeline) Enable(name string) error {
+	return p.setEnabled(name, true)
+}
+
+// Disable leaves the rule set name out of the replaces, keeping its place in the pipeline
+func (p *Pipeline) Disable(name string) error {
+	return p.setEnabled(name, false)
+}
+
+// Move moves the rule set name to position, counting from 0, shifting the ones in between. A position past the end
+// moves it last.
+func (p *Pipeline) Move(name string, position int) error {
+	i, err := p.find(name)
+	if err != nil {
+		return err
+	}
+	stage := p.stages[i]
+	p.stages = append(p.stages[:i], p.stages[i+1:]...)
+	position = min(max(position, 0), len(p.stages))
+	p.stages = append(p.stages[:position], append([]pipelineStage{stage}, p.stages[position:]...)...)
+	return nil
+}
+
+// RuleSets returns the names of the rule sets of the pipeline, in order, disabled ones included
+func (p *Pipeline) RuleSets() []string {
+	names := make([]string, len(p.stages))
+	for i, stage := range p.stages {
+		names[i] = stage.set.Name
+	}
+	return names
+}
+
+// Enabled reports whether the rule set name is in the pipeline and enabled
+func (p *Pipeline) Enabled(name string) bool {
+	i := p.index(name)
+	return i >= 0 && p.stages[i].enabled
+}
+
+// Replace applies the enabled rule sets to every file in turn. A failure on one file is recorded in the report and
+// the pipeline carries on with the next.
+func (p *Pipeline) Replace(files ...string) (*PipelineReport, error) {
+	return p.ReplaceContext(context.Background(), files...)
+}
+
+// ReplaceContext is Replace, cancelled when ctx is done: the file in flight is rolled back, unless its commit has
+// already begun, and the remaining files are left untouched and reported as skipped, along with the error of ctx.
+func (p *Pipeline) ReplaceContext(ctx context.Context, files ...string) (*PipelineReport, error) {
+	start := time.Now()
+	var enabled []*RuleSet
+	mappings := &replacerMappings{}
+	for _, stage := range p.stages {
+		if stage.enabled {
+			enabled = append(enabled, stage.set)
+			mappings.extend(stage.set.mappings)
+		}
+	}
+	report := &PipelineReport{Files: make([]FileResult, len(files))}
+	report.Stats.Mappings = make([]MappingStats, len(mappings.Keys))
+	for i, key := range mappings.Keys {
+		report.Stats.Mappings[i].Key = key
+	}
+	for i, file := range files {
+		if ctx.Err() != nil {
+			report.Files[i] = FileResult{Path: file, Status: FileSkipped}
+			continue
+		}
+		var stats Stats
+		report.Files[i], stats = p.replaceFile(ctx, file, mappings)
+		if report.Files[i].Status == FileReplaced {
+			addStats(&report.Stats, stats)
+		}
+	}
+	report.Stats.Elapsed = time.Since(start)
+	offset := 0
+	for _, set := range enabled {
+		rs := RuleSetStats{Name: set.Name, Mappings: report.Stats.Mappings[offset : offset+len(set.mappings.Keys)]}
+		for _, m := range rs.Mappings {
+			rs.Occurrences += m.Occurrences
+			rs.Elapsed += m.Elapsed
+		}
+		report.RuleSets = append(report.RuleSets, rs)
+		offset += len(set.mappings.Keys)
+	}
+	return report, ctx.Err()
+}
+
+// replaceFile applies the mappings of the enabled rule sets to a single file
+func (p *Pipeline) replaceFile(ctx context.Context, file string, mappings *replacerMappings) (FileResult, Stats) {
+	rp, err := NewReplacer(file, p.Options...)
+	if err != nil {
+		return FileResult{Path: file, Status: FileFailed, Err: err}, Stats{}
+	}
+	defer func(rp *Replacer) {
+		_ = rp.Config.File.Close()
+	}(rp)
+	rp.Config.Mappings = mappings.clone()
+	wrote, err := rp.ReplaceChainedContext(ctx)
+	result := FileResult{Path: file, Status: FileReplaced, Wrote: wrote, Err: err}
+	switch {
+	case err != nil && ctx.Err() != nil:
+		result.Status = FileCancelled
+	case err != nil:
+		result.Status = FileFailed
+	}
+	return result, rp.Stats()
+}
+
+// setEnabled enables or disables the rule set name
+func (p *Pipeline) setEnabled(name string, enabled bool) error {
+	i, err := p.find(name)
+	if err != nil {
+		return err
+	}
+	p.stages[i].enabled = enabled
+	return nil
+}
+
+// find returns the position of the rule set name, or ErrUnknownRuleSet
+func (p *Pipeline) find(name string) (int, error) {
+	if i := p.index(name); i >= 0 {
+		return i, nil
+	}
+	return -1, fmt.Errorf("%w %q", ErrUnknownRuleSet, name)
+}
+
+// index returns the position of the rule set name, -1 if the pipeline does not hold it
+func (p *Pipeline) index(name string) int {
+	for i, stage := range p.stages {
+		if stage.set.Name == name {
+			return i
+		}
+	}
+	return -1
+}
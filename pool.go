@@ -0,0 +1,120 @@
+package gosed
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ReplacerPool hands out Replacers for named mapping sets, for services that apply the same substitutions to many
+// files concurrently. A Replacer returned to the pool keeps its buffers, so that the next file replaced with the same
+// mapping set does not allocate them again. A ReplacerPool is safe for concurrent use; the Replacers it hands out
+// are not, and each must only be used by one goroutine until it is put back.
+type ReplacerPool struct {
+	// Options configures every Replacer of the pool
+	Options []Option
+
+	mu    sync.RWMutex
+	sets  map[string]*MappingSet
+	pools map[string]*sync.Pool
+}
+
+// NewReplacerPool returns a new *ReplacerPool whose replacers are configured with opts
+func NewReplacerPool(opts ...Option) *ReplacerPool {
+	return &ReplacerPool{
+		Options: opts,
+		sets:    make(map[string]*MappingSet),
+		pools:   make(map[string]*sync.Pool),
+	}
+}
+
+// NewMapping maps a new oldString:newString []byte entry in the mapping set named set, creating it if needed
+func (p *ReplacerPool) NewMapping(set string, oldString, newString []byte) error {
+	if len(oldString) == 0 {
+		return ErrEmptyKey
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.mappingSet(set).NewMapping(oldString, newString)
+}
+
+// NewMappingWithOptions maps a new oldString:newString []byte entry that matches according to opts in the mapping
+// set named set, creating it if needed
+func (p *ReplacerPool) NewMappingWithOptions(set string, oldString, newString []byte, opts ...MappingOption) error {
+	if len(oldString) == 0 {
+		return ErrEmptyKey
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.mappingSet(set).NewMappingWithOptions(oldString, newString, opts...)
+}
+
+// NewStringMapping maps a new oldString:newString string entry in the mapping set named set, creating it if needed
+func (p *ReplacerPool) NewStringMapping(set, oldString, newString string) error {
+	return p.NewMapping(set, []byte(oldString), []byte(newString))
+}
+
+// mappingSet returns the mapping set named set, creating it if needed. p.mu must be held.
+func (p *ReplacerPool) mappingSet(set string) *MappingSet {
+	ms, ok := p.sets[set]
+	if !ok {
+		created := newMappingSet()
+		ms = &created
+		p.sets[set] = ms
+		p.pools[set] = &sync.Pool{}
+	}
+	return ms
+}
+
+// Get returns a Replacer of the mapping set named set, ready to replace fileName. It must be given back with Put once
+// the replace is done.
+func (p *ReplacerPool) Get(set, fileName string) (*Replacer, error) {
+	p.mu.RLock()
+	ms, ok := p.sets[set]
+	var mappings *replacerMappings
+	var pool *sync.Pool
+	if ok {
+		mappings, pool = ms.mappings.clone(), p.pools[set]
+	}
+	p.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown mapping set %q", set)
+	}
+	rp, _ := pool.Get().(*Replacer)
+	if rp == nil {
+		var err error
+		if rp, err = NewReplacer(fileName, p.Options...); err != nil {
+			return nil, err
+		}
+	} else {
+		fi, fd, err := openTarget(fileName)
+		if err != nil {
+			rp.Config.Tx.record(fileName, err)
+			pool.Put(rp)
+			return nil, err
+		}
+		rp.Config.setTarget(fileName, fi, fd)
+		if err := rp.Config.followSymlink(); err != nil {
+			_ = fi.Close()
+			rp.Config.File = nil
+			rp.Config.Tx.record(fileName, err)
+			pool.Put(rp)
+			return nil, err
+		}
+	}
+	rp.Config.Mappings, rp.Config.spent = mappings, nil
+	rp.set = set
+	return rp, nil
+}
+
+// Put closes the file of rp, which was returned by Get, and gives rp back to the pool. rp must not be used afterwards.
+func (p *ReplacerPool) Put(rp *Replacer) error {
+	err := rp.Config.File.Close()
+	rp.Config.File = nil
+	p.mu.RLock()
+	pool := p.pools[rp.set]
+	p.mu.RUnlock()
+	if pool != nil {
+		pool.Put(rp)
+	}
+	return err
+}
@@ -0,0 +1,295 @@
+package gosed
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around every change of a preview
+const diffContext = 3
+
+// diffWindow bounds how many lines ahead a preview looks to resynchronize the original and the result after a change
+const diffWindow = 64
+
+// errPreviewZip is returned when previewing zip members, whose result is an archive rather than text
+var errPreviewZip = errors.New("zip members cannot be previewed")
+
+// PreviewResult is what a Preview would have done to the file
+type PreviewResult struct {
+	Stats Stats
+	// Hunks are the changed regions of the file, with up to 3 unchanged lines of context around them
+	Hunks []DiffHunk
+}
+
+// DiffHunk is a changed region of a file, in the layout of a unified diff
+type DiffHunk struct {
+	// OrigStart and NewStart are the 1-based numbers of the first line of the hunk in the original and in the result,
+	// and OrigLines and NewLines the number of lines it spans in each
+	OrigStart, OrigLines int
+	NewStart, NewLines   int
+	// Lines are the lines of the hunk, each prefixed with ' ' if unchanged, '-' if removed or '+' if added
+	Lines []string
+}
+
+// String formats the hunks as the body of a unified diff
+func (pr *PreviewResult) String() string {
+	var sb strings.Builder
+	for _, hunk := range pr.Hunks {
+		_, _ = fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", hunk.OrigStart, hunk.OrigLines, hunk.NewStart, hunk.NewLines)
+		for _, line := range hunk.Lines {
+			if strings.HasSuffix(line, "\n") {
+				sb.WriteString(line)
+			} else {
+				sb.WriteString(line + "\n\\ No newline at end of file\n")
+			}
+		}
+	}
+	return sb.String()
+}
+
+// Preview runs the replace without touching the file: the result is written to w, or discarded if w is nil, and
+// the changes it makes are returned as diff hunks along with the statistics. The mappings stay registered, so
+// Replace can follow once the preview looks right. For compressed and encrypted files, the hunks compare the
+// plaintext while w receives the result as it would be stored. The hunks are found by looking up to 64 lines ahead
+// after every change, so a change that moves more lines than that shows up as lines removed and added.
+func (rp *Replacer) Preview(w io.Writer) (*PreviewResult, error) {
+	if len(rp.Config.ZipMembers) > 0 {
+		return nil, errPreviewZip
+	}
+	if hold, err := rp.guardsHold(); err != nil || !hold {
+		if err != nil {
+			return nil, err
+		}
+		rp.Config.skip()
+		return &PreviewResult{Stats: rp.Stats()}, nil
+	}
+	if w == nil {
+		w = ioutil.Discard
+	}
+	input, err := os.Open(rp.Config.FilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func(input *os.File) {
+		_ = input.Close()
+	}(input)
+	orig, closeOrig, err := rp.Config.openOriginal()
+	if err != nil {
+		return nil, err
+	}
+	defer closeOrig()
+	rp.Config.UTF8Errors = nil
+	rp.Config.beginStats()
+	rp.Config.beginProgress(1)
+	differ := newLineDiffer(orig)
+	wrote, err := rp.render(rp.Config.track(input), nil, 0, w, differ)
+	if err == nil {
+		err = differ.finish()
+	}
+	if err != nil {
+		return nil, err
+	}
+	rp.Config.finishStats(wrote)
+	rp.Config.finishProgress()
+	return &PreviewResult{Stats: rp.Stats(), Hunks: differ.hunks}, nil
+}
+
+// lineDiffer diffs the lines written to it against the lines of the original
+type lineDiffer struct {
+	orig    *bufio.Reader
+	origEOF bool
+	// a holds the original lines and b the result lines read but not diffed yet, line feeds included
+	a, b    []string
+	partial []byte
+	// origLine and newLine count the lines diffed so far on either side
+	origLine, newLine int
+	// before holds the unchanged lines preceding the next hunk
+	before []string
+	hunk   *DiffHunk
+	// trailing counts the unchanged lines at the end of the open hunk
+	trailing int
+	hunks    []DiffHunk
+}
+
+func newLineDiffer(orig io.Reader) *lineDiffer {
+	return &lineDiffer{orig: bufio.NewReader(orig)}
+}
+
+// Write implements the `io.Writer` interface.
+func (ld *lineDiffer) Write(p []byte) (int, error) {
+	ld.partial = append(ld.partial, p...)
+	for {
+		i := bytes.IndexByte(ld.partial, '\n')
+		if i < 0 {
+			break
+		}
+		ld.b = append(ld.b, string(ld.partial[:i+1]))
+		ld.partial = ld.partial[i+1:]
+	}
+	if err := ld.diff(false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// finish diffs what is left once the result is complete
+func (ld *lineDiffer) finish() error {
+	if len(ld.partial) > 0 {
+		ld.b = append(ld.b, string(ld.partial))
+		ld.partial = nil
+	}
+	if err := ld.diff(true); err != nil {
+		return err
+	}
+	ld.close()
+	return nil
+}
+
+// fill reads original lines until diffWindow+1 of them are pending or the original ends
+func (ld *lineDiffer) fill() error {
+	for !ld.origEOF && len(ld.a) <= diffWindow {
+		line, err := ld.orig.ReadString('\n')
+		if len(line) > 0 {
+			ld.a = append(ld.a, line)
+		}
+		if err == io.EOF {
+			ld.origEOF = true
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diff matches the pending lines of both sides, waiting for more result lines unless final
+func (ld *lineDiffer) diff(final bool) error {
+	for {
+		if err := ld.fill(); err != nil {
+			return err
+		}
+		switch {
+		case len(ld.b) == 0 && !final:
+			return nil
+		case len(ld.b) == 0 && len(ld.a) == 0:
+			return nil
+		case len(ld.b) == 0:
+			ld.remove(1)
+		case len(ld.a) == 0:
+			ld.add(1)
+		case ld.a[0] == ld.b[0]:
+			ld.keep()
+		case !final && len(ld.b) <= diffWindow:
+			// wait for enough of the result to resynchronize
+			return nil
+		default:
+			i, j := ld.resync()
+			ld.remove(i)
+			ld.add(j)
+		}
+	}
+}
+
+// resync returns how many original lines were removed and result lines added before both sides agree again,
+// preferring the smallest change; a line is replaced by another if they do not agree within the window
+func (ld *lineDiffer) resync() (int, int) {
+	for n := 1; n <= len(ld.a)+len(ld.b)-2; n++ {
+		for i := max(0, n-len(ld.b)+1); i <= n && i < len(ld.a); i++ {
+			if ld.a[i] == ld.b[n-i] {
+				return i, n - i
+			}
+		}
+	}
+	return 1, 1
+}
+
+// keep diffs a line present on both sides
+func (ld *lineDiffer) keep() {
+	line := ld.a[0]
+	ld.a, ld.b = ld.a[1:], ld.b[1:]
+	ld.origLine++
+	ld.newLine++
+	if ld.hunk == nil {
+		ld.before = append(ld.before, line)
+		if len(ld.before) > diffContext {
+			ld.before = ld.before[1:]
+		}
+		return
+	}
+	ld.hunk.Lines = append(ld.hunk.Lines, " "+line)
+	ld.hunk.OrigLines++
+	ld.hunk.NewLines++
+	ld.trailing++
+	if ld.trailing > 2*diffContext {
+		ld.close()
+	}
+}
+
+// remove diffs n lines only present in the original
+func (ld *lineDiffer) remove(n int) {
+	for _, line := range ld.a[:n] {
+		ld.open()
+		ld.hunk.Lines = append(ld.hunk.Lines, "-"+line)
+		ld.hunk.OrigLines++
+		ld.origLine++
+	}
+	ld.a = ld.a[n:]
+}
+
+// add diffs n lines only present in the result
+func (ld *lineDiffer) add(n int) {
+	for _, line := range ld.b[:n] {
+		ld.open()
+		ld.hunk.Lines = append(ld.hunk.Lines, "+"+line)
+		ld.hunk.NewLines++
+		ld.newLine++
+	}
+	ld.b = ld.b[n:]
+}
+
+// open starts a hunk with the unchanged lines before it, unless one is open already
+func (ld *lineDiffer) open() {
+	ld.trailing = 0
+	if ld.hunk != nil {
+		return
+	}
+	ld.hunk = &DiffHunk{
+		OrigStart: ld.origLine - len(ld.before) + 1,
+		OrigLines: len(ld.before),
+		NewStart:  ld.newLine - len(ld.before) + 1,
+		NewLines:  len(ld.before),
+	}
+	for _, line := range ld.before {
+		ld.hunk.Lines = append(ld.hunk.Lines, " "+line)
+	}
+	ld.before = nil
+}
+
+// close ends the open hunk after diffContext unchanged lines, keeping the rest as the context of the next one
+func (ld *lineDiffer) close() {
+	if ld.hunk == nil {
+		return
+	}
+	extra := max(0, ld.trailing-diffContext)
+	kept := len(ld.hunk.Lines) - extra
+	for _, line := range ld.hunk.Lines[max(kept, len(ld.hunk.Lines)-diffContext):] {
+		ld.before = append(ld.before, line[1:])
+	}
+	ld.hunk.Lines = ld.hunk.Lines[:kept]
+	ld.hunk.OrigLines -= extra
+	ld.hunk.NewLines -= extra
+	// unified diffs number an empty side by the line before it
+	if ld.hunk.OrigLines == 0 {
+		ld.hunk.OrigStart--
+	}
+	if ld.hunk.NewLines == 0 {
+		ld.hunk.NewStart--
+	}
+	ld.hunks = append(ld.hunks, *ld.hunk)
+	ld.hunk, ld.trailing = nil, 0
+}
@@ -0,0 +1,52 @@
+package gosed
+
+import (
+	"os"
+)
+
+// progressInterval is how many bytes a replace reads between two progress reports
+const progressInterval = 1 << 20
+
+// WithProgress calls fn as the file is read, about every MiB and once more when the replace completes, with the
+// number of bytes processed so far and the total to process, for progress bars and metrics. fn is called from the
+// goroutine running the replace. Replace reads the file once per mapping, so its total counts the file as many times,
+// which is an estimate when the mappings change its length; the last call reports the total as processed.
+func WithProgress(fn func(bytesProcessed, totalBytes int64)) Option {
+	return func(c *replacerConfig) {
+		c.ProgressFunc = fn
+	}
+}
+
+// progressReport is the progress of the replace in flight
+type progressReport struct {
+	done, total, reported int64
+}
+
+// beginProgress starts reporting the progress of a replace reading the file passes times
+func (rc *replacerConfig) beginProgress(passes int) {
+	if rc.ProgressFunc == nil {
+		return
+	}
+	rc.progressReport = progressReport{}
+	if info, err := os.Stat(rc.FilePath); err == nil {
+		rc.progressReport.total = info.Size() * int64(passes)
+	}
+	rc.ProgressFunc(0, rc.progressReport.total)
+}
+
+// advance reports that n more bytes were processed
+func (rc *replacerConfig) advance(n int) {
+	pr := &rc.progressReport
+	pr.done += int64(n)
+	if pr.done-pr.reported >= progressInterval && pr.done < pr.total {
+		pr.reported = pr.done
+		rc.ProgressFunc(pr.done, pr.total)
+	}
+}
+
+// finishProgress reports a completed replace
+func (rc *replacerConfig) finishProgress() {
+	if rc.ProgressFunc != nil {
+		rc.ProgressFunc(rc.progressReport.total, rc.progressReport.total)
+	}
+}
@@ -0,0 +1,89 @@
+package gosed
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrRecordTooLong is returned by record-oriented operations when a single record grows past the configured maximum record length.
+var ErrRecordTooLong = errors.New("record exceeds the maximum record length")
+
+// DefaultMaxRecordLength is the maximum length of a single record (line) that record-oriented operations will buffer.
+const DefaultMaxRecordLength = 64 * 1024 * 1024
+
+const defaultRecordBufSize = 64 * 1024
+
+// recordReader splits a stream into separator-terminated records.
+// Every record is buffered whole, but it is read in segments of at most defaultRecordBufSize bytes, so that a record
+// longer than maxLen is given up once that much of it is buffered, rather than after the whole of it.
+type recordReader struct {
+	r      *bufio.Reader
+	sep    byte
+	maxLen int
+	// record is the 1-based number of the record currently being read
+	record int
+	// n is the length of the record currently being read, summed across segments
+	n   int
+	buf []byte
+	// err is the read error met while skipping a record that is too long, returned by the next call
+	err error
+}
+
+func newRecordReader(r io.Reader, sep byte, maxLen int) *recordReader {
+	return &recordReader{
+		r:      bufio.NewReaderSize(r, defaultRecordBufSize),
+		sep:    sep,
+		maxLen: maxLen,
+	}
+}
+
+// readSegment returns the next piece of the current record.
+// more is true when the record continues past the returned segment; the separator is part of the last segment.
+// The segment is only valid until the next call.
+func (rr *recordReader) readSegment() (seg []byte, more bool, err error) {
+	if rr.n == 0 {
+		rr.record++
+	}
+	seg, err = rr.r.ReadSlice(rr.sep)
+	switch err {
+	case bufio.ErrBufferFull:
+		more, err = true, nil
+		rr.n += len(seg)
+	default:
+		rr.n = 0
+	}
+	return seg, more, err
+}
+
+// ReadRecord returns the next whole record including its separator.
+// Records are assembled from segments, and a record longer than maxLen fails with ErrRecordTooLong instead of growing without bound;
+// the rest of that record is then skipped, so the next call returns the record after it, or the error skipping it met.
+// A maxLen of 0 or less disables the guard. The record is only valid until the next call.
+func (rr *recordReader) ReadRecord() ([]byte, error) {
+	if rr.err != nil {
+		return nil, rr.err
+	}
+	seg, more, err := rr.readSegment()
+	if !more && (rr.maxLen <= 0 || len(seg) <= rr.maxLen) {
+		return seg, err
+	}
+	rr.buf = append(rr.buf[:0], seg...)
+	for {
+		if rr.maxLen > 0 && len(rr.buf) > rr.maxLen {
+			tooLong := fmt.Errorf("%w: record %d is longer than %d bytes", ErrRecordTooLong, rr.record, rr.maxLen)
+			for more && err == nil {
+				_, more, err = rr.readSegment()
+			}
+			// bufio.Reader forgets the error once it returned it, so it is kept for the next call
+			rr.n, rr.err = 0, err
+			return nil, tooLong
+		}
+		if !more {
+			return rr.buf, err
+		}
+		seg, more, err = rr.readSegment()
+		rr.buf = append(rr.buf, seg...)
+	}
+}
@@ -0,0 +1,167 @@
+package gosed
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+)
+
+// NewRegexMapping replaces every match of the regular expression pattern with replacement, in which $1, ${name} and
+// the like are expanded to the submatches as in regexp.Expand. Like sed, the expression is matched against one line
+// at a time, without its line feed, so ^ and $ anchor to the line and a match never spans two lines.
+// Lines end with the separator of WithRecordSeparator, and those longer than the maximum record length fail the
+// replace with ErrRecordTooLong.
+func (rp *Replacer) NewRegexMapping(pattern string, replacement []byte) error {
+	switch len(pattern) {
+	case 0:
+		return ErrEmptyKey
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	rp.Config.Mappings.add([]byte(pattern), replacement, &mappingOptions{Regex: re})
+	return nil
+}
+
+// lineOp is what a regex mapping does to the lines its expression matches
+type lineOp int
+
+const (
+	// lineSubstitute replaces the matches within the line
+	lineSubstitute lineOp = iota
+	lineDelete
+	lineInsert
+	lineAppend
+	lineChange
+)
+
+// DeleteLinesMatching deletes every line matched by the regular expression pattern, like sed's d command.
+func (rp *Replacer) DeleteLinesMatching(pattern string) error {
+	return rp.newLineMapping(pattern, nil, lineDelete)
+}
+
+// InsertBefore inserts text as a line of its own before every line matched by the regular expression pattern, like
+// sed's i command.
+func (rp *Replacer) InsertBefore(pattern string, text []byte) error {
+	return rp.newLineMapping(pattern, text, lineInsert)
+}
+
+// AppendAfter appends text as a line of its own after every line matched by the regular expression pattern, like
+// sed's a command. After a last line without a line feed, the text is appended without one either.
+func (rp *Replacer) AppendAfter(pattern string, text []byte) error {
+	return rp.newLineMapping(pattern, text, lineAppend)
+}
+
+// ChangeLines replaces every line matched by the regular expression pattern with text, like sed's c command.
+func (rp *Replacer) ChangeLines(pattern string, text []byte) error {
+	return rp.newLineMapping(pattern, text, lineChange)
+}
+
+// newLineMapping adds a regex mapping applying op to the lines matched by pattern. Like the other mappings, it runs
+// in order in the same pass over the file, matching lines as the mappings before it left them.
+func (rp *Replacer) newLineMapping(pattern string, text []byte, op lineOp) error {
+	switch len(pattern) {
+	case 0:
+		return ErrEmptyKey
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	rp.Config.Mappings.add([]byte(pattern), text, &mappingOptions{Regex: re, Line: op})
+	return nil
+}
+
+// regexReader applies a regex mapping line by line
+type regexReader struct {
+	rr          *recordReader
+	re          *regexp.Regexp
+	replacement []byte
+	op          lineOp
+	// filter selects the matches replaced when the mapping has occurrence options
+	filter      *occurrenceFilter
+	occurrences int
+	buf         []byte
+	out         []byte
+	err         error
+}
+
+func newRegexReader(r io.Reader, rc *replacerConfig, opts *mappingOptions, replacement []byte) *regexReader {
+	rr := &regexReader{rr: newRecordReader(r, rc.RecordSeparator, rc.MaxRecordLength), re: opts.Regex, replacement: replacement, op: opts.Line}
+	if opts.limited() {
+		rr.filter = &occurrenceFilter{opts: opts}
+	}
+	return rr
+}
+
+// Read implements the `io.Reader` interface.
+func (rr *regexReader) Read(p []byte) (int, error) {
+	for len(rr.out) == 0 {
+		if rr.err != nil {
+			return 0, rr.err
+		}
+		var record []byte
+		record, rr.err = rr.rr.ReadRecord()
+		if len(record) == 0 {
+			continue
+		}
+		rr.out = rr.rewrite(record)
+	}
+	n := copy(p, rr.out)
+	rr.out = rr.out[n:]
+	return n, nil
+}
+
+// rewrite returns what record, a line with its line feed if it has one, becomes
+func (rr *regexReader) rewrite(record []byte) []byte {
+	line := bytes.TrimSuffix(record, []byte{rr.rr.sep})
+	newline := record[len(line):]
+	if rr.op == lineSubstitute {
+		matches := rr.re.FindAllSubmatchIndex(line, -1)
+		if rr.filter != nil {
+			rr.filter.newLine()
+			kept := matches[:0]
+			for _, match := range matches {
+				if !rr.filter.keep() {
+					kept = append(kept, match)
+				}
+			}
+			matches = kept
+		}
+		if len(matches) == 0 {
+			return record
+		}
+		rr.occurrences += len(matches)
+		rr.buf = rr.buf[:0]
+		last := 0
+		for _, match := range matches {
+			rr.buf = append(rr.buf, line[last:match[0]]...)
+			rr.buf = rr.re.Expand(rr.buf, rr.replacement, line, match)
+			last = match[1]
+		}
+		rr.buf = append(append(rr.buf, line[last:]...), newline...)
+		return rr.buf
+	}
+	if !rr.re.Match(line) {
+		return record
+	}
+	rr.occurrences++
+	switch rr.op {
+	case lineDelete:
+		// an empty result reads the next record
+		return nil
+	case lineInsert:
+		rr.buf = append(append(append(rr.buf[:0], rr.replacement...), rr.rr.sep), record...)
+	case lineAppend:
+		rr.buf = append(append(append(append(rr.buf[:0], line...), rr.rr.sep), rr.replacement...), newline...)
+	case lineChange:
+		rr.buf = append(append(rr.buf[:0], rr.replacement...), newline...)
+	}
+	return rr.buf
+}
+
+// GetOccurrences returns the number of matches replaced, or of lines matched by a line operation
+func (rr *regexReader) GetOccurrences() int {
+	return rr.occurrences
+}
@@ -0,0 +1,139 @@
+package gosed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ErrRemoteChanged is returned when the remote resource changed between the GET and the PUT of a RemoteReplacer
+var ErrRemoteChanged = errors.New("remote resource changed during replace")
+
+// RemoteReplacer replaces a resource served over HTTP, such as a WebDAV file or an object store key: the resource is
+// fetched with GET, streamed through the mappings and uploaded back with PUT, without a local copy. The PUT carries the
+// ETag of the GET in an If-Match precondition, so that a concurrent change of the resource fails the replace with
+// ErrRemoteChanged instead of being overwritten.
+type RemoteReplacer struct {
+	URL string
+	// Client sends the requests, http.DefaultClient if nil
+	Client *http.Client
+	// Header is added to both requests, e.g. for authorization
+	Header http.Header
+	// Offset and Length, if Length is positive, only replace that byte range of the resource, fetched with a Range
+	// request and written back with a Content-Range PUT, which the server must support. The mappings must then
+	// preserve the length of the range, as with WithPatchInPlace.
+	Offset, Length int64
+	Options        []Option
+	MappingSet
+}
+
+// NewRemoteReplacer returns a new *RemoteReplacer for the resource at url, whose replace is configured with opts
+func NewRemoteReplacer(url string, opts ...Option) *RemoteReplacer {
+	return &RemoteReplacer{
+		URL:        url,
+		Options:    opts,
+		MappingSet: newMappingSet(),
+	}
+}
+
+// Replace fetches the resource, replaces it and uploads the result, returning the number of bytes uploaded.
+// The resource must be served with an ETag.
+func (rr *RemoteReplacer) Replace(ctx context.Context) (int, error) {
+	rp := &Replacer{Config: &replacerConfig{Mappings: rr.mappings.clone(), MaxRecordLength: DefaultMaxRecordLength, RecordSeparator: '\n'}}
+	for _, opt := range rr.Options {
+		opt(rp.Config)
+	}
+	if len(rp.Config.ZipMembers) > 0 || rp.Config.Compression != nil || rp.Config.Codec != nil {
+		return 0, errors.New("zip members, compressed and encrypted resources cannot be replaced remotely")
+	}
+	ranged := rr.Length > 0
+	if ranged {
+		if err := rp.Config.checkLengthPreserving(); err != nil {
+			return 0, err
+		}
+	}
+	client := rr.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	get, err := rr.newRequest(ctx, http.MethodGet, nil)
+	if err != nil {
+		return 0, err
+	}
+	if ranged {
+		get.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", rr.Offset, rr.Offset+rr.Length-1))
+	}
+	resp, err := client.Do(get)
+	if err != nil {
+		return 0, err
+	}
+	defer func(body io.Closer) {
+		_ = body.Close()
+	}(resp.Body)
+	switch {
+	case ranged && resp.StatusCode != http.StatusPartialContent:
+		return 0, fmt.Errorf("GET %s: expected a partial response, got %s", rr.URL, resp.Status)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return 0, fmt.Errorf("GET %s: %s", rr.URL, resp.Status)
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return 0, fmt.Errorf("GET %s: no ETag to make the upload conditional on", rr.URL)
+	}
+
+	var src io.Reader = resp.Body
+	if ranged {
+		src = io.LimitReader(src, rr.Length)
+	}
+	counter := &countingReader{r: rp.resultReader(rp.Config.transform(rp.sourceReader(src)))}
+	put, err := rr.newRequest(ctx, http.MethodPut, counter)
+	if err != nil {
+		return 0, err
+	}
+	put.Header.Set("If-Match", etag)
+	if ranged {
+		put.ContentLength = rr.Length
+		put.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", rr.Offset, rr.Offset+rr.Length-1))
+	}
+	presp, err := client.Do(put)
+	if err != nil {
+		return 0, err
+	}
+	_ = presp.Body.Close()
+	switch {
+	case presp.StatusCode == http.StatusPreconditionFailed:
+		return 0, fmt.Errorf("PUT %s: %w", rr.URL, ErrRemoteChanged)
+	case presp.StatusCode < 200 || presp.StatusCode > 299:
+		return 0, fmt.Errorf("PUT %s: %s", rr.URL, presp.Status)
+	}
+	return int(counter.n), nil
+}
+
+func (rr *RemoteReplacer) newRequest(ctx context.Context, method string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rr.URL, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range rr.Header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	return req, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read implements the `io.Reader` interface.
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package gosed
+
+import "os"
+
+// replaceFile renames from over to
+func replaceFile(from, to string) error {
+	return os.Rename(from, to)
+}
@@ -0,0 +1,50 @@
+package gosed
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	// movefileReplaceExisting and movefileWriteThrough are the MOVEFILE_REPLACE_EXISTING and MOVEFILE_WRITE_THROUGH
+	// flags of MoveFileEx
+	movefileReplaceExisting = 0x1
+	movefileWriteThrough    = 0x8
+	// errorSharingViolation and errorLockViolation are returned while another process has the file open or locked
+	errorSharingViolation syscall.Errno = 32
+	errorLockViolation    syscall.Errno = 33
+	// renameAttempts bounds the retries of a rename that another process, such as a virus scanner, holds up
+	renameAttempts = 8
+)
+
+var procMoveFileExW = syscall.NewLazyDLL("kernel32.dll").NewProc("MoveFileExW")
+
+// replaceFile renames from over to with MoveFileEx, which returns once the rename is on disk. Virus scanners and
+// indexers briefly open new files without sharing them for deletion, so a rename that is denied is retried with a
+// growing delay.
+func replaceFile(from, to string) error {
+	fromp, err := syscall.UTF16PtrFromString(from)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: err}
+	}
+	top, err := syscall.UTF16PtrFromString(to)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: err}
+	}
+	delay := 10 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		r, _, errno := procMoveFileExW.Call(uintptr(unsafe.Pointer(fromp)), uintptr(unsafe.Pointer(top)), movefileReplaceExisting|movefileWriteThrough)
+		if r != 0 {
+			return nil
+		}
+		retry := errors.Is(errno, syscall.ERROR_ACCESS_DENIED) || errors.Is(errno, errorSharingViolation) || errors.Is(errno, errorLockViolation)
+		if !retry || attempt == renameAttempts {
+			return &os.LinkError{Op: "rename", Old: from, New: to, Err: errno}
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
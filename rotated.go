@@ -0,0 +1,101 @@
+package gosed
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// rotatedSuffix matches what log rotation appends to a file name: a generation number or date, and an optional
+// compression extension
+var rotatedSuffix = regexp.MustCompile(`^(?:[.-]([0-9][0-9-]*))?(\.gz|\.bz2|\.zst)?$`)
+
+// ReplaceRotated applies the mappings to the file and every rotated generation of it in the same directory,
+// e.g. app.log, app.log.1 and app.log.2.gz. Generations ending in ".gz", ".bz2" or ".zst" are decompressed and
+// compressed again, unless a Compression was configured, and every file keeps its name. It returns the bytes written to all of them.
+func (rp *Replacer) ReplaceRotated() (int, error) {
+	members, err := rotatedSet(rp.Config.FilePath)
+	if err != nil {
+		return 0, err
+	}
+	mappings := rp.Config.Mappings.clone()
+	defer rp.Config.spend()
+	total := 0
+	for _, member := range members {
+		// every member runs on its own copy of the configuration, so per-member settings stay out of rp
+		cfg := *rp.Config
+		cfg.applyChain, cfg.spent = nil, nil
+		if member != rp.Config.FilePath {
+			mrp, err := NewReplacer(member)
+			if err != nil {
+				return total, err
+			}
+			cfg.File, cfg.FilePath, cfg.FileSize, cfg.FilePerm = mrp.Config.File, mrp.Config.FilePath, mrp.Config.FileSize, mrp.Config.FilePerm
+		}
+		cfg.Mappings = mappings.clone()
+		if cfg.Compression == nil {
+			cfg.Compression = compressionFor(member)
+		}
+		wrote, err := (&Replacer{Config: &cfg}).ReplaceChained()
+		if member != rp.Config.FilePath {
+			_ = cfg.File.Close()
+		} else {
+			// the commit opens the replaced file anew
+			rp.Config.File = cfg.File
+			if err == nil {
+				rp.Config.FileSize = cfg.FileSize
+			}
+		}
+		if err != nil {
+			return total, fmt.Errorf("%s: %w", member, err)
+		}
+		total += wrote
+	}
+	return total, nil
+}
+
+// rotatedSet returns base followed by its rotated generations
+func rotatedSet(base string) ([]string, error) {
+	dir, name := filepath.Split(base)
+	candidates, err := filepath.Glob(filepath.Join(dir, globEscape(name)+"*"))
+	if err != nil {
+		return nil, err
+	}
+	members := []string{base}
+	generation := map[string]string{}
+	for _, candidate := range candidates {
+		m := rotatedSuffix.FindStringSubmatch(strings.TrimPrefix(filepath.Base(candidate), name))
+		if m == nil || m[1] == "" {
+			continue
+		}
+		members = append(members, candidate)
+		generation[candidate] = m[1]
+	}
+	// numbered generations come first, from the newest (.1) up, then dated ones, newest first
+	rank := func(member string) (int, int, string) {
+		if n, err := strconv.Atoi(generation[member]); err == nil {
+			return 0, n, ""
+		}
+		return 1, 0, generation[member]
+	}
+	sort.SliceStable(members[1:], func(i, j int) bool {
+		ri, ni, di := rank(members[1+i])
+		rj, nj, dj := rank(members[1+j])
+		switch {
+		case ri != rj:
+			return ri < rj
+		case ri == 0:
+			return ni < nj
+		}
+		return di > dj
+	})
+	return members, nil
+}
+
+// globEscape quotes the meta characters of a filepath.Match pattern
+func globEscape(name string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`).Replace(name)
+}
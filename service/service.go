@@ -0,0 +1,212 @@
+// Package service exposes the gosed replace engine over HTTP, so that it can run as a sidecar text transformation
+// service.
+//
+// Mapping sets are registered by name and then referenced by the requests that use them:
+//
+//	POST /sets/{name}          appends the JSON array of Mapping in the body to the mapping set
+//	POST /sets/{name}/stream   replies with the body, replaced with the mapping set, as it streams in
+//	POST /sets/{name}/files    replaces the server-local file named by the JSON FileRequest body, and replies with a
+//	                           JSON FileResponse; only files under Server.Root can be replaced
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/mohamed-essam/gosed"
+)
+
+// Mapping is an old:new entry of a mapping set
+type Mapping struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// FileRequest names the server-local file to replace
+type FileRequest struct {
+	Path string `json:"path"`
+}
+
+// FileResponse is the outcome of replacing a server-local file
+type FileResponse struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	Wrote  int    `json:"wrote"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Server is an http.Handler serving the gosed replace engine
+type Server struct {
+	// Root is the directory server-local files must be in, requests for files are refused if it is empty
+	Root string
+	// AllowSymlinks lets requests name files through symbolic links, to files or directories, as long as the files
+	// they lead to are under Root; the files are then replaced where the links lead. Requests naming a path through a
+	// link are refused otherwise.
+	AllowSymlinks bool
+	// Pool replaces the server-local files
+	Pool *gosed.ReplacerPool
+
+	mu   sync.RWMutex
+	sets map[string][]Mapping
+}
+
+// New returns a new *Server replacing the files under root, whose replacers are configured with opts
+func New(root string, opts ...gosed.Option) *Server {
+	return &Server{
+		Root: root,
+		Pool: gosed.NewReplacerPool(opts...),
+		sets: make(map[string][]Mapping),
+	}
+}
+
+// ServeHTTP implements the `http.Handler` interface.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] != "sets" || parts[1] == "" {
+		http.NotFound(w, r)
+		return
+	}
+	set := parts[1]
+	if len(parts) == 2 {
+		s.addMappings(w, r, set)
+		return
+	}
+	switch parts[2] {
+	case "stream":
+		s.stream(w, r, set)
+	case "files":
+		s.replaceFile(w, r, set)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) addMappings(w http.ResponseWriter, r *http.Request, set string) {
+	var mappings []Mapping
+	if err := json.NewDecoder(r.Body).Decode(&mappings); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, m := range mappings {
+		if m.Old == "" {
+			http.Error(w, gosed.ErrEmptyKey.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range mappings {
+		if err := s.Pool.NewStringMapping(set, m.Old, m.New); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.sets[set] = append(s.sets[set], m)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) mappings(set string) ([]Mapping, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	mappings, ok := s.sets[set]
+	return mappings, ok
+}
+
+func (s *Server) stream(w http.ResponseWriter, r *http.Request, set string) {
+	mappings, ok := s.mappings(set)
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown mapping set %q", set), http.StatusNotFound)
+		return
+	}
+	var result io.Reader = r.Body
+	for _, m := range mappings {
+		result = gosed.NewBytesReplacingReader(result, []byte(m.Old), []byte(m.New))
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	// the reply is streamed, so an error reading the body can only cut it short
+	_, _ = io.Copy(w, result)
+}
+
+func (s *Server) replaceFile(w http.ResponseWriter, r *http.Request, set string) {
+	if _, ok := s.mappings(set); !ok {
+		http.Error(w, fmt.Sprintf("unknown mapping set %q", set), http.StatusNotFound)
+		return
+	}
+	var req FileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	path, err := s.resolve(req.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	resp := FileResponse{Path: req.Path, Status: gosed.FileReplaced.String()}
+	rp, err := s.Pool.Get(set, path)
+	if err == nil {
+		resp.Wrote, err = rp.ReplaceChained()
+		if perr := s.Pool.Put(rp); err == nil {
+			err = perr
+		}
+	}
+	if err != nil {
+		resp.Status, resp.Error = gosed.FileFailed.String(), err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// resolve returns the server-local path of name, with the symbolic links along it resolved, which must be under Root
+func (s *Server) resolve(name string) (string, error) {
+	if s.Root == "" {
+		return "", errors.New("server-local files are disabled")
+	}
+	root, err := filepath.Abs(s.Root)
+	if err != nil {
+		return "", err
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return "", err
+	}
+	path := filepath.Join(root, filepath.FromSlash(name))
+	if !within(root, path) {
+		return "", fmt.Errorf("%s is outside of the root", name)
+	}
+	// the links are resolved up to the parent of a file that does not exist yet
+	resolved, err := filepath.EvalSymlinks(path)
+	if errors.Is(err, os.ErrNotExist) {
+		var dir string
+		if dir, err = filepath.EvalSymlinks(filepath.Dir(path)); err == nil {
+			resolved = filepath.Join(dir, filepath.Base(path))
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case !within(root, resolved):
+		return "", fmt.Errorf("%s leads outside of the root", name)
+	case resolved != path && !s.AllowSymlinks:
+		return "", fmt.Errorf("%s goes through a symbolic link", name)
+	}
+	return resolved, nil
+}
+
+// within reports whether path is root or under it, lexically
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	root := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(root, "config.txt"), []byte("host=old.example\n"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	srv := httptest.NewServer(New(root))
+	defer srv.Close()
+	post := func(path, body string) *http.Response {
+		resp, err := http.Post(srv.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return resp
+	}
+
+	resp := post("/sets/hosts", `[{"old":"old.example","new":"new.example"}]`)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("registering mappings: %s", resp.Status)
+	}
+	_ = resp.Body.Close()
+
+	resp = post("/sets/hosts/stream", "a old.example b old.example")
+	streamed, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(streamed) != "a new.example b new.example" {
+		t.Fatalf("unexpected stream %q", streamed)
+	}
+
+	resp = post("/sets/hosts/files", `{"path":"config.txt"}`)
+	var result FileResponse
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if result.Status != "replaced" {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(root, "config.txt"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(content) != "host=new.example\n" {
+		t.Fatalf("unexpected content %q", content)
+	}
+
+	resp = post("/sets/hosts/files", `{"path":"../config.txt"}`)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a path outside the root to be refused, got %s", resp.Status)
+	}
+	resp = post("/sets/missing/stream", "old.example")
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected an unknown mapping set to be refused, got %s", resp.Status)
+	}
+}
+
+func TestServerSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links need privileges here")
+	}
+	root, outside := t.TempDir(), t.TempDir()
+	for _, path := range []string{filepath.Join(root, "config.txt"), filepath.Join(outside, "hosts.txt")} {
+		if err := ioutil.WriteFile(path, []byte("host=old.example\n"), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	links := map[string]string{
+		"x":          outside,
+		"hosts.txt":  filepath.Join(outside, "hosts.txt"),
+		"config.lnk": filepath.Join(root, "config.txt"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	s := New(root)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	post := func(path, body string) *http.Response {
+		resp, err := http.Post(srv.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return resp
+	}
+	resp := post("/sets/hosts", `[{"old":"old.example","new":"new.example"}]`)
+	_ = resp.Body.Close()
+
+	for _, allow := range []bool{false, true} {
+		s.AllowSymlinks = allow
+		for _, path := range []string{"x/hosts.txt", "hosts.txt"} {
+			resp = post("/sets/hosts/files", `{"path":"`+path+`"}`)
+			_ = resp.Body.Close()
+			if resp.StatusCode != http.StatusForbidden {
+				t.Fatalf("expected %s to be refused, got %s", path, resp.Status)
+			}
+		}
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(outside, "hosts.txt")); string(content) != "host=old.example\n" {
+		t.Fatalf("file outside of the root replaced: %q", content)
+	}
+
+	// links within the root are followed when allowed
+	s.AllowSymlinks = false
+	resp = post("/sets/hosts/files", `{"path":"config.lnk"}`)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a link to be refused, got %s", resp.Status)
+	}
+	s.AllowSymlinks = true
+	resp = post("/sets/hosts/files", `{"path":"config.lnk"}`)
+	var result FileResponse
+	err := json.NewDecoder(resp.Body).Decode(&result)
+	_ = resp.Body.Close()
+	if err != nil || result.Status != "replaced" {
+		t.Fatalf("unexpected result %+v: %v", result, err)
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(root, "config.txt")); string(content) != "host=new.example\n" {
+		t.Fatalf("unexpected content %q", content)
+	}
+	if info, err := os.Lstat(filepath.Join(root, "config.lnk")); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Fatal("link replaced")
+	}
+}
@@ -0,0 +1,112 @@
+package gosed
+
+import (
+	"bytes"
+	"errors"
+	"os"
+)
+
+// sparseBlockSize is the size of the blocks a sparse copy checks for zeros, that of most filesystem blocks
+const sparseBlockSize = 4096
+
+// zeroBlock is compared with the blocks of a sparse copy
+var zeroBlock [sparseBlockSize]byte
+
+// errPunchUnsupported is returned by punchHole where the platform or filesystem cannot deallocate a range of a file
+var errPunchUnsupported = errors.New("punching holes is not supported")
+
+// WithPreallocation reserves the size of the original file for the temporary file before writing the replaced content,
+// with fallocate where available, so that the copy of a large file is not fragmented. The copy is cut to its actual
+// size once written. Sparse files are not preallocated, since that would fill their holes.
+func WithPreallocation() Option {
+	return func(c *replacerConfig) {
+		c.Preallocate = true
+	}
+}
+
+// isSparse reports whether f has holes, fewer bytes allocated on disk than its size
+func isSparse(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	allocated, ok := allocatedSize(info)
+	return ok && allocated < info.Size()
+}
+
+// sparseWriter writes the replaced content of a file to a copy, leaving holes where whole blocks are zeros if sparse
+type sparseWriter struct {
+	f      *os.File
+	offset int64
+	sparse bool
+	// punch deallocates the zero blocks instead of skipping them, for a file that may hold other content there
+	punch bool
+}
+
+// newSparseWriter returns a writer over dst, a new temporary file for the replaced content of src, that keeps the
+// holes of a sparse src, or preallocates dst if configured to; nil if neither applies
+func (rc *replacerConfig) newSparseWriter(dst, src *os.File) *sparseWriter {
+	sparse := isSparse(src)
+	if !sparse && !rc.Preallocate {
+		return nil
+	}
+	if !sparse {
+		// a failed preallocation only costs the fragmentation it was meant to avoid
+		_ = preallocate(dst, rc.FileSize)
+	}
+	return &sparseWriter{f: dst, sparse: sparse}
+}
+
+// Write implements the `io.Writer` interface.
+func (sw *sparseWriter) Write(p []byte) (int, error) {
+	if !sw.sparse {
+		n, err := sw.f.WriteAt(p, sw.offset)
+		sw.offset += int64(n)
+		return n, err
+	}
+	// data is written in runs of blocks, aligned on the offset in the file so that holes cover whole blocks
+	start := 0
+	for i := 0; i < len(p); {
+		n := min(len(p)-i, sparseBlockSize-int((sw.offset+int64(i))%sparseBlockSize))
+		if !bytes.Equal(p[i:i+n], zeroBlock[:n]) {
+			i += n
+			continue
+		}
+		if err := sw.flush(p[start:i], start); err != nil {
+			return start, err
+		}
+		if err := sw.hole(p[i:i+n], i); err != nil {
+			return i, err
+		}
+		i += n
+		start = i
+	}
+	if err := sw.flush(p[start:], start); err != nil {
+		return start, err
+	}
+	sw.offset += int64(len(p))
+	return len(p), nil
+}
+
+// flush writes data, found at index i of the current write
+func (sw *sparseWriter) flush(data []byte, i int) error {
+	if len(data) == 0 {
+		return nil
+	}
+	_, err := sw.f.WriteAt(data, sw.offset+int64(i))
+	return err
+}
+
+// hole leaves a hole for zeros, found at index i of the current write
+func (sw *sparseWriter) hole(zeros []byte, i int) error {
+	if !sw.punch || punchHole(sw.f, sw.offset+int64(i), int64(len(zeros))) == nil {
+		return nil
+	}
+	return sw.flush(zeros, i)
+}
+
+// finish sets the size of the file to that of the content written, which ends with a hole or is shorter than the
+// space preallocated
+func (sw *sparseWriter) finish() error {
+	return sw.f.Truncate(sw.offset)
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package gosed
+
+import "os"
+
+// allocatedSize returns the number of bytes allocated on disk for the file described by info, which is not known here
+func allocatedSize(info os.FileInfo) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,18 @@
+//go:build !windows && !plan9
+
+package gosed
+
+import (
+	"os"
+	"syscall"
+)
+
+// allocatedSize returns the number of bytes allocated on disk for the file described by info
+func allocatedSize(info os.FileInfo) (int64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	// st_blocks counts 512-byte units whatever the block size of the filesystem
+	return int64(st.Blocks) * 512, true
+}
@@ -0,0 +1,140 @@
+package gosed
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrStalled is reported for a file of a batch that made no I/O progress within the stall timeout
+var ErrStalled = errors.New("no I/O progress")
+
+// trackingReader counts the bytes read through it and fails once the replace is cancelled
+type trackingReader struct {
+	r        io.Reader
+	ctx      context.Context
+	progress *int64
+	// report, if set, receives the number of bytes of every read
+	report func(n int)
+}
+
+// track wraps the reader of the source file so that progress is counted and reported, and cancellation is noticed
+// between reads
+func (rc *replacerConfig) track(r io.Reader) io.Reader {
+	if rc.ctx == nil && rc.ProgressFunc == nil {
+		return r
+	}
+	tr := &trackingReader{r: r, ctx: rc.ctx, progress: rc.progress}
+	if rc.ProgressFunc != nil {
+		tr.report = rc.advance
+	}
+	return tr
+}
+
+// count wraps r so that progress is counted, without failing on cancellation, for I/O that must run to completion
+func (rc *replacerConfig) count(r io.Reader) io.Reader {
+	if rc.progress == nil {
+		return r
+	}
+	return &trackingReader{r: r, progress: rc.progress}
+}
+
+// Read implements the `io.Reader` interface.
+func (tr *trackingReader) Read(p []byte) (int, error) {
+	if tr.ctx != nil {
+		if err := tr.ctx.Err(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := tr.r.Read(p)
+	if tr.progress != nil {
+		atomic.AddInt64(tr.progress, int64(n))
+	}
+	if tr.report != nil {
+		tr.report(n)
+	}
+	return n, err
+}
+
+// trackingReaderAt is the trackingReader of random access sources
+type trackingReaderAt struct {
+	ra       io.ReaderAt
+	ctx      context.Context
+	progress *int64
+	report   func(n int)
+}
+
+// trackAt is track for random access sources
+func (rc *replacerConfig) trackAt(ra io.ReaderAt) io.ReaderAt {
+	if rc.ctx == nil && rc.ProgressFunc == nil {
+		return ra
+	}
+	tr := &trackingReaderAt{ra: ra, ctx: rc.ctx, progress: rc.progress}
+	if rc.ProgressFunc != nil {
+		tr.report = rc.advance
+	}
+	return tr
+}
+
+// ReadAt implements the `io.ReaderAt` interface.
+func (tr *trackingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if tr.ctx != nil {
+		if err := tr.ctx.Err(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := tr.ra.ReadAt(p, off)
+	if tr.progress != nil {
+		atomic.AddInt64(tr.progress, int64(n))
+	}
+	if tr.report != nil {
+		tr.report(n)
+	}
+	return n, err
+}
+
+// commitGate settles the race between a replace committing its file and the batch abandoning it:
+// whichever of commit and abandon is called first wins, and the other one then returns false.
+type commitGate struct {
+	mu        sync.Mutex
+	committed bool
+	abandoned bool
+}
+
+// commit reports whether the file may be committed, which it may no longer be once abandoned
+func (g *commitGate) commit() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.committed = !g.abandoned
+	return g.committed
+}
+
+// abandon reports whether the file was abandoned before its commit began
+func (g *commitGate) abandon() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.abandoned = !g.committed
+	return g.abandoned
+}
+
+// beginCommit is called right before the file is first modified, and returns an error if the replace must stop instead.
+// From then on, the replace is no longer interrupted by cancellation.
+func (rc *replacerConfig) beginCommit() error {
+	if err := rc.cancelled(); err != nil {
+		return err
+	}
+	if rc.gate != nil && !rc.gate.commit() {
+		return context.Canceled
+	}
+	return nil
+}
+
+// cancelled returns the error of a cancelled replace, which must not be committed any more
+func (rc *replacerConfig) cancelled() error {
+	if rc.ctx == nil {
+		return nil
+	}
+	return rc.ctx.Err()
+}
@@ -0,0 +1,168 @@
+package gosed
+
+import (
+	"io"
+	"time"
+)
+
+// MappingStats is what a single mapping did during a replace
+type MappingStats struct {
+	// Key is the key of the mapping; the prefix of a numeric mapping, the pattern of a regex mapping
+	Key []byte
+	// Occurrences is the number of matches replaced, or of lines changed by a line operation
+	Occurrences int
+	// BytesRead is the number of bytes the mapping read, and BytesWritten the number it passed on to the next one
+	BytesRead, BytesWritten int64
+	// Elapsed is the time spent in the mapping itself, not waiting on the stages before it
+	Elapsed time.Duration
+}
+
+// Stats is what the last replace did
+type Stats struct {
+	// Mappings holds the statistics of every mapping, in order
+	Mappings []MappingStats
+	// BytesRead is the size of the file as it was read, and BytesWritten the size of the result
+	BytesRead, BytesWritten int64
+	Elapsed                 time.Duration
+	// Skipped is set when the guards of OnlyIfContains and SkipIfContains, or a LinkSkip policy, left the file alone
+	Skipped bool
+}
+
+// Stats returns the statistics of the last replace, or the zero Stats if none has run. A mapping that never saw the
+// data, such as one scoped to front matter in a file without any, reports no bytes read.
+func (rp *Replacer) Stats() Stats {
+	rs := rp.Config.stats
+	if rs == nil {
+		return Stats{}
+	}
+	stats := Stats{Mappings: make([]MappingStats, len(rs.mappings)), BytesRead: rs.read, BytesWritten: rs.written, Elapsed: rs.elapsed, Skipped: rs.skipped}
+	for i, m := range rs.mappings {
+		stats.Mappings[i] = MappingStats{
+			Key:          rs.keys[i],
+			Occurrences:  m.occurrences,
+			BytesRead:    m.read,
+			BytesWritten: m.written,
+			Elapsed:      m.through - m.upstream,
+		}
+	}
+	return stats
+}
+
+// addStats adds the statistics of a replaced file to total, which holds the same mappings
+func addStats(total *Stats, s Stats) {
+	total.BytesRead += s.BytesRead
+	total.BytesWritten += s.BytesWritten
+	for m := range s.Mappings {
+		t := &total.Mappings[m]
+		t.Occurrences += s.Mappings[m].Occurrences
+		t.BytesRead += s.Mappings[m].BytesRead
+		t.BytesWritten += s.Mappings[m].BytesWritten
+		t.Elapsed += s.Mappings[m].Elapsed
+	}
+}
+
+// replaceStats collects the statistics of a replace in progress
+type replaceStats struct {
+	start         time.Time
+	elapsed       time.Duration
+	read, written int64
+	keys          [][]byte
+	mappings      []mappingMeter
+	skipped       bool
+}
+
+// mappingMeter collects the statistics of a mapping. The readers of a stage run inside the reads of the stage after
+// them, so the time a mapping takes is the time spent reading its output, less the time spent reading its input.
+type mappingMeter struct {
+	occurrences       int
+	read, written     int64
+	upstream, through time.Duration
+}
+
+// beginStats starts collecting the statistics of a replace of the file as it is now
+func (rc *replacerConfig) beginStats() {
+	rs := &replaceStats{start: time.Now(), keys: append([][]byte{}, rc.Mappings.Keys...), mappings: make([]mappingMeter, len(rc.Mappings.Keys))}
+	if info, err := rc.stat(); err == nil {
+		rs.read = info.Size()
+	}
+	rc.stats = rs
+}
+
+// finishStats records the size of the result of a successful replace
+func (rc *replacerConfig) finishStats(written int64) {
+	if rs := rc.stats; rs != nil {
+		rs.written = written
+		rs.elapsed = time.Since(rs.start)
+	}
+}
+
+// merge adds the meters of other, which collected the statistics of a part of the file, to those of rs
+func (rs *replaceStats) merge(other *replaceStats) {
+	if rs == nil || other == nil {
+		return
+	}
+	for i, o := range other.mappings {
+		m := &rs.mappings[i]
+		m.occurrences += o.occurrences
+		m.read += o.read
+		m.written += o.written
+		m.upstream += o.upstream
+		m.through += o.through
+	}
+}
+
+// occurrenceCounter is a stage reader that counts its matches
+type occurrenceCounter interface {
+	GetOccurrences() int
+}
+
+// stage wraps r with the reader of the mapping at index, reusing brr for a mapping replaced by a BytesReplacingReader
+// if it is not nil, and meters it
+func (rc *replacerConfig) stage(r io.Reader, index int, brr *BytesReplacingReader) io.Reader {
+	var meter *mappingMeter
+	if rc.stats != nil && index < len(rc.stats.mappings) {
+		meter = &rc.stats.mappings[index]
+		r = &meteredReader{r: r, bytes: &meter.read, elapsed: &meter.upstream}
+	}
+	var out interface {
+		io.Reader
+		occurrenceCounter
+	}
+	if opts := rc.Mappings.Options[index]; opts != nil && opts.Regex != nil {
+		out = newRegexReader(r, rc, opts, rc.Mappings.Indices[index])
+	} else if opts != nil && opts.addressed() {
+		out = newAddressReader(r, rc, opts, rc.replacer(index))
+	} else {
+		if brr == nil {
+			brr = &BytesReplacingReader{}
+		}
+		out = brr.ResetEx(r, rc.replacer(index))
+	}
+	if meter == nil {
+		return out
+	}
+	return &meteredReader{r: out, bytes: &meter.written, elapsed: &meter.through, counter: out, occurrences: &meter.occurrences}
+}
+
+// meteredReader adds the bytes read through it and the time spent reading to a mappingMeter, and the occurrences
+// counted by counter once it is drained
+type meteredReader struct {
+	r           io.Reader
+	bytes       *int64
+	elapsed     *time.Duration
+	counter     occurrenceCounter
+	occurrences *int
+}
+
+// Read implements the `io.Reader` interface.
+func (mr *meteredReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := mr.r.Read(p)
+	*mr.elapsed += time.Since(start)
+	*mr.bytes += int64(n)
+	if err != nil && mr.counter != nil {
+		*mr.occurrences += mr.counter.GetOccurrences()
+		mr.counter = nil
+	}
+	return n, err
+}
@@ -0,0 +1,103 @@
+package gosed
+
+import (
+	"io"
+)
+
+// Mapping is a single replacement of the streaming API
+type Mapping struct {
+	// Old cannot be nil/empty, which fails with ErrEmptyKey. New can.
+	Old, New []byte
+	Options  []MappingOption
+}
+
+// newStreamConfig returns the configuration applying mappings to a stream
+func newStreamConfig(mappings []Mapping) *replacerConfig {
+	rc := &replacerConfig{
+		Mappings: &replacerMappings{
+			Keys:    make([][]byte, 0, len(mappings)),
+			Indices: make([][]byte, 0, len(mappings)),
+			Options: make([]*mappingOptions, 0, len(mappings)),
+		},
+		MaxRecordLength: DefaultMaxRecordLength,
+		RecordSeparator: '\n',
+	}
+	for _, m := range mappings {
+		var mo *mappingOptions
+		if len(m.Options) > 0 {
+			mo = &mappingOptions{}
+			for _, opt := range m.Options {
+				opt(mo)
+			}
+		}
+		rc.Mappings.add(m.Old, m.New, mo)
+	}
+	return rc
+}
+
+// checkMappings returns ErrEmptyKey if a mapping has an empty key
+func checkMappings(mappings []Mapping) error {
+	for _, m := range mappings {
+		if len(m.Old) == 0 {
+			return ErrEmptyKey
+		}
+	}
+	return nil
+}
+
+// NewReader returns a reader of r with the mappings applied in order, as ReplaceChained applies them to a file,
+// for streams that are not files: sockets, stdin, or the reader of a gzip stream. If a mapping has an empty key, every
+// read fails with ErrEmptyKey.
+func NewReader(r io.Reader, mappings ...Mapping) io.Reader {
+	if err := checkMappings(mappings); err != nil {
+		return &failedReader{err: err}
+	}
+	return newStreamConfig(mappings).chain(r)
+}
+
+// failedReader fails every read with err
+type failedReader struct {
+	err error
+}
+
+// Read implements the `io.Reader` interface.
+func (fr *failedReader) Read([]byte) (int, error) {
+	return 0, fr.err
+}
+
+// NewWriter returns a writer that applies the mappings in order to what is written to it and writes the result to w.
+// The replacing readers hold back the bytes a match may still span, so the result is only complete once the writer
+// is closed; Close returns the first error writing to w, which later writes return as well. Closing the writer
+// does not close w. If a mapping has an empty key, writes and Close fail with ErrEmptyKey.
+func NewWriter(w io.Writer, mappings ...Mapping) io.WriteCloser {
+	pr, pw := io.Pipe()
+	rw := &replacingWriter{pw: pw, done: make(chan struct{})}
+	result := NewReader(pr, mappings...)
+	go func() {
+		_, err := io.Copy(w, result)
+		// unblocks a Write waiting on a failed copy
+		_ = pr.CloseWithError(err)
+		rw.err = err
+		close(rw.done)
+	}()
+	return rw
+}
+
+// replacingWriter feeds the reader chain of NewWriter through a pipe
+type replacingWriter struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	err  error
+}
+
+// Write implements the `io.Writer` interface.
+func (rw *replacingWriter) Write(p []byte) (int, error) {
+	return rw.pw.Write(p)
+}
+
+// Close implements the `io.Closer` interface.
+func (rw *replacingWriter) Close() error {
+	_ = rw.pw.Close()
+	<-rw.done
+	return rw.err
+}
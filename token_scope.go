@@ -0,0 +1,172 @@
+package gosed
+
+import (
+	"bytes"
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"io"
+	"io/ioutil"
+)
+
+// TokenScope is a set of kinds of source code tokens
+type TokenScope int
+
+const (
+	// ScopeCode is everything that is neither a string literal nor a comment
+	ScopeCode TokenScope = 1 << iota
+	// ScopeString is string and character literals, quotes included
+	ScopeString
+	// ScopeComment is comments, delimiters included
+	ScopeComment
+)
+
+// Span is a range of source code of a single scope
+type Span struct {
+	Scope      TokenScope
+	Start, End int
+}
+
+// Lexer splits source code into scopes for WithTokenScope
+type Lexer interface {
+	// Lex returns the string literals and comments of src, in order and without overlap; the rest of src is code.
+	Lex(src []byte) ([]Span, error)
+}
+
+// GoLexer lexes Go source code
+var GoLexer Lexer = goLexer{}
+
+// WithTokenScope restricts the mappings to the tokens of the given scopes, as split by lexer, so that a rename can
+// leave comments alone, or fix only comments: WithTokenScope(GoLexer, ScopeCode|ScopeString) keeps them out of
+// comments. A key never matches across two tokens of different scopes. The file is buffered whole, so it is bounded
+// by the max record length.
+func WithTokenScope(lexer Lexer, scopes TokenScope) Option {
+	return func(c *replacerConfig) {
+		c.Lexer = lexer
+		c.TokenScopes = scopes
+	}
+}
+
+// tokenScopeReader applies the mappings to the in scope spans of the source code read from r
+type tokenScopeReader struct {
+	r   io.Reader
+	rc  *replacerConfig
+	out []byte
+	err error
+}
+
+func newTokenScopeReader(r io.Reader, rc *replacerConfig) *tokenScopeReader {
+	return &tokenScopeReader{r: r, rc: rc}
+}
+
+// Read implements the `io.Reader` interface.
+func (tr *tokenScopeReader) Read(p []byte) (int, error) {
+	if tr.r != nil {
+		tr.out, tr.err = tr.rewrite()
+		tr.r = nil
+		if tr.err == nil {
+			tr.err = io.EOF
+		}
+	}
+	if len(tr.out) == 0 {
+		return 0, tr.err
+	}
+	n := copy(p, tr.out)
+	tr.out = tr.out[n:]
+	return n, nil
+}
+
+// rewrite reads the whole source and applies the mappings to every span in scope
+func (tr *tokenScopeReader) rewrite() ([]byte, error) {
+	src := tr.r
+	limit := tr.rc.MaxRecordLength
+	if limit > 0 {
+		src = io.LimitReader(src, int64(limit)+1)
+	}
+	code, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(code) > limit {
+		return nil, fmt.Errorf("%w: source is longer than %d bytes", ErrRecordTooLong, limit)
+	}
+	spans, err := tr.rc.Lexer.Lex(code)
+	if err != nil {
+		return nil, err
+	}
+	var out []byte
+	offset := 0
+	emit := func(scope TokenScope, end int) error {
+		if end <= offset {
+			return nil
+		}
+		part := code[offset:end]
+		if tr.rc.TokenScopes&scope != 0 {
+			replaced, err := tr.rc.apply(part)
+			if err != nil {
+				return err
+			}
+			part = replaced
+		}
+		out = append(out, part...)
+		offset = end
+		return nil
+	}
+	for _, span := range spans {
+		if span.Start < offset || span.End < span.Start || span.End > len(code) {
+			return nil, fmt.Errorf("lexer returned an invalid span [%d, %d)", span.Start, span.End)
+		}
+		if err := emit(ScopeCode, span.Start); err != nil {
+			return nil, err
+		}
+		if err := emit(span.Scope, span.End); err != nil {
+			return nil, err
+		}
+	}
+	if err := emit(ScopeCode, len(code)); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type goLexer struct{}
+
+// Lex implements the Lexer interface with go/scanner
+func (goLexer) Lex(src []byte) ([]Span, error) {
+	var s scanner.Scanner
+	var lexErr error
+	file := token.NewFileSet().AddFile("", -1, len(src))
+	s.Init(file, src, func(pos token.Position, msg string) {
+		if lexErr == nil {
+			lexErr = fmt.Errorf("%s: %s", pos, msg)
+		}
+	}, scanner.ScanComments)
+	var spans []Span
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		start := file.Offset(pos)
+		switch tok {
+		case token.STRING, token.CHAR:
+			end := start + len(lit)
+			if lit != "" && lit[0] == '`' {
+				// carriage returns are left out of the literal of raw strings
+				end = start + 1 + bytes.IndexByte(src[start+1:], '`') + 1
+			}
+			spans = append(spans, Span{Scope: ScopeString, Start: start, End: end})
+		case token.COMMENT:
+			end := start + len(lit)
+			if bytes.HasPrefix(src[start:], []byte("/*")) {
+				// and out of the literal of general comments
+				end = start + 2 + bytes.Index(src[start+2:], []byte("*/")) + 2
+			}
+			spans = append(spans, Span{Scope: ScopeComment, Start: start, End: end})
+		}
+	}
+	if lexErr != nil {
+		return nil, lexErr
+	}
+	return spans, nil
+}
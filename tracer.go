@@ -0,0 +1,144 @@
+package gosed
+
+import (
+	"io"
+	"time"
+)
+
+// TraceStage is a stage of a replace, timed by WithTracer
+type TraceStage int
+
+const (
+	// TraceRead is the time spent reading the file
+	TraceRead TraceStage = iota
+	// TraceMatch is the time spent in the mappings, decompression, decryption and their counterparts included
+	TraceMatch
+	// TraceWrite is the time spent writing the result to the temporary file
+	TraceWrite
+	// TraceRename is the time spent committing the result over the file, from the AfterFile hooks and the undo journal
+	// to the backup, the rename and the fsyncs
+	TraceRename
+)
+
+// String returns the name of the stage
+func (s TraceStage) String() string {
+	switch s {
+	case TraceRead:
+		return "read"
+	case TraceMatch:
+		return "match"
+	case TraceWrite:
+		return "write"
+	case TraceRename:
+		return "rename"
+	}
+	return "unknown"
+}
+
+// WithTracer calls fn once every file is replaced with the time each stage of its replace took, in the order of the
+// stages, for profiling and for choosing between Replace and ReplaceChained. fn is called from the goroutine running
+// the replace, and not for files that fail or are skipped.
+// Replace, which reads and writes the file once per mapping, adds up the stages of its passes. Files patched in place
+// and the replaces of an FSReplacer are not traced.
+func WithTracer(fn func(path string, stage TraceStage, elapsed time.Duration)) Option {
+	return func(c *replacerConfig) {
+		c.Tracer = fn
+	}
+}
+
+// replaceTrace adds up the time spent in every stage of the replace in flight
+type replaceTrace struct {
+	start                      time.Time
+	read, match, write, commit time.Duration
+}
+
+// beginTrace starts timing a replace, if traced
+func (rc *replacerConfig) beginTrace() {
+	rc.trace = nil
+	if rc.Tracer != nil {
+		rc.trace = &replaceTrace{start: time.Now()}
+	}
+}
+
+// timeRead wraps r so that the time spent reading it is traced
+func (rc *replacerConfig) timeRead(r io.Reader) io.Reader {
+	if rc.trace == nil {
+		return r
+	}
+	return &timedReader{r: r, elapsed: &rc.trace.read}
+}
+
+// timeReadAt is timeRead for the files of zip members, which are read at offsets
+func (rc *replacerConfig) timeReadAt(ra io.ReaderAt) io.ReaderAt {
+	if rc.trace == nil {
+		return ra
+	}
+	return &timedReader{ra: ra, elapsed: &rc.trace.read}
+}
+
+// timeWrite wraps w so that the time spent writing it is traced
+func (rc *replacerConfig) timeWrite(w io.Writer) io.Writer {
+	if rc.trace == nil {
+		return w
+	}
+	return &timedWriter{w: w, elapsed: &rc.trace.write}
+}
+
+// rendered ends the timing of the result: what was not spent reading or writing the file was spent matching
+func (rc *replacerConfig) rendered() {
+	if rt := rc.trace; rt != nil {
+		rt.match = time.Since(rt.start) - rt.read - rt.write
+		rt.start = time.Now()
+	}
+}
+
+// finishTrace ends the timing of a committed replace and reports it
+func (rc *replacerConfig) finishTrace() {
+	rt := rc.trace
+	if rt == nil {
+		return
+	}
+	rc.trace = nil
+	rt.commit = time.Since(rt.start)
+	rc.Tracer(rc.FilePath, TraceRead, rt.read)
+	rc.Tracer(rc.FilePath, TraceMatch, rt.match)
+	rc.Tracer(rc.FilePath, TraceWrite, rt.write)
+	rc.Tracer(rc.FilePath, TraceRename, rt.commit)
+}
+
+// timedReader adds the time spent in its reads to elapsed
+type timedReader struct {
+	r       io.Reader
+	ra      io.ReaderAt
+	elapsed *time.Duration
+}
+
+// Read implements the `io.Reader` interface.
+func (tr *timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := tr.r.Read(p)
+	*tr.elapsed += time.Since(start)
+	return n, err
+}
+
+// ReadAt implements the `io.ReaderAt` interface.
+func (tr *timedReader) ReadAt(p []byte, off int64) (int, error) {
+	start := time.Now()
+	n, err := tr.ra.ReadAt(p, off)
+	*tr.elapsed += time.Since(start)
+	return n, err
+}
+
+// timedWriter adds the time spent in its writes to elapsed
+type timedWriter struct {
+	w       io.Writer
+	elapsed *time.Duration
+}
+
+// Write implements the `io.Writer` interface.
+func (tw *timedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := tw.w.Write(p)
+	*tw.elapsed += time.Since(start)
+	return n, err
+}
@@ -0,0 +1,220 @@
+package gosed
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrTxDone is returned when a transaction is used after it was applied or rolled back
+var ErrTxDone = errors.New("transaction already applied or rolled back")
+
+// ErrTxAborted is returned by Tx.Apply when a replace of the transaction failed, in which case no file was changed
+var ErrTxAborted = errors.New("transaction aborted")
+
+// errTxPatchInPlace is returned when patching a file in place within a transaction, which leaves nothing to stage
+var errTxPatchInPlace = errors.New("files patched in place cannot join a transaction")
+
+// Tx makes the replaces of several files all or nothing. A replace configured WithTx writes its result to a temporary
+// file as usual but leaves the file alone; Apply then puts every staged result in place if every replace succeeded,
+// and Rollback discards them. A Tx is safe for concurrent use, so it can be given to a DirReplacer or a Batch:
+//
+//	tx := gosed.NewTx()
+//	dr := gosed.NewDirReplacer("src", gosed.WithTx(tx))
+//	...
+//	if _, err := dr.Replace(); err != nil {
+//		_ = tx.Rollback()
+//	} else if err := tx.Apply(); err != nil {
+//		...
+//	}
+type Tx struct {
+	mu     sync.Mutex
+	staged []stagedFile
+	failed []FileResult
+	done   bool
+}
+
+// stagedFile is the result of a replace waiting for the transaction to be applied
+type stagedFile struct {
+	rp    *Replacer
+	tmp   string
+	state *sourceState
+}
+
+// NewTx returns a new, empty *Tx
+func NewTx() *Tx {
+	return &Tx{}
+}
+
+// WithTx stages the results of the replaces in tx instead of replacing the file. Replace returns as it would
+// otherwise, and a replace that fails, or a file that cannot be opened by NewReplacer, aborts tx. Backups are taken
+// when tx is applied. Patching in place cannot be staged and fails.
+func WithTx(tx *Tx) Option {
+	return func(c *replacerConfig) {
+		c.Tx = tx
+	}
+}
+
+// Apply puts the staged results in place. If a replace of the transaction failed, or a staged file was written to
+// since it was read, nothing is changed, the staged results are discarded and an error wrapping ErrTxAborted or
+// ErrConcurrentWrite is returned. Renaming several files is not atomic: should putting one in place fail, the files
+// already replaced are restored from a copy of their original taken beforehand, as far as possible.
+func (tx *Tx) Apply() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	if len(tx.failed) > 0 {
+		tx.discard(tx.staged)
+		first := tx.failed[0]
+		return fmt.Errorf("%w: %d files failed, %s: %v", ErrTxAborted, len(tx.failed), first.Path, first.Err)
+	}
+	// the locks of WithFileLock are held until every file is in place
+	for _, sf := range tx.staged {
+		unlock, err := sf.rp.Config.lock()
+		if err != nil {
+			tx.discard(tx.staged)
+			return err
+		}
+		defer unlock()
+	}
+	for _, sf := range tx.staged {
+		if sf.state == nil {
+			continue
+		}
+		changed, err := sf.state.changed(sf.rp.Config)
+		if err == nil && changed {
+			err = fmt.Errorf("%w: %s", ErrConcurrentWrite, sf.rp.Config.FilePath)
+		}
+		if err != nil {
+			tx.discard(tx.staged)
+			return err
+		}
+	}
+	originals := make([]string, 0, len(tx.staged))
+	defer func() {
+		for _, original := range originals {
+			_ = os.Remove(original)
+		}
+	}()
+	for _, sf := range tx.staged {
+		original, err := sf.rp.Config.keepOriginal()
+		if err != nil {
+			tx.discard(tx.staged)
+			return err
+		}
+		originals = append(originals, original)
+	}
+	for i, sf := range tx.staged {
+		if err := sf.rp.install(sf.tmp); err != nil {
+			tx.discard(tx.staged[i+1:])
+			for j := i - 1; j >= 0; j-- {
+				tx.staged[j].rp.restore(originals[j])
+			}
+			return err
+		}
+	}
+	for _, sf := range tx.staged {
+		if err := sf.rp.Config.fixModTime(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rollback discards the staged results, leaving every file as it was
+func (tx *Tx) Rollback() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.discard(tx.staged)
+	return nil
+}
+
+// stage keeps tmpFile, the result of replacing the file of rp, until the transaction is applied
+func (tx *Tx) stage(rp *Replacer, tmpFile string, ss *sourceState) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		_ = os.Remove(tmpFile)
+		return ErrTxDone
+	}
+	for _, sf := range tx.staged {
+		if sf.rp.Config.FilePath == rp.Config.FilePath {
+			_ = os.Remove(tmpFile)
+			return fmt.Errorf("%s is already staged in the transaction", rp.Config.FilePath)
+		}
+	}
+	tx.staged = append(tx.staged, stagedFile{rp: rp, tmp: tmpFile, state: ss})
+	return nil
+}
+
+// record remembers that the replace of path failed with err, if it did
+func (tx *Tx) record(path string, err error) {
+	if tx == nil || err == nil {
+		return
+	}
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.failed = append(tx.failed, FileResult{Path: path, Status: FileFailed, Err: err})
+}
+
+// discard removes the temporary files of staged
+func (tx *Tx) discard(staged []stagedFile) {
+	for _, sf := range staged {
+		_ = os.Remove(sf.tmp)
+	}
+}
+
+// install puts tmpFile in place of the file, as a replace outside a transaction commits it
+func (rp *Replacer) install(tmpFile string) error {
+	if err := rp.Config.backup(); err != nil {
+		_ = os.Remove(tmpFile)
+		return err
+	}
+	if rp.Config.inPlace() {
+		return rp.writeBack(tmpFile)
+	}
+	return rp.Config.rename(tmpFile)
+}
+
+// keepOriginal saves the file next to it, hard linked when it is renamed over and copied otherwise, and returns the
+// name of the saved file
+func (rc *replacerConfig) keepOriginal() (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(rc.FilePath), "tmp-gosed-*")
+	if err != nil {
+		return "", &ErrTempFileCreate{Dir: filepath.Dir(rc.FilePath), Err: err}
+	}
+	name := tmp.Name()
+	_ = tmp.Close()
+	if !rc.inPlace() {
+		if err := os.Remove(name); err != nil {
+			return "", err
+		}
+		if err := os.Link(rc.FilePath, name); err == nil {
+			return name, nil
+		}
+	}
+	if err := rc.copyBackup(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// restore puts the original saved by keepOriginal back in place of the file
+func (rp *Replacer) restore(original string) {
+	if rp.Config.inPlace() {
+		_ = rp.writeBack(original)
+		return
+	}
+	reopen := rp.Config.release()
+	_ = replaceFile(original, rp.Config.FilePath)
+	reopen()
+}
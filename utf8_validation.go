@@ -0,0 +1,116 @@
+package gosed
+
+import (
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// UTF8Policy controls how a Replacer treats malformed UTF-8 in the file and in the replaced output
+type UTF8Policy int
+
+const (
+	// UTF8Ignore performs no validation
+	UTF8Ignore UTF8Policy = iota
+	// UTF8Fail aborts the replace operation at the first invalid sequence
+	UTF8Fail
+	// UTF8Report records the position of every invalid sequence and lets the replace operation complete
+	UTF8Report
+)
+
+// InvalidUTF8Error describes a malformed UTF-8 sequence found during validation
+type InvalidUTF8Error struct {
+	// Offset is the byte offset of the invalid sequence
+	Offset int64
+	// Output is true if the sequence was found in the replaced output rather than in the original file
+	Output bool
+}
+
+func (e *InvalidUTF8Error) Error() string {
+	if e.Output {
+		return fmt.Sprintf("invalid UTF-8 sequence at offset %d of the replaced output", e.Offset)
+	}
+	return fmt.Sprintf("invalid UTF-8 sequence at offset %d of the input file", e.Offset)
+}
+
+// WithUTF8Validation checks that the file is well-formed UTF-8 and that the replacements keep it so.
+func WithUTF8Validation(policy UTF8Policy) Option {
+	return func(c *replacerConfig) {
+		c.UTF8Policy = policy
+	}
+}
+
+// InvalidUTF8 returns the invalid sequences recorded by the last replace operation
+func (rp *Replacer) InvalidUTF8() []InvalidUTF8Error {
+	return rp.Config.UTF8Errors
+}
+
+// utf8ValidatingReader passes data through unchanged while checking it for malformed UTF-8.
+// Runes split across reads are carried over, so a sequence is only judged once it is complete.
+type utf8ValidatingReader struct {
+	r       io.Reader
+	rc      *replacerConfig
+	output  bool
+	offset  int64
+	pending []byte
+}
+
+func newUTF8ValidatingReader(r io.Reader, rc *replacerConfig, output bool) *utf8ValidatingReader {
+	return &utf8ValidatingReader{
+		r:       r,
+		rc:      rc,
+		output:  output,
+		pending: make([]byte, 0, utf8.UTFMax),
+	}
+}
+
+// Read implements the `io.Reader` interface.
+func (v *utf8ValidatingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	if verr := v.validate(p[:n], err == io.EOF); verr != nil {
+		return n, verr
+	}
+	return n, err
+}
+
+func (v *utf8ValidatingReader) validate(p []byte, eof bool) error {
+	data := p
+	start := v.offset
+	if len(v.pending) > 0 {
+		start -= int64(len(v.pending))
+		data = append(v.pending, p...)
+		v.pending = v.pending[:0]
+	}
+	v.offset += int64(len(p))
+	for i := 0; i < len(data); {
+		if data[i] < utf8.RuneSelf {
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRune(data[i:])
+		if r != utf8.RuneError || size > 1 {
+			i += size
+			continue
+		}
+		if !eof && !utf8.FullRune(data[i:]) {
+			v.pending = append(v.pending, data[i:]...)
+			return nil
+		}
+		if err := v.invalid(start + int64(i)); err != nil {
+			return err
+		}
+		i++
+	}
+	return nil
+}
+
+// invalid records the sequence at offset. Under UTF8Fail the first recorded sequence is returned, so a problem in
+// the input is reported ahead of the same bytes surfacing again in the output.
+func (v *utf8ValidatingReader) invalid(offset int64) error {
+	v.rc.UTF8Errors = append(v.rc.UTF8Errors, InvalidUTF8Error{Offset: offset, Output: v.output})
+	switch v.rc.UTF8Policy {
+	case UTF8Fail:
+		return &v.rc.UTF8Errors[0]
+	}
+	return nil
+}
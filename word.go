@@ -0,0 +1,49 @@
+package gosed
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// MatchWholeWord only replaces matches that are whole words, like sed's \bkey\b: a match starting with a word
+// character must not follow one, and a match ending with a word character must not be followed by one, so that
+// replacing "cat" leaves "catalog" and "bobcat" alone. Word characters are Unicode letters, digits and the underscore.
+func MatchWholeWord() MappingOption {
+	return func(o *mappingOptions) {
+		o.WholeWord = true
+	}
+}
+
+// wordBoundaryReplacer rejects matches of the wrapped BytesReplacer that start or end inside a word
+type wordBoundaryReplacer struct {
+	BytesReplacer
+}
+
+func (w *wordBoundaryReplacer) LookaroundHints() (int, int) {
+	behind, ahead := utf8.UTFMax, utf8.UTFMax
+	if f, ok := w.BytesReplacer.(BytesMatchFilter); ok {
+		b, a := f.LookaroundHints()
+		behind, ahead = max(behind, b), max(ahead, a)
+	}
+	return behind, ahead
+}
+
+func (w *wordBoundaryReplacer) FilterMatch(before, match, after []byte) bool {
+	if f, ok := w.BytesReplacer.(BytesMatchFilter); ok && !f.FilterMatch(before, match, after) {
+		return false
+	}
+	first, _ := utf8.DecodeRune(match)
+	last, _ := utf8.DecodeLastRune(match)
+	prev, _ := utf8.DecodeLastRune(before)
+	next, _ := utf8.DecodeRune(after)
+	return !(isWordRune(first) && len(before) > 0 && isWordRune(prev)) && !(isWordRune(last) && len(after) > 0 && isWordRune(next))
+}
+
+func (w *wordBoundaryReplacer) ExpandMatch(match, replace []byte) []byte {
+	return expandMatch(w.BytesReplacer, match, replace)
+}
+
+// isWordRune reports whether r is a word character
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
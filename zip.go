@@ -0,0 +1,85 @@
+package gosed
+
+import (
+	"archive/zip"
+	"io"
+	"path"
+)
+
+// WithZipMembers treats the file as a zip archive and applies the mappings to the content of every member whose name
+// matches one of the patterns (see path.Match, e.g. "word/*.xml"). Other members are copied without being recompressed.
+func WithZipMembers(patterns ...string) Option {
+	return func(c *replacerConfig) {
+		c.ZipMembers = append(c.ZipMembers, patterns...)
+	}
+}
+
+// zipMember reports whether the archive member called name should be rewritten
+func (rc *replacerConfig) zipMember(name string) bool {
+	for _, pattern := range rc.ZipMembers {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// zipReader returns a reader of the zip archive in ra, with the matching members rewritten.
+// The archive is written from a separate goroutine; closing the reader stops it.
+func (rp *Replacer) zipReader(ra io.ReaderAt, size int64) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(rp.rewriteZip(pw, ra, size))
+	}()
+	return pr
+}
+
+func (rp *Replacer) rewriteZip(w io.Writer, ra io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(w)
+	for _, f := range zr.File {
+		if !rp.Config.zipMember(f.Name) {
+			if err := zw.Copy(f); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := rp.rewriteZipMember(zw, f); err != nil {
+			return err
+		}
+	}
+	if err := zw.SetComment(zr.Comment); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func (rp *Replacer) rewriteZipMember(zw *zip.Writer, f *zip.File) error {
+	src, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer func(src io.ReadCloser) {
+		_ = src.Close()
+	}(src)
+	// the writer computes the checksum and sizes of the rewritten content itself
+	fh := f.FileHeader
+	dst, err := zw.CreateHeader(&fh)
+	if err != nil {
+		return err
+	}
+	var content io.Reader
+	if rp.Config.OfficeXML && path.Ext(f.Name) == ".xml" {
+		content, err = rp.Config.xmlTextReader(src)
+		if err != nil {
+			return err
+		}
+	} else {
+		content = rp.resultReader(rp.Config.transform(rp.sourceReader(src)))
+	}
+	_, err = io.Copy(dst, content)
+	return err
+}